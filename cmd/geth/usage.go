@@ -101,6 +101,12 @@ var AppHelpFlagGroups = []flagGroup{
 			utils.EthashDatasetsOnDiskFlag,
 		},
 	},
+	{
+		Name: "SPROUTS",
+		Flags: []cli.Flag{
+			utils.SproutsRecordsKeyFlag,
+		},
+	},
 	//{
 	//	Name: "DASHBOARD",
 	//	Flags: []cli.Flag{
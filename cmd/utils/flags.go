@@ -247,6 +247,11 @@ var (
 		Usage: "Number of recent ethash mining DAGs to keep on disk (1+GB each)",
 		Value: eth.DefaultConfig.EthashDatasetsOnDisk,
 	}
+	// Sprouts settings
+	SproutsRecordsKeyFlag = cli.StringFlag{
+		Name:  "sprouts.recordskey",
+		Usage: "File holding the hex encoded AES key (16, 24 or 32 bytes) to encrypt the engine's records with",
+	}
 	// Transaction pool settings
 	TxPoolNoLocalsFlag = cli.BoolFlag{
 		Name:  "txpool.nolocals",
@@ -943,6 +948,12 @@ func setEthash(ctx *cli.Context, cfg *eth.Config) {
 	}
 }
 
+func setSprouts(ctx *cli.Context, cfg *eth.Config) {
+	if ctx.GlobalIsSet(SproutsRecordsKeyFlag.Name) {
+		cfg.SproutsRecordsKeyFile = ctx.GlobalString(SproutsRecordsKeyFlag.Name)
+	}
+}
+
 func checkExclusive(ctx *cli.Context, flags ...cli.Flag) {
 	set := make([]string, 0, 1)
 	for _, flag := range flags {
@@ -976,6 +987,7 @@ func SetEthConfig(ctx *cli.Context, stack *node.Node, cfg *eth.Config) {
 	setGPO(ctx, &cfg.GPO)
 	setTxPool(ctx, &cfg.TxPool)
 	setEthash(ctx, cfg)
+	setSprouts(ctx, cfg)
 
 	switch {
 	case ctx.GlobalIsSet(SyncModeFlag.Name):
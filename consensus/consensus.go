@@ -18,6 +18,8 @@
 package consensus
 
 import (
+	"math/big"
+
 	"github.com/applicature/sprouts-plus/params"
 	"github.com/applicature/sprouts-plus/common"
 	"github.com/applicature/sprouts-plus/core/state"
@@ -92,6 +94,32 @@ type Engine interface {
 	APIs(chain ChainReader) []rpc.API
 }
 
+// StakeVerifier is implemented by proof-of-stake engines which check the stake
+// claimed by a block against the state of its parent. Unlike the header
+// verification, this is only done during full block validation.
+type StakeVerifier interface {
+	// VerifyStakeBalance checks whether the minter of the header could have
+	// held the claimed stake in the given parent state.
+	VerifyStakeBalance(chain ChainReader, header *types.Header, parent *state.StateDB) error
+}
+
+// BodyValidator is implemented by engines which check block bodies against
+// their headers on every import path, before anything is persisted.
+type BodyValidator interface {
+	// ValidateBody checks whether the body of the block matches its header.
+	ValidateBody(block *types.Block) error
+}
+
+// ChainWeigher is implemented by engines which may choose between forks by a
+// weight of their own rather than by the total difficulty.
+type ChainWeigher interface {
+	// ChainWeight returns the cumulative weight of the chain up to the header,
+	// whose ancestors must be known to the chain, or nil if forks are to be
+	// chosen by the total difficulty. It is called while the chain is being
+	// written to, so it may only look up headers.
+	ChainWeight(chain ChainReader, header *types.Header) *big.Int
+}
+
 // PoW is a consensus engine based on proof-of-work.
 type PoW interface {
 	Engine
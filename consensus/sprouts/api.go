@@ -0,0 +1,440 @@
+package sprouts
+
+import (
+	"bytes"
+	"context"
+	"math/big"
+	"sort"
+
+	"github.com/applicature/sprouts-plus/common"
+	"github.com/applicature/sprouts-plus/common/hexutil"
+	"github.com/applicature/sprouts-plus/consensus"
+	"github.com/applicature/sprouts-plus/core/types"
+	"github.com/applicature/sprouts-plus/rpc"
+	lru "github.com/hashicorp/golang-lru"
+)
+
+// API is a user facing RPC API to inspect the state of the proof-of-stake
+// engine. The numbers in its results are copies owned by the caller, they
+// never alias the engine's caches or configuration.
+type API struct {
+	chain   consensus.ChainReader
+	sprouts *PoS
+}
+
+// AdminAPI is an RPC API to adjust the engine at runtime, registered in the
+// admin namespace.
+type AdminAPI struct {
+	sprouts *PoS
+}
+
+// SproutsRPCBudget returns the budget limiting the expensive sprouts calls.
+func (api *AdminAPI) SproutsRPCBudget() RPCBudget {
+	return api.sprouts.limiter.currentBudget()
+}
+
+// SetSproutsRPCBudget replaces the budget limiting the expensive sprouts
+// calls. A rate of 0 lifts the limit.
+func (api *AdminAPI) SetSproutsRPCBudget(budget RPCBudget) {
+	api.sprouts.limiter.setBudget(budget)
+}
+
+// VerificationEvents creates a subscription that fires for the outcome of every
+// header verification, subject to the sampling of accepted headers.
+func (api *API) VerificationEvents(ctx context.Context) (*rpc.Subscription, error) {
+	notifier, supported := rpc.NotifierFromContext(ctx)
+	if !supported {
+		return &rpc.Subscription{}, rpc.ErrNotificationsUnsupported
+	}
+	rpcSub := notifier.CreateSubscription()
+
+	events := make(chan VerificationEvent, 64)
+	eventsSub := api.sprouts.SubscribeVerificationEvents(events)
+
+	spawned := api.sprouts.life.spawn(func(quit <-chan struct{}, _ uint64) {
+		defer eventsSub.Unsubscribe()
+		for {
+			select {
+			case ev := <-events:
+				notifier.Notify(rpcSub.ID, ev)
+			case <-eventsSub.Err():
+				return
+			case <-rpcSub.Err():
+				return
+			case <-notifier.Closed():
+				return
+			case <-quit:
+				return
+			}
+		}
+	})
+	if !spawned {
+		eventsSub.Unsubscribe()
+		return nil, errEngineClosed
+	}
+	return rpcSub, nil
+}
+
+// PeerRejectionStats returns the decayed number of invalid headers delivered
+// by every source, broken down by the class of the rejection.
+func (api *API) PeerRejectionStats() map[string]map[string]float64 {
+	return api.sprouts.rejections.stats()
+}
+
+// EstimateNextStake estimates when the local signer can mint the next block.
+// It is charged to the caller's RPC budget.
+func (api *API) EstimateNextStake() (*StakeEstimate, error) {
+	if head := api.chain.CurrentHeader(); head != nil {
+		if err := api.sprouts.limiter.charge(anonymousCaller, coinAgeCost(api.sprouts.config, head.Number.Uint64())); err != nil {
+			return nil, err
+		}
+	}
+	return api.sprouts.EstimateNextStake(api.chain)
+}
+
+// SealEligibility tells whether the local signer could mint the next block.
+type SealEligibility struct {
+	Eligible bool         `json:"eligible"`
+	Step     *hexutil.Big `json:"step"` // Timestamp step the kernel is found at, nil if not eligible
+}
+
+// CanSeal reports whether the local signer would find a kernel for the next
+// block right now. It is charged to the caller's RPC budget.
+func (api *API) CanSeal() (*SealEligibility, error) {
+	if head := api.chain.CurrentHeader(); head != nil {
+		if err := api.sprouts.limiter.charge(anonymousCaller, coinAgeCost(api.sprouts.config, head.Number.Uint64())); err != nil {
+			return nil, err
+		}
+	}
+	eligible, step, err := api.sprouts.CanSeal(api.chain)
+	if err != nil {
+		return nil, err
+	}
+	return &SealEligibility{Eligible: eligible, Step: (*hexutil.Big)(step)}, nil
+}
+
+// CoinAge is the coin age available for staking at some point of the chain.
+type CoinAge struct {
+	Time  hexutil.Uint64 `json:"time"`  // Time the coin age is computed for
+	Age   *hexutil.Big   `json:"age"`   // Coin age in coin-days
+	Value *hexutil.Big   `json:"value"` // Value received within the coin age lifetime
+}
+
+// CoinAgeAt returns the coin age the local signer could stake when the
+// canonical block with the given number was the head. It is charged to the
+// caller's RPC budget.
+func (api *API) CoinAgeAt(number hexutil.Uint64) (*CoinAge, error) {
+	if err := api.sprouts.limiter.charge(anonymousCaller, coinAgeCost(api.sprouts.config, uint64(number))); err != nil {
+		return nil, err
+	}
+	ca, err := api.sprouts.CoinAgeAt(api.chain, uint64(number))
+	if err != nil {
+		return nil, err
+	}
+	return &CoinAge{
+		Time:  hexutil.Uint64(ca.Time),
+		Age:   (*hexutil.Big)(ca.Age),
+		Value: (*hexutil.Big)(ca.Value),
+	}, nil
+}
+
+// CoinAgeOf returns the coin age the given address could stake on top of the
+// current head. It is charged to the caller's RPC budget.
+func (api *API) CoinAgeOf(address common.Address) (*CoinAge, error) {
+	head := api.chain.CurrentHeader()
+	if head == nil {
+		return nil, errUnknownBlock
+	}
+	if err := api.sprouts.limiter.charge(anonymousCaller, coinAgeCost(api.sprouts.config, head.Number.Uint64())); err != nil {
+		return nil, err
+	}
+	ca, err := api.sprouts.ComputeCoinAge(api.chain, address, api.sprouts.unixNow())
+	if err != nil {
+		return nil, err
+	}
+	return &CoinAge{
+		Time:  hexutil.Uint64(ca.Time),
+		Age:   (*hexutil.Big)(ca.Age),
+		Value: (*hexutil.Big)(ca.Value),
+	}, nil
+}
+
+// CoinAgeContribution is what a block contributes to the coin age of a signer.
+type CoinAgeContribution struct {
+	Number hexutil.Uint64 `json:"number"`
+	Time   hexutil.Uint64 `json:"time"`  // Timestamp of the block
+	Delta  *hexutil.Big   `json:"delta"` // Coin-seconds, negative for value sent and age staked
+}
+
+// CoinAgeBreakdown returns the contributions of the blocks from the given
+// number to the given one inclusive to the coin age of a local signer, as of
+// the latest time its coin age was accumulated.
+func (api *API) CoinAgeBreakdown(address common.Address, from, to hexutil.Uint64) ([]CoinAgeContribution, error) {
+	contributions, err := api.sprouts.CoinAgeBreakdown(address, uint64(from), uint64(to))
+	if err != nil {
+		return nil, err
+	}
+	results := make([]CoinAgeContribution, 0, len(contributions))
+	for _, contribution := range contributions {
+		results = append(results, CoinAgeContribution{
+			Number: hexutil.Uint64(contribution.Number),
+			Time:   hexutil.Uint64(contribution.Time),
+			Delta:  (*hexutil.Big)(new(big.Int).Set(contribution.Delta)),
+		})
+	}
+	return results, nil
+}
+
+// BlockReward is the reward paid by a block, split among its recipients, and
+// the stake it was computed from.
+type BlockReward struct {
+	Coinbase   common.Address `json:"coinbase"`
+	Netto      *hexutil.Big   `json:"netto"`   // Reward credited to the minter
+	Charity    *hexutil.Big   `json:"charity"` // Reward credited to the charity account
+	RD         *hexutil.Big   `json:"rd"`      // Reward credited to the r&d account
+	StakeValue *hexutil.Big   `json:"stakeValue"`
+	StakeAge   *hexutil.Big   `json:"stakeAge"`
+}
+
+// GetBlockReward returns the reward paid by the canonical block with the given
+// number, as recorded when the block was finalized. The rewards of blocks not
+// recorded are computed from their stakes.
+func (api *API) GetBlockReward(number uint64) (*BlockReward, error) {
+	header := api.chain.GetHeaderByNumber(number)
+	if header == nil {
+		return nil, errUnknownBlock
+	}
+	stake, err := extractStake(header)
+	if err != nil {
+		return nil, err
+	}
+	record, err := api.sprouts.loadBlockReward(header.Hash())
+	if err == errNoRewardRecord {
+		rewards := splitBlockReward(api.sprouts.config, header.Number, blockReward(api.sprouts.config, stake))
+		record, err = &rewardRecord{Netto: rewards.Minter, Charity: rewards.Charity, RD: rewards.RD}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &BlockReward{
+		Coinbase:   header.Coinbase,
+		Netto:      (*hexutil.Big)(record.Netto),
+		Charity:    (*hexutil.Big)(record.Charity),
+		RD:         (*hexutil.Big)(record.RD),
+		StakeValue: (*hexutil.Big)(stake.Value),
+		StakeAge:   (*hexutil.Big)(stake.Age),
+	}, nil
+}
+
+// EpochSummary sums up the canonical blocks of an epoch. Summaries which
+// aren't sealed yet cover the blocks of the open epoch up to the head.
+type EpochSummary struct {
+	Version           hexutil.Uint64   `json:"version"` // Version of the summary schema
+	Index             hexutil.Uint64   `json:"index"`
+	First             hexutil.Uint64   `json:"first"` // First block of the epoch
+	Last              hexutil.Uint64   `json:"last"`  // Last block summarized
+	Sealed            bool             `json:"sealed"`
+	Blocks            hexutil.Uint64   `json:"blocks"`
+	AverageDifficulty *hexutil.Big     `json:"averageDifficulty"`
+	Stake             *hexutil.Big     `json:"stake"`   // Coin-days staked by the blocks
+	Rewards           *hexutil.Big     `json:"rewards"` // Rewards paid, including charity and r&d
+	Minters           []common.Address `json:"minters"` // Distinct coinbases of the blocks
+}
+
+func newEpochSummaryResult(length uint64, summary *epochSummary) *EpochSummary {
+	average := new(big.Int)
+	if summary.Blocks > 0 {
+		average.Div(summary.Difficulty, new(big.Int).SetUint64(summary.Blocks))
+	}
+	return &EpochSummary{
+		Version:           hexutil.Uint64(summary.Version),
+		Index:             hexutil.Uint64(summary.Index),
+		First:             hexutil.Uint64(summary.Index*length + 1),
+		Last:              hexutil.Uint64(summary.Last),
+		Sealed:            summary.Sealed,
+		Blocks:            hexutil.Uint64(summary.Blocks),
+		AverageDifficulty: (*hexutil.Big)(average),
+		Stake:             (*hexutil.Big)(new(big.Int).Set(summary.Stake)),
+		Rewards:           (*hexutil.Big)(new(big.Int).Set(summary.Rewards)),
+		Minters:           append([]common.Address{}, summary.Minters...),
+	}
+}
+
+// EpochSummary returns the summary of the epoch with the given index, which
+// may be the open one.
+func (api *API) EpochSummary(index hexutil.Uint64) (*EpochSummary, error) {
+	if api.sprouts.epochLength == 0 || api.sprouts.db == nil {
+		return nil, errNoEpochSummaries
+	}
+	summary, err := api.sprouts.loadEpochSummary(uint64(index))
+	if err != nil {
+		return nil, err
+	}
+	return newEpochSummaryResult(api.sprouts.epochLength, summary), nil
+}
+
+// EpochRange returns the summaries of the epochs from the given index to the
+// given one inclusive, at most maxEpochRange of them. Epochs not summarized
+// yet are left out, the last one returned may be the open one.
+func (api *API) EpochRange(from, to hexutil.Uint64) ([]*EpochSummary, error) {
+	if api.sprouts.epochLength == 0 || api.sprouts.db == nil {
+		return nil, errNoEpochSummaries
+	}
+	if to < from || to-from >= maxEpochRange {
+		return nil, errInvalidEpochRange
+	}
+	summaries := []*EpochSummary{}
+	for index := uint64(from); index <= uint64(to); index++ {
+		summary, err := api.sprouts.loadEpochSummary(index)
+		if err == errUnknownEpoch {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		summaries = append(summaries, newEpochSummaryResult(api.sprouts.epochLength, summary))
+	}
+	return summaries, nil
+}
+
+// StakeEntry is a stake known to the engine, used to reject blocks reusing it.
+type StakeEntry struct {
+	Number    hexutil.Uint64 `json:"number"`
+	Hash      common.Hash    `json:"hash"`
+	Timestamp hexutil.Uint64 `json:"timestamp"`
+	Kernel    hexutil.Bytes  `json:"kernel"`
+	Stake     *hexutil.Big   `json:"stake"`
+}
+
+// ListStakes returns the stakes known to the engine sorted by block number. A
+// new block is rejected as a duplicate if it claims the same stake and kernel
+// as any of them, whatever its timestamp.
+func (api *API) ListStakes() ([]StakeEntry, error) {
+	stakes, err := api.sprouts.getMappedStakes()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]StakeEntry, 0, len(*stakes))
+	for _, s := range *stakes {
+		entries = append(entries, StakeEntry{
+			Number:    hexutil.Uint64(s.Number),
+			Hash:      s.Hash,
+			Timestamp: hexutil.Uint64(s.Timestamp),
+			Kernel:    common.CopyBytes(s.Kernel),
+			Stake:     (*hexutil.Big)(new(big.Int).Set(s.Stake)),
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Number != entries[j].Number {
+			return entries[i].Number < entries[j].Number
+		}
+		return bytes.Compare(entries[i].Hash[:], entries[j].Hash[:]) < 0
+	})
+	return entries, nil
+}
+
+// ExtraDump is the decoded content of the extra-data field of a header.
+type ExtraDump struct {
+	Version         hexutil.Uint64  `json:"version"` // Layout version, 0 for legacy extras
+	Reserved        hexutil.Bytes   `json:"reserved"`
+	KernelHash      hexutil.Bytes   `json:"kernelHash"`
+	HashedTimestamp hexutil.Bytes   `json:"hashedTimestamp"`
+	StakeAge        *hexutil.Big    `json:"stakeAge"`
+	StakeValue      *hexutil.Big    `json:"stakeValue"`
+	StakeTime       hexutil.Uint64  `json:"stakeTime"`
+	Signature       hexutil.Bytes   `json:"signature"`
+	Signer          *common.Address `json:"signer"` // nil if the signature can't be recovered
+	Kernel          *KernelDump     `json:"kernel"` // nil if the parent or the claimed offset is unknown
+}
+
+// KernelDump contains the inputs and intermediates of the kernel check of a
+// block at its claimed offset, enough to reproduce the check independently.
+type KernelDump struct {
+	Version       hexutil.Uint64 `json:"version"`
+	StakeModifier *hexutil.Big   `json:"stakeModifier"`
+	ParentTime    hexutil.Uint64 `json:"parentTime"`
+	Offset        hexutil.Uint64 `json:"offset"`
+	TimeWeight    hexutil.Uint64 `json:"timeWeight"`
+	Target        *hexutil.Big   `json:"target"`
+	Preimage      hexutil.Bytes  `json:"preimage"`
+	Hash          hexutil.Bytes  `json:"hash"`
+	Value         *hexutil.Big   `json:"value"` // part of the hash compared against the target
+	Valid         bool           `json:"valid"` // whether the value beats the target and the hash is the embedded one
+}
+
+// DecodeExtra returns all regions of the extra-data field of the block with
+// the given hash, along with the signer recovered from the signature.
+func (api *API) DecodeExtra(hash common.Hash) (*ExtraDump, error) {
+	header := api.chain.GetHeaderByHash(hash)
+	if header == nil {
+		return nil, errUnknownBlock
+	}
+	dump, err := decodeExtra(header, api.sprouts.signatures)
+	if err != nil {
+		return nil, err
+	}
+	if header.Number.Sign() > 0 {
+		if parent := api.chain.GetHeader(header.ParentHash, header.Number.Uint64()-1); parent != nil {
+			dump.Kernel = api.sprouts.kernelDump(parent, header)
+		}
+	}
+	return dump, nil
+}
+
+// kernelDump recomputes the kernel check of the header at the offset claimed
+// by its extra-data.
+func (engine *PoS) kernelDump(parent, header *types.Header) *KernelDump {
+	stake, err := extractStake(header)
+	if err != nil {
+		return nil
+	}
+	kernel, err := extractKernel(header)
+	if err != nil {
+		return nil
+	}
+	step, ok := kernelStep(kernel)
+	if !ok {
+		return nil
+	}
+	attempt := engine.attemptKernel(parent, stake.Age, header, step)
+	embedded := new(big.Int).SetBytes(kernel[:extraKernel/2])
+
+	return &KernelDump{
+		Version:       hexutil.Uint64(attempt.Version),
+		StakeModifier: (*hexutil.Big)(attempt.StakeModifier),
+		ParentTime:    hexutil.Uint64(attempt.ParentTime),
+		Offset:        hexutil.Uint64(attempt.Offset),
+		TimeWeight:    hexutil.Uint64(attempt.TimeWeight),
+		Target:        (*hexutil.Big)(attempt.Target),
+		Preimage:      attempt.Preimage,
+		Hash:          attempt.Hash,
+		Value:         (*hexutil.Big)(attempt.Value),
+		Valid:         attempt.found() && embedded.Cmp(new(big.Int).SetBytes(attempt.Hash)) == 0,
+	}
+}
+
+// decodeExtra splits the extra-data field of the header into its regions.
+func decodeExtra(header *types.Header, sigcache *lru.ARCCache) (*ExtraDump, error) {
+	extra, err := decodeHeaderExtra(header.Extra)
+	if err != nil || len(extra.Reserved) < extraDefault {
+		return nil, errMissingSignature
+	}
+	stake, err := parseStake(extra.Stake)
+	if err != nil {
+		return nil, err
+	}
+	dump := &ExtraDump{
+		Version:         hexutil.Uint64(extra.Version),
+		Reserved:        common.CopyBytes(extra.Reserved),
+		KernelHash:      common.CopyBytes(extra.Kernel),
+		HashedTimestamp: common.CopyBytes(extra.HashedTimestamp),
+		StakeAge:        (*hexutil.Big)(stake.Age),
+		StakeValue:      (*hexutil.Big)(stake.Value),
+		StakeTime:       hexutil.Uint64(stake.Time),
+		Signature:       common.CopyBytes(extra.Seal),
+	}
+	if signer, err := ecrecover(header, sigcache); err == nil {
+		dump.Signer = &signer
+	}
+	return dump, nil
+}
@@ -0,0 +1,296 @@
+package sprouts
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/big"
+	"reflect"
+	"testing"
+
+	"github.com/applicature/sprouts-plus/common"
+	"github.com/applicature/sprouts-plus/common/hexutil"
+	"github.com/applicature/sprouts-plus/core"
+	"github.com/applicature/sprouts-plus/core/types"
+	"github.com/applicature/sprouts-plus/ethdb"
+)
+
+func TestDecodeExtra(t *testing.T) {
+	blockchain, blocks, engine := newTestChain(t, 1)
+	defer blockchain.Stop()
+
+	header := blocks[0].Header()
+	copy(header.Extra, "vanity")
+	signTestHeader(t, header, rewardsKey)
+
+	chain := &headersChainReader{headers: []*types.Header{blockchain.Genesis().Header(), header}}
+	api := &API{chain: chain, sprouts: engine}
+
+	dump, err := api.DecodeExtra(header.Hash())
+	if err != nil {
+		t.Fatalf("failed to decode extra: %v", err)
+	}
+	if !bytes.HasPrefix(dump.Reserved, []byte("vanity")) || len(dump.Reserved) != extraDefault {
+		t.Errorf("reserved bytes mismatch: %x", dump.Reserved)
+	}
+	hash, _, err := engine.computeKernel(blockchain.Genesis().Header(), testStakeAge, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(dump.KernelHash, hash.Bytes()) {
+		t.Errorf("kernel hash mismatch: have %x, want %x", dump.KernelHash, hash.Bytes())
+	}
+	extra, err := decodeHeaderExtra(header.Extra)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dump.Version != headerExtraVersion {
+		t.Errorf("layout version mismatch: have %d, want %d", dump.Version, headerExtraVersion)
+	}
+	if !bytes.Equal(dump.HashedTimestamp, extra.HashedTimestamp) {
+		t.Errorf("hashed timestamp mismatch: %x", dump.HashedTimestamp)
+	}
+	if dump.StakeAge.ToInt().Cmp(testStakeAge) != 0 || dump.StakeValue.ToInt().Cmp(big.NewInt(1000)) != 0 || uint64(dump.StakeTime) != header.Time.Uint64() {
+		t.Errorf("stake mismatch: age %v, value %v, time %d", dump.StakeAge, dump.StakeValue, dump.StakeTime)
+	}
+	if !bytes.Equal(dump.Signature, extra.Seal) {
+		t.Errorf("signature mismatch: %x", dump.Signature)
+	}
+	if dump.Signer == nil || *dump.Signer != rewardsAddr {
+		t.Errorf("signer mismatch: have %v, want %x", dump.Signer, rewardsAddr)
+	}
+	if dump.Kernel == nil || !dump.Kernel.Valid {
+		t.Errorf("kernel not reproduced: %+v", dump.Kernel)
+	}
+
+	// Unknown blocks and malformed extras are reported as errors
+	if _, err := api.DecodeExtra(common.Hash{0x01}); err != errUnknownBlock {
+		t.Errorf("unknown block error mismatch: have %v, want %v", err, errUnknownBlock)
+	}
+	header.Extra = header.Extra[:10]
+	if _, err := decodeExtra(header, engine.signatures); err != errMissingSignature {
+		t.Errorf("short extra error mismatch: have %v, want %v", err, errMissingSignature)
+	}
+}
+
+func TestGetBlockReward(t *testing.T) {
+	blockchain, blocks, engine := newTestChain(t, 1)
+	defer blockchain.Stop()
+
+	header := blocks[0].Header()
+	chain := &headersChainReader{headers: []*types.Header{blockchain.Genesis().Header(), header}}
+	api := &API{chain: chain, sprouts: engine}
+
+	reward, err := api.GetBlockReward(1)
+	if err != nil {
+		t.Fatalf("failed to get block reward: %v", err)
+	}
+	if reward.Charity.ToInt().Cmp(reward.RD.ToInt()) != 0 {
+		t.Errorf("charity and r&d rewards differ: %v != %v", reward.Charity, reward.RD)
+	}
+	total := new(big.Int).Add(reward.Netto.ToInt(), reward.Charity.ToInt())
+	total.Add(total, reward.RD.ToInt())
+	if want := estimateBlockReward(engine.config, header); total.Cmp(want) != 0 {
+		t.Errorf("reward split doesn't add up: have %v, want %v", total, want)
+	}
+
+	if _, err := api.GetBlockReward(2); err != errUnknownBlock {
+		t.Errorf("unknown block error mismatch: have %v, want %v", err, errUnknownBlock)
+	}
+}
+
+func TestListStakes(t *testing.T) {
+	db, _ := ethdb.NewMemDatabase()
+	engine := newTestEngine(t, &sproutsConfig, db)
+	api := &API{sprouts: engine}
+
+	stakes, err := api.ListStakes()
+	if err != nil || len(stakes) != 0 {
+		t.Fatalf("empty stakes mismatch: have %v (%v), want none", stakes, err)
+	}
+	stakeMap := make(mappedStakes)
+	for _, number := range []int64{3, 1, 2} {
+		ca := &coinAge{Time: uint64(100 + number), Age: big.NewInt(1000 * number), Value: big1}
+		stakeMap.add(&types.Header{Number: big.NewInt(number)}, ca, bytes.Repeat([]byte{byte(number)}, extraKernel))
+	}
+	if err := engine.saveMappedStakes(&stakeMap); err != nil {
+		t.Fatal(err)
+	}
+	stakes, err = api.ListStakes()
+	if err != nil {
+		t.Fatalf("failed to list stakes: %v", err)
+	}
+	if len(stakes) != 3 {
+		t.Fatalf("stakes count mismatch: have %d, want 3", len(stakes))
+	}
+	for i, s := range stakes {
+		number := uint64(i + 1)
+		if uint64(s.Number) != number || uint64(s.Timestamp) != 100+number || s.Stake.ToInt().Uint64() != 1000*number {
+			t.Errorf("stake %d mismatch: %+v", i, s)
+		}
+		if !bytes.Equal(s.Kernel, bytes.Repeat([]byte{byte(number)}, extraKernel)) {
+			t.Errorf("stake %d: kernel mismatch: %x", i, s.Kernel)
+		}
+	}
+}
+
+// Tests that the intermediates of the kernel check stay the same, so any change
+// of the kernel formula surfaces here.
+// Tests that the coin age of an address can't be queried before there is a
+// head to compute it on.
+func TestCoinAgeOfWithoutHead(t *testing.T) {
+	engine := newTestEngine(t, &sproutsConfig, nil)
+	api := &API{chain: &headersChainReader{}, sprouts: engine}
+
+	if _, err := api.CoinAgeOf(testAddr); err != errUnknownBlock {
+		t.Errorf("error mismatch: have %v, want %v", err, errUnknownBlock)
+	}
+}
+
+func TestKernelDumpGolden(t *testing.T) {
+	engine := newTestEngine(t, &sproutsConfig, nil)
+
+	parent := &types.Header{Number: big.NewInt(0), Time: big.NewInt(startDate.Unix()), Difficulty: big.NewInt(10)}
+	header := &types.Header{
+		Number:     big.NewInt(1),
+		ParentHash: parent.Hash(),
+		Time:       big.NewInt(startDate.Unix() + 3600),
+		Difficulty: big.NewInt(10),
+	}
+	stake := &coinAge{Time: header.Time.Uint64(), Age: testStakeAge, Value: big.NewInt(1000)}
+	setTestStake(header, stake)
+
+	attempt, err := engine.findKernel(parent, stake.Age, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setTestKernel(header, new(big.Int).SetBytes(attempt.Hash).Bytes(), attempt.Offset)
+
+	dump := engine.kernelDump(parent, header)
+	if dump == nil {
+		t.Fatal("kernel not decoded")
+	}
+	golden := &KernelDump{
+		Version:       1,
+		StakeModifier: (*hexutil.Big)(big.NewInt(0)),
+		ParentTime:    0x5a2fd2d0,
+		Offset:        60,
+		TimeWeight:    3540,
+		Target:        (*hexutil.Big)(hexutil.MustDecodeBig("0x152ea0e2c256d6e49b8e38e")),
+		Preimage:      hexutil.MustDecode("0x5a2fd2d031383434363734343037333730393535313631353135313330383336303031353133303837313430"),
+		Hash:          hexutil.MustDecode("0x3bae2415d34c960fafc52ca0e7268a1d27d62f46189896510b7bbe5d2f5923cd"),
+		Value:         (*hexutil.Big)(big.NewInt(0x1524ae3b)),
+		Valid:         true,
+	}
+	if !reflect.DeepEqual(dump, golden) {
+		t.Errorf("kernel intermediates mismatch:\nhave %+v\nwant %+v", dump, golden)
+	}
+}
+
+// mutateBigInts overwrites every big integer reachable from the value and
+// returns how many were found.
+func mutateBigInts(v reflect.Value) int {
+	bigType := reflect.TypeOf(big.Int{})
+	hexType := reflect.TypeOf(hexutil.Big{})
+
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return 0
+		}
+		switch v.Elem().Type() {
+		case bigType:
+			v.Interface().(*big.Int).SetInt64(-0xdead)
+			return 1
+		case hexType:
+			(*big.Int)(v.Interface().(*hexutil.Big)).SetInt64(-0xdead)
+			return 1
+		}
+		return mutateBigInts(v.Elem())
+	case reflect.Interface:
+		if v.IsNil() {
+			return 0
+		}
+		return mutateBigInts(v.Elem())
+	case reflect.Struct:
+		n := 0
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).PkgPath == "" {
+				n += mutateBigInts(v.Field(i))
+			}
+		}
+		return n
+	case reflect.Slice, reflect.Array:
+		n := 0
+		for i := 0; i < v.Len(); i++ {
+			n += mutateBigInts(v.Index(i))
+		}
+		return n
+	case reflect.Map:
+		n := 0
+		for _, key := range v.MapKeys() {
+			n += mutateBigInts(v.MapIndex(key))
+		}
+		return n
+	}
+	return 0
+}
+
+// Tests that the big integers returned by the exported API are copies: mutating
+// them neither changes the results of subsequent calls nor the configuration.
+func TestAPIReturnsCopies(t *testing.T) {
+	blockchain, blocks, engine := newTestChain(t, 3)
+	defer blockchain.Stop()
+
+	if _, err := blockchain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	api := &API{chain: blockchain, sprouts: engine}
+	genesis := &core.Genesis{
+		Timestamp: blockchain.Genesis().Time().Uint64(),
+		Alloc:     core.GenesisAlloc{rewardsAddr: {Balance: big.NewInt(1000000)}},
+	}
+	head := blockchain.CurrentHeader()
+	// the kernels of the test chain predate their parents, which StakeWeight rejects
+	parent := types.CopyHeader(blockchain.GetHeaderByNumber(head.Number.Uint64() - 1))
+	parent.Time = new(big.Int)
+
+	calls := map[string]func() (interface{}, error){
+		"CalcDifficulty": func() (interface{}, error) {
+			return engine.CalcDifficulty(blockchain, head.Time.Uint64()+1, head), nil
+		},
+		"GenesisStake": func() (interface{}, error) {
+			return GenesisStake(engine.config, genesis, rewardsAddr, genesis.Timestamp+3600), nil
+		},
+		"StakeWeight": func() (interface{}, error) {
+			return StakeWeight(parent, head)
+		},
+		"GetBlockReward": func() (interface{}, error) {
+			return api.GetBlockReward(head.Number.Uint64())
+		},
+		"DecodeExtra": func() (interface{}, error) {
+			return api.DecodeExtra(head.Hash())
+		},
+	}
+	digest := configDigest(engine.config)
+	for name, call := range calls {
+		want, err := call()
+		if err != nil {
+			t.Fatalf("%s: call failed: %v", name, err)
+		}
+		wantJSON, _ := json.Marshal(want)
+
+		if n := mutateBigInts(reflect.ValueOf(want)); n == 0 {
+			t.Errorf("%s: no big integers returned", name)
+		}
+		have, err := call()
+		if err != nil {
+			t.Fatalf("%s: call after mutation failed: %v", name, err)
+		}
+		if haveJSON, _ := json.Marshal(have); !bytes.Equal(haveJSON, wantJSON) {
+			t.Errorf("%s: result changed by mutation:\nhave %s\nwant %s", name, haveJSON, wantJSON)
+		}
+		if configDigest(engine.config) != digest {
+			t.Fatalf("%s: configuration changed by mutation", name)
+		}
+	}
+}
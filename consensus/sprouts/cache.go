@@ -0,0 +1,116 @@
+package sprouts
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/applicature/sprouts-plus/common"
+	"github.com/applicature/sprouts-plus/core"
+	"github.com/applicature/sprouts-plus/crypto"
+	"github.com/applicature/sprouts-plus/log"
+	"github.com/applicature/sprouts-plus/params"
+	"github.com/applicature/sprouts-plus/rlp"
+)
+
+const (
+	cacheSnapshotVersion  = 1               // Version of the cache snapshot format
+	cacheSnapshotInterval = 5 * time.Minute // Minimum time between two periodic cache snapshots
+)
+
+var cacheSnapshotKey = []byte("sprouts-cache-snapshot")
+
+var (
+	errSnapshotVersion = errors.New("unsupported cache snapshot version")
+	errSnapshotDigest  = errors.New("cache snapshot made with a different configuration")
+)
+
+// cacheSnapshot is the persisted content of the engine's caches used to warm
+// up a restarted node.
+type cacheSnapshot struct {
+	Version uint64
+	Digest  common.Hash // Digest of the configuration the snapshot was made with
+	Signers []cachedSigner
+}
+
+// cachedSigner is a single entry of the signatures cache.
+type cachedSigner struct {
+	Hash   common.Hash
+	Signer common.Address
+}
+
+// configDigest returns a hash identifying the consensus configuration.
+func configDigest(config *params.SproutsConfig) common.Hash {
+	blob, _ := json.Marshal(config)
+	return crypto.Keccak256Hash(blob)
+}
+
+// SaveCacheSnapshot persists the content of the signatures cache, so that a
+// restarted engine doesn't begin with a cold cache.
+func (engine *PoS) SaveCacheSnapshot() error {
+	snapshot := cacheSnapshot{
+		Version: cacheSnapshotVersion,
+		Digest:  configDigest(engine.config),
+	}
+	for _, key := range engine.signatures.Keys() {
+		if signer, ok := engine.signatures.Peek(key); ok {
+			snapshot.Signers = append(snapshot.Signers, cachedSigner{key.(common.Hash), signer.(common.Address)})
+		}
+	}
+	blob, err := rlp.EncodeToBytes(&snapshot)
+	if err != nil {
+		return err
+	}
+	engine.lock.Lock()
+	engine.lastSnapshot = time.Now()
+	engine.lock.Unlock()
+
+	return engine.persist(func() error { return engine.db.Put(cacheSnapshotKey, blob) })
+}
+
+// maybeSaveCacheSnapshot persists the caches if the last snapshot is old enough.
+func (engine *PoS) maybeSaveCacheSnapshot() {
+	if engine.db == nil {
+		return
+	}
+	engine.lock.RLock()
+	due := time.Since(engine.lastSnapshot) >= cacheSnapshotInterval
+	engine.lock.RUnlock()
+
+	if due {
+		if err := engine.SaveCacheSnapshot(); err != nil {
+			log.Warn("Failed to save cache snapshot", "err", err)
+		}
+	}
+}
+
+// loadCacheSnapshot repopulates the caches from the persisted snapshot. Entries
+// of blocks which are not canonical any more are dropped.
+func (engine *PoS) loadCacheSnapshot() error {
+	if engine.db == nil {
+		return nil
+	}
+	blob, err := engine.db.Get(cacheSnapshotKey)
+	if err != nil {
+		// no snapshot has been made yet
+		return nil
+	}
+	var snapshot cacheSnapshot
+	if err := rlp.DecodeBytes(blob, &snapshot); err != nil {
+		return err
+	}
+	if snapshot.Version != cacheSnapshotVersion {
+		return errSnapshotVersion
+	}
+	if snapshot.Digest != configDigest(engine.config) {
+		return errSnapshotDigest
+	}
+	for _, entry := range snapshot.Signers {
+		number := core.GetBlockNumber(engine.db, entry.Hash)
+		if core.GetCanonicalHash(engine.db, number) != entry.Hash {
+			continue
+		}
+		engine.signatures.Add(entry.Hash, entry.Signer)
+	}
+	return nil
+}
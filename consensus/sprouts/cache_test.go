@@ -0,0 +1,146 @@
+package sprouts
+
+import (
+	"crypto/ecdsa"
+	"math/big"
+	"testing"
+
+	"github.com/applicature/sprouts-plus/common"
+	"github.com/applicature/sprouts-plus/core"
+	"github.com/applicature/sprouts-plus/core/types"
+	"github.com/applicature/sprouts-plus/crypto"
+	"github.com/applicature/sprouts-plus/ethdb"
+)
+
+// newCanonicalTestHeaders creates n headers signed by the rewards account and
+// stores them as the canonical chain.
+func newCanonicalTestHeaders(tb testing.TB, db ethdb.Database, n int) []*types.Header {
+	headers := make([]*types.Header, n)
+	for i := range headers {
+		headers[i] = &types.Header{
+			Number:     big.NewInt(int64(i + 1)),
+			Time:       big.NewInt(startDate.Unix() + int64(i)),
+			Difficulty: big.NewInt(1),
+			GasLimit:   big.NewInt(4700000),
+			GasUsed:    new(big.Int),
+			Extra:      make([]byte, extraDefault+extraKernel+extraCoinAge+extraSeal),
+		}
+		signTestHeader(tb, headers[i], rewardsKey)
+
+		if err := core.WriteHeader(db, headers[i]); err != nil {
+			tb.Fatal(err)
+		}
+		if err := core.WriteCanonicalHash(db, headers[i].Hash(), uint64(i+1)); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	return headers
+}
+
+func TestCacheSnapshot(t *testing.T) {
+	db, _ := ethdb.NewMemDatabase()
+	headers := newCanonicalTestHeaders(t, db, 10)
+
+	engine := newTestEngine(t, &sproutsConfig, db)
+	for _, header := range headers {
+		if signer, err := engine.Author(header); err != nil || signer != rewardsAddr {
+			t.Fatalf("failed to recover signer: %x, %v", signer, err)
+		}
+	}
+	if err := engine.SaveCacheSnapshot(); err != nil {
+		t.Fatalf("failed to save snapshot: %v", err)
+	}
+
+	// Reorganise the chain at the last header
+	reorged := headers[len(headers)-1]
+	core.WriteCanonicalHash(db, common.Hash{0x01}, reorged.Number.Uint64())
+
+	// A restarted engine knows all canonical signers right away
+	engine = newTestEngine(t, &sproutsConfig, db)
+	for _, header := range headers[:len(headers)-1] {
+		if signer, ok := engine.signatures.Get(header.Hash()); !ok || signer.(common.Address) != rewardsAddr {
+			t.Errorf("signer of block %d not restored", header.Number)
+		}
+	}
+	if engine.signatures.Contains(reorged.Hash()) {
+		t.Errorf("signer of reorged block %d restored", reorged.Number)
+	}
+
+	// Snapshots made under a different configuration are discarded
+	config := sproutsConfig
+	config.BlockPeriod++
+	if engine = newTestEngine(t, &config, db); engine.signatures.Len() != 0 {
+		t.Errorf("snapshot of a different configuration restored %d signers", engine.signatures.Len())
+	}
+	if err := engine.loadCacheSnapshot(); err != errSnapshotDigest {
+		t.Errorf("snapshot error mismatch: have %v, want %v", err, errSnapshotDigest)
+	}
+}
+
+// Tests that a signature copied into another header isn't attributed to the
+// original signer, even if the original header's signer is cached.
+func TestEcrecoverCopiedSignature(t *testing.T) {
+	db, _ := ethdb.NewMemDatabase()
+	header := newCanonicalTestHeaders(t, db, 1)[0]
+
+	engine := newTestEngine(t, &sproutsConfig, db)
+	if signer, err := engine.Author(header); err != nil || signer != rewardsAddr {
+		t.Fatalf("failed to recover signer: %x, %v", signer, err)
+	}
+	forged := types.CopyHeader(header)
+	forged.Time = new(big.Int).Add(forged.Time, big1)
+	if signer, err := engine.Author(forged); err == nil && signer == rewardsAddr {
+		t.Errorf("copied signature attributed to the original signer")
+	}
+}
+
+func BenchmarkAuthorColdCache(b *testing.B) { benchmarkAuthor(b, false) }
+func BenchmarkAuthorWarmCache(b *testing.B) { benchmarkAuthor(b, true) }
+
+func benchmarkAuthor(b *testing.B, warm bool) {
+	db, _ := ethdb.NewMemDatabase()
+	headers := newCanonicalTestHeaders(b, db, 2000)
+	if warm {
+		engine := newTestEngine(b, &sproutsConfig, db)
+		for _, header := range headers {
+			engine.Author(header)
+		}
+		engine.SaveCacheSnapshot()
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		engine := newTestEngine(b, &sproutsConfig, db)
+		for _, header := range headers {
+			engine.Author(header)
+		}
+	}
+}
+
+// BenchmarkAuthorRepeatedSigners recovers the signers of a batch of headers
+// minted by a few accounts taking turns, like VerifyHeaders does.
+func BenchmarkAuthorRepeatedSigners(b *testing.B) {
+	keys := []*ecdsa.PrivateKey{rewardsKey, testKey}
+	for i := 0; i < 2; i++ {
+		key, _ := crypto.GenerateKey()
+		keys = append(keys, key)
+	}
+	headers := make([]*types.Header, 512)
+	for i := range headers {
+		headers[i] = &types.Header{
+			Number:     big.NewInt(int64(i + 1)),
+			Time:       big.NewInt(startDate.Unix() + int64(i)),
+			Difficulty: big.NewInt(1),
+			GasLimit:   big.NewInt(4700000),
+			GasUsed:    new(big.Int),
+			Extra:      make([]byte, extraDefault+extraKernel+extraCoinAge+extraSeal),
+		}
+		signTestHeader(b, headers[i], keys[i%len(keys)])
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		engine := newTestEngine(b, &sproutsConfig, nil)
+		for _, header := range headers {
+			engine.Author(header)
+		}
+	}
+}
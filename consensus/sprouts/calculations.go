@@ -2,15 +2,19 @@ package sprouts
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"math/big"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/applicature/sprouts-plus/common"
 	"github.com/applicature/sprouts-plus/consensus"
+	"github.com/applicature/sprouts-plus/core"
 	"github.com/applicature/sprouts-plus/core/state"
 	"github.com/applicature/sprouts-plus/core/types"
 	"github.com/applicature/sprouts-plus/crypto"
@@ -22,17 +26,31 @@ import (
 )
 
 var (
-	big0   = big.NewInt(0)
-	big1   = big.NewInt(1)
-	big8   = big.NewInt(8)
-	big16  = big.NewInt(16)
-	big100 = big.NewInt(100)
+	big0  = big.NewInt(0)
+	big1  = big.NewInt(1)
+	big16 = big.NewInt(16)
+
+	bigBasisPoints = big.NewInt(params.BasisPoints)
 )
 
 var (
-	stakeMaxTime        uint64 // stake age of full weight
-	stakeMaxAge, _      = new(big.Int).SetString("999999999999999999999999999999999999999999999", 10)
-	preAllocCoefficient = new(big.Int).Lsh(big.NewInt(1), 256-200)
+	stakeMaxTime   uint64 // stake age of full weight
+	stakeMaxAge, _ = new(big.Int).SetString("999999999999999999999999999999999999999999999", 10)
+
+	// kernel target = difficulty * stake * timeWeight * numerator / denominator
+	defaultKernelTargetNumerator   = big.NewInt(1)
+	defaultKernelTargetDenominator = new(big.Int).Mul(new(big.Int).SetUint64(coinValue), big.NewInt(24*60*60))
+
+	// reward per coin-year: 0.0212 coins
+	defaultAnnualRewardNumerator   = big.NewInt(212)
+	defaultAnnualRewardDenominator = big.NewInt(10000)
+
+	// upper bound of the total reward of a block: 1000 coins
+	defaultMaxBlockReward = new(big.Int).Mul(big.NewInt(1000), new(big.Int).SetUint64(coinValue))
+
+	// coin-days = coin-seconds * numerator / denominator
+	defaultCoinDayNumerator   = big.NewInt(1)
+	defaultCoinDayDenominator = new(big.Int).SetUint64(coinValue / (24 * 60 * 60))
 )
 
 func init() {
@@ -40,319 +58,874 @@ func init() {
 	stakeMaxTime = uint64(d)
 }
 
-func computeDifficulty(chain consensus.ChainReader, number uint64) *big.Int {
+// computeDifficulty returns the difficulty of the block with the given number.
+// Its ancestors are taken from the given parents if there, like the batch of
+// VerifyHeaders, otherwise from the canonical chain. consensus.ErrUnknownAncestor
+// is returned if either is unknown, as during a partial header sync.
+func computeDifficulty(chain consensus.ChainReader, number uint64, parents []*types.Header) (*big.Int, error) {
 	// return 100000 for the first three blocks
+	if number < 3 {
+		return big.NewInt(10), nil
+	}
+	parent, grandparent := ancestorByNumber(chain, parents, number-1), ancestorByNumber(chain, parents, number-2)
+	if parent == nil || grandparent == nil {
+		return nil, consensus.ErrUnknownAncestor
+	}
+	return retargetDifficulty(parent, grandparent), nil
+}
+
+// ancestorByNumber returns the header with the given number among the parents,
+// falling back to the canonical chain.
+func ancestorByNumber(chain consensus.ChainReader, parents []*types.Header, number uint64) *types.Header {
+	for i := len(parents) - 1; i >= 0; i-- {
+		if parents[i] != nil && parents[i].Number.Uint64() == number {
+			return parents[i]
+		}
+	}
+	return chain.GetHeaderByNumber(number)
+}
+
+// CalcDifficulty is the difficulty adjustment algorithm. It returns the
+// difficulty that a new block should have when created at time given the
+// parent block's time and difficulty. The ancestors are looked up through the
+// parent itself, so it works for side chains as well. The returned value never
+// aliases the parent's difficulty.
+func (engine *PoS) CalcDifficulty(chain consensus.ChainReader, time uint64, parent *types.Header) *big.Int {
+	number := parent.Number.Uint64() + 1
 	if number < 3 {
 		return big.NewInt(10)
 	}
+	grandparent := chain.GetHeader(parent.ParentHash, number-2)
+	if grandparent == nil {
+		return new(big.Int).Set(parent.Difficulty)
+	}
+	return retargetDifficulty(parent, grandparent)
+}
 
-	diff := new(big.Int).Set(chain.GetHeaderByNumber(number - 1).Difficulty)
+// retargetDifficulty adjusts the difficulty of the parent by the spacing
+// between the parent and the grandparent.
+func retargetDifficulty(parent, grandparent *types.Header) *big.Int {
+	diff := new(big.Int).Set(parent.Difficulty)
 
 	// 1 week / 10 min
 	targetSpacing := uint64(10 * 60)
 	nInt := uint64((7 * 24 * 60 * 60) / targetSpacing)
 
-	prevBlockTime := new(big.Int).Set(chain.GetHeaderByNumber(number - 1).Time)
-	timeDelta := prevBlockTime.Sub(prevBlockTime, chain.GetHeaderByNumber(number-2).Time).Uint64()
-	diff.Mul(diff, new(big.Int).SetUint64(((nInt-1)*targetSpacing + 2*timeDelta)))
+	// out of order timestamps must not underflow the time delta
+	timeDelta := new(big.Int).Sub(parent.Time, grandparent.Time)
+	if timeDelta.Cmp(big1) < 0 {
+		timeDelta.Set(big1)
+	}
+	spacing := new(big.Int).Lsh(timeDelta, 1)
+	spacing.Add(spacing, new(big.Int).SetUint64((nInt-1)*targetSpacing))
+	diff.Mul(diff, spacing)
 	diff.Div(diff, new(big.Int).SetUint64((nInt+1)*targetSpacing))
 
+	// make sure staking continues
+	if diff.Cmp(big1) == -1 {
+		diff.Set(big1)
+	}
 	return diff
 }
 
-// stakeOfBlock checks if this block was mined by current signer and if so,
+// stakeOfBlock checks if this block was mined by the account and if so,
 // returns the stake
-func (engine *PoS) stakeOfBlock(block *types.Block) (*coinAge, bool) {
-	if !engine.isItMe(block.Coinbase()) {
+func (engine *PoS) stakeOfBlock(header *types.Header, account common.Address) (*coinAge, bool) {
+	if !equalAddresses(header.Coinbase, account) {
 		return nil, false
 	}
-	stake, err := extractStake(block.Header())
+	stake, err := engine.headerStake(header)
 	if err != nil {
 		return nil, false
 	}
 	return stake, true
 }
 
-func (engine *PoS) blockAge(block *types.Block, timeDiff *big.Int) (value, age *big.Int) {
-	bValue := new(big.Int).Set(big0)
-	bAge := new(big.Int).Set(big0)
-	caFromTx := new(big.Int)
-
-	// coin-seconds:
-	transactions := block.Transactions()
-	for _, transaction := range transactions {
-		if fromAddress, fromErr := From(transaction); fromErr == nil {
-			// we count regular transaction to us only when they are old enough
-			if engine.isItMe(fromAddress) && timeDiff.Cmp(engine.config.CoinAgeFermentation) == 1 {
-				// coin age of transaction
-				caFromTx.Set(transaction.Value())
-				caFromTx.Mul(caFromTx, timeDiff)
-
-				// this transaction should be taken from block age
-				bAge.Sub(bAge, caFromTx)
-				bValue.Sub(bValue, transaction.Value())
-				continue
-			}
-
-			// transactions from DistributionAccount should always be counted
-			if equalAddresses(fromAddress, engine.config.DistributionAccount) {
-				// coin age of transaction
-				caFromTx.Set(transaction.Value())
-				caFromTx.Mul(caFromTx, timeDiff)
-				caFromTx.Mul(caFromTx, big.NewInt(100)) // experiment
-
-				// this transaction should be added to block age
-				bAge.Add(bAge, caFromTx)
-				bValue.Add(bValue, transaction.Value())
+// blockEntries returns the transfers of the block affecting the coin age of
+// the account, stamped with the given block time. The senders are derived with
+// the signer the chain configuration prescribes for the block, like the state
+// transition does. Distributions count for every account, other transfers to
+// the account only if their sender can't be derived.
+func (engine *PoS) blockEntries(config *params.ChainConfig, block *types.Block, blockTime uint64, account common.Address) []coinAgeEntry {
+	var entries []coinAgeEntry
+	signer := types.MakeSigner(config, block.Number())
+	for _, transaction := range block.Transactions() {
+		entry := coinAgeEntry{Number: block.NumberU64(), Time: blockTime, Amount: transaction.Value()}
+
+		if fromAddress, fromErr := types.Sender(signer, transaction); fromErr == nil {
+			switch {
+			case fromAddress == account:
+				entry.Kind = entrySent
+			case engine.config.IsDistributionAccount(fromAddress):
+				entry.Kind = entryDistributed
+			default:
 				continue
 			}
 		} else {
 			toAddress := transaction.To()
+			if toAddress == nil || *toAddress != account {
+				continue
+			}
+			entry.Kind = entryReceived
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
 
-			if toAddress != nil && engine.isItMe(*toAddress) && timeDiff.Cmp(engine.config.CoinAgeFermentation) == 1 {
-				caFromTx.Set(transaction.Value())
-				caFromTx.Mul(caFromTx, timeDiff)
+// blockAge returns the value and coin-seconds the transfers of the block
+// contribute to the coin age of the primary signer timeDiff seconds after it.
+func (engine *PoS) blockAge(config *params.ChainConfig, block *types.Block, timeDiff *big.Int) (value, age *big.Int) {
+	value, age = new(big.Int), new(big.Int)
+	for _, entry := range engine.blockEntries(config, block, 0, engine.primarySigner().address) {
+		entry.accumulate(engine.config, value, age, timeDiff)
+	}
+	return value, age
+}
 
-				// this transaction should be added to block age
-				bAge.Add(bAge, caFromTx)
-				bValue.Add(bValue, transaction.Value())
-			}
+// coinAge computes and records the coin age the primary signer can stake at
+// the given time, see signerCoinAge and recordCoinAge.
+func (engine *PoS) coinAge(chain consensus.ChainReader, at uint64) (*coinAge, error) {
+	ctx, cancel := engine.prepareContext()
+	defer cancel()
+
+	signer := engine.primarySigner().address
+	lastCoinAge, acc, err := engine.signerCoinAge(ctx, chain, signer, at)
+	if err != nil {
+		return nil, err
+	}
+	engine.recordCoinAge(signer, lastCoinAge, acc, at)
+	return lastCoinAge, nil
+}
+
+// signerCoinAge computes the coin age the local signer can stake at the given
+// time, the timestamp of the block being sealed, on top of the current head,
+// and records a checkpoint if one is due. Once the signer has a checkpoint,
+// the walk is abandoned when the context is done and the stake approximated
+// from the checkpoint instead, without an accrual. The transactions of all
+// blocks within the coin age lifetime after the latest checkpoint are needed;
+// if any of them or their bodies are missing (e.g. pruned or not yet synced),
+// the age can't be known and errCoinAgeNotReady is returned.
+func (engine *PoS) signerCoinAge(ctx context.Context, chain consensus.ChainReader, signer common.Address, at uint64) (*coinAge, *accrual, error) {
+	head := chain.CurrentHeader()
+	now := time.Unix(int64(at), 0)
+
+	// without a checkpoint to approximate from, the walk finishes whatever
+	// it takes, so it can record the first one
+	if engine.latestCoinAgeCheckpoint(signer) == nil {
+		ctx = context.Background()
+	}
+	start := time.Now()
+	lastCoinAge, acc, err := engine.coinAgeAt(ctx, chain, head, now, signer)
+	coinAgeTimer.UpdateSince(start)
+	if err == context.DeadlineExceeded {
+		if lastCoinAge, err = engine.approximateCoinAge(chain, head, now, signer); err != nil {
+			return nil, nil, err
 		}
+		coinAgeFallbackMeter.Mark(1)
+		coinAgeGauge.Update(gaugeValue(lastCoinAge.Age))
+		log.Warn("Coin age exceeded its time budget, staking an approximation", "signer", signer, "budget", engine.prepareBudget(), "age", lastCoinAge.Age, "value", lastCoinAge.Value)
+		return lastCoinAge, nil, nil
 	}
+	if err != nil {
+		return nil, nil, err
+	}
+	coinAgeGauge.Update(gaugeValue(lastCoinAge.Age))
+	engine.maybeWriteCoinAgeCheckpoint(chain, head, acc, signer)
+	return lastCoinAge, acc, nil
+}
 
-	return bValue, bAge
+// recordCoinAge records the coin age the signer stakes at the given time along
+// with the contribution log of its accrual. Approximated stakes, which come
+// without an accrual, aren't recorded. Only blocks being prepared are recorded
+// this way, queries go through ComputeCoinAge.
+func (engine *PoS) recordCoinAge(signer common.Address, lastCoinAge *coinAge, acc *accrual, at uint64) {
+	if acc == nil {
+		return
+	}
+	contributions := newCoinAgeLog(engine.config, signer, acc, at)
+	engine.persist(func() error {
+		if err := lastCoinAge.saveCoinAge(engine.db, signer); err != nil {
+			return err
+		}
+		return engine.storeCoinAgeLog(contributions)
+	})
 }
 
-// only called by the sealer
-func (engine *PoS) coinAge(chain consensus.ChainReader) *coinAge {
-	lastCoinAge := &coinAge{0, new(big.Int).Set(big0), new(big.Int).Set(big0)}
+// CoinAgeAt computes the coin age the primary signer could stake when the canonical
+// block with the given number was the head, taking the block's timestamp as
+// the current time. Unlike the age computed for sealing, the result only
+// depends on the chain and isn't recorded.
+func (engine *PoS) CoinAgeAt(chain consensus.ChainReader, number uint64) (*coinAge, error) {
+	head := chain.GetHeaderByNumber(number)
+	if head == nil {
+		return nil, errUnknownBlock
+	}
+	ca, _, err := engine.coinAgeAt(context.Background(), chain, head, time.Unix(head.Time.Int64(), 0), engine.primarySigner().address)
+	return ca, err
+}
 
-	now := time.Now()
+// ComputeCoinAge computes the coin age the given address could stake at the
+// given time on top of the current head, like the sealer does for the signer.
+// Nothing is recorded, whichever the address.
+func (engine *PoS) ComputeCoinAge(chain consensus.ChainReader, addr common.Address, at uint64) (*coinAge, error) {
+	head := chain.CurrentHeader()
+	if head == nil {
+		return nil, errUnknownBlock
+	}
+	ca, _, err := engine.coinAgeAt(context.Background(), chain, head, time.Unix(int64(at), 0), addr)
+	return ca, err
+}
 
-	accumulateCoinAge := func(fromTime, number uint64) {
-		holdingPeriod := uint64(now.Unix()) + engine.config.CoinAgeHoldingPeriod.Uint64()
-		for {
-			if number == 0 {
-				// add premined value
-				lastCoinAge.Age.Add(lastCoinAge.Age, engine.getPremineCoinAge())
-				return
-			}
+// prepareBudget returns the time the coin age of a block being prepared may
+// take, half the block period unless configured.
+func (engine *PoS) prepareBudget() time.Duration {
+	if engine.budget > 0 {
+		return engine.budget
+	}
+	return time.Duration(engine.config.BlockPeriod) * time.Second / 2
+}
 
-			header := chain.GetHeaderByNumber(number)
-			if header == nil {
-				return
-			}
+// prepareContext returns the context the coin age computations of a block
+// being prepared share, done once the budget is used up.
+func (engine *PoS) prepareContext() (context.Context, context.CancelFunc) {
+	if budget := engine.prepareBudget(); budget > 0 {
+		return context.WithTimeout(context.Background(), budget)
+	}
+	return context.WithCancel(context.Background())
+}
 
-			t := new(big.Int).Set(header.Time).Uint64()
-			if t < fromTime {
-				return
-			}
-			diffTime := new(big.Int).SetUint64(uint64(now.Unix()) - t)
-
-			if stake, isMyStake := engine.stakeOfBlock(chain.GetBlock(header.Hash(), number)); isMyStake {
-				if t > holdingPeriod {
-					// can't use the staked amount yet
-					lastCoinAge.Age.Sub(lastCoinAge.Age, stake.Age)
-				}
-				// add reward amount from the minted block to coin age
-				_, nettoReward := splitRewards(estimateBlockReward(header))
-				nettoReward.Mul(nettoReward, diffTime)
-				lastCoinAge.Age.Add(lastCoinAge.Age, nettoReward)
-			}
+// accrual is the coin age of an account in coin-seconds along with the
+// entries it is made of.
+type accrual struct {
+	value   *big.Int
+	age     *big.Int              // Coin age in coin-seconds
+	entries []coinAgeEntry        // Entries by descending block number
+	held    []coinAgeContribution // Coin-seconds of the stakes still held, by descending block number
+	since   uint64                // Time from which on the entries are complete
+	retired uint64                // Block the account migrated its key in, 0 if it didn't
+}
 
-			bValue, bAge := engine.blockAge(chain.GetBlock(header.Hash(), number), diffTime)
-			lastCoinAge.Age.Add(lastCoinAge.Age, bAge)
-			lastCoinAge.Value.Add(lastCoinAge.Value, bValue)
+// coinAgeAt accumulates the coin age of the account on top of the given head
+// as of the given time, converted to coin-days. The accrual it is computed
+// from is returned too. The walk over the blocks is abandoned with the
+// context's error once it is done.
+func (engine *PoS) coinAgeAt(ctx context.Context, chain consensus.ChainReader, head *types.Header, now time.Time, account common.Address) (*coinAge, *accrual, error) {
+	acc, err := engine.accrue(ctx, chain, head, now, account)
+	if err != nil {
+		return nil, nil, err
+	}
+	return engine.accruedStake(chain, head, account, acc, now), acc, nil
+}
+
+// accruedStake converts the accrual of the account to the stake as of the
+// given time. The age is bounded by the balance of the account at the head,
+// so VerifyStakeBalance accepts the stake in a block on top of it.
+func (engine *PoS) accruedStake(chain consensus.ChainReader, head *types.Header, account common.Address, acc *accrual, now time.Time) *coinAge {
+	lastCoinAge := &coinAge{
+		Time:  uint64(now.Unix()),
+		Age:   new(big.Int).Set(acc.age),
+		Value: new(big.Int).Set(acc.value),
+	}
+	// coin-days:
+	numerator, denominator := coinDayRatio(engine.config)
+	lastCoinAge.Age.Mul(lastCoinAge.Age, numerator)
+	lastCoinAge.Age.Div(lastCoinAge.Age, denominator)
 
-			number--
+	// stakeMaxAge would result in as fast kernel computation as possible,
+	// so there is no need to store meaningless information
+	if lastCoinAge.Age.Cmp(stakeMaxAge) == 1 {
+		lastCoinAge.Age.Set(stakeMaxAge)
+	}
+	// value spent since it was received leaves age the balance doesn't back
+	if balance, ok := engine.balanceOf(head, account); ok {
+		premine := engine.premineCoinAgeOf(chain, lastCoinAge.Time, account)
+		if maxAge := maxStakeAge(engine.config, balance, premine); lastCoinAge.Age.Cmp(maxAge) > 0 {
+			lastCoinAge.Age.Set(maxAge)
 		}
 	}
+	// spending and staking reduce the age faster than the value, which must
+	// not claim more than the age could have accrued
+	lastCoinAge.clampValue(engine.config)
+	return lastCoinAge
+}
+
+// accrue accumulates the coin age of the account in coin-seconds on top of
+// the given head as of the given time. The blocks are walked down to the start
+// of the coin age lifetime, to the latest checkpoint covering it or to the
+// block the account migrated its key in, which ends its coin age. Past a
+// checkpoint, the headers are walked on for the stakes still held.
+func (engine *PoS) accrue(ctx context.Context, chain consensus.ChainReader, head *types.Header, now time.Time, account common.Address) (*accrual, error) {
+	acc := &accrual{value: new(big.Int), age: new(big.Int)}
 
-	currentN := chain.CurrentHeader().Number.Uint64()
+	var missing []uint64
+	fromTime := uint64(now.Unix()) - engine.config.CoinAgeLifetime.Uint64()
+
+	currentN := head.Number.Uint64()
 	if currentN > 0 {
 		currentN--
 	}
-	accumulateCoinAge(uint64(now.Unix())-engine.config.CoinAgeLifetime.Uint64(), currentN)
+	// premined value is added once below, so the entries are complete if the
+	// walk reaches the genesis
+	for number := currentN; number > 0; number-- {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		header := chain.GetHeaderByNumber(number)
+		if header == nil {
+			// partially synced, nothing tells where the lifetime starts
+			missing = append(missing, number)
+			break
+		}
+		t := header.Time.Uint64()
+		if t < fromTime {
+			acc.since = t + 1
+			break
+		}
+		if checkpoint := engine.coinAgeCheckpoint(header.Hash(), fromTime, account); checkpoint != nil {
+			acc.entries = append(acc.entries, checkpoint.Entries...)
+			acc.since, acc.retired = checkpoint.Since, checkpoint.Retired
+			engine.holdStakes(chain, number, now, account, acc)
+			break
+		}
+		block := chain.GetBlock(header.Hash(), number)
+		if block == nil {
+			missing = append(missing, number)
+			continue
+		}
+		migrated, retired, err := engine.keyMigrationEntries(ctx, chain, block, account)
+		if err != nil {
+			return nil, err
+		}
+		if retired {
+			// nothing before the migration counts anymore
+			acc.since, acc.retired = 0, number
+			break
+		}
+		if stake, isMyStake := engine.stakeOfBlock(header, account); isMyStake {
+			engine.holdStake(header, stake, now, acc)
+			// add reward amount from the minted block to coin age
+			acc.entries = append(acc.entries, coinAgeEntry{
+				Number: number,
+				Time:   t,
+				Kind:   entryReward,
+				Amount: splitBlockReward(engine.config, header.Number, blockReward(engine.config, stake)).Minter,
+			})
+		}
+		acc.entries = append(acc.entries, engine.blockEntries(chain.Config(), block, t, account)...)
+		acc.entries = append(acc.entries, migrated...)
+	}
+	if len(missing) > 0 {
+		log.Warn("Blocks needed for coin age are missing", "blocks", blockRanges(missing))
+		return nil, errCoinAgeNotReady
+	}
+	engine.settle(chain, head, now, account, acc)
+	return acc, nil
+}
+
+// holdStake takes the age of the stake made in the header from the accrual if
+// the stake is still held at now.
+func (engine *PoS) holdStake(header *types.Header, stake *coinAge, now time.Time, acc *accrual) {
+	t := header.Time.Uint64()
+	if !withinHoldingPeriod(engine.config, t, uint64(now.Unix())) {
+		return
+	}
+	// can't use the staked age yet, the stake is in coin-days
+	numerator, denominator := coinDayRatio(engine.config)
+	staked := new(big.Int).Mul(stake.Age, denominator)
+	acc.age.Sub(acc.age, staked.Div(staked, numerator))
+	acc.held = append(acc.held, coinAgeContribution{Number: header.Number.Uint64(), Time: t, Delta: new(big.Int).Neg(staked)})
+}
+
+// holdStakes takes the stakes of the account still held at now from the
+// accrual, from the block with the given number down. Only the headers are
+// needed, so the stakes of the blocks a checkpoint covers are held too.
+func (engine *PoS) holdStakes(chain consensus.ChainReader, number uint64, now time.Time, account common.Address, acc *accrual) {
+	for ; number > acc.retired; number-- {
+		header := chain.GetHeaderByNumber(number)
+		if header == nil || !withinHoldingPeriod(engine.config, header.Time.Uint64(), uint64(now.Unix())) {
+			return
+		}
+		if stake, isMyStake := engine.stakeOfBlock(header, account); isMyStake {
+			engine.holdStake(header, stake, now, acc)
+		}
+	}
+}
+
+// withinHoldingPeriod returns whether a stake made in a block with the given
+// time is still held at now, so the age it consumed can't be staked again.
+func withinHoldingPeriod(config *params.SproutsConfig, blockTime, now uint64) bool {
+	if config.CoinAgeHoldingPeriod == nil {
+		return false
+	}
+	period := config.CoinAgeHoldingPeriod.Uint64()
+	return now < period || blockTime > now-period
+}
+
+// settle accumulates the entries of the accrual within the coin age lifetime
+// as of the given time, adds the premine and bounds the value by the balance
+// of the account at the head.
+func (engine *PoS) settle(chain consensus.ChainReader, head *types.Header, now time.Time, account common.Address, acc *accrual) {
+	fromTime := uint64(now.Unix()) - engine.config.CoinAgeLifetime.Uint64()
+	for _, entry := range acc.entries {
+		if entry.Time < fromTime {
+			// checkpoints may hold entries past the lifetime
+			continue
+		}
+		entry.accumulate(engine.config, acc.value, acc.age, new(big.Int).SetUint64(uint64(now.Unix())-entry.Time))
+	}
 
 	// Even if node has made a stake recently with premined coins,
 	// it still can use them for another stake. This ensures continuation of minting
 	// in any situation.
-	lastCoinAge.Age.Add(lastCoinAge.Age, engine.getPremineCoinAge())
+	if acc.retired == 0 {
+		acc.age.Add(acc.age, engine.premineCoinAgeOf(chain, uint64(now.Unix()), account))
+	}
 
-	// coin-days:
-	lastCoinAge.Age.Div(lastCoinAge.Age, new(big.Int).SetUint64(coinValue/(24*60*60)))
+	// spent and staked coins must not make the age negative, it would be
+	// encoded as its absolute value
+	if acc.age.Sign() < 0 {
+		acc.age.Set(big0)
+	}
 
-	// stakeMaxAge would result in as fast kernel computation as possible,
-	// so there is no need to store meaningless information
-	if lastCoinAge.Age.Cmp(stakeMaxAge) == 1 {
-		lastCoinAge.Age.Set(stakeMaxAge)
+	// value received within the lifetime may have been spent since
+	if balance, ok := engine.balanceOf(head, account); ok && acc.value.Cmp(balance) > 0 {
+		acc.value.Set(balance)
+	}
+	if acc.value.Sign() < 0 {
+		acc.value.Set(big0)
 	}
-	lastCoinAge.Time = uint64(time.Now().Unix())
-	lastCoinAge.saveCoinAge(engine.db, engine.signer)
-	return lastCoinAge
 }
 
-// not used at the moment
-func (engine *PoS) getPremineCoinAge() *big.Int {
-	genesis := engine.getGenesis()
-	// count pre-allocated funds only for half a year
-	if genesis.Timestamp < uint64(time.Now().AddDate(0, -6, 0).Unix()) {
-		return big0
+// blockRanges formats the given descending block numbers as ascending ranges.
+func blockRanges(numbers []uint64) string {
+	var ranges []string
+	for i := len(numbers) - 1; i >= 0; {
+		first, last := numbers[i], numbers[i]
+		for i--; i >= 0 && numbers[i] == last+1; i-- {
+			last = numbers[i]
+		}
+		if first == last {
+			ranges = append(ranges, strconv.FormatUint(first, 10))
+		} else {
+			ranges = append(ranges, fmt.Sprintf("%d-%d", first, last))
+		}
 	}
-	for address, genesisAccount := range genesis.Alloc {
-		if len(address) > 0 && engine.isItMe(address) {
-			premined := new(big.Int).Set(genesisAccount.Balance)
-			premined.Mul(premined, preAllocCoefficient)
-			return premined
+	return strings.Join(ranges, ",")
+}
+
+// premineCoinAgeOf returns the coin age in coin-seconds the genesis allocation
+// of the account has accrued at the given time. The allocation is read from the
+// state of the genesis block, so it's found even if the genesis specification
+// doesn't embed it, falling back to the specification if the state is missing.
+func (engine *PoS) premineCoinAgeOf(chain consensus.ChainReader, at uint64, account common.Address) *big.Int {
+	if engine.db != nil {
+		if header := chain.GetHeaderByNumber(0); header != nil {
+			statedb, err := state.New(header.Root, state.NewDatabase(engine.db))
+			if err == nil {
+				return premineCoinAge(engine.config, statedb.GetBalance(account), header.Time.Uint64(), at)
+			}
+			log.Debug("Genesis state unavailable for premine coin age", "err", err)
 		}
 	}
-	return big0
+	genesis := engine.getGenesis(chain)
+	return premineCoinAge(engine.config, genesis.Alloc[account].Balance, genesis.Timestamp, at)
 }
 
+// balanceOf returns the balance of the account in the state of the header,
+// if the state is available.
+func (engine *PoS) balanceOf(header *types.Header, account common.Address) (*big.Int, bool) {
+	if engine.db == nil {
+		return nil, false
+	}
+	statedb, err := state.New(header.Root, state.NewDatabase(engine.db))
+	if err != nil {
+		log.Debug("Head state unavailable for coin age", "number", header.Number, "err", err)
+		return nil, false
+	}
+	return statedb.GetBalance(account), true
+}
+
+// premineCoinAge returns the coin age in coin-seconds a genesis allocation of
+// the given balance has accrued at the given time. Genesis allocations accrue
+// from the genesis timestamp without fermenting first, so the initial holders
+// can mint right away, but no longer than the coin age lifetime.
+func premineCoinAge(config *params.SproutsConfig, balance *big.Int, genesisTime, at uint64) *big.Int {
+	if balance == nil || at <= genesisTime {
+		return new(big.Int)
+	}
+	held := at - genesisTime
+	if config.CoinAgeLifetime != nil && held > config.CoinAgeLifetime.Uint64() {
+		held = config.CoinAgeLifetime.Uint64()
+	}
+	return new(big.Int).Mul(balance, new(big.Int).SetUint64(held))
+}
+
+// GenesisStake returns the stake in coin-days a signer holding nothing but its
+// genesis allocation claims at the given time. It allows such stakes to be
+// verified from the genesis alone. The returned value is owned by the caller.
+func GenesisStake(config *params.SproutsConfig, genesis *core.Genesis, address common.Address, at uint64) *big.Int {
+	age := premineCoinAge(config, genesis.Alloc[address].Balance, genesis.Timestamp, at)
+
+	numerator, denominator := coinDayRatio(config)
+	age.Mul(age, numerator)
+	age.Div(age, denominator)
+	if age.Cmp(stakeMaxAge) == 1 {
+		age.Set(stakeMaxAge)
+	}
+	return age
+}
+
+// extractStake decodes the stake embedded into the extra-data of the header.
 func extractStake(header *types.Header) (*coinAge, error) {
-	stakeBytes := header.Extra[len(header.Extra)-extraSeal-extraCoinAge : len(header.Extra)-extraSeal]
-	return parseStake(stakeBytes)
+	extra, err := decodeHeaderExtra(header.Extra)
+	if err != nil {
+		return nil, errInvalidStake
+	}
+	return parseStake(extra.Stake)
 }
 
-func extractKernel(header *types.Header) []byte {
-	return header.Extra[len(header.Extra)-extraSeal-extraCoinAge-extraKernel : len(header.Extra)-extraSeal-extraCoinAge]
+// extractKernel returns the kernel embedded into the extra-data of the header,
+// the kernel hash followed by the hashed timestamp. The returned slice is a
+// copy.
+func extractKernel(header *types.Header) ([]byte, error) {
+	extra, err := decodeHeaderExtra(header.Extra)
+	if err != nil {
+		return nil, err
+	}
+	return append(common.CopyBytes(extra.Kernel), extra.HashedTimestamp...), nil
 }
 
+// isItMe reports whether the address is one of the local signers.
 func (engine *PoS) isItMe(address common.Address) bool {
-	return equalAddresses(address, engine.signer)
+	_, ok := engine.signerOf(address)
+	return ok
 }
 
 func equalAddresses(a, b common.Address) bool {
 	return bytes.Equal(a.Bytes(), b.Bytes())
 }
 
-func (engine *PoS) computeKernel(prevBlock *types.Header, stake *big.Int, header *types.Header) (hash *big.Int, timestamp *big.Int, err error) {
-	hash = new(big.Int)
-	timestamp = new(big.Int).SetInt64(0)
-	err = errCantFindKernel
+// ratio returns the configured numerator and denominator, falling back to the
+// defaults if either of them is unset or the denominator isn't positive.
+func ratio(numerator, denominator, defaultNumerator, defaultDenominator *big.Int) (*big.Int, *big.Int) {
+	if numerator == nil || denominator == nil || denominator.Sign() <= 0 {
+		return defaultNumerator, defaultDenominator
+	}
+	return numerator, denominator
+}
 
-	if header.Number.Uint64() < 1 || prevBlock == nil {
-		return
+// kernelTargetRatio returns the coefficient of the kernel target.
+func kernelTargetRatio(config *params.SproutsConfig) (*big.Int, *big.Int) {
+	if config == nil {
+		return defaultKernelTargetNumerator, defaultKernelTargetDenominator
 	}
+	return ratio(config.KernelTargetNumerator, config.KernelTargetDenominator, defaultKernelTargetNumerator, defaultKernelTargetDenominator)
+}
 
+// coinDayRatio returns the coefficient converting coin-seconds to coin-days.
+func coinDayRatio(config *params.SproutsConfig) (*big.Int, *big.Int) {
+	if config == nil {
+		return defaultCoinDayNumerator, defaultCoinDayDenominator
+	}
+	return ratio(config.CoinDayNumerator, config.CoinDayDenominator, defaultCoinDayNumerator, defaultCoinDayDenominator)
+}
+
+// annualRewardRatio returns the reward per coin-year.
+func annualRewardRatio(config *params.SproutsConfig) (*big.Int, *big.Int) {
+	if config == nil {
+		return defaultAnnualRewardNumerator, defaultAnnualRewardDenominator
+	}
+	return ratio(config.AnnualRewardNumerator, config.AnnualRewardDenominator, defaultAnnualRewardNumerator, defaultAnnualRewardDenominator)
+}
+
+// kernelTarget computes the target a kernel hash must stay below. All factors
+// are multiplied first and divided once, so no precision is lost in between.
+func kernelTarget(config *params.SproutsConfig, difficulty, stake *big.Int, timeWeight uint64) *big.Int {
+	numerator, denominator := kernelTargetRatio(config)
+
+	target := new(big.Int).Set(difficulty)
+	target.Mul(target, stake)
+	target.Mul(target, new(big.Int).SetUint64(timeWeight))
+	target.Mul(target, numerator)
+	return target.Div(target, denominator)
+}
+
+// kernelPreimageVersion identifies the layout of the kernel hash preimage.
+const kernelPreimageVersion = 1
+
+// kernelAttempt holds the inputs and intermediates of checking a kernel at a
+// single offset, enough to reproduce the comparison independently.
+type kernelAttempt struct {
+	Version       uint64   // Layout of the preimage
+	StakeModifier *big.Int // Stake modifier in effect
+	ParentTime    uint64   // Timestamp of the parent block
+	Offset        uint64   // Offset of the kernel timestamp from the block timestamp
+	TimeWeight    uint64   // Time weight the target is computed with
+	Target        *big.Int // Target the kernel hash had to stay below
+	Preimage      []byte   // Preimage of the double SHA256 kernel hash
+	Hash          []byte   // Kernel hash
+	Value         *big.Int // Part of the kernel hash compared against the target
+}
+
+// found reports whether the attempt satisfies the target.
+func (attempt *kernelAttempt) found() bool {
+	return attempt.Value.Cmp(attempt.Target) == -1
+}
+
+// attemptKernel computes the kernel hash and target at the given offset.
+func (engine *PoS) attemptKernel(prevBlock *types.Header, stake *big.Int, header *types.Header, step uint64) *kernelAttempt {
+	timeWeight := header.Time.Uint64() - step - prevBlock.Time.Uint64()
+	if timeWeight > stakeMaxTime {
+		timeWeight = stakeMaxTime
+	}
+	target := kernelTarget(engine.config, header.Difficulty, stake, timeWeight)
+
+	rawHash := append(stakeModifier.Bytes(), prevBlock.Time.Bytes()...)
+	rawHash = append(rawHash, []byte(strconv.FormatUint(uint64(binary.Size(*header)), 10))...)
+	rawHash = append(rawHash, []byte(strconv.FormatUint(prevBlock.Time.Uint64(), 10))...)
+	rawHash = append(rawHash, []byte(strconv.FormatUint(header.Time.Uint64()-step, 10))...)
+	h1 := sha256.New()
+	h1.Write(rawHash)
+	h2 := sha256.New()
+	h2.Write(h1.Sum(nil))
+	hash := h2.Sum(nil)
+
+	return &kernelAttempt{
+		Version:       kernelPreimageVersion,
+		StakeModifier: new(big.Int).Set(stakeModifier),
+		ParentTime:    prevBlock.Time.Uint64(),
+		Offset:        step,
+		TimeWeight:    timeWeight,
+		Target:        target,
+		Preimage:      rawHash,
+		Hash:          hash,
+		Value:         new(big.Int).SetUint64(uint64(binary.LittleEndian.Uint32(hash))),
+	}
+}
+
+// findKernel searches the offsets for a kernel satisfying the target.
+func (engine *PoS) findKernel(prevBlock *types.Header, stake *big.Int, header *types.Header) (*kernelAttempt, error) {
+	if header.Number.Uint64() < 1 || prevBlock == nil {
+		return nil, errCantFindKernel
+	}
 	// increase gradually target until kernel is found
 	for t := 60; t >= 0; t-- {
-		step := uint64(t)
-		timeWeight := header.Time.Uint64() - step - prevBlock.Time.Uint64()
-		if timeWeight > stakeMaxTime {
-			timeWeight = stakeMaxTime
-		}
-		target := new(big.Int).Set(header.Difficulty)
-		// target.Div(target, big.NewInt(100000))
-		target.Mul(target, stake)
-		target.Mul(target, new(big.Int).SetUint64(timeWeight))
-		target.Div(target, new(big.Int).SetUint64(coinValue))
-		target.Div(target, new(big.Int).SetUint64(24*60*60))
-
-		rawHash := append(stakeModifier.Bytes(), prevBlock.Time.Bytes()...)
-		rawHash = append(rawHash, []byte(strconv.FormatUint(uint64(binary.Size(*header)), 10))...)
-		rawHash = append(rawHash, []byte(strconv.FormatUint(prevBlock.Time.Uint64(), 10))...)
-		rawHash = append(rawHash, []byte(strconv.FormatUint(header.Time.Uint64()-step, 10))...)
-		h1 := sha256.New()
-		h1.Write(rawHash)
-		h2 := sha256.New()
-		h2.Write(h1.Sum(nil))
-
-		computedHash := new(big.Int).SetUint64(uint64(binary.LittleEndian.Uint32(h2.Sum(nil))))
-		log.Info("Attempt to find kernel", "hash", computedHash, "target", target, "diff", header.Difficulty, "stake", stake, "timeWeight", timeWeight)
-
-		if computedHash.Cmp(target) == -1 {
-			// kernel found
-			err = nil
-			hash.SetBytes(h2.Sum(nil))
-			timestamp.SetUint64(step)
-			return
+		attempt := engine.attemptKernel(prevBlock, stake, header, uint64(t))
+		kernelAttemptCounter.Inc(1)
+		log.Trace("Attempt to find kernel", "hash", attempt.Value, "target", attempt.Target, "diff", header.Difficulty, "stake", stake, "timeWeight", attempt.TimeWeight)
+
+		if attempt.found() {
+			return attempt, nil
 		}
 	}
+	return nil, errCantFindKernel
+}
+
+func (engine *PoS) computeKernel(prevBlock *types.Header, stake *big.Int, header *types.Header) (hash *big.Int, timestamp *big.Int, err error) {
+	defer kernelTimer.UpdateSince(time.Now())
 
-	return
+	attempt, err := engine.findKernel(prevBlock, stake, header)
+	if err != nil {
+		kernelMissedCounter.Inc(1)
+		return new(big.Int), new(big.Int), err
+	}
+	kernelFoundCounter.Inc(1)
+	return new(big.Int).SetBytes(attempt.Hash), new(big.Int).SetUint64(attempt.Offset), nil
 }
 
+// checkKernelHash verifies the kernel embedded into the header. The kernel is
+// recomputed at the offset the sealer found it at, recovered from its hashed
+// timestamp, instead of searching the offsets again, so the outcome doesn't
+// depend on which offset the search would pick.
 func (engine *PoS) checkKernelHash(prevBlock *types.Header, header *types.Header, stake *coinAge) error {
 	if header.Number.Uint64() == 0 {
 		// should never get here
 		return errUnknownBlock
 	}
-
-	hash, timestamp, err := engine.computeKernel(
-		prevBlock,
-		new(big.Int).Set(stake.Age),
-		header)
+	_, kernel, err := engine.stakeAndKernel(header)
 	if err != nil {
 		return err
 	}
+	step, ok := kernelStep(kernel)
+	if !ok {
+		return errWrongKernel
+	}
+	attempt := engine.attemptKernel(prevBlock, new(big.Int).Set(stake.Age), header, step)
+	if !attempt.found() {
+		return errCantFindKernel
+	}
+	// the hash is embedded as a big integer, without its leading zero bytes
+	hashAsBytes := new(big.Int).SetBytes(attempt.Hash).Bytes()
+	if !bytes.Equal(kernel[:len(hashAsBytes)], hashAsBytes) {
+		return errWrongKernel
+	}
+	return nil
+}
+
+// finalization is the state of a block being finalized, passed along the
+// finalization steps.
+type finalization struct {
+	header *types.Header
+	state  *state.StateDB
+	reward *big.Int    // Total reward of the block
+	split  RewardSplit // Shares of the total reward
+	paid   RewardSplit // Rewards credited so far
+}
+
+// finalizationStep is a single named step of the end-of-block finalization.
+type finalizationStep struct {
+	name  string
+	apply func(config *params.SproutsConfig, f *finalization)
+}
+
+// finalizationSteps lists the end-of-block steps in the order they are
+// applied. Block production and verification both go through this list, so
+// reordering it changes the state roots and is a consensus change.
+var finalizationSteps = []finalizationStep{
+	{"reward", computeReward},
+	{"rewardCap", capReward},
+	{"rewardSplit", splitReward},
+	{"payout", payRewards},
+}
+
+// applyFinalizationSteps runs all finalization steps on the state in their
+// canonical order and returns the rewards they paid.
+func applyFinalizationSteps(config *params.SproutsConfig, header *types.Header, state *state.StateDB) RewardSplit {
+	f := &finalization{header: header, state: state, reward: new(big.Int), split: newRewardSplit(), paid: newRewardSplit()}
+	for _, step := range finalizationSteps {
+		step.apply(config, f)
+	}
+	return f.paid
+}
 
-	h := sha3.NewShake256()
-	h.Write(timestamp.Bytes())
-	hashedTimestamp := make([]byte, 32)
-	h.Read(hashedTimestamp)
+// finalizeState applies all finalization steps in their canonical order and
+// sets the resulting state root in the header. The rewards the steps paid are
+// returned.
+func finalizeState(config *params.SproutsConfig, chainConfig *params.ChainConfig, header *types.Header, state *state.StateDB) RewardSplit {
+	paid := applyFinalizationSteps(config, header, state)
+	header.Root = state.IntermediateRoot(chainConfig.IsEIP158(header.Number))
+	return paid
+}
 
-	hashAsBytes := hash.Bytes()
+// RewardSplit is the breakdown of the reward paid by a block.
+type RewardSplit struct {
+	Minter  *big.Int // Netto reward credited to the coinbase
+	Charity *big.Int // Reward credited to the charity account
+	RD      *big.Int // Reward credited to the r&d account
+}
 
-	// compare kernel and timestamp
-	kernel := extractKernel(header)
+// newRewardSplit returns a split paying nothing.
+func newRewardSplit() RewardSplit {
+	return RewardSplit{Minter: new(big.Int), Charity: new(big.Int), RD: new(big.Int)}
+}
 
-	// sometimes hash can take 31
-	till := extraKernel / 2
-	if len(hashAsBytes) < till {
-		till = len(hashAsBytes)
+// splitBlockReward splits the total reward of the block with the given number
+// according to the shares configured for it.
+func splitBlockReward(config *params.SproutsConfig, number *big.Int, totalReward *big.Int) RewardSplit {
+	charity, rd := uint64(params.DefaultRewardsBasisPoints), uint64(params.DefaultRewardsBasisPoints)
+	if config != nil {
+		charity, rd = config.RewardBasisPoints(number)
 	}
+	return splitRewards(totalReward, charity, rd)
+}
 
-	if !bytes.Equal(kernel[:till], hashAsBytes) || !bytes.Equal(kernel[extraKernel/2:extraKernel], hashedTimestamp) {
-		return errWrongKernel
+// computeReward sets the total reward earned by the coin age of the stake
+// embedded into the header.
+func computeReward(config *params.SproutsConfig, f *finalization) {
+	stake, err := extractStake(f.header)
+	if err != nil {
+		log.Warn(err.Error())
+		return
 	}
+	f.reward = stakeReward(config, stake)
+}
 
-	return nil
+// capReward bounds the total reward by the maximum block reward.
+func capReward(config *params.SproutsConfig, f *finalization) {
+	f.reward = capBlockReward(config, f.reward)
 }
 
+// splitReward splits the total reward into the shares of the minter and the
+// charity and r&d accounts. By default:
 // 0.84 = netto reward
 // 0.08 = charity (to a Sprouts+ address C)
 // 0.08 = r&d (to a Sprouts+ address D)
-func accumulateRewards(config *params.SproutsConfig, header *types.Header, state *state.StateDB) {
-	// first estimate complete reward
-	reward := new(big.Int).Set(estimateBlockReward(header))
+func splitReward(config *params.SproutsConfig, f *finalization) {
+	f.split = splitBlockReward(config, f.header.Number, f.reward)
+}
 
-	// now form rewards to charity and r&d (brutto) and minter (netto)
-	bruttoReward, nettoReward := splitRewards(reward)
+// payRewards credits the shares of the reward to their recipients.
+func payRewards(config *params.SproutsConfig, f *finalization) {
+	f.state.AddBalance(f.header.Coinbase, f.split.Minter)
+	f.state.AddBalance(config.RewardsCharityAccount, f.split.Charity)
+	f.state.AddBalance(config.RewardsRDAccount, f.split.RD)
 
-	// add rewards to balances
-	state.AddBalance(header.Coinbase, nettoReward)
-	state.AddBalance(config.RewardsCharityAccount, bruttoReward)
-	state.AddBalance(config.RewardsRDAccount, bruttoReward)
+	f.paid.Minter.Add(f.paid.Minter, f.split.Minter)
+	f.paid.Charity.Add(f.paid.Charity, f.split.Charity)
+	f.paid.RD.Add(f.paid.RD, f.split.RD)
 }
 
-// total reward for the block
-// 8% annual reward split in 365 daily rewards
-func estimateBlockReward(header *types.Header) *big.Int {
+// estimateBlockReward computes the total reward for the stake embedded into
+// the header, see blockReward. The coin age earns the configured annual reward
+// rate, prorated per day, and the result is capped at the maximum block reward.
+func estimateBlockReward(config *params.SproutsConfig, header *types.Header) *big.Int {
 	stake, err := extractStake(header)
 	if err != nil {
 		log.Warn(err.Error())
 		return big0
 	}
-	// 0.0212 from 1 coin
-	rewardCoinYear := uint64(21200000000000000)
-	r := stake.Value.Mul(stake.Value, new(big.Int).SetUint64(33))
-	r.Mul(r, new(big.Int).SetUint64(365*33+8))
-	return r.Mul(r, new(big.Int).SetUint64(rewardCoinYear))
+	return blockReward(config, stake)
+}
+
+// blockReward computes the total reward for the coin age of the stake, capped
+// at the maximum block reward.
+func blockReward(config *params.SproutsConfig, stake *coinAge) *big.Int {
+	return capBlockReward(config, stakeReward(config, stake))
+}
+
+// stakeReward computes the uncapped reward for the coin age of the stake. All
+// factors are multiplied before dividing once, so small stakes don't round to
+// zero.
+func stakeReward(config *params.SproutsConfig, stake *coinAge) *big.Int {
+	numerator, denominator := annualRewardRatio(config)
+
+	// reward = coin-days * coin * numerator / denominator * 33 / (365 * 33 + 8)
+	r := new(big.Int).Mul(stake.Age, new(big.Int).SetUint64(coinValue))
+	r.Mul(r, numerator)
+	r.Mul(r, big.NewInt(33))
+	return r.Div(r, new(big.Int).Mul(denominator, big.NewInt(365*33+8)))
+}
+
+// capBlockReward bounds the reward by the maximum block reward. The returned
+// value is a copy.
+func capBlockReward(config *params.SproutsConfig, reward *big.Int) *big.Int {
+	max := defaultMaxBlockReward
+	if config != nil && config.MaxBlockReward != nil {
+		max = config.MaxBlockReward
+	}
+	if reward.Cmp(max) > 0 {
+		return new(big.Int).Set(max)
+	}
+	return new(big.Int).Set(reward)
 }
 
-func splitRewards(totalReward *big.Int) (brutto, netto *big.Int) {
-	// rewards to charity and r&d take 8% each
-	brutto = new(big.Int).Set(totalReward)
-	brutto.Mul(brutto, big8)
-	brutto.Div(brutto, big100)
+// splitRewards splits the total reward into the rewards paid to the charity
+// and r&d accounts, given as their shares in basis points, and the netto
+// reward of the minter. The shares are rounded down, so the minter receives
+// the rounding remainder and the parts always add up to the total.
+func splitRewards(totalReward *big.Int, charityBasisPoints, rdBasisPoints uint64) RewardSplit {
+	charity := new(big.Int).Mul(totalReward, new(big.Int).SetUint64(charityBasisPoints))
+	charity.Div(charity, bigBasisPoints)
+
+	rd := new(big.Int).Mul(totalReward, new(big.Int).SetUint64(rdBasisPoints))
+	rd.Div(rd, bigBasisPoints)
 
-	// minter's reward is the rest
-	netto = new(big.Int).Set(totalReward)
-	netto.Sub(netto, brutto)
-	netto.Sub(netto, brutto)
+	// minter's reward is the rest, including the rounding remainder
+	netto := new(big.Int).Sub(totalReward, charity)
+	netto.Sub(netto, rd)
 
-	return
+	return RewardSplit{Minter: netto, Charity: charity, RD: rd}
 }
 
 // borrowing two PoA (clique) methods for signing blocks:
@@ -388,7 +961,10 @@ func sigHash(header *types.Header) (hash common.Hash) {
 	return hash
 }
 
-// ecrecover extracts the Ethereum account address from a signed header.
+// ecrecover extracts the Ethereum account address from a signed header. The
+// recovered signers are cached by header hash, which covers both the signed
+// fields and the signature. A signature alone must never be the key: copied
+// into another header it recovers another address, or none at all.
 func ecrecover(header *types.Header, sigcache *lru.ARCCache) (common.Address, error) {
 	// If the signature's already cached, return that
 	hash := header.Hash()
@@ -396,10 +972,11 @@ func ecrecover(header *types.Header, sigcache *lru.ARCCache) (common.Address, er
 		return address.(common.Address), nil
 	}
 	// Retrieve the signature from the header extra-data
-	if len(header.Extra) < extraDefault+extraKernel+extraCoinAge+extraSeal {
+	extra, err := decodeHeaderExtra(header.Extra)
+	if err != nil || len(extra.Reserved) < extraDefault {
 		return common.Address{}, errMissingSignature
 	}
-	signature := header.Extra[len(header.Extra)-extraSeal:]
+	signature := extra.Seal
 
 	// Recover the public key and the Ethereum address
 	pubkey, err := crypto.Ecrecover(sigHash(header).Bytes(), signature)
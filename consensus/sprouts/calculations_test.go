@@ -1,12 +1,17 @@
 package sprouts
 
 import (
-	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"fmt"
 	"math/big"
+	"math/rand"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/applicature/sprouts-plus/common"
+	"github.com/applicature/sprouts-plus/consensus"
 	"github.com/applicature/sprouts-plus/core"
 	"github.com/applicature/sprouts-plus/core/state"
 	"github.com/applicature/sprouts-plus/core/types"
@@ -48,6 +53,7 @@ var (
 		CoinAgeHoldingPeriod:  big.NewInt(60 * 60 * 24 * 1),
 		CoinAgeFermentation:   big.NewInt(60 * 60 * 24 * 7),
 		BlockPeriod:           10,
+		StakeTimeBlock:        big.NewInt(0),
 	}
 
 	testKey, _ = crypto.HexToECDSA("49a7b37aa6f6645917e7b807e9d1c00d4fa71f18343b0d4122a4d2df64dd6fee")
@@ -93,12 +99,51 @@ func TestComputeKernel(t *testing.T) {
 	}
 }
 
+// Tests that a kernel is verified at the offset it was sealed at, even if
+// searching the offsets would pick another one.
+func TestCheckKernelSealedOffset(t *testing.T) {
+	blockchain, blocks, engine := newTestChain(t, 1)
+	defer blockchain.Stop()
+
+	parent := blockchain.Genesis().Header()
+	stake, err := extractStake(blocks[0].Header())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := engine.checkKernelHash(parent, blocks[0].Header(), stake); err != nil {
+		t.Fatalf("sealed kernel rejected: %v", err)
+	}
+	// embed a kernel found at another offset than the searched one
+	searched, err := engine.findKernel(parent, stake.Age, blocks[0].Header())
+	if err != nil {
+		t.Fatal(err)
+	}
+	embed := func(step uint64) *types.Header {
+		header := blocks[0].Header()
+		attempt := engine.attemptKernel(parent, stake.Age, header, step)
+		setTestKernel(header, new(big.Int).SetBytes(attempt.Hash).Bytes(), step)
+		return header
+	}
+	other := searched.Offset - 10
+	if !engine.attemptKernel(parent, stake.Age, blocks[0].Header(), other).found() {
+		t.Fatalf("no kernel at offset %d", other)
+	}
+	header := embed(other)
+	if err := engine.checkKernelHash(parent, header, stake); err != nil {
+		t.Errorf("kernel at offset %d rejected: %v", other, err)
+	}
+	// offsets beyond the search are refused
+	if err := engine.checkKernelHash(parent, embed(61), stake); err != errWrongKernel {
+		t.Errorf("error mismatch: have %v, want %v", err, errWrongKernel)
+	}
+}
+
 // shortut for generation key data structures
-func initBlockchainStructures() (*ethdb.MemDatabase, *core.Genesis, *PoS) {
+func initBlockchainStructures(t testing.TB) (*ethdb.MemDatabase, *core.Genesis, *PoS) {
 	db, _ := ethdb.NewMemDatabase()
 
 	var (
-		engine = New(&sproutsConfig, db)
+		engine = newTestEngine(t, &sproutsConfig, db)
 
 		genesis = &core.Genesis{
 			Config:     params.TestSproutsChainConfig,
@@ -115,14 +160,15 @@ func initBlockchainStructures() (*ethdb.MemDatabase, *core.Genesis, *PoS) {
 }
 
 func TestGeneration(t *testing.T) {
-	db, genesis, engine := initBlockchainStructures()
+	db, genesis, _ := initBlockchainStructures(t)
+	engine := newTestFaker(t, &sproutsConfig, db)
 	genesisBlock := genesis.MustCommit(db)
 	blockchain, err := core.NewBlockChain(db, genesis.Config, engine, vm.Config{})
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer blockchain.Stop()
 
-	// for tx
 	var (
 		key1, _ = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
 		addr1   = crypto.PubkeyToAddress(key1.PublicKey)
@@ -130,55 +176,80 @@ func TestGeneration(t *testing.T) {
 		code   = common.Hex2Bytes("60606040525b7f24ec1d3ff24c2f6ff210738839dbc339cd45a5294d85c79361016243157aae7b60405180905060405180910390a15b600a8060416000396000f360606040526008565b00")
 		signer = types.NewEIP155Signer(genesis.Config.ChainId)
 	)
+	blocks, _ := GenerateFakeChain(&sproutsConfig, params.TestSproutsChainConfig, genesisBlock, db, 1000, func(i int, b *BlockGen) {
+		b.SetCoinbase(rewardsAddr)
+		if i%2 == 1 {
+			tx, _ := types.SignTx(types.NewContractCreation(b.TxNonce(addr1), new(big.Int), big.NewInt(1000000), new(big.Int), code), signer, key1)
+			b.AddTx(tx)
+		}
+	})
+	if _, err := blockchain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+}
 
-	blocks, _ :=
-		GenerateChain(&sproutsConfig, params.TestSproutsChainConfig, genesisBlock, db, 1000, func(i int, b *BlockGen) {
-			// i starts from zero in GenerateChain so make sure that difficulty is non-zero
-			b.SetDifficulty(big.NewInt(int64(i + 1)))
-
-			b.SetCoinbase(rewardsAddr)
-
-			// get parent block
-			parent := b.PrevBlock(-1)
-			// put large stake here to ensure that kernel is found
-			hash, timestamp, err := engine.computeKernel(parent.Header(), big.NewInt(1000000), b.Header())
-			if err != nil {
-				t.Fatal(err)
-			}
-			h := sha3.NewShake256()
-			h.Write(timestamp.Bytes())
-			hashedTimestamp := make([]byte, 32)
-			h.Read(hashedTimestamp)
-
-			coinAge := &coinAge{Time: uint64(time.Now().Unix()), Age: new(big.Int).Set(big0)}
-
-			extra := bytes.Repeat([]byte{0x00}, extraDefault+extraSeal+extraKernel+extraCoinAge)
-			copy(extra[len(extra)-extraCoinAge-extraKernel:], hash.Bytes())
-			copy(extra[len(extra)-extraCoinAge-extraKernel/2:], hashedTimestamp)
-			copy(extra[len(extra)-extraCoinAge:], coinAge.bytes())
-			b.SetExtra(extra)
-
-			if i%2 == 1 {
-				tx, err := types.SignTx(types.NewContractCreation(b.TxNonce(addr1), new(big.Int), big.NewInt(1000000), new(big.Int), code), signer, key1)
-				if err != nil {
-					t.Fatalf("failed to create tx: %v", err)
-				}
-				b.AddTx(tx)
-			}
-		})
+// Tests that the generation stops once its abort channel is closed, keeping
+// the blocks generated until then.
+func TestGenerationAbort(t *testing.T) {
+	db, genesis, _ := initBlockchainStructures(t)
+	genesisBlock := genesis.MustCommit(db)
 
-	// Insert blocks one by one to ensure that chain is complete enough for all checks to execute
-	for i := range blocks {
-		// Here VerifyHeaders and Finalize are being called internally
-		if _, err := blockchain.InsertChain(blocks[i : i+1]); err != nil {
-			t.Fatalf("failed to insert original chain[%d]: %v", i, err)
+	abort := make(chan struct{})
+	calls := 0
+	blocks, receipts := GenerateChainWithAbort(&sproutsConfig, params.TestSproutsChainConfig, genesisBlock, db, 100, abort, func(i int, b *BlockGen) {
+		calls++
+		if i == 4 {
+			// the fifth block fails, no more are generated
+			close(abort)
+		}
+	})
+	if len(blocks) != 5 || len(receipts) != 5 {
+		t.Fatalf("generated blocks mismatch: have %d blocks, %d receipts, want 5", len(blocks), len(receipts))
+	}
+	if calls != 5 {
+		t.Errorf("generator calls mismatch: have %d, want 5", calls)
+	}
+	for i, block := range blocks {
+		if block.NumberU64() != uint64(i+1) {
+			t.Errorf("block %d number mismatch: have %d", i, block.NumberU64())
 		}
 	}
+}
+
+// Tests that the fake failer rejects exactly the configured block.
+func TestFakeFailer(t *testing.T) {
+	db, genesis, _ := initBlockchainStructures(t)
+	engine, err := NewFakeFailer(&sproutsConfig, db, 5)
+	if err != nil {
+		t.Fatalf("failed to create engine: %v", err)
+	}
+	genesisBlock := genesis.MustCommit(db)
+	blockchain, err := core.NewBlockChain(db, genesis.Config, engine, vm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
 	defer blockchain.Stop()
+
+	blocks, _ := GenerateFakeChain(&sproutsConfig, params.TestSproutsChainConfig, genesisBlock, db, 8, func(i int, b *BlockGen) {
+		b.SetCoinbase(rewardsAddr)
+	})
+	n, err := blockchain.InsertChain(blocks)
+	if err != errWrongKernel {
+		t.Fatalf("error mismatch: have %v, want %v", err, errWrongKernel)
+	}
+	if n != 4 || blockchain.CurrentBlock().NumberU64() != 4 {
+		t.Errorf("failed block mismatch: have index %d, head %d, want index 4, head 4", n, blockchain.CurrentBlock().NumberU64())
+	}
+	if err := engine.VerifySeal(blockchain, blocks[3].Header()); err != nil {
+		t.Errorf("block 4 rejected: %v", err)
+	}
+	if err := engine.VerifySeal(blockchain, blocks[5].Header()); err != nil {
+		t.Errorf("block 6 rejected: %v", err)
+	}
 }
 
 func TestComputeDifficulty(t *testing.T) {
-	db, genesis, engine := initBlockchainStructures()
+	db, genesis, engine := initBlockchainStructures(t)
 	genesisBlock := genesis.MustCommit(db)
 	blockchain, err := core.NewBlockChain(db, genesis.Config, engine, vm.Config{})
 	if err != nil {
@@ -208,11 +279,9 @@ func TestComputeDifficulty(t *testing.T) {
 
 			coinAge := &coinAge{Time: uint64(time.Now().Unix()), Age: new(big.Int).Set(big0)}
 
-			extra := bytes.Repeat([]byte{0x00}, extraDefault+extraSeal+extraKernel+extraCoinAge)
-			copy(extra[len(extra)-extraCoinAge-extraKernel:], hash.Bytes())
-			copy(extra[len(extra)-extraCoinAge-extraKernel/2:], hashedTimestamp)
-			copy(extra[len(extra)-extraCoinAge:], coinAge.bytes())
-			b.SetExtra(extra)
+			extra := newHeaderExtra(nil)
+			extra.Kernel, extra.HashedTimestamp, extra.Stake = hash.Bytes(), hashedTimestamp, coinAge.bytes()
+			b.SetExtra(extra.encode())
 		})
 
 	// Insert blocks one by one to ensure that chain is complete enough for all checks to execute
@@ -232,15 +301,58 @@ func TestComputeDifficulty(t *testing.T) {
 	}
 
 	for i := 1; i <= n; i++ {
-		diff := computeDifficulty(blockchain, uint64(i))
+		diff, err := computeDifficulty(blockchain, uint64(i), nil)
+		if err != nil {
+			t.Fatalf("block %d: failed to compute difficulty: %v", i, err)
+		}
 		if diff.Cmp(expectedDiff[i-1]) != 0 {
 			t.Fatalf("Incorrect difficulty, expected %d, got %d\n", expectedDiff[i-1].Uint64(), diff.Uint64())
 		}
 	}
 }
 
+// Tests that the difficulty retargeted after a block grows with the spacing
+// between the block and its parent.
+func TestComputeDifficultySpacing(t *testing.T) {
+	db, genesis, engine := initBlockchainStructures(t)
+	genesisBlock := genesis.MustCommit(db)
+	blockchain, err := core.NewBlockChain(db, genesis.Config, engine, vm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blockchain.Stop()
+
+	var last *big.Int
+	for _, spacing := range []int64{1, 10, 60, 600, 3600, 24 * 60 * 60} {
+		blocks, _ := GenerateFakeChain(&sproutsConfig, params.TestSproutsChainConfig, genesisBlock, db, 2, func(i int, b *BlockGen) {
+			b.SetDifficulty(big.NewInt(1000000000000))
+			if i == 1 {
+				b.SetTime(new(big.Int).Add(b.PrevBlock(0).Time(), big.NewInt(spacing)))
+			}
+		})
+		headers := []*types.Header{blocks[0].Header(), blocks[1].Header()}
+		diff, err := computeDifficulty(blockchain, 3, headers)
+		if err != nil {
+			t.Fatalf("spacing %ds: failed to compute difficulty: %v", spacing, err)
+		}
+		if last != nil && diff.Cmp(last) <= 0 {
+			t.Errorf("spacing %ds: difficulty %v not above %v", spacing, diff, last)
+		}
+		last = diff
+	}
+	// a block can't be as old as its parent
+	defer func() {
+		if recover() == nil {
+			t.Error("block timed at its parent's time generated")
+		}
+	}()
+	GenerateFakeChain(&sproutsConfig, params.TestSproutsChainConfig, genesisBlock, db, 1, func(i int, b *BlockGen) {
+		b.SetTime(genesisBlock.Time())
+	})
+}
+
 func TestCoinAge(t *testing.T) {
-	db, genesis, engine := initBlockchainStructures()
+	db, genesis, engine := initBlockchainStructures(t)
 
 	// It must be more than a month for coin age to grow
 	genesis.Timestamp = uint64(time.Now().AddDate(0, -2, 0).Unix())
@@ -273,11 +385,9 @@ func TestCoinAge(t *testing.T) {
 
 			coinAge := &coinAge{Age: new(big.Int).Set(big0), Time: uint64(time.Now().Unix())}
 
-			extra := bytes.Repeat([]byte{0x00}, extraDefault+extraSeal+extraKernel+extraCoinAge)
-			copy(extra[len(extra)-extraCoinAge-extraKernel:], hash.Bytes())
-			copy(extra[len(extra)-extraCoinAge-extraKernel/2:], hashedTimestamp)
-			copy(extra[len(extra)-extraCoinAge:], coinAge.bytes())
-			b.SetExtra(extra)
+			extra := newHeaderExtra(nil)
+			extra.Kernel, extra.HashedTimestamp, extra.Stake = hash.Bytes(), hashedTimestamp, coinAge.bytes()
+			b.SetExtra(extra.encode())
 
 			tx, err := types.SignTx(types.NewTransaction(b.TxNonce(testAddr), rewardsAddr, big.NewInt(10), big.NewInt(1000000), new(big.Int), nil), signer, testKey)
 			if err != nil {
@@ -294,12 +404,932 @@ func TestCoinAge(t *testing.T) {
 	}
 	defer blockchain.Stop()
 
-	coinage := engine.coinAge(blockchain)
+	at := blocks[n-1].Time().Uint64() + sproutsConfig.BlockPeriod
+	coinage, err := engine.coinAge(blockchain, at)
+	if err != nil {
+		t.Fatal(err)
+	}
 	statedb, err := state.New(genesisBlock.Root(), state.NewDatabase(db))
 	statedb.AddBalance(rewardsAddr, big.NewInt(10))
 
-	coinageNew := engine.coinAge(blockchain)
+	coinageNew, err := engine.coinAge(blockchain, at)
+	if err != nil {
+		t.Fatal(err)
+	}
 	if coinage.Age.Cmp(big0) <= 0 || coinage.Time <= 0 || coinage.Age.Cmp(coinageNew.Age) != 0 || coinage.Time != coinageNew.Time {
 		t.Fatal("incorrect coin age calculation, value shouldn't have changed:", coinage, coinageNew)
 	}
 }
+
+// headersChainReader implements consensus.ChainReader serving a fixed list of
+// headers by their numbers. Side chain headers are only served by hash.
+type headersChainReader struct {
+	testerChainReader
+	headers []*types.Header
+	side    []*types.Header
+}
+
+func (r *headersChainReader) Config() *params.ChainConfig { return params.TestSproutsChainConfig }
+func (r *headersChainReader) CurrentHeader() *types.Header {
+	if len(r.headers) == 0 {
+		return nil
+	}
+	return r.headers[len(r.headers)-1]
+}
+func (r *headersChainReader) GetHeaderByNumber(number uint64) *types.Header {
+	if number < uint64(len(r.headers)) {
+		return r.headers[number]
+	}
+	return nil
+}
+func (r *headersChainReader) GetHeaderByHash(hash common.Hash) *types.Header {
+	for _, header := range append(r.headers, r.side...) {
+		if header.Hash() == hash {
+			return header
+		}
+	}
+	return nil
+}
+func (r *headersChainReader) GetHeader(hash common.Hash, number uint64) *types.Header {
+	if header := r.GetHeaderByHash(hash); header != nil && header.Number.Uint64() == number {
+		return header
+	}
+	return nil
+}
+
+func TestComputeDifficultyLowerBound(t *testing.T) {
+	timeDeltas := []uint64{0, 1, 600, 1 << 40, 1 << 62}
+
+	for _, delta := range timeDeltas {
+		chain := &headersChainReader{headers: []*types.Header{
+			{Number: big.NewInt(0), Time: big.NewInt(0), Difficulty: big.NewInt(1)},
+			{Number: big.NewInt(1), Time: big.NewInt(0), Difficulty: big.NewInt(1)},
+			{Number: big.NewInt(2), Time: new(big.Int).SetUint64(delta), Difficulty: big.NewInt(1)},
+		}}
+		if diff, _ := computeDifficulty(chain, 3, nil); diff.Cmp(big1) < 0 {
+			t.Errorf("time delta %d: difficulty dropped below 1: %v", delta, diff)
+		}
+	}
+}
+
+func TestComputeDifficultyTimeDelta(t *testing.T) {
+	difficulty := func(parentTime int64) *big.Int {
+		chain := &headersChainReader{headers: []*types.Header{
+			{Number: big.NewInt(0), Time: big.NewInt(1000), Difficulty: big.NewInt(1000000)},
+			{Number: big.NewInt(1), Time: big.NewInt(1000), Difficulty: big.NewInt(1000000)},
+			{Number: big.NewInt(2), Time: big.NewInt(parentTime), Difficulty: big.NewInt(1000000)},
+		}}
+		diff, _ := computeDifficulty(chain, 3, nil)
+		return diff
+	}
+	want := difficulty(1001)
+
+	// Equal and decreasing timestamps are treated as a one second delta
+	if diff := difficulty(1000); diff.Cmp(want) != 0 {
+		t.Errorf("equal timestamps: difficulty mismatch: have %v, want %v", diff, want)
+	}
+	if diff := difficulty(10); diff.Cmp(want) != 0 {
+		t.Errorf("decreasing timestamps: difficulty mismatch: have %v, want %v", diff, want)
+	}
+}
+
+// Tests that the difficulty of a block whose ancestors aren't canonical yet is
+// retargeted from the given parents, and fails instead of panicking without.
+func TestComputeDifficultyMissingAncestors(t *testing.T) {
+	genesis := &types.Header{Number: big.NewInt(0), Time: big.NewInt(0), Difficulty: big.NewInt(10)}
+	first := &types.Header{Number: big.NewInt(1), ParentHash: genesis.Hash(), Time: big.NewInt(10), Difficulty: big.NewInt(1000000)}
+	second := &types.Header{Number: big.NewInt(2), ParentHash: first.Hash(), Time: big.NewInt(20), Difficulty: big.NewInt(1000000)}
+	want := retargetDifficulty(second, first)
+
+	tests := []struct {
+		headers []*types.Header
+		parents []*types.Header
+		err     error
+	}{
+		{headers: []*types.Header{genesis, first, second}},
+		{headers: []*types.Header{genesis}, parents: []*types.Header{first, second}},
+		{headers: []*types.Header{genesis, first}, parents: []*types.Header{second}},
+		{headers: []*types.Header{genesis, first}, err: consensus.ErrUnknownAncestor},
+		{headers: []*types.Header{genesis}, parents: []*types.Header{first}, err: consensus.ErrUnknownAncestor},
+		{headers: []*types.Header{genesis, nil, second}, err: consensus.ErrUnknownAncestor},
+	}
+	for i, tt := range tests {
+		diff, err := computeDifficulty(&headersChainReader{headers: tt.headers}, 3, tt.parents)
+		if err != tt.err {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, tt.err)
+			continue
+		}
+		if err == nil && diff.Cmp(want) != 0 {
+			t.Errorf("test %d: difficulty mismatch: have %v, want %v", i, diff, want)
+		}
+	}
+}
+
+func TestVerifyHeaderTimestampOrder(t *testing.T) {
+	config := sproutsConfig
+	config.BlockPeriod = 0
+	engine := newTestEngine(t, &config, nil)
+	chain := &headersChainReader{}
+
+	parent := &types.Header{
+		Number:     big.NewInt(1),
+		Time:       big.NewInt(1000),
+		Difficulty: big.NewInt(1),
+		UncleHash:  types.CalcUncleHash(nil),
+		Extra:      make([]byte, extraDefault+extraKernel+extraCoinAge+extraSeal),
+	}
+	for _, time := range []int64{1000, 999} {
+		header := &types.Header{
+			Number:     big.NewInt(2),
+			ParentHash: parent.Hash(),
+			Time:       big.NewInt(time),
+			Difficulty: big.NewInt(1),
+			UncleHash:  types.CalcUncleHash(nil),
+			Extra:      make([]byte, extraDefault+extraKernel+extraCoinAge+extraSeal),
+		}
+		if err := engine.verifyHeader(chain, header, []*types.Header{parent}, true, false); err != errInvalidTimestamp {
+			t.Errorf("time %d: error mismatch: have %v, want %v", time, err, errInvalidTimestamp)
+		}
+	}
+}
+
+func TestBlockAgeDistributionFermentation(t *testing.T) {
+	config := sproutsConfig
+	config.DistributionAccount = testAddr
+
+	signer := types.NewEIP155Signer(params.TestSproutsChainConfig.ChainId)
+	tx, err := types.SignTx(types.NewTransaction(0, rewardsAddr, big.NewInt(10), big.NewInt(21000), new(big.Int), nil), signer, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := types.NewBlock(&types.Header{Number: big.NewInt(1)}, []*types.Transaction{tx}, nil, nil)
+
+	// The transaction is a day old, well within the fermentation period
+	timeDiff := big.NewInt(60 * 60 * 24)
+
+	engine := newTestEngine(t, &config, nil)
+	engine.Authorize(rewardsAddr, nil)
+	if value, age := engine.blockAge(params.TestSproutsChainConfig, block, timeDiff); value.Cmp(big.NewInt(10)) != 0 || age.Sign() <= 0 {
+		t.Errorf("recent distribution not counted: value %v, age %v", value, age)
+	}
+	config.EnforceFermentationForDistribution = true
+	engine = newTestEngine(t, &config, nil)
+	engine.Authorize(rewardsAddr, nil)
+	if value, age := engine.blockAge(params.TestSproutsChainConfig, block, timeDiff); value.Sign() != 0 || age.Sign() != 0 {
+		t.Errorf("recent distribution counted despite enforced fermentation: value %v, age %v", value, age)
+	}
+	// Fermented distributions count either way
+	if value, _ := engine.blockAge(params.TestSproutsChainConfig, block, new(big.Int).Mul(timeDiff, big.NewInt(8))); value.Cmp(big.NewInt(10)) != 0 {
+		t.Errorf("fermented distribution not counted: value %v", value)
+	}
+}
+
+// Tests that value sent away by the signer is taken from the block age right
+// away, while received value has to ferment first.
+// Tests that recent transfers from every distribution account are credited,
+// and from the singular one only if no set is configured.
+func TestBlockAgeDistributionAccounts(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	staker := crypto.PubkeyToAddress(key.PublicKey)
+
+	signer := types.NewEIP155Signer(params.TestSproutsChainConfig.ChainId)
+	var txs []*types.Transaction
+	for _, key := range []*ecdsa.PrivateKey{testKey, rewardsKey} {
+		tx, err := types.SignTx(types.NewTransaction(0, staker, big.NewInt(10), big.NewInt(21000), new(big.Int), nil), signer, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		txs = append(txs, tx)
+	}
+	block := types.NewBlock(&types.Header{Number: big.NewInt(1)}, txs, nil, nil)
+
+	// The transactions are a day old, well within the fermentation period
+	timeDiff := big.NewInt(60 * 60 * 24)
+
+	tests := []struct {
+		single   common.Address
+		multiple []common.Address
+		value    int64
+	}{
+		{single: testAddr, value: 10},
+		{single: testAddr, multiple: []common.Address{testAddr, rewardsAddr}, value: 20},
+		{single: testAddr, multiple: []common.Address{rewardsAddr}, value: 10},
+		{multiple: []common.Address{staker}, value: 0},
+	}
+	for i, tt := range tests {
+		config := sproutsConfig
+		config.DistributionAccount, config.DistributionAccounts = tt.single, tt.multiple
+
+		engine := newTestEngine(t, &config, nil)
+		engine.Authorize(staker, nil)
+		value, age := engine.blockAge(params.TestSproutsChainConfig, block, timeDiff)
+		if value.Cmp(big.NewInt(tt.value)) != 0 {
+			t.Errorf("test %d: value mismatch: have %v, want %v", i, value, tt.value)
+		}
+		if (age.Sign() > 0) != (tt.value > 0) {
+			t.Errorf("test %d: age %v doesn't match the value", i, age)
+		}
+	}
+}
+
+func TestBlockAgeOutgoingUnfermented(t *testing.T) {
+	signer := types.NewEIP155Signer(params.TestSproutsChainConfig.ChainId)
+	tx, err := types.SignTx(types.NewTransaction(0, rewardsAddr, big.NewInt(10), big.NewInt(21000), new(big.Int), nil), signer, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := types.NewBlock(&types.Header{Number: big.NewInt(1)}, []*types.Transaction{tx}, nil, nil)
+
+	engine := newTestEngine(t, &sproutsConfig, nil)
+	engine.Authorize(testAddr, nil)
+
+	timeDiff := big.NewInt(60 * 60 * 24)
+	if value, age := engine.blockAge(params.TestSproutsChainConfig, block, timeDiff); value.Cmp(big.NewInt(-10)) != 0 || age.Cmp(big.NewInt(-10*60*60*24)) != 0 {
+		t.Errorf("recent transfer not subtracted: value %v, age %v", value, age)
+	}
+}
+
+// Tests that the senders of unprotected and replay protected transactions are
+// derived with the signer of the chain, that transactions whose sender can't
+// be derived aren't attributed to the signer and that only distributions are
+// received from known senders.
+func TestBlockAgeSenders(t *testing.T) {
+	config := *params.TestSproutsChainConfig
+	config.ChainId = big.NewInt(4242)
+
+	var (
+		homestead = types.HomesteadSigner{}
+		protected = types.NewEIP155Signer(config.ChainId)
+		foreign   = types.NewEIP155Signer(params.TestSproutsChainConfig.ChainId)
+		value     = big.NewInt(10)
+	)
+	transfer := func(to common.Address) *types.Transaction {
+		return types.NewTransaction(0, to, value, big.NewInt(21000), new(big.Int), nil)
+	}
+	creation := types.NewContractCreation(0, value, big.NewInt(100000), new(big.Int), nil)
+	otherKey, _ := crypto.GenerateKey()
+
+	tests := []struct {
+		name   string
+		tx     *types.Transaction
+		signer types.Signer
+		key    *ecdsa.PrivateKey
+		value  int64
+	}{
+		{"unprotected distribution", transfer(testAddr), homestead, rewardsKey, 10},
+		{"unprotected spending", transfer(rewardsAddr), homestead, testKey, -10},
+		{"protected distribution", transfer(testAddr), protected, rewardsKey, 10},
+		{"protected spending", transfer(rewardsAddr), protected, testKey, -10},
+		{"spending for another chain", transfer(rewardsAddr), foreign, testKey, 0},
+		{"regular receipt", transfer(testAddr), protected, otherKey, 0},
+		{"contract creation by another", creation, protected, otherKey, 0},
+		{"contract creation", creation, protected, testKey, -10},
+	}
+	sprouts := sproutsConfig
+	sprouts.DistributionAccount = rewardsAddr
+	engine := newTestEngine(t, &sprouts, nil)
+	engine.Authorize(testAddr, nil)
+
+	// fermented, so received value counts
+	timeDiff := new(big.Int).Add(sproutsConfig.CoinAgeFermentation, big1)
+	for _, tt := range tests {
+		tx, err := types.SignTx(tt.tx, tt.signer, tt.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block := types.NewBlock(&types.Header{Number: big.NewInt(1)}, []*types.Transaction{tx}, nil, nil)
+		if value, _ := engine.blockAge(&config, block, timeDiff); value.Cmp(big.NewInt(tt.value)) != 0 {
+			t.Errorf("%s: value mismatch: have %v, want %v", tt.name, value, tt.value)
+		}
+	}
+}
+
+// Tests that funds received and spent again within the fermentation period
+// aren't counted towards the value of the coin age.
+func TestCoinAgeSpentFunds(t *testing.T) {
+	config := sproutsConfig
+	config.DistributionAccount = rewardsAddr
+
+	db, genesis, _ := initBlockchainStructures(t)
+	engine := newTestEngine(t, &config, db)
+	engine.Authorize(rewardsAddr, nil)
+	fundTestStaker(genesis)
+	genesisBlock := genesis.MustCommit(db)
+	blockchain, err := core.NewBlockChain(db, genesis.Config, engine, vm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blockchain.Stop()
+
+	signer := types.NewEIP155Signer(genesis.Config.ChainId)
+	blocks, _ := GenerateChain(&config, params.TestSproutsChainConfig, genesisBlock, db, 3, func(i int, b *BlockGen) {
+		b.SetCoinbase(rewardsAddr)
+		switch i {
+		case 0:
+			// receive funds from the distribution account
+			tx, _ := types.SignTx(types.NewTransaction(b.TxNonce(rewardsAddr), testAddr, big.NewInt(100), big.NewInt(21000), new(big.Int), nil), signer, rewardsKey)
+			b.AddTx(tx)
+		case 1:
+			// and spend them right away
+			tx, _ := types.SignTx(types.NewTransaction(b.TxNonce(testAddr), rewardsAddr, big.NewInt(100), big.NewInt(21000), new(big.Int), nil), signer, testKey)
+			b.AddTx(tx)
+		}
+		sealTestBlock(t, engine, b, &coinAge{
+			Time:  b.Header().Time.Uint64(),
+			Age:   testStakeAge,
+			Value: big.NewInt(1000),
+		})
+	})
+	if _, err := blockchain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	engine.Authorize(testAddr, nil)
+	ca, err := engine.CoinAgeAt(blockchain, 3)
+	if err != nil {
+		t.Fatalf("failed to compute coin age: %v", err)
+	}
+	if ca.Value.Sign() != 0 {
+		t.Errorf("spent funds counted: value %v", ca.Value)
+	}
+}
+
+// Tests that the single-division kernel target and coin-day conversions
+// reproduce the former step-by-step divisions exactly.
+func TestKernelTargetRatioCompatibility(t *testing.T) {
+	oldKernelTarget := func(difficulty, stake *big.Int, timeWeight uint64) *big.Int {
+		target := new(big.Int).Set(difficulty)
+		target.Mul(target, stake)
+		target.Mul(target, new(big.Int).SetUint64(timeWeight))
+		target.Div(target, new(big.Int).SetUint64(coinValue))
+		return target.Div(target, new(big.Int).SetUint64(24*60*60))
+	}
+	oldCoinDays := func(age *big.Int) *big.Int {
+		return new(big.Int).Div(age, new(big.Int).SetUint64(coinValue/(24*60*60)))
+	}
+	newCoinDays := func(age *big.Int) *big.Int {
+		numerator, denominator := coinDayRatio(&sproutsConfig)
+		days := new(big.Int).Mul(age, numerator)
+		return days.Div(days, denominator)
+	}
+
+	values := []*big.Int{
+		big.NewInt(0), big.NewInt(1), big.NewInt(10), big.NewInt(86399), big.NewInt(86400),
+		new(big.Int).SetUint64(coinValue - 1), new(big.Int).SetUint64(coinValue),
+		new(big.Int).Lsh(big1, 64), new(big.Int).Lsh(big1, 200), stakeMaxAge,
+	}
+	weights := []uint64{0, 1, 59, 60, 86400, stakeMaxTime, 1 << 63}
+
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 40; i++ {
+		values = append(values, new(big.Int).Rand(rnd, new(big.Int).Lsh(big1, uint(rnd.Intn(160)+1))))
+		weights = append(weights, uint64(rnd.Int63()))
+	}
+
+	var mismatches []string
+	for _, difficulty := range values {
+		for _, stake := range values {
+			for _, weight := range weights {
+				have := kernelTarget(&sproutsConfig, difficulty, stake, weight)
+				want := oldKernelTarget(difficulty, stake, weight)
+				if have.Cmp(want) != 0 {
+					mismatches = append(mismatches, fmt.Sprintf("target(%v, %v, %d): have %v, want %v", difficulty, stake, weight, have, want))
+				}
+			}
+		}
+		if have, want := newCoinDays(difficulty), oldCoinDays(difficulty); have.Cmp(want) != 0 {
+			mismatches = append(mismatches, fmt.Sprintf("coin days(%v): have %v, want %v", difficulty, have, want))
+		}
+	}
+	if len(mismatches) > 0 {
+		t.Fatalf("%d inputs differ from the former formulas:\n%s", len(mismatches), strings.Join(mismatches, "\n"))
+	}
+}
+
+func TestKernelTargetCustomRatio(t *testing.T) {
+	config := sproutsConfig
+	config.KernelTargetNumerator = big.NewInt(3)
+	config.KernelTargetDenominator = big.NewInt(2)
+
+	if target := kernelTarget(&config, big.NewInt(10), big.NewInt(7), 3); target.Cmp(big.NewInt(315)) != 0 {
+		t.Errorf("target mismatch: have %v, want 315", target)
+	}
+	// Non-positive denominators fall back to the defaults
+	config.KernelTargetDenominator = big.NewInt(0)
+	if target := kernelTarget(&config, big.NewInt(10), big.NewInt(7), 3); target.Sign() != 0 {
+		t.Errorf("target mismatch: have %v, want 0", target)
+	}
+}
+
+func TestCalcDifficultyFirstBlocks(t *testing.T) {
+	engine := &PoS{}
+	chain := &headersChainReader{}
+
+	for number := int64(0); number < 2; number++ {
+		parent := &types.Header{Number: big.NewInt(number), Time: big.NewInt(0), Difficulty: big.NewInt(1000000)}
+		if diff := engine.CalcDifficulty(chain, 10, parent); diff.Cmp(big.NewInt(10)) != 0 {
+			t.Errorf("block %d: difficulty mismatch: have %v, want %v", number+1, diff, 10)
+		}
+	}
+	// the third block is retargeted from its ancestors
+	genesis := &types.Header{Number: big.NewInt(0), Time: big.NewInt(0), Difficulty: big.NewInt(10)}
+	first := &types.Header{Number: big.NewInt(1), ParentHash: genesis.Hash(), Time: big.NewInt(10), Difficulty: big.NewInt(10)}
+	second := &types.Header{Number: big.NewInt(2), ParentHash: first.Hash(), Time: big.NewInt(20), Difficulty: big.NewInt(1000000)}
+	chain.headers = []*types.Header{genesis, first, second}
+
+	want, _ := computeDifficulty(chain, 3, nil)
+	if diff := engine.CalcDifficulty(chain, 30, second); diff.Cmp(want) != 0 {
+		t.Errorf("block 3: difficulty mismatch: have %v, want %v", diff, want)
+	}
+}
+
+func TestCalcDifficultySideChain(t *testing.T) {
+	engine := &PoS{}
+
+	genesis := &types.Header{Number: big.NewInt(0), Time: big.NewInt(0), Difficulty: big.NewInt(10)}
+	first := &types.Header{Number: big.NewInt(1), ParentHash: genesis.Hash(), Time: big.NewInt(10), Difficulty: big.NewInt(1000000)}
+	second := &types.Header{Number: big.NewInt(2), ParentHash: first.Hash(), Time: big.NewInt(20), Difficulty: big.NewInt(1000000)}
+
+	// the side branch forks off the genesis with much slower blocks
+	sideFirst := &types.Header{Number: big.NewInt(1), ParentHash: genesis.Hash(), Time: big.NewInt(1000), Difficulty: big.NewInt(1000000)}
+	sideSecond := &types.Header{Number: big.NewInt(2), ParentHash: sideFirst.Hash(), Time: big.NewInt(100000), Difficulty: big.NewInt(1000000)}
+
+	chain := &headersChainReader{
+		headers: []*types.Header{genesis, first, second},
+		side:    []*types.Header{sideFirst, sideSecond},
+	}
+	canonical := engine.CalcDifficulty(chain, 30, second)
+	if want, _ := computeDifficulty(chain, 3, nil); canonical.Cmp(want) != 0 {
+		t.Fatalf("canonical difficulty mismatch: have %v, want %v", canonical, want)
+	}
+	side := engine.CalcDifficulty(chain, 100010, sideSecond)
+	if want := retargetDifficulty(sideSecond, sideFirst); side.Cmp(want) != 0 {
+		t.Fatalf("side chain difficulty mismatch: have %v, want %v", side, want)
+	}
+	if side.Cmp(canonical) == 0 {
+		t.Fatalf("side chain difficulty computed from the canonical ancestors: %v", side)
+	}
+}
+
+func TestSplitRewardsRemainder(t *testing.T) {
+	totals := []*big.Int{big.NewInt(0), big.NewInt(1), big.NewInt(12), big.NewInt(99), big.NewInt(100), big.NewInt(101), big.NewInt(1249)}
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		totals = append(totals, new(big.Int).Rand(random, new(big.Int).Lsh(big1, uint(random.Intn(256)+1))))
+	}
+	shares := [][2]uint64{{800, 800}, {500, 1000}, {0, 0}, {0, 9999}, {3333, 3333}}
+	for _, total := range totals {
+		for _, share := range shares {
+			rewards := splitRewards(total, share[0], share[1])
+
+			sum := new(big.Int).Add(rewards.Minter, rewards.Charity)
+			sum.Add(sum, rewards.RD)
+			if sum.Cmp(total) != 0 {
+				t.Fatalf("total %v, shares %v: split doesn't add up: %+v", total, share, rewards)
+			}
+			// the shares are exact and rounded down
+			charity := new(big.Int).Div(new(big.Int).Mul(total, new(big.Int).SetUint64(share[0])), bigBasisPoints)
+			if rewards.Charity.Cmp(charity) != 0 {
+				t.Fatalf("total %v, shares %v: charity mismatch: have %v, want %v", total, share, rewards.Charity, charity)
+			}
+			rd := new(big.Int).Div(new(big.Int).Mul(total, new(big.Int).SetUint64(share[1])), bigBasisPoints)
+			if rewards.RD.Cmp(rd) != 0 {
+				t.Fatalf("total %v, shares %v: r&d mismatch: have %v, want %v", total, share, rewards.RD, rd)
+			}
+		}
+	}
+}
+
+func TestBlockRanges(t *testing.T) {
+	tests := []struct {
+		numbers []uint64
+		want    string
+	}{
+		{nil, ""},
+		{[]uint64{7}, "7"},
+		{[]uint64{9, 8, 7, 5, 3, 2}, "2-3,5,7-9"},
+	}
+	for i, tt := range tests {
+		if have := blockRanges(tt.numbers); have != tt.want {
+			t.Errorf("test %d: ranges mismatch: have %q, want %q", i, have, tt.want)
+		}
+	}
+}
+
+// Tests that the coin age isn't computed over pruned block bodies, which could
+// overstate it.
+func TestCoinAgeMissingBodies(t *testing.T) {
+	db, genesis, engine := initBlockchainStructures(t)
+	genesis.Timestamp = uint64(time.Now().AddDate(0, 0, -30).Unix())
+	fundTestStaker(genesis)
+	genesisBlock := genesis.MustCommit(db)
+
+	blockchain, err := core.NewBlockChain(db, genesis.Config, engine, vm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks, _ := GenerateChain(&sproutsConfig, params.TestSproutsChainConfig, genesisBlock, db, 5, func(i int, b *BlockGen) {
+		b.SetCoinbase(rewardsAddr)
+		sealTestBlock(t, engine, b, &coinAge{Time: b.Header().Time.Uint64(), Age: testStakeAge, Value: big.NewInt(1000)})
+	})
+	if _, err := blockchain.InsertChain(blocks); err != nil {
+		t.Fatal(err)
+	}
+	blockchain.Stop()
+
+	reopen := func() *core.BlockChain {
+		blockchain, err := core.NewBlockChain(db, genesis.Config, engine, vm.Config{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return blockchain
+	}
+	blockchain = reopen()
+	if _, err := engine.coinAge(blockchain, uint64(time.Now().Unix())); err != nil {
+		t.Fatalf("failed to compute coin age: %v", err)
+	}
+	blockchain.Stop()
+
+	// prune bodies within the coin age lifetime
+	for _, block := range blocks[1:3] {
+		core.DeleteBody(db, block.Hash(), block.NumberU64())
+	}
+	blockchain = reopen()
+	defer blockchain.Stop()
+
+	if _, err := engine.coinAge(blockchain, uint64(time.Now().Unix())); err != errCoinAgeNotReady {
+		t.Fatalf("missing bodies error mismatch: have %v, want %v", err, errCoinAgeNotReady)
+	}
+	header := &types.Header{ParentHash: blocks[4].Hash(), Number: big.NewInt(6), Time: new(big.Int)}
+	if err := engine.Prepare(blockchain, header); err != errCoinAgeNotReady {
+		t.Fatalf("prepare error mismatch: have %v, want %v", err, errCoinAgeNotReady)
+	}
+}
+
+func TestWithinHoldingPeriod(t *testing.T) {
+	config := &params.SproutsConfig{CoinAgeHoldingPeriod: big.NewInt(86400)}
+	tests := []struct {
+		blockTime, now uint64
+		held           bool
+	}{
+		{blockTime: 1000000 - 3600, now: 1000000, held: true},
+		{blockTime: 1000000 - 86400 + 1, now: 1000000, held: true},
+		{blockTime: 1000000 - 86400, now: 1000000, held: false},
+		{blockTime: 1000000 - 3*86400, now: 1000000, held: false},
+		{blockTime: 10, now: 3600, held: true},
+	}
+	for i, tt := range tests {
+		if held := withinHoldingPeriod(config, tt.blockTime, tt.now); held != tt.held {
+			t.Errorf("test %d: holding mismatch: have %v, want %v", i, held, tt.held)
+		}
+	}
+	if withinHoldingPeriod(new(params.SproutsConfig), 1000000, 1000000) {
+		t.Errorf("stake held without a holding period")
+	}
+}
+
+// Tests that the age consumed by a stake of the signer can't be staked again
+// within the holding period, but can once it is over.
+func TestCoinAgeHoldingPeriod(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	staker := crypto.PubkeyToAddress(key.PublicKey)
+
+	db, genesis, _ := initBlockchainStructures(t)
+	engine := newTestFaker(t, &sproutsConfig, db)
+	genesis.Alloc[testAddr] = core.GenesisAccount{Balance: new(big.Int).Mul(big.NewInt(10), big.NewInt(coinValue))}
+	genesisBlock := genesis.MustCommit(db)
+	blockchain, err := core.NewBlockChain(db, genesis.Config, engine, vm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blockchain.Stop()
+
+	// the staker is funded, and stakes more age than accrued ten days later
+	signer := types.NewEIP155Signer(genesis.Config.ChainId)
+	blocks, _ := GenerateFakeChain(&sproutsConfig, params.TestSproutsChainConfig, genesisBlock, db, 2, func(i int, b *BlockGen) {
+		switch i {
+		case 0:
+			tx, _ := types.SignTx(types.NewTransaction(b.TxNonce(testAddr), staker, big.NewInt(coinValue), big.NewInt(21000), new(big.Int), nil), signer, testKey)
+			b.AddTx(tx)
+		case 1:
+			b.OffsetTime(10 * 86400)
+			b.SetCoinbase(staker)
+			stake := &coinAge{Time: b.header.Time.Uint64(), Age: maxStakeAge(&sproutsConfig, big.NewInt(coinValue), new(big.Int)), Value: big.NewInt(coinValue)}
+			setTestStake(b.header, stake)
+		}
+	})
+	if _, err := blockchain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	staked := blocks[1].Time().Uint64()
+
+	// the head is excluded from the walk, so the age is computed on top of a
+	// successor
+	tests := []struct {
+		after uint64
+		held  bool
+	}{
+		{after: 3600, held: true},
+		{after: 3 * 86400, held: false},
+	}
+	for _, tt := range tests {
+		acc, err := engine.accrue(context.Background(), blockchain, &types.Header{Number: big.NewInt(3)}, time.Unix(int64(staked+tt.after), 0), staker)
+		if err != nil {
+			t.Fatalf("%ds after the stake: failed to accrue coin age: %v", tt.after, err)
+		}
+		if held := acc.age.Sign() == 0; held != tt.held {
+			t.Errorf("%ds after the stake: age %v, want held %v", tt.after, acc.age, tt.held)
+		}
+	}
+}
+
+// holeyChain hides the headers and blocks of selected heights of a chain, like
+// a partially synced one does.
+type holeyChain struct {
+	*core.BlockChain
+	headers map[uint64]bool // Heights whose headers are missing
+	bodies  map[uint64]bool // Heights whose blocks are missing
+}
+
+func (c *holeyChain) GetHeaderByNumber(number uint64) *types.Header {
+	if c.headers[number] {
+		return nil
+	}
+	return c.BlockChain.GetHeaderByNumber(number)
+}
+
+func (c *holeyChain) GetBlock(hash common.Hash, number uint64) *types.Block {
+	if c.headers[number] || c.bodies[number] {
+		return nil
+	}
+	return c.BlockChain.GetBlock(hash, number)
+}
+
+// Tests that the coin age walk stops without panicking on missing headers and
+// blocks, reporting the age as not ready.
+func TestCoinAgeMissingHeaders(t *testing.T) {
+	db, genesis, engine := initBlockchainStructures(t)
+	genesis.Timestamp = uint64(time.Now().AddDate(0, 0, -30).Unix())
+	fundTestStaker(genesis)
+	genesisBlock := genesis.MustCommit(db)
+
+	blockchain, err := core.NewBlockChain(db, genesis.Config, engine, vm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blockchain.Stop()
+
+	blocks, _ := GenerateChain(&sproutsConfig, params.TestSproutsChainConfig, genesisBlock, db, 5, func(i int, b *BlockGen) {
+		b.SetCoinbase(rewardsAddr)
+		sealTestBlock(t, engine, b, &coinAge{Time: b.Header().Time.Uint64(), Age: testStakeAge, Value: big.NewInt(1000)})
+	})
+	if _, err := blockchain.InsertChain(blocks); err != nil {
+		t.Fatal(err)
+	}
+	now := uint64(time.Now().Unix())
+	if _, err := engine.ComputeCoinAge(blockchain, rewardsAddr, now); err != nil {
+		t.Fatalf("failed to compute coin age of the complete chain: %v", err)
+	}
+	tests := []*holeyChain{
+		{BlockChain: blockchain, headers: map[uint64]bool{2: true}},
+		{BlockChain: blockchain, headers: map[uint64]bool{1: true, 2: true, 3: true}},
+		{BlockChain: blockchain, bodies: map[uint64]bool{3: true}},
+	}
+	for i, chain := range tests {
+		if _, err := engine.ComputeCoinAge(chain, rewardsAddr, now); err != errCoinAgeNotReady {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, errCoinAgeNotReady)
+		}
+	}
+}
+
+// Tests that the coin age for sealing depends on the given block time only, not
+// on the wall clock.
+func TestCoinAgeBlockTime(t *testing.T) {
+	db, genesis, engine := initBlockchainStructures(t)
+	genesis.Alloc[testAddr] = core.GenesisAccount{Balance: big.NewInt(1e18)}
+	genesis.MustCommit(db)
+	blockchain, err := core.NewBlockChain(db, genesis.Config, engine, vm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blockchain.Stop()
+	engine.Authorize(testAddr, nil)
+
+	at := genesis.Timestamp + 3600
+	first, err := engine.coinAge(blockchain, at)
+	if err != nil {
+		t.Fatalf("failed to compute coin age: %v", err)
+	}
+	second, err := engine.coinAge(blockchain, at)
+	if err != nil {
+		t.Fatalf("failed to compute coin age: %v", err)
+	}
+	if first.Time != at || first.Age.Cmp(second.Age) != 0 || first.Time != second.Time {
+		t.Errorf("coin age not reproducible: %+v, %+v", first, second)
+	}
+	if want := GenesisStake(&sproutsConfig, genesis, testAddr, at); first.Age.Cmp(want) != 0 {
+		t.Errorf("age mismatch: have %v, want %v", first.Age, want)
+	}
+	later, err := engine.coinAge(blockchain, at+3600)
+	if err != nil {
+		t.Fatalf("failed to compute coin age: %v", err)
+	}
+	if later.Age.Cmp(first.Age) <= 0 {
+		t.Errorf("age didn't grow: have %v, before %v", later.Age, first.Age)
+	}
+}
+
+// Tests that the historical coin age is computed as of the given block, so it is
+// reproducible and doesn't touch the signer's coin age record.
+func TestCoinAgeAt(t *testing.T) {
+	db, genesis, engine := initBlockchainStructures(t)
+	fundTestStaker(genesis)
+	genesis.Alloc[testAddr] = core.GenesisAccount{Balance: big.NewInt(1e18)}
+	genesisBlock := genesis.MustCommit(db)
+	blockchain, err := core.NewBlockChain(db, genesis.Config, engine, vm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blockchain.Stop()
+
+	blocks, _ := GenerateChain(&sproutsConfig, params.TestSproutsChainConfig, genesisBlock, db, 4, func(i int, b *BlockGen) {
+		b.SetCoinbase(rewardsAddr)
+		sealTestBlock(t, engine, b, &coinAge{
+			Time:  b.Header().Time.Uint64(),
+			Age:   testStakeAge,
+			Value: big.NewInt(1000),
+		})
+	})
+	if _, err := blockchain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	// Only the premine of the signer contributes to its coin age
+	engine.Authorize(testAddr, nil)
+	for number := uint64(0); number <= 4; number++ {
+		header := blockchain.GetHeaderByNumber(number)
+		ca, err := engine.CoinAgeAt(blockchain, number)
+		if err != nil {
+			t.Fatalf("block %d: failed to compute coin age: %v", number, err)
+		}
+		if ca.Time != header.Time.Uint64() {
+			t.Errorf("block %d: time mismatch: have %d, want %d", number, ca.Time, header.Time)
+		}
+		if want := GenesisStake(&sproutsConfig, genesis, testAddr, header.Time.Uint64()); ca.Age.Cmp(want) != 0 {
+			t.Errorf("block %d: age mismatch: have %v, want %v", number, ca.Age, want)
+		}
+		again, err := engine.CoinAgeAt(blockchain, number)
+		if err != nil || again.Age.Cmp(ca.Age) != 0 || again.Time != ca.Time {
+			t.Errorf("block %d: result not reproducible: have %+v, want %+v", number, again, ca)
+		}
+	}
+	if _, err := engine.CoinAgeAt(blockchain, 5); err != errUnknownBlock {
+		t.Errorf("unknown block error mismatch: have %v, want %v", err, errUnknownBlock)
+	}
+	if _, err := loadCoinAge(db, testAddr); err == nil {
+		t.Error("historical coin age recorded")
+	}
+}
+
+func TestBlockReward(t *testing.T) {
+	huge, _ := new(big.Int).SetString("18446744073709551615", 10)
+	maxReward := new(big.Int).Mul(big.NewInt(1000), new(big.Int).SetUint64(coinValue))
+	capped := &params.SproutsConfig{MaxBlockReward: big.NewInt(1000000)}
+
+	tests := []struct {
+		config *params.SproutsConfig
+		age    *big.Int
+		want   *big.Int
+	}{
+		{&sproutsConfig, big.NewInt(0), big.NewInt(0)},
+		{&sproutsConfig, big.NewInt(1), big.NewInt(58043640587405)},
+		{&sproutsConfig, big.NewInt(1000), big.NewInt(58043640587405625)},
+		{&sproutsConfig, big.NewInt(12053), big.NewInt(699600000000000000)},
+		{&sproutsConfig, big.NewInt(1000000000), maxReward},
+		{&sproutsConfig, huge, maxReward},
+		{&sproutsConfig, stakeMaxAge, maxReward},
+		{capped, big.NewInt(1), big.NewInt(1000000)},
+		{nil, big.NewInt(1000), big.NewInt(58043640587405625)},
+	}
+	for i, tt := range tests {
+		if reward := blockReward(tt.config, &coinAge{Age: tt.age, Value: big.NewInt(1)}); reward.Cmp(tt.want) != 0 {
+			t.Errorf("test %d: reward mismatch: have %v, want %v", i, reward, tt.want)
+		}
+	}
+}
+
+func TestBlockRewardAnnualRate(t *testing.T) {
+	tests := []struct {
+		numerator, denominator *big.Int
+		want                   *big.Int
+	}{
+		{nil, nil, big.NewInt(58043640587405625)},
+		{big.NewInt(212), big.NewInt(10000), big.NewInt(58043640587405625)},
+		{big.NewInt(5), big.NewInt(100), big.NewInt(136895378743881191)},
+		{big.NewInt(1), big.NewInt(10), big.NewInt(273790757487762382)},
+		// invalid denominators fall back to the default rate
+		{big.NewInt(1), big.NewInt(0), big.NewInt(58043640587405625)},
+	}
+	for i, tt := range tests {
+		config := sproutsConfig
+		config.AnnualRewardNumerator = tt.numerator
+		config.AnnualRewardDenominator = tt.denominator
+
+		stake := &coinAge{Age: big.NewInt(1000), Value: big.NewInt(1)}
+		if reward := blockReward(&config, stake); reward.Cmp(tt.want) != 0 {
+			t.Errorf("test %d: reward mismatch: have %v, want %v", i, reward, tt.want)
+		}
+	}
+}
+
+// Tests that the coin age of any address can be computed over the same chain
+// without being recorded.
+func TestComputeCoinAge(t *testing.T) {
+	config := sproutsConfig
+	config.DistributionAccount = rewardsAddr
+
+	db, genesis, _ := initBlockchainStructures(t)
+	engine := newTestEngine(t, &config, db)
+	engine.Authorize(rewardsAddr, nil)
+	genesis.Timestamp = uint64(time.Now().Add(-30 * 24 * time.Hour).Unix())
+	fundTestStaker(genesis)
+	genesisBlock := genesis.MustCommit(db)
+
+	blockchain, err := core.NewBlockChain(db, genesis.Config, engine, vm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blockchain.Stop()
+
+	var (
+		contract = common.Address{0xc0} // no key, it can only receive
+		coin     = big.NewInt(coinValue)
+		quarter  = new(big.Int).Div(coin, big.NewInt(4))
+		signer   = types.NewEIP155Signer(genesis.Config.ChainId)
+	)
+	// the head itself isn't accounted, like for the sealer
+	blocks, _ := GenerateChain(&config, params.TestSproutsChainConfig, genesisBlock, db, 3, func(i int, b *BlockGen) {
+		b.SetCoinbase(rewardsAddr)
+		switch i {
+		case 0:
+			tx, _ := types.SignTx(types.NewTransaction(b.TxNonce(rewardsAddr), testAddr, coin, big.NewInt(21000), new(big.Int), nil), signer, rewardsKey)
+			b.AddTx(tx)
+		case 1:
+			tx, _ := types.SignTx(types.NewTransaction(b.TxNonce(testAddr), contract, quarter, big.NewInt(21000), new(big.Int), nil), signer, testKey)
+			b.AddTx(tx)
+		}
+		sealTestBlock(t, engine, b, &coinAge{
+			Time:  b.Header().Time.Uint64(),
+			Age:   testStakeAge,
+			Value: big.NewInt(1000),
+		})
+	})
+	if _, err := blockchain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	t1, t2 := blocks[0].Time().Uint64(), blocks[1].Time().Uint64()
+	at := t2 + 8*24*60*60 // the transfer to the contract has fermented
+
+	numerator, denominator := coinDayRatio(&config)
+	coinDays := func(age *big.Int) *big.Int {
+		return age.Div(age.Mul(age, numerator), denominator)
+	}
+	// The distribution counts right away and a hundredfold for every account
+	// within what its balance backs, the transfer is taken from the sender
+	// right away and not counted for the contract, whose sender is known
+	distributed := new(big.Int).Mul(coin, new(big.Int).SetUint64((at-t1)*distributionAgeFactor))
+	sent := new(big.Int).Mul(quarter, new(big.Int).SetUint64(at-t2))
+
+	tests := []struct {
+		addr  common.Address
+		age   *big.Int
+		value *big.Int
+	}{
+		{testAddr, coinDays(new(big.Int).Sub(distributed, sent)), new(big.Int).Sub(coin, quarter)},
+		{contract, coinDays(new(big.Int).Set(distributed)), quarter},
+		{common.Address{0xff}, new(big.Int), new(big.Int)},
+	}
+	for i, tt := range tests {
+		ca, err := engine.ComputeCoinAge(blockchain, tt.addr, at)
+		if err != nil {
+			t.Fatalf("test %d: failed to compute coin age: %v", i, err)
+		}
+		if ca.Age.Cmp(tt.age) != 0 || ca.Value.Cmp(tt.value) != 0 || ca.Time != at {
+			t.Errorf("test %d: coin age mismatch: have %+v, want age %v, value %v", i, ca, tt.age, tt.value)
+		}
+	}
+	// The distribution account doesn't receive its own distributions
+	ca, err := engine.ComputeCoinAge(blockchain, rewardsAddr, at)
+	if err != nil {
+		t.Fatalf("failed to compute coin age: %v", err)
+	}
+	if ca.Value.Sign() != 0 {
+		t.Errorf("distribution account value mismatch: have %v, want 0", ca.Value)
+	}
+	// Nothing is recorded for foreign addresses
+	if _, err := loadCoinAge(db, testAddr); err == nil {
+		t.Error("coin age of a foreign address recorded")
+	}
+	api := &API{chain: blockchain, sprouts: engine}
+	if ca, err := api.CoinAgeOf(common.Address{0xff}); err != nil || ca.Age.ToInt().Sign() != 0 {
+		t.Errorf("api coin age mismatch: have %v (%v), want 0", ca, err)
+	}
+}
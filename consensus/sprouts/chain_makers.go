@@ -10,6 +10,7 @@ import (
 	"github.com/applicature/sprouts-plus/core/state"
 	"github.com/applicature/sprouts-plus/core/types"
 	"github.com/applicature/sprouts-plus/core/vm"
+	"github.com/applicature/sprouts-plus/crypto/sha3"
 	"github.com/applicature/sprouts-plus/ethdb"
 	"github.com/applicature/sprouts-plus/params"
 )
@@ -62,6 +63,32 @@ func (b *BlockGen) SetExtra(data []byte) {
 	b.header.Extra = data
 }
 
+// SealWith embeds a stake of the given age, claimed at the block's time, into
+// the extra data of the generated block, along with the kernel the engine
+// finds for it on top of the parent. The block passes the kernel verification
+// of the engine, the signature is left empty. The timestamp and difficulty of
+// the block must be final.
+func (b *BlockGen) SealWith(engine *PoS, stake *big.Int) error {
+	return b.sealWith(engine, &coinAge{Time: b.header.Time.Uint64(), Age: stake, Value: new(big.Int)})
+}
+
+// sealWith embeds the stake and the kernel found for it like SealWith.
+func (b *BlockGen) sealWith(engine *PoS, stake *coinAge) error {
+	hash, timestamp, err := engine.computeKernel(b.PrevBlock(-1).Header(), stake.Age, b.header)
+	if err != nil {
+		return err
+	}
+	h := sha3.NewShake256()
+	h.Write(timestamp.Bytes())
+	hashedTimestamp := make([]byte, extraKernel/2)
+	h.Read(hashedTimestamp)
+
+	extra := newHeaderExtra(nil)
+	extra.Kernel, extra.HashedTimestamp, extra.Stake = hash.Bytes(), hashedTimestamp, stake.bytes()
+	b.SetExtra(extra.encode())
+	return nil
+}
+
 // AddTx adds a transaction to the generated block. If no coinbase has
 // been set, the block's coinbase is set to the zero address.
 //
@@ -134,6 +161,15 @@ func (b *BlockGen) OffsetTime(seconds int64) {
 	}
 }
 
+// SetTime sets the timestamp of the generated block, which must be after the
+// parent's, implicitly changing the difficulty of the blocks on top of it.
+func (b *BlockGen) SetTime(t *big.Int) {
+	if t.Cmp(b.parent.Header().Time) <= 0 {
+		panic("block time out of range")
+	}
+	b.header.Time = new(big.Int).Set(t)
+}
+
 func (b *BlockGen) SetDifficulty(diff *big.Int) {
 	b.header.Difficulty = new(big.Int).Set(diff)
 }
@@ -155,6 +191,14 @@ func (b *BlockGen) Header() *types.Header {
 // values. Inserting them into BlockChain requires use of FakePow or
 // a similar non-validating proof of work implementation.
 func GenerateChain(sproutsConfig *params.SproutsConfig, config *params.ChainConfig, parent *types.Block, db ethdb.Database, n int, gen func(int, *BlockGen)) ([]*types.Block, []types.Receipts) {
+	return GenerateChainWithAbort(sproutsConfig, config, parent, db, n, nil, gen)
+}
+
+// GenerateChainWithAbort creates a chain of n blocks like GenerateChain, but
+// stops before the next block once abort is closed, e.g. by the generator
+// function failing a block. Only the blocks completed until then are
+// returned. A nil abort channel never stops the generation.
+func GenerateChainWithAbort(sproutsConfig *params.SproutsConfig, config *params.ChainConfig, parent *types.Block, db ethdb.Database, n int, abort <-chan struct{}, gen func(int, *BlockGen)) ([]*types.Block, []types.Receipts) {
 	if config == nil {
 		config = params.TestChainConfig
 	}
@@ -178,7 +222,7 @@ func GenerateChain(sproutsConfig *params.SproutsConfig, config *params.ChainConf
 			gen(i, b)
 		}
 
-		accumulateRewards(sproutsConfig, h, statedb)
+		applyFinalizationSteps(sproutsConfig, h, statedb)
 		root, err := statedb.CommitTo(db, config.IsEIP158(h.Number))
 		if err != nil {
 			panic(fmt.Sprintf("state write error: %v", err))
@@ -187,6 +231,11 @@ func GenerateChain(sproutsConfig *params.SproutsConfig, config *params.ChainConf
 		return types.NewBlock(h, b.txs, b.uncles, b.receipts), b.receipts
 	}
 	for i := 0; i < n; i++ {
+		select {
+		case <-abort:
+			return blocks[:i], receipts[:i]
+		default:
+		}
 		statedb, err := state.New(parent.Root(), state.NewDatabase(db))
 		if err != nil {
 			panic(err)
@@ -200,6 +249,21 @@ func GenerateChain(sproutsConfig *params.SproutsConfig, config *params.ChainConf
 	return blocks, receipts
 }
 
+// GenerateFakeChain creates a chain of n blocks like GenerateChain does, for
+// engines created by NewFaker. Every block is given an extra-data field of the
+// right size claiming an empty stake, which the generator may still replace.
+func GenerateFakeChain(sproutsConfig *params.SproutsConfig, config *params.ChainConfig, parent *types.Block, db ethdb.Database, n int, gen func(int, *BlockGen)) ([]*types.Block, []types.Receipts) {
+	return GenerateChain(sproutsConfig, config, parent, db, n, func(i int, b *BlockGen) {
+		stake := &coinAge{Time: b.header.Time.Uint64(), Age: new(big.Int), Value: new(big.Int)}
+		extra := newHeaderExtra(nil)
+		extra.Stake = stake.bytes()
+		b.SetExtra(extra.encode())
+		if gen != nil {
+			gen(i, b)
+		}
+	})
+}
+
 func makeHeader(config *params.ChainConfig, parent *types.Block, state *state.StateDB) *types.Header {
 	var time *big.Int
 	if parent.Time() == nil {
@@ -0,0 +1,291 @@
+package sprouts
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"math/big"
+	"time"
+
+	"github.com/applicature/sprouts-plus/common"
+	"github.com/applicature/sprouts-plus/consensus"
+	"github.com/applicature/sprouts-plus/core/types"
+	"github.com/applicature/sprouts-plus/log"
+	"github.com/applicature/sprouts-plus/params"
+)
+
+// DefaultCoinAgeCheckpointInterval is the suggested number of blocks between
+// two coin age checkpoints.
+const DefaultCoinAgeCheckpointInterval = 1024
+
+var (
+	coinAgeCheckpointPrefix = []byte("sprouts-coinage-checkpoint-")        // Prefix of the checkpoints, followed by the block hash and signer
+	latestCheckpointPrefix  = []byte("sprouts-latest-coinage-checkpoint-") // Prefix of the hash of the latest checkpoint, followed by the signer
+)
+
+var (
+	errNoCoinAgeCheckpoint      = errors.New("no coin age checkpoint")
+	errInvalidCoinAgeCheckpoint = errors.New("invalid coin age checkpoint")
+)
+
+// Kinds of the transfers contributing to the coin age.
+const (
+	entryReceived    = iota // Value received from a regular account, fermenting first
+	entryDistributed        // Value received from the distribution account
+	entrySent               // Value sent away by the signer
+	entryReward             // Netto reward of a block minted by the signer
+	entryMigrated           // Value and coin age carried over by a key migration
+)
+
+// distributionAgeFactor multiplies the coin-seconds of value received from the
+// distribution account.
+const distributionAgeFactor = 100 // experiment
+
+// coinAgeEntry is a single transfer contributing to the coin age of the signer.
+// Its contribution depends on the time it is evaluated at, so entries are kept
+// as they are rather than summed up.
+type coinAgeEntry struct {
+	Number uint64   `json:"number"` // Block the transfer is included in
+	Time   uint64   `json:"time"`   // Timestamp of the block
+	Kind   uint8    `json:"kind"`
+	Amount *big.Int `json:"amount"`
+	Age    *big.Int `json:"age,omitempty"` // Coin-seconds carried over by a key migration
+}
+
+// accumulate adds the value and coin-seconds the entry contributes timeDiff
+// seconds after its block to the given sums.
+func (entry *coinAgeEntry) accumulate(config *params.SproutsConfig, value, age, timeDiff *big.Int) {
+	fermented := timeDiff.Cmp(config.CoinAgeFermentation) == 1
+	caFromTx := new(big.Int).Mul(entry.Amount, timeDiff)
+
+	switch entry.Kind {
+	case entryReceived:
+		// we count regular transaction to us only when they are old enough
+		if !fermented {
+			return
+		}
+		age.Add(age, caFromTx)
+		value.Add(value, entry.Amount)
+
+	case entryDistributed:
+		// transactions from the distribution accounts are counted right away
+		// unless fermentation is enforced for them as well
+		if config.EnforceFermentationForDistribution && !fermented {
+			return
+		}
+		caFromTx.Mul(caFromTx, big.NewInt(distributionAgeFactor))
+		age.Add(age, caFromTx)
+		value.Add(value, entry.Amount)
+
+	case entrySent:
+		// value sent away is taken right away, only received value ferments
+		age.Sub(age, caFromTx)
+		value.Sub(value, entry.Amount)
+
+	case entryReward:
+		age.Add(age, caFromTx)
+
+	case entryMigrated:
+		// the value was held by the previous key, so it doesn't ferment again
+		age.Add(age, entry.Age)
+		age.Add(age, caFromTx)
+		value.Add(value, entry.Amount)
+	}
+}
+
+// coinAgeCheckpoint holds the entries of the coin age of a signer up to and
+// including a block, so the coin age can be computed without the bodies of
+// the blocks before it.
+type coinAgeCheckpoint struct {
+	Number  uint64         `json:"number"`
+	Hash    common.Hash    `json:"hash"`
+	Time    uint64         `json:"time"`              // Timestamp of the block
+	Since   uint64         `json:"since"`             // Entries are complete from this time on
+	Signer  common.Address `json:"signer"`            // Signer the entries belong to
+	Retired uint64         `json:"retired,omitempty"` // Block the signer migrated its key in, 0 if it didn't
+	Entries []coinAgeEntry `json:"entries"`           // Entries by descending block number
+}
+
+// validate checks the internal consistency of the checkpoint.
+func (cp *coinAgeCheckpoint) validate() error {
+	if cp.Retired > cp.Number {
+		return errInvalidCoinAgeCheckpoint
+	}
+	number, time := cp.Number, cp.Time
+	for _, entry := range cp.Entries {
+		if entry.Number > number || entry.Time > time || entry.Time < cp.Since || entry.Number <= cp.Retired {
+			return errInvalidCoinAgeCheckpoint
+		}
+		if entry.Kind > entryMigrated || entry.Amount == nil || entry.Amount.Sign() < 0 {
+			return errInvalidCoinAgeCheckpoint
+		}
+		if entry.Kind == entryMigrated && (entry.Age == nil || entry.Age.Sign() < 0) {
+			return errInvalidCoinAgeCheckpoint
+		}
+		number, time = entry.Number, entry.Time
+	}
+	return nil
+}
+
+func coinAgeCheckpointKey(hash common.Hash, signer common.Address) []byte {
+	key := make([]byte, 0, len(coinAgeCheckpointPrefix)+common.HashLength+common.AddressLength)
+	return append(append(append(key, coinAgeCheckpointPrefix...), hash[:]...), signer[:]...)
+}
+
+func latestCheckpointKey(signer common.Address) []byte {
+	key := make([]byte, 0, len(latestCheckpointPrefix)+common.AddressLength)
+	return append(append(key, latestCheckpointPrefix...), signer[:]...)
+}
+
+// loadCoinAgeCheckpoint retrieves the checkpoint of the signer at the block
+// with the given hash.
+func (engine *PoS) loadCoinAgeCheckpoint(hash common.Hash, signer common.Address) (*coinAgeCheckpoint, error) {
+	if engine.db == nil {
+		return nil, errNoDatabase
+	}
+	blob, err := engine.db.Get(coinAgeCheckpointKey(hash, signer))
+	if err != nil {
+		return nil, err
+	}
+	cp := new(coinAgeCheckpoint)
+	if err := json.Unmarshal(blob, cp); err != nil {
+		return nil, err
+	}
+	return cp, nil
+}
+
+// storeCoinAgeCheckpoint persists the checkpoint and makes it the latest one of
+// its signer.
+func (engine *PoS) storeCoinAgeCheckpoint(cp *coinAgeCheckpoint) error {
+	blob, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	if err := engine.db.Put(coinAgeCheckpointKey(cp.Hash, cp.Signer), blob); err != nil {
+		return err
+	}
+	return engine.db.Put(latestCheckpointKey(cp.Signer), cp.Hash[:])
+}
+
+// latestCoinAgeCheckpoint returns the latest checkpoint of the signer, nil if
+// it has none.
+func (engine *PoS) latestCoinAgeCheckpoint(signer common.Address) *coinAgeCheckpoint {
+	if engine.db == nil {
+		return nil
+	}
+	hash, err := engine.db.Get(latestCheckpointKey(signer))
+	if err != nil {
+		return nil
+	}
+	cp, err := engine.loadCoinAgeCheckpoint(common.BytesToHash(hash), signer)
+	if err != nil || cp.Signer != signer {
+		return nil
+	}
+	return cp
+}
+
+// coinAgeCheckpoint returns the checkpoint of the block with the given hash if
+// it belongs to the account and is complete from the given time on.
+func (engine *PoS) coinAgeCheckpoint(hash common.Hash, since uint64, account common.Address) *coinAgeCheckpoint {
+	if engine.db == nil {
+		return nil
+	}
+	cp, err := engine.loadCoinAgeCheckpoint(hash, account)
+	if err != nil || cp.Signer != account || cp.Since > since {
+		return nil
+	}
+	return cp
+}
+
+// maybeWriteCoinAgeCheckpoint records a checkpoint of the signer at the latest
+// block at a multiple of the checkpoint interval below the head, unless it has
+// one there already. The entries are the ones of the signer's accrual on top of the
+// head.
+func (engine *PoS) maybeWriteCoinAgeCheckpoint(chain consensus.ChainReader, head *types.Header, acc *accrual, signer common.Address) {
+	if engine.checkpointInterval == 0 || engine.db == nil || head.Number.Uint64() < 2 {
+		return
+	}
+	number := (head.Number.Uint64() - 1) / engine.checkpointInterval * engine.checkpointInterval
+	if number == 0 || acc.retired > number {
+		// the walk ended at a key migration after the checkpoint
+		return
+	}
+	header := chain.GetHeaderByNumber(number)
+	if header == nil {
+		return
+	}
+	if has, err := engine.db.Has(coinAgeCheckpointKey(header.Hash(), signer)); err != nil || has {
+		return
+	}
+	cp := &coinAgeCheckpoint{
+		Number:  number,
+		Hash:    header.Hash(),
+		Time:    header.Time.Uint64(),
+		Since:   acc.since,
+		Signer:  signer,
+		Retired: acc.retired,
+		Entries: []coinAgeEntry{},
+	}
+	for _, entry := range acc.entries {
+		if entry.Number <= number {
+			cp.Entries = append(cp.Entries, entry)
+		}
+	}
+	if err := engine.persist(func() error { return engine.storeCoinAgeCheckpoint(cp) }); err != nil {
+		log.Warn("Failed to store coin age checkpoint", "number", number, "err", err)
+	}
+}
+
+// approximateCoinAge estimates the coin age the signer can stake at the given
+// time on top of the head from its latest checkpoint, when walking the blocks
+// takes too long. The entries after the checkpoint are missed, the stake is
+// bounded by the balance at the head like any other. The stakes still held are
+// taken from the headers like the walk does. errCoinAgeNotReady is returned if
+// there is no checkpoint of the signer.
+func (engine *PoS) approximateCoinAge(chain consensus.ChainReader, head *types.Header, now time.Time, signer common.Address) (*coinAge, error) {
+	cp := engine.latestCoinAgeCheckpoint(signer)
+	if cp == nil || cp.Number >= head.Number.Uint64() {
+		return nil, errCoinAgeNotReady
+	}
+	acc := &accrual{
+		value:   new(big.Int),
+		age:     new(big.Int),
+		entries: cp.Entries,
+		since:   cp.Since,
+		retired: cp.Retired,
+	}
+	// the walk leaves out the head as well
+	if number := head.Number.Uint64(); number > 0 {
+		engine.holdStakes(chain, number-1, now, signer, acc)
+	}
+	engine.settle(chain, head, now, signer, acc)
+	return engine.accruedStake(chain, head, signer, acc, now), nil
+}
+
+// ExportCoinAgeSnapshot writes the latest coin age checkpoint of the primary
+// signer as JSON. It allows seeding a node which lacks the block bodies before
+// it.
+func (engine *PoS) ExportCoinAgeSnapshot(w io.Writer) error {
+	cp := engine.latestCoinAgeCheckpoint(engine.primarySigner().address)
+	if cp == nil {
+		return errNoCoinAgeCheckpoint
+	}
+	return json.NewEncoder(w).Encode(cp)
+}
+
+// ImportCoinAgeSnapshot reads a coin age checkpoint written by
+// ExportCoinAgeSnapshot and stores it. The checkpoint must come from a trusted
+// source, only its internal consistency is verified.
+func (engine *PoS) ImportCoinAgeSnapshot(r io.Reader) error {
+	if engine.db == nil {
+		return errNoCoinAgeCheckpoint
+	}
+	cp := new(coinAgeCheckpoint)
+	if err := json.NewDecoder(r).Decode(cp); err != nil {
+		return err
+	}
+	if err := cp.validate(); err != nil {
+		return err
+	}
+	return engine.persist(func() error { return engine.storeCoinAgeCheckpoint(cp) })
+}
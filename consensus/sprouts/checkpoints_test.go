@@ -0,0 +1,415 @@
+package sprouts
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/applicature/sprouts-plus/common"
+	"github.com/applicature/sprouts-plus/consensus"
+	"github.com/applicature/sprouts-plus/core"
+	"github.com/applicature/sprouts-plus/core/types"
+	"github.com/applicature/sprouts-plus/core/vm"
+	"github.com/applicature/sprouts-plus/crypto"
+	"github.com/applicature/sprouts-plus/ethdb"
+	"github.com/applicature/sprouts-plus/params"
+)
+
+// Tests that the coin age is computed from a checkpoint once the block bodies
+// before it are gone, and that an exported checkpoint seeds a node lacking them.
+func TestCoinAgeCheckpoint(t *testing.T) {
+	config := sproutsConfig
+	config.DistributionAccount = rewardsAddr
+
+	db, genesis, _ := initBlockchainStructures(t)
+	engine, err := NewWithOptions(&config, db, Options{CoinAgeCheckpointInterval: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine.Authorize(rewardsAddr, nil)
+	genesis.Timestamp = uint64(time.Now().Add(-time.Hour).Unix())
+	fundTestStaker(genesis)
+	// amounts in milli-coins, so their coin age isn't rounded down to zero
+	unit := big.NewInt(coinValue / 1000)
+	amount := func(n int64) *big.Int { return new(big.Int).Mul(unit, big.NewInt(n)) }
+	genesis.Alloc[testAddr] = core.GenesisAccount{Balance: amount(1000000)}
+	genesisBlock := genesis.MustCommit(db)
+
+	reopen := func() *core.BlockChain {
+		blockchain, err := core.NewBlockChain(db, genesis.Config, engine, vm.Config{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return blockchain
+	}
+	blockchain := reopen()
+
+	signer := types.NewEIP155Signer(genesis.Config.ChainId)
+	blocks, _ := GenerateChain(&config, params.TestSproutsChainConfig, genesisBlock, db, 110, func(i int, b *BlockGen) {
+		b.SetCoinbase(rewardsAddr)
+		switch i {
+		case 9, 49, 104:
+			// distributions to the signer before and after the checkpoint
+			tx, _ := types.SignTx(types.NewTransaction(b.TxNonce(rewardsAddr), testAddr, amount(1000), big.NewInt(21000), new(big.Int), nil), signer, rewardsKey)
+			b.AddTx(tx)
+		case 59:
+			// a transfer by the signer
+			tx, _ := types.SignTx(types.NewTransaction(b.TxNonce(testAddr), rewardsAddr, amount(300), big.NewInt(21000), new(big.Int), nil), signer, testKey)
+			b.AddTx(tx)
+		}
+		sealTestBlock(t, engine, b, &coinAge{
+			Time:  b.Header().Time.Uint64(),
+			Age:   testStakeAge,
+			Value: big.NewInt(1000),
+		})
+	})
+	if _, err := blockchain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	engine.Authorize(testAddr, nil)
+
+	want, err := engine.CoinAgeAt(blockchain, 110)
+	if err != nil {
+		t.Fatalf("failed to compute coin age: %v", err)
+	}
+	if want.Value.Cmp(amount(2700)) != 0 {
+		t.Fatalf("value mismatch: have %v, want %v", want.Value, amount(2700))
+	}
+	// Sealing records the checkpoint of block 100
+	if _, err := engine.coinAge(blockchain, uint64(time.Now().Unix())); err != nil {
+		t.Fatalf("failed to compute coin age: %v", err)
+	}
+	cp, err := engine.loadCoinAgeCheckpoint(blocks[99].Hash(), testAddr)
+	if err != nil {
+		t.Fatalf("checkpoint missing: %v", err)
+	}
+	if len(cp.Entries) != 3 || cp.Signer != testAddr {
+		t.Fatalf("checkpoint mismatch: %+v", cp)
+	}
+	blockchain.Stop()
+
+	for _, block := range blocks[:100] {
+		core.DeleteBody(db, block.Hash(), block.NumberU64())
+	}
+	blockchain = reopen()
+	defer blockchain.Stop()
+
+	checkCoinAge := func(number uint64) {
+		have, err := engine.CoinAgeAt(blockchain, number)
+		if err != nil {
+			t.Fatalf("failed to compute coin age from the checkpoint: %v", err)
+		}
+		if have.Age.Cmp(want.Age) != 0 || have.Value.Cmp(want.Value) != 0 {
+			t.Errorf("coin age mismatch: have %+v, want %+v", have, want)
+		}
+	}
+	checkCoinAge(110)
+
+	// Heads before the checkpoint still need the bodies
+	if _, err := engine.CoinAgeAt(blockchain, 90); err != errCoinAgeNotReady {
+		t.Errorf("error mismatch: have %v, want %v", err, errCoinAgeNotReady)
+	}
+
+	// An exported checkpoint restores the coin age of a node lacking it
+	var snapshot bytes.Buffer
+	if err := engine.ExportCoinAgeSnapshot(&snapshot); err != nil {
+		t.Fatalf("failed to export checkpoint: %v", err)
+	}
+	if err := db.Delete(coinAgeCheckpointKey(blocks[99].Hash(), testAddr)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := engine.CoinAgeAt(blockchain, 110); err != errCoinAgeNotReady {
+		t.Errorf("error mismatch: have %v, want %v", err, errCoinAgeNotReady)
+	}
+	if err := engine.ImportCoinAgeSnapshot(&snapshot); err != nil {
+		t.Fatalf("failed to import checkpoint: %v", err)
+	}
+	checkCoinAge(110)
+}
+
+// Tests that a stake still held is taken from the coin age computed from a
+// checkpoint after it, and from the approximation, like from the full walk.
+func TestCoinAgeCheckpointHolding(t *testing.T) {
+	db, genesis, _ := initBlockchainStructures(t)
+	engine := newTestFaker(t, &sproutsConfig, db)
+	engine.checkpointInterval = 100
+	genesis.Timestamp = uint64(time.Now().Add(-time.Hour).Unix())
+	genesis.Alloc[testAddr] = core.GenesisAccount{Balance: new(big.Int).Mul(big.NewInt(1000), big.NewInt(coinValue))}
+	genesisBlock := genesis.MustCommit(db)
+
+	blockchain, err := core.NewBlockChain(db, genesis.Config, engine, vm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blockchain.Stop()
+
+	// the signer stakes in block 50, before the checkpoint of block 100
+	blocks, _ := GenerateFakeChain(&sproutsConfig, params.TestSproutsChainConfig, genesisBlock, db, 110, func(i int, b *BlockGen) {
+		if i != 49 {
+			b.SetCoinbase(rewardsAddr)
+			return
+		}
+		b.SetCoinbase(testAddr)
+		setTestStake(b.header, &coinAge{Time: b.header.Time.Uint64(), Age: big.NewInt(10), Value: big.NewInt(coinValue)})
+	})
+	if _, err := blockchain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	engine.Authorize(testAddr, nil)
+
+	head := blockchain.CurrentHeader()
+	now := time.Unix(head.Time.Int64(), 0)
+	want, acc, err := engine.coinAgeAt(context.Background(), blockchain, head, now, testAddr)
+	if err != nil {
+		t.Fatalf("failed to compute coin age: %v", err)
+	}
+	if len(acc.held) != 1 || want.Age.Sign() == 0 {
+		t.Fatalf("stake not held: age %v, held %v", want.Age, acc.held)
+	}
+	// Sealing records the checkpoint of block 100
+	if _, err := engine.coinAge(blockchain, uint64(now.Unix())); err != nil {
+		t.Fatalf("failed to compute coin age: %v", err)
+	}
+	if cp := engine.latestCoinAgeCheckpoint(testAddr); cp == nil || cp.Number != 100 {
+		t.Fatalf("checkpoint mismatch: have %+v, want block 100", cp)
+	}
+	have, _, err := engine.coinAgeAt(context.Background(), blockchain, head, now, testAddr)
+	if err != nil {
+		t.Fatalf("failed to compute coin age from the checkpoint: %v", err)
+	}
+	if have.Age.Cmp(want.Age) != 0 || have.Value.Cmp(want.Value) != 0 {
+		t.Errorf("checkpointed coin age mismatch: have %+v, want %+v", have, want)
+	}
+	approximated, err := engine.approximateCoinAge(blockchain, head, now, testAddr)
+	if err != nil {
+		t.Fatalf("failed to approximate coin age: %v", err)
+	}
+	if approximated.Age.Cmp(want.Age) != 0 || approximated.Value.Cmp(want.Value) != 0 {
+		t.Errorf("approximated coin age mismatch: have %+v, want %+v", approximated, want)
+	}
+}
+
+func TestCoinAgeCheckpointValidation(t *testing.T) {
+	db, _ := ethdb.NewMemDatabase()
+	engine := newTestEngine(t, &sproutsConfig, db)
+
+	valid := coinAgeCheckpoint{
+		Number: 100,
+		Time:   1000,
+		Since:  10,
+		Signer: testAddr,
+		Entries: []coinAgeEntry{
+			{Number: 90, Time: 900, Kind: entryDistributed, Amount: big.NewInt(5)},
+			{Number: 50, Time: 500, Kind: entrySent, Amount: big.NewInt(3)},
+		},
+	}
+	tests := []func(cp *coinAgeCheckpoint){
+		func(cp *coinAgeCheckpoint) { cp.Entries[0].Number = 101 },
+		func(cp *coinAgeCheckpoint) { cp.Entries[0].Time = 1001 },
+		func(cp *coinAgeCheckpoint) { cp.Entries[1].Time = 901 },
+		func(cp *coinAgeCheckpoint) { cp.Entries[1].Time = 9 },
+		func(cp *coinAgeCheckpoint) { cp.Entries[1].Amount = big.NewInt(-3) },
+		func(cp *coinAgeCheckpoint) { cp.Entries[1].Amount = nil },
+		func(cp *coinAgeCheckpoint) { cp.Entries[1].Kind = entryMigrated + 1 },
+		func(cp *coinAgeCheckpoint) { cp.Entries[1].Kind = entryMigrated },
+		func(cp *coinAgeCheckpoint) { cp.Retired = 50 },
+	}
+	importCheckpoint := func(cp *coinAgeCheckpoint) error {
+		blob, _ := json.Marshal(cp)
+		return engine.ImportCoinAgeSnapshot(bytes.NewReader(blob))
+	}
+	if err := importCheckpoint(&valid); err != nil {
+		t.Fatalf("valid checkpoint rejected: %v", err)
+	}
+	for i, tamper := range tests {
+		cp := valid
+		cp.Entries = []coinAgeEntry{valid.Entries[0], valid.Entries[1]}
+		tamper(&cp)
+		if err := importCheckpoint(&cp); err != errInvalidCoinAgeCheckpoint {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, errInvalidCoinAgeCheckpoint)
+		}
+	}
+}
+
+// slowChain delays the retrieval of block bodies, like a cold database does.
+type slowChain struct {
+	*core.BlockChain
+	delay time.Duration
+}
+
+func (c *slowChain) GetBlock(hash common.Hash, number uint64) *types.Block {
+	time.Sleep(c.delay)
+	return c.BlockChain.GetBlock(hash, number)
+}
+
+// Tests that Prepare stakes an approximation of the coin age from the latest
+// checkpoint once walking the blocks exceeds its budget, which still passes
+// the stake verification.
+func TestPrepareBudgetFallback(t *testing.T) {
+	config := sproutsConfig
+	config.DistributionAccount = rewardsAddr
+
+	db, genesis, _ := initBlockchainStructures(t)
+	engine, err := NewWithOptions(&config, db, Options{CoinAgeCheckpointInterval: 10, PrepareBudget: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine.Authorize(rewardsAddr, nil)
+	genesis.Timestamp = uint64(time.Now().Add(-time.Hour).Unix())
+	fundTestStaker(genesis)
+	unit := big.NewInt(coinValue / 1000)
+	amount := func(n int64) *big.Int { return new(big.Int).Mul(unit, big.NewInt(n)) }
+	genesis.Alloc[testAddr] = core.GenesisAccount{Balance: amount(1000000)}
+	genesisBlock := genesis.MustCommit(db)
+
+	blockchain, err := core.NewBlockChain(db, genesis.Config, engine, vm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blockchain.Stop()
+
+	signer := types.NewEIP155Signer(genesis.Config.ChainId)
+	blocks, _ := GenerateChain(&config, params.TestSproutsChainConfig, genesisBlock, db, 25, func(i int, b *BlockGen) {
+		b.SetCoinbase(rewardsAddr)
+		switch i {
+		case 4, 21:
+			tx, _ := types.SignTx(types.NewTransaction(b.TxNonce(rewardsAddr), testAddr, amount(1000), big.NewInt(21000), new(big.Int), nil), signer, rewardsKey)
+			b.AddTx(tx)
+		case 22:
+			tx, _ := types.SignTx(types.NewTransaction(b.TxNonce(testAddr), rewardsAddr, amount(999000), big.NewInt(21000), new(big.Int), nil), signer, testKey)
+			b.AddTx(tx)
+		}
+		sealTestBlock(t, engine, b, &coinAge{
+			Time:  b.Header().Time.Uint64(),
+			Age:   testStakeAge,
+			Value: big.NewInt(1000),
+		})
+	})
+	if _, err := blockchain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	engine.Authorize(testAddr, nil)
+
+	// Without a checkpoint to fall back to, the walk exceeds the budget and
+	// records the checkpoint of block 20
+	budget := 20 * time.Millisecond
+	engine.budget = budget
+	chain := &slowChain{BlockChain: blockchain, delay: 50 * time.Millisecond}
+	if _, err := engine.coinAge(chain, uint64(time.Now().Unix())); err != nil {
+		t.Fatalf("failed to compute coin age: %v", err)
+	}
+	if cp := engine.latestCoinAgeCheckpoint(testAddr); cp == nil || cp.Number != 20 {
+		t.Fatalf("checkpoint mismatch: have %+v, want block 20", cp)
+	}
+
+	head := blockchain.CurrentBlock()
+	header := &types.Header{
+		ParentHash: head.Hash(),
+		Number:     new(big.Int).Add(head.Number(), big1),
+		Time:       new(big.Int),
+	}
+	start := time.Now()
+	if err := engine.Prepare(chain, header); err != nil {
+		t.Fatalf("failed to prepare header: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > budget+chain.delay+time.Second {
+		t.Errorf("prepare took %v, budget %v", elapsed, budget)
+	}
+	stake, err := engine.headerStake(header)
+	if err != nil {
+		t.Fatalf("failed to decode stake: %v", err)
+	}
+	if stake.Value.Sign() == 0 || stake.Age.Sign() == 0 {
+		t.Errorf("approximated stake is empty: %+v", stake)
+	}
+	if err := checkStakeConsistency(engine.config, stake); err != nil {
+		t.Errorf("approximated stake inconsistent: %v", err)
+	}
+	statedb, err := blockchain.StateAt(head.Root())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the transfer after the checkpoint is missed, the balance bounds the stake
+	if err := engine.VerifyStakeBalance(blockchain, header, statedb); err != nil {
+		t.Errorf("approximated stake rejected: %v", err)
+	}
+}
+
+// Tests that the coin age walks of several local signers share the budget of
+// Prepare, and that every signer gets its own checkpoint to fall back to.
+func TestPrepareSharedBudget(t *testing.T) {
+	config := sproutsConfig
+	config.DistributionAccount = rewardsAddr
+
+	db, genesis, _ := initBlockchainStructures(t)
+	engine, err := NewWithOptions(&config, db, Options{CoinAgeCheckpointInterval: 10, PrepareBudget: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesis.Timestamp = uint64(time.Now().Add(-time.Hour).Unix())
+	fundTestStaker(genesis)
+	unit := big.NewInt(coinValue / 1000)
+	amount := func(n int64) *big.Int { return new(big.Int).Mul(unit, big.NewInt(n)) }
+	genesisBlock := genesis.MustCommit(db)
+
+	blockchain, err := core.NewBlockChain(db, genesis.Config, engine, vm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blockchain.Stop()
+
+	otherKey, _ := crypto.GenerateKey()
+	otherAddr := crypto.PubkeyToAddress(otherKey.PublicKey)
+	signer := types.NewEIP155Signer(genesis.Config.ChainId)
+	blocks, _ := GenerateChain(&config, params.TestSproutsChainConfig, genesisBlock, db, 25, func(i int, b *BlockGen) {
+		b.SetCoinbase(rewardsAddr)
+		if i == 4 {
+			for _, to := range []common.Address{testAddr, otherAddr} {
+				tx, _ := types.SignTx(types.NewTransaction(b.TxNonce(rewardsAddr), to, amount(1000), big.NewInt(21000), new(big.Int), nil), signer, rewardsKey)
+				b.AddTx(tx)
+			}
+		}
+		sealTestBlock(t, engine, b, &coinAge{
+			Time:  b.Header().Time.Uint64(),
+			Age:   testStakeAge,
+			Value: big.NewInt(1000),
+		})
+	})
+	if _, err := blockchain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	engine.Authorize(testAddr, nil)
+	engine.AddSigner(otherAddr, nil)
+
+	prepare := func(chain consensus.ChainReader) {
+		head := blockchain.CurrentBlock()
+		header := &types.Header{
+			ParentHash: head.Hash(),
+			Number:     new(big.Int).Add(head.Number(), big1),
+			Time:       new(big.Int),
+		}
+		if err := engine.Prepare(chain, header); err != nil {
+			t.Fatalf("failed to prepare header: %v", err)
+		}
+	}
+	// The first walks record the checkpoint of block 20 for both signers
+	prepare(blockchain)
+	for _, addr := range []common.Address{testAddr, otherAddr} {
+		if cp := engine.latestCoinAgeCheckpoint(addr); cp == nil || cp.Number != 20 || cp.Signer != addr {
+			t.Fatalf("signer %x: checkpoint mismatch: have %+v, want block 20", addr, cp)
+		}
+	}
+	// Walking the chain takes longer than the budget for either signer, yet
+	// both together fall back within it
+	budget := 300 * time.Millisecond
+	engine.budget = budget
+	chain := &slowChain{BlockChain: blockchain, delay: 200 * time.Millisecond}
+	start := time.Now()
+	prepare(chain)
+	if elapsed := time.Since(start); elapsed >= 2*budget {
+		t.Errorf("prepare took %v, budget %v", elapsed, budget)
+	}
+}
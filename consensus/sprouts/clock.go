@@ -0,0 +1,32 @@
+package sprouts
+
+import "time"
+
+// Clock is the source of the current time of the engine. Everything the
+// engine derives from the current time, like the timestamps it seals, the coin
+// age it stakes and the future blocks it rejects, is read from it, so a chain
+// can be replayed at any given time.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// After returns a channel receiving the current time once d has passed.
+	After(d time.Duration) <-chan time.Time
+}
+
+// systemClock is the Clock of the local system.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// SetClock replaces the clock of the engine, the system clock by default. It
+// must be called before the engine is in use.
+func (engine *PoS) SetClock(clock Clock) {
+	engine.clock = clock
+}
+
+// unixNow returns the current time of the engine's clock in seconds.
+func (engine *PoS) unixNow() uint64 {
+	return uint64(engine.clock.Now().Unix())
+}
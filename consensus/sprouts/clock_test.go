@@ -0,0 +1,97 @@
+package sprouts
+
+import (
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/applicature/sprouts-plus/core"
+	"github.com/applicature/sprouts-plus/core/vm"
+	"github.com/applicature/sprouts-plus/ethdb"
+	"github.com/applicature/sprouts-plus/params"
+)
+
+// fakeClock is a Clock standing still, moving on only when waited for.
+type fakeClock struct {
+	lock sync.Mutex
+	now  time.Time
+}
+
+func newFakeClock(unix int64) *fakeClock {
+	return &fakeClock{now: time.Unix(unix, 0)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if d > 0 {
+		c.now = c.now.Add(d)
+	}
+	ch := make(chan time.Time, 1)
+	ch <- c.now
+	return ch
+}
+
+// set moves the clock to the given time.
+func (c *fakeClock) set(unix int64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = time.Unix(unix, 0)
+}
+
+// Tests that the same chain replayed at different times yields the coin age
+// accrued up to each of them, the genesis allocation aging with every second.
+func TestCoinAgeReplayedAtClock(t *testing.T) {
+	balance := new(big.Int).Mul(big.NewInt(1000000), new(big.Int).SetUint64(coinValue))
+	genesis := &core.Genesis{
+		Config:     params.TestSproutsChainConfig,
+		Timestamp:  uint64(startDate.Unix()),
+		Difficulty: big0,
+		ExtraData:  make([]byte, extraDefault+extraSeal+extraKernel+extraCoinAge),
+		Alloc:      core.GenesisAlloc{testAddr: {Balance: balance}},
+	}
+	db, _ := ethdb.NewMemDatabase()
+	genesis.MustCommit(db)
+
+	engine := newTestEngine(t, &sproutsConfig, db)
+	engine.SetGenesis(genesis)
+	clock := newFakeClock(startDate.Unix())
+	engine.SetClock(clock)
+
+	blockchain, err := core.NewBlockChain(db, genesis.Config, engine, vm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blockchain.Stop()
+	api := &API{chain: blockchain, sprouts: engine}
+
+	var last *big.Int
+	for _, offset := range []int64{24 * 60 * 60, 10 * 24 * 60 * 60, 20 * 24 * 60 * 60} {
+		now := startDate.Unix() + offset
+		clock.set(now)
+
+		ca, err := api.CoinAgeOf(testAddr)
+		if err != nil {
+			t.Fatalf("offset %ds: %v", offset, err)
+		}
+		if uint64(ca.Time) != uint64(now) {
+			t.Errorf("offset %ds: time mismatch: have %d, want %d", offset, ca.Time, now)
+		}
+		age := (*big.Int)(ca.Age)
+		if want := GenesisStake(&sproutsConfig, genesis, testAddr, uint64(now)); age.Cmp(want) != 0 {
+			t.Errorf("offset %ds: coin age mismatch: have %v, want %v", offset, age, want)
+		}
+		if last != nil && age.Cmp(last) <= 0 {
+			t.Errorf("offset %ds: coin age %v not above %v", offset, age, last)
+		}
+		last = age
+	}
+}
@@ -0,0 +1,167 @@
+package sprouts
+
+import (
+	"encoding/json"
+	"errors"
+	"math/big"
+	"sort"
+
+	"github.com/applicature/sprouts-plus/common"
+	"github.com/applicature/sprouts-plus/log"
+	"github.com/applicature/sprouts-plus/params"
+)
+
+// coinAgeLogPrefix is the prefix of the coin age contribution logs, followed
+// by the signer.
+var coinAgeLogPrefix = []byte("sprouts-coinage-log-")
+
+var (
+	errNoCoinAgeLog          = errors.New("no coin age log")
+	errInvalidBreakdownRange = errors.New("invalid block range")
+)
+
+// coinAgeContribution is what the transfers and stakes of a single block
+// contribute to the coin age of a signer, as of the time the log was
+// accumulated at.
+type coinAgeContribution struct {
+	Number uint64   `json:"number"`
+	Time   uint64   `json:"time"`  // Timestamp of the block
+	Delta  *big.Int `json:"delta"` // Coin-seconds, negative for value sent and age staked
+}
+
+// coinAgeLog breaks the coin age of a signer down to the blocks contributing
+// to it. It is written along with the coin age record whenever the signer's
+// coin age is accumulated, and pruned as its blocks age past the coin age
+// lifetime. The premine never expires, so it isn't logged.
+type coinAgeLog struct {
+	Signer        common.Address        `json:"signer"`
+	Time          uint64                `json:"time"`          // Time the contributions were accumulated at
+	Age           *big.Int              `json:"age"`           // Sum of the deltas in coin-seconds
+	Contributions []coinAgeContribution `json:"contributions"` // Contributions by ascending block number
+}
+
+func coinAgeLogKey(signer common.Address) []byte {
+	key := make([]byte, 0, len(coinAgeLogPrefix)+common.AddressLength)
+	return append(append(key, coinAgeLogPrefix...), signer[:]...)
+}
+
+// newCoinAgeLog sums up the entries and held stakes of the signer's accrual
+// per block as of the given time. Blocks contributing nothing are left out.
+func newCoinAgeLog(config *params.SproutsConfig, signer common.Address, acc *accrual, now uint64) *coinAgeLog {
+	deltas := make(map[uint64]*coinAgeContribution)
+	add := func(number, time uint64, delta *big.Int) {
+		if contribution, ok := deltas[number]; ok {
+			contribution.Delta.Add(contribution.Delta, delta)
+			return
+		}
+		deltas[number] = &coinAgeContribution{Number: number, Time: time, Delta: new(big.Int).Set(delta)}
+	}
+	fromTime := now - config.CoinAgeLifetime.Uint64()
+	for _, entry := range acc.entries {
+		if entry.Time < fromTime {
+			// checkpoints may hold entries past the lifetime
+			continue
+		}
+		value, age := new(big.Int), new(big.Int)
+		entry.accumulate(config, value, age, new(big.Int).SetUint64(now-entry.Time))
+		add(entry.Number, entry.Time, age)
+	}
+	for _, held := range acc.held {
+		add(held.Number, held.Time, held.Delta)
+	}
+
+	l := &coinAgeLog{Signer: signer, Time: now, Age: new(big.Int), Contributions: []coinAgeContribution{}}
+	for _, contribution := range deltas {
+		if contribution.Delta.Sign() == 0 {
+			continue
+		}
+		l.Contributions = append(l.Contributions, *contribution)
+		l.Age.Add(l.Age, contribution.Delta)
+	}
+	sort.Slice(l.Contributions, func(i, j int) bool {
+		return l.Contributions[i].Number < l.Contributions[j].Number
+	})
+	return l
+}
+
+// prune drops the contributions of the blocks aged past the coin age lifetime
+// at the given time and subtracts their deltas from the sum. It returns the
+// number of contributions dropped.
+func (l *coinAgeLog) prune(config *params.SproutsConfig, now uint64) int {
+	fromTime := now - config.CoinAgeLifetime.Uint64()
+	kept := l.Contributions[:0]
+	for _, contribution := range l.Contributions {
+		if contribution.Time < fromTime {
+			l.Age.Sub(l.Age, contribution.Delta)
+			continue
+		}
+		kept = append(kept, contribution)
+	}
+	dropped := len(l.Contributions) - len(kept)
+	l.Contributions = kept
+	return dropped
+}
+
+// loadCoinAgeLog retrieves the contribution log of the signer.
+func (engine *PoS) loadCoinAgeLog(signer common.Address) (*coinAgeLog, error) {
+	if engine.db == nil {
+		return nil, errNoCoinAgeLog
+	}
+	blob, err := engine.db.Get(coinAgeLogKey(signer))
+	if err != nil {
+		return nil, errNoCoinAgeLog
+	}
+	l := new(coinAgeLog)
+	if err := json.Unmarshal(blob, l); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// storeCoinAgeLog persists the contribution log, replacing the former one of
+// its signer.
+func (engine *PoS) storeCoinAgeLog(l *coinAgeLog) error {
+	blob, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	return engine.db.Put(coinAgeLogKey(l.Signer), blob)
+}
+
+// pruneCoinAgeLogs prunes the contribution logs of the local signers as of the
+// given time, storing those which changed.
+func (engine *PoS) pruneCoinAgeLogs(now uint64) {
+	for _, signer := range engine.localSigners() {
+		l, err := engine.loadCoinAgeLog(signer.address)
+		if err != nil {
+			continue
+		}
+		if l.prune(engine.config, now) == 0 {
+			continue
+		}
+		if err := engine.persist(func() error { return engine.storeCoinAgeLog(l) }); err != nil {
+			log.Warn("Failed to store pruned coin age log", "signer", signer.address, "err", err)
+		}
+	}
+}
+
+// CoinAgeBreakdown returns the logged contributions of the blocks from the
+// given number to the given one inclusive to the coin age of the signer, as
+// of the latest time its coin age was accumulated. Only the local signers'
+// coin ages are logged.
+func (engine *PoS) CoinAgeBreakdown(addr common.Address, fromBlock, toBlock uint64) ([]coinAgeContribution, error) {
+	if toBlock < fromBlock {
+		return nil, errInvalidBreakdownRange
+	}
+	l, err := engine.loadCoinAgeLog(addr)
+	if err != nil {
+		return nil, err
+	}
+	contributions := []coinAgeContribution{}
+	for _, contribution := range l.Contributions {
+		if contribution.Number >= fromBlock && contribution.Number <= toBlock {
+			contributions = append(contributions, contribution)
+		}
+	}
+	return contributions, nil
+}
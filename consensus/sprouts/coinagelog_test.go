@@ -0,0 +1,79 @@
+package sprouts
+
+import (
+	"math/big"
+	"testing"
+)
+
+// Tests that the contribution log of a signer is written as its coin age is
+// accumulated, and that pruning drops exactly the contributions aged past the
+// lifetime from the aggregate.
+func TestCoinAgeLogPruning(t *testing.T) {
+	// the walk leaves out the head, so a block follows the hundred logged
+	blockchain, blocks, engine := newTestChain(t, 101)
+	defer blockchain.Stop()
+
+	if _, err := blockchain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	// accumulate once the stakes aren't held anymore, so every block
+	// contributes its reward only
+	at := blocks[len(blocks)-1].Time().Uint64() + 2*24*60*60
+	clock := newFakeClock(int64(at))
+	engine.SetClock(clock)
+	if _, err := engine.coinAge(blockchain, at); err != nil {
+		t.Fatalf("failed to accumulate coin age: %v", err)
+	}
+	contributions, err := engine.CoinAgeBreakdown(rewardsAddr, 0, uint64(len(blocks)))
+	if err != nil {
+		t.Fatalf("failed to break the coin age down: %v", err)
+	}
+	if len(contributions) != 100 {
+		t.Fatalf("contributions mismatch: have %d, want 100", len(contributions))
+	}
+	sum := new(big.Int)
+	for i, contribution := range contributions {
+		if contribution.Number != uint64(i+1) || contribution.Delta.Sign() <= 0 {
+			t.Errorf("contribution %d mismatch: block %d, delta %v", i, contribution.Number, contribution.Delta)
+		}
+		sum.Add(sum, contribution.Delta)
+	}
+	l, err := engine.loadCoinAgeLog(rewardsAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Age.Cmp(sum) != 0 {
+		t.Errorf("aggregate mismatch: have %v, want %v", l.Age, sum)
+	}
+
+	// the first fifty blocks age past the lifetime
+	clock.set(blocks[49].Time().Int64() + engine.config.CoinAgeLifetime.Int64() + 1)
+	engine.pruneCoinAgeLogs(engine.unixNow())
+
+	remaining, err := engine.CoinAgeBreakdown(rewardsAddr, 0, uint64(len(blocks)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(remaining) != 50 || remaining[0].Number != 51 {
+		t.Fatalf("remaining contributions mismatch: have %d from block %d, want 50 from 51", len(remaining), remaining[0].Number)
+	}
+	sum.SetInt64(0)
+	for _, contribution := range remaining {
+		sum.Add(sum, contribution.Delta)
+	}
+	if l, err = engine.loadCoinAgeLog(rewardsAddr); err != nil {
+		t.Fatal(err)
+	}
+	if l.Age.Cmp(sum) != 0 {
+		t.Errorf("aggregate mismatch after pruning: have %v, want %v", l.Age, sum)
+	}
+	if partial, _ := engine.CoinAgeBreakdown(rewardsAddr, 60, 69); len(partial) != 10 || partial[0].Number != 60 {
+		t.Errorf("breakdown of blocks 60-69 mismatch: %v", partial)
+	}
+	if _, err := engine.CoinAgeBreakdown(rewardsAddr, 2, 1); err != errInvalidBreakdownRange {
+		t.Errorf("inverted range error mismatch: have %v, want %v", err, errInvalidBreakdownRange)
+	}
+	if _, err := engine.CoinAgeBreakdown(testAddr, 0, 1); err != errNoCoinAgeLog {
+		t.Errorf("unlogged signer error mismatch: have %v, want %v", err, errNoCoinAgeLog)
+	}
+}
@@ -0,0 +1,419 @@
+package sprouts
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/applicature/sprouts-plus/accounts"
+	"github.com/applicature/sprouts-plus/consensus"
+	"github.com/applicature/sprouts-plus/core"
+	"github.com/applicature/sprouts-plus/core/types"
+	"github.com/applicature/sprouts-plus/crypto"
+)
+
+// The tests in this file drive the engine purely through the consensus.Engine
+// interface, the way the node's core does, so that any drift from the
+// interface contract breaks them rather than the node at runtime.
+
+var (
+	_ consensus.Engine        = (*PoS)(nil)
+	_ consensus.BodyValidator = (*PoS)(nil)
+	_ consensus.ChainWeigher  = (*PoS)(nil)
+)
+
+// newConformanceChain creates a blockchain with n inserted blocks along with an
+// engine authorized to seal with rewardsKey.
+func newConformanceChain(t *testing.T, n int) (*core.BlockChain, consensus.Engine) {
+	blockchain, blocks, engine := newTestChain(t, n)
+	if _, err := blockchain.InsertChain(blocks); err != nil {
+		blockchain.Stop()
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	engine.Authorize(rewardsAddr, func(account accounts.Account, hash []byte) ([]byte, error) {
+		return crypto.Sign(hash, rewardsKey)
+	})
+	return blockchain, engine
+}
+
+// prepareConformanceBlock runs Prepare and Finalize for a block on top of the
+// current head, replacing the prepared stake with one large enough for a
+// kernel to be found.
+func prepareConformanceBlock(t *testing.T, blockchain *core.BlockChain, engine consensus.Engine) *types.Block {
+	parent := blockchain.CurrentBlock()
+	header := &types.Header{
+		ParentHash: parent.Hash(),
+		Number:     new(big.Int).Add(parent.Number(), big1),
+		GasLimit:   core.CalcGasLimit(parent),
+		GasUsed:    new(big.Int),
+		Time:       new(big.Int),
+	}
+	if err := engine.Prepare(blockchain, header); err != nil {
+		t.Fatalf("failed to prepare header: %v", err)
+	}
+	if header.Coinbase != rewardsAddr {
+		t.Errorf("coinbase mismatch: have %x, want %x", header.Coinbase, rewardsAddr)
+	}
+	stake := &coinAge{Time: header.Time.Uint64(), Age: testStakeAge, Value: big.NewInt(1000)}
+	setTestStake(header, stake)
+
+	statedb, err := blockchain.StateAt(parent.Root())
+	if err != nil {
+		t.Fatal(err)
+	}
+	txs := []*types.Transaction{types.NewTransaction(0, rewardsAddr, new(big.Int), big.NewInt(21000), new(big.Int), nil)}
+	block, err := engine.Finalize(blockchain, header, statedb, txs, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to finalize block: %v", err)
+	}
+	if block.UncleHash() != types.CalcUncleHash(nil) {
+		t.Errorf("uncle hash mismatch: have %x, want %x", block.UncleHash(), types.CalcUncleHash(nil))
+	}
+	return block
+}
+
+// Tests that a block passing through Prepare, Finalize and Seal is accepted by
+// the verification and attributed to the local signer.
+func TestEngineSealHappyPath(t *testing.T) {
+	blockchain, engine := newConformanceChain(t, 4)
+	defer blockchain.Stop()
+
+	block := prepareConformanceBlock(t, blockchain, engine)
+	sealed, err := engine.Seal(blockchain, block, make(chan struct{}))
+	if err != nil {
+		t.Fatalf("failed to seal block: %v", err)
+	}
+	if sealed == nil {
+		t.Fatal("no block sealed")
+	}
+	if signer, err := engine.Author(sealed.Header()); err != nil || signer != rewardsAddr {
+		t.Errorf("author mismatch: have %x (%v), want %x", signer, err, rewardsAddr)
+	}
+	if err := engine.VerifyHeader(blockchain, sealed.Header(), true); err != nil {
+		t.Errorf("sealed header rejected: %v", err)
+	}
+}
+
+// Tests that Seal returns neither a block nor an error once it is stopped.
+func TestEngineSealStop(t *testing.T) {
+	blockchain, engine := newConformanceChain(t, 1)
+	defer blockchain.Stop()
+
+	// Stopped before sealing starts
+	stop := make(chan struct{})
+	close(stop)
+	block := prepareConformanceBlock(t, blockchain, engine)
+	if sealed, err := engine.Seal(blockchain, block, stop); sealed != nil || err != nil {
+		t.Errorf("stopped seal result mismatch: have (%v, %v), want (nil, nil)", sealed, err)
+	}
+	// Stopped while waiting for the block's timestamp
+	header := block.Header()
+	header.Time = big.NewInt(time.Now().Add(time.Hour).Unix())
+
+	stop = make(chan struct{})
+	time.AfterFunc(50*time.Millisecond, func() { close(stop) })
+
+	start := time.Now()
+	if sealed, err := engine.Seal(blockchain, block.WithSeal(header), stop); sealed != nil || err != nil {
+		t.Errorf("aborted seal result mismatch: have (%v, %v), want (nil, nil)", sealed, err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("seal didn't return on stop, took %v", elapsed)
+	}
+}
+
+// Tests that Seal retries later timestamps after missing a kernel until its
+// retry time is up, moving the header on to the timestamp the kernel is found
+// at.
+func TestEngineSealRetry(t *testing.T) {
+	blockchain, engine := newConformanceChain(t, 4)
+	defer blockchain.Stop()
+	pos := engine.(*PoS)
+
+	// a stake just large enough to find a kernel six seconds on
+	block := prepareConformanceBlock(t, blockchain, engine)
+	parent := blockchain.GetHeaderByHash(block.ParentHash())
+	header := block.Header()
+	header.Time = new(big.Int).Add(parent.Time, big.NewInt(113))
+	stake := &coinAge{Time: header.Time.Uint64()}
+	stake.Age, _ = new(big.Int).SetString("40000000000000000000000000000", 10)
+	stake.Value = big.NewInt(1000)
+	setTestStake(header, stake)
+	block = block.WithSeal(header)
+
+	clock := newFakeClock(header.Time.Int64())
+	pos.SetClock(clock)
+	if _, err := engine.Seal(blockchain, block, make(chan struct{})); err != errCantFindKernel {
+		t.Fatalf("error mismatch without retries: have %v, want %v", err, errCantFindKernel)
+	}
+	pos.sealRetry = 5 * time.Second
+	if _, err := engine.Seal(blockchain, block, make(chan struct{})); err != errCantFindKernel {
+		t.Fatalf("error mismatch retrying too briefly: have %v, want %v", err, errCantFindKernel)
+	}
+	pos.sealRetry = time.Minute
+	clock.set(header.Time.Int64())
+	sealed, err := engine.Seal(blockchain, block, make(chan struct{}))
+	if err != nil {
+		t.Fatalf("failed to seal block: %v", err)
+	}
+	if want := header.Time.Uint64() + 6; sealed.Time().Uint64() != want {
+		t.Errorf("timestamp mismatch: have %v, want %v", sealed.Time(), want)
+	}
+	if err := pos.checkKernelHash(parent, sealed.Header(), stake); err != nil {
+		t.Errorf("sealed kernel rejected: %v", err)
+	}
+	if signer, err := engine.Author(sealed.Header()); err != nil || signer != rewardsAddr {
+		t.Errorf("author mismatch: have %x (%v), want %x", signer, err, rewardsAddr)
+	}
+}
+
+// Tests that Seal moves a header prepared a while ago on to the time it is
+// sealed at, and that the block is still accepted.
+func TestEngineSealRestamp(t *testing.T) {
+	blockchain, engine := newConformanceChain(t, 4)
+	defer blockchain.Stop()
+	pos := engine.(*PoS)
+
+	parent := blockchain.CurrentHeader()
+	clock := newFakeClock(parent.Time.Int64() + 10)
+	pos.SetClock(clock)
+	block := prepareConformanceBlock(t, blockchain, engine)
+	if block.Time().Cmp(big.NewInt(parent.Time.Int64()+10)) != 0 {
+		t.Fatalf("prepared timestamp mismatch: have %v, want %d", block.Time(), parent.Time.Int64()+10)
+	}
+	// assembling the transactions took a while
+	clock.set(parent.Time.Int64() + 40)
+
+	sealed, err := engine.Seal(blockchain, block, make(chan struct{}))
+	if err != nil {
+		t.Fatalf("failed to seal block: %v", err)
+	}
+	if want := parent.Time.Uint64() + 40; sealed.Time().Uint64() != want {
+		t.Errorf("timestamp mismatch: have %v, want %d", sealed.Time(), want)
+	}
+	if want := pos.CalcDifficulty(blockchain, sealed.Time().Uint64(), parent); sealed.Difficulty().Cmp(want) != 0 {
+		t.Errorf("difficulty mismatch: have %v, want %v", sealed.Difficulty(), want)
+	}
+	if err := engine.VerifyHeader(blockchain, sealed.Header(), true); err != nil {
+		t.Errorf("sealed header rejected: %v", err)
+	}
+}
+
+// Tests that Seal leaves the block to others within the minimum signer gap.
+func TestEngineSealSignerGap(t *testing.T) {
+	blockchain, engine := newConformanceChain(t, 4)
+	defer blockchain.Stop()
+	engine.(*PoS).config.MinSignerGap = 2
+
+	// the whole chain was sealed by the same signer
+	block := prepareConformanceBlock(t, blockchain, engine)
+	if _, err := engine.Seal(blockchain, block, make(chan struct{})); err != errRecentlySigned {
+		t.Fatalf("error mismatch: have %v, want %v", err, errRecentlySigned)
+	}
+}
+
+// Tests that stakes below the minimum age are neither sealed nor accepted.
+func TestEngineMinStakeAge(t *testing.T) {
+	blockchain, engine := newConformanceChain(t, 1)
+	defer blockchain.Stop()
+
+	block := prepareConformanceBlock(t, blockchain, engine)
+	sealed, err := engine.Seal(blockchain, block, make(chan struct{}))
+	if err != nil {
+		t.Fatalf("failed to seal block: %v", err)
+	}
+	engine.(*PoS).config.MinStakeAge = new(big.Int).Add(testStakeAge, big1)
+
+	if _, err := engine.Seal(blockchain, block, make(chan struct{})); err != errInsufficientStake {
+		t.Errorf("seal error mismatch: have %v, want %v", err, errInsufficientStake)
+	}
+	if err := engine.VerifyHeader(blockchain, sealed.Header(), true); err != errInsufficientStake {
+		t.Errorf("verification error mismatch: have %v, want %v", err, errInsufficientStake)
+	}
+	engine.(*PoS).config.MinStakeAge = testStakeAge
+	if err := engine.VerifyHeader(blockchain, sealed.Header(), true); err != nil {
+		t.Errorf("stake at the minimum rejected: %v", err)
+	}
+}
+
+// Tests that Seal refuses to work without an authorized signer instead of
+// panicking.
+func TestEngineSealUnauthorized(t *testing.T) {
+	blockchain, engine := newConformanceChain(t, 1)
+	defer blockchain.Stop()
+
+	block := prepareConformanceBlock(t, blockchain, engine)
+	engine.(*PoS).Deauthorize()
+
+	if _, err := engine.Seal(blockchain, block, make(chan struct{})); err != errUnauthorized {
+		t.Errorf("error mismatch: have %v, want %v", err, errUnauthorized)
+	}
+}
+
+// Tests that batch verification reports the results in the order of the input
+// and that the documented sentinel errors are returned.
+func TestEngineVerifyHeadersOrder(t *testing.T) {
+	blockchain, blocks, pos := newTestChain(t, 4)
+	defer blockchain.Stop()
+
+	var engine consensus.Engine = pos
+
+	headers := make([]*types.Header, len(blocks))
+	for i, block := range blocks {
+		headers[i] = block.Header()
+	}
+	// Move the third header into the future, orphaning the fourth
+	headers[2].Time = big.NewInt(time.Now().Add(time.Hour).Unix())
+
+	want := []error{nil, nil, consensus.ErrFutureBlock, consensus.ErrUnknownAncestor}
+	seals := []bool{true, true, true, true}
+
+	_, results := engine.VerifyHeaders(blockchain, headers, seals)
+	for i := range headers {
+		select {
+		case err := <-results:
+			if err != want[i] {
+				t.Errorf("header %d: error mismatch: have %v, want %v", i, err, want[i])
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("header %d: verification timed out", i)
+		}
+	}
+	// Single header verification must agree with the batch
+	if err := engine.VerifyHeader(blockchain, headers[2], true); err != consensus.ErrFutureBlock {
+		t.Errorf("future header error mismatch: have %v, want %v", err, consensus.ErrFutureBlock)
+	}
+	if err := engine.VerifyHeader(blockchain, headers[3], true); err != consensus.ErrUnknownAncestor {
+		t.Errorf("orphan header error mismatch: have %v, want %v", err, consensus.ErrUnknownAncestor)
+	}
+}
+
+// Tests that aborting a batch verification stops it, delivering at most an
+// in-order prefix of the results.
+func TestEngineVerifyHeadersAbort(t *testing.T) {
+	blockchain, blocks, pos := newTestChain(t, 16)
+	defer blockchain.Stop()
+
+	var engine consensus.Engine = pos
+
+	headers := make([]*types.Header, len(blocks))
+	seals := make([]bool, len(blocks))
+	for i, block := range blocks {
+		headers[i], seals[i] = block.Header(), true
+	}
+	abort, results := engine.VerifyHeaders(blockchain, headers, seals)
+	close(abort)
+
+	// Closing the engine waits for the verification to exit
+	pos.Close()
+
+	delivered := len(results)
+	if delivered > len(headers) {
+		t.Fatalf("too many results: have %d, want at most %d", delivered, len(headers))
+	}
+	for i := 0; i < delivered; i++ {
+		if err := <-results; err != nil {
+			t.Errorf("header %d: verification failed: %v", i, err)
+		}
+	}
+}
+
+// Tests that aborting a batch verification stops it before the next header
+// rather than after verifying it.
+func TestEngineVerifyHeadersAbortPrompt(t *testing.T) {
+	blockchain, blocks, pos := newTestChain(t, 8)
+	defer blockchain.Stop()
+
+	headers := make([]*types.Header, len(blocks))
+	seals := make([]bool, len(blocks))
+	for i, block := range blocks {
+		headers[i], seals[i] = block.Header(), true
+	}
+	// The verification blocks until all subscribers received the event of the
+	// first header, so abort is closed before it continues.
+	first, second := make(chan VerificationEvent), make(chan VerificationEvent)
+	sub1, sub2 := pos.SubscribeVerificationEvents(first), pos.SubscribeVerificationEvents(second)
+	defer sub1.Unsubscribe()
+	defer sub2.Unsubscribe()
+
+	abort, results := pos.VerifyHeaders(blockchain, headers, seals)
+	<-first
+	close(abort)
+	<-second
+
+	closed := make(chan struct{})
+	go func() {
+		pos.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case ev := <-first:
+		t.Fatalf("header %d verified after abort", ev.Number)
+	case <-time.After(10 * time.Second):
+		t.Fatal("verification didn't exit")
+	}
+	if len(results) > 1 {
+		t.Errorf("too many results: have %d, want at most 1", len(results))
+	}
+}
+
+// Tests that blocks with uncles are rejected.
+func TestEngineVerifyUncles(t *testing.T) {
+	blockchain, blocks, pos := newTestChain(t, 2)
+	defer blockchain.Stop()
+
+	var engine consensus.Engine = pos
+
+	if err := engine.VerifyUncles(blockchain, blocks[1]); err != nil {
+		t.Errorf("block without uncles rejected: %v", err)
+	}
+	uncled := types.NewBlock(blocks[1].Header(), nil, []*types.Header{blocks[0].Header()}, nil)
+	if err := engine.VerifyUncles(blockchain, uncled); err == nil {
+		t.Error("block with uncles accepted")
+	}
+}
+
+// Tests that Author fails on unsigned headers instead of returning a bogus
+// address.
+func TestEngineAuthor(t *testing.T) {
+	pos := newTestEngine(t, &sproutsConfig, nil)
+	var engine consensus.Engine = pos
+
+	header := &types.Header{Number: big1, Extra: make([]byte, extraDefault)}
+	if _, err := engine.Author(header); err != errMissingSignature {
+		t.Errorf("short extra error mismatch: have %v, want %v", err, errMissingSignature)
+	}
+	header.Extra = make([]byte, extraDefault+extraKernel+extraCoinAge+extraSeal)
+	signTestHeader(t, header, testKey)
+	if signer, err := engine.Author(header); err != nil || signer != testAddr {
+		t.Errorf("author mismatch: have %x (%v), want %x", signer, err, testAddr)
+	}
+}
+
+// Tests that Prepare reports unknown parents with the documented sentinel.
+func TestEnginePrepareUnknownAncestor(t *testing.T) {
+	blockchain, engine := newConformanceChain(t, 1)
+	defer blockchain.Stop()
+
+	header := &types.Header{Number: big.NewInt(10), Time: new(big.Int)}
+	if err := engine.Prepare(blockchain, header); err != consensus.ErrUnknownAncestor {
+		t.Errorf("error mismatch: have %v, want %v", err, consensus.ErrUnknownAncestor)
+	}
+}
+
+// Tests that the engine provides its APIs even without a chain.
+func TestEngineAPIs(t *testing.T) {
+	pos := newTestEngine(t, &sproutsConfig, nil)
+	var engine consensus.Engine = pos
+
+	apis := engine.APIs(nil)
+	if len(apis) == 0 {
+		t.Fatal("no APIs provided")
+	}
+	for i, api := range apis {
+		if api.Namespace == "" || api.Service == nil {
+			t.Errorf("api %d: incomplete: %+v", i, api)
+		}
+	}
+}
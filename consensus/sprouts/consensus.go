@@ -1,14 +1,15 @@
 package sprouts
 
 import (
-	"bytes"
 	"errors"
+	"fmt"
 	"math/big"
 	"sync"
 	"time"
 
 	"github.com/applicature/sprouts-plus/accounts"
 	"github.com/applicature/sprouts-plus/common"
+	"github.com/applicature/sprouts-plus/common/hexutil"
 	"github.com/applicature/sprouts-plus/consensus"
 	"github.com/applicature/sprouts-plus/consensus/misc"
 	"github.com/applicature/sprouts-plus/core"
@@ -16,6 +17,7 @@ import (
 	"github.com/applicature/sprouts-plus/core/types"
 	"github.com/applicature/sprouts-plus/crypto/sha3"
 	"github.com/applicature/sprouts-plus/ethdb"
+	"github.com/applicature/sprouts-plus/log"
 	"github.com/applicature/sprouts-plus/params"
 	"github.com/applicature/sprouts-plus/rpc"
 	lru "github.com/hashicorp/golang-lru"
@@ -23,6 +25,7 @@ import (
 
 const (
 	inMemorySignatures = 4096                // Number of recent block signatures to keep in memory
+	inMemoryExtras     = 4096                // Number of recent decoded stakes and kernels to keep in memory
 	coinValue          = 1000000000000000000 // 1 coin is 10^18 of cents (weis) same as 1 ether
 )
 
@@ -36,8 +39,17 @@ var (
 	extraKernel  = 32 + 32 // Fixed number of extra-data bytes reserved for kernel, hash and timestamp
 	extraCoinAge = 52      // Fixed number of extra-data bytes reserved for the stake
 	extraSeal    = 65      // Fixed number of extra-data bytes reserved for signer seal
+
+	// extraMax is the length of the longest extra-data accepted, whose vanity
+	// fills the reserved bytes at most
+	extraMax = extraDefault + extraKernel + extraCoinAge + extraSeal
 )
 
+// MaxVanityLength is the length of the longest vanity kept in the reserved
+// extra-data bytes of the blocks sealed, the last reserved byte holds the
+// layout version. Miners' longer vanities are truncated.
+const MaxVanityLength = 31
+
 // errors
 var (
 	errUnknownBlock = errors.New("unknown block")
@@ -46,56 +58,293 @@ var (
 	// to contain a 65 byte secp256k1 signature.
 	errMissingSignature = errors.New("extra-data 65 byte suffix signature missing")
 
+	// errExtraTooLong is returned if the extra-data holds more than the
+	// reserved bytes before its consensus regions.
+	errExtraTooLong = errors.New("extra-data too long")
+
 	errUnclesAreInvalid = errors.New("uncles are invalid")
 
+	// errUnclesNotAllowed is returned if a block body carries uncles.
+	errUnclesNotAllowed = errors.New("uncles not allowed")
+
+	// errTxHashMismatch is returned if the transactions of a block body don't
+	// hash to the transaction root of its header.
+	errTxHashMismatch = errors.New("transactions don't match header")
+
 	errInvalidSignature = errors.New("invalid signature")
 
 	// errInvalidTimestamp is returned if the timestamp of a block is lower than
 	// the previous block's timestamp + the minimum block period.
 	errInvalidTimestamp = errors.New("invalid timestamp")
 
+	// errInvalidGasLimit is returned if a block or its parent lacks a gas
+	// limit, limits out of bounds are reported by a gasLimitError.
+	errInvalidGasLimit = errors.New("missing gas limit")
+
 	errCantFindKernel = errors.New("no kernel found")
 
 	errWrongKernel = errors.New("kernel check failed")
 
 	errWaitTransactions = errors.New("waiting for transactions")
 
+	// errUnauthorized is returned if a block is to be sealed without a signer
+	// authorized to do so.
+	errUnauthorized = errors.New("unauthorized")
+
 	errDuplicateStake = errors.New("received duplicate stake")
 
+	// errRecentlySigned is returned if the coinbase of a block sealed one of
+	// the MinSignerGap blocks before it.
+	errRecentlySigned = errors.New("signer sealed too recently")
+
 	errInvalidStake = errors.New("stake has invalid encoding")
+
+	// errInsufficientStake is returned if the age of a stake is below the
+	// configured minimum.
+	errInsufficientStake = errors.New("stake age below the minimum")
+
+	// errStakeTooLarge is returned if the stake claimed by a block exceeds what
+	// its minter could have held according to the parent state.
+	errStakeTooLarge = errors.New("stake exceeds the minter's balance")
+
+	// errInconsistentStake is returned if the value of a stake can't have
+	// accrued its age, like a value claimed without any age.
+	errInconsistentStake = errors.New("stake value inconsistent with its age")
+
+	// errCoinAgeNotReady is returned if the coin age can't be computed because
+	// block bodies within the coin age lifetime are missing.
+	errCoinAgeNotReady = errors.New("coin age not ready, block bodies missing")
+
+	// errReceiptsMismatch is returned if the number of receipts doesn't match
+	// the number of transactions of a block.
+	errReceiptsMismatch = errors.New("receipts don't match transactions")
+
+	// errGasUsedMismatch is returned if the gas used by the receipts differs
+	// from the gas used declared in the header.
+	errGasUsedMismatch = errors.New("receipts gas used doesn't match header")
 )
 
 type PoS struct {
-	config        *params.SproutsConfig
-	db            ethdb.Database
-	signatures    *lru.ARCCache
-	signer        common.Address
-	signerFn      func(account accounts.Account, hash []byte) ([]byte, error)
-	stakeModifier *big.Int
-	lock          sync.RWMutex
+	config             *params.SproutsConfig
+	db                 ethdb.Database
+	signatures         *lru.ARCCache
+	extras             *lru.ARCCache // Decoded stakes and kernels of recent headers
+	migrations         *lru.ARCCache // Key migration senders of the ancestry of recent blocks
+	recents            *lru.ARCCache // Coinbases of the blocks up to recent headers, see recentSigners
+	weights            *lru.ARCCache // Cumulative chain weights up to recent headers, see ChainWeight
+	minted             *lru.ARCCache // Rewards paid by the blocks being minted, by parent hash
+	signers            []localSigner // Accounts to mint with, the primary signer first
+	stakeModifier      *big.Int
+	genesis            *core.Genesis       // Genesis of the network, defaults are derived from the chain id if nil
+	rejections         *rejectionStats     // Peer-fault rejections of headers per source
+	lastSnapshot       time.Time           // Time the caches were last persisted
+	life               *lifecycle          // Owner of the background goroutines
+	verifications      *verificationEvents // Feed of the header verification outcomes
+	checkpointInterval uint64              // Blocks between two coin age checkpoints, none are written if 0
+	budget             time.Duration       // Time the coin age of a sealed block may take, see Options
+	epochLength        uint64              // Blocks summarized by an epoch summary, none are kept if 0
+	sealRetry          time.Duration       // Time sealing retries later timestamps after missing a kernel, see Options
+	lightClient        bool                // Whether headers are verified without bodies and records, see Options
+	clock              Clock               // Source of the current time, see SetClock
+	epochLock          sync.Mutex          // Serializes the updates of the epoch summaries
+	limiter            *costLimiter        // Limiter of the expensive API calls
+	writesClosed       bool                // Whether records are no longer written, set by Close
+	fakeMode           bool                // Flag whether to skip the kernel, stake and signature checks
+	fakeFail           uint64              // Block number which fails the checks even in fake mode
+	writeLock          sync.Mutex          // Serializes the writes of the records
+	stakes             stakeIndex          // Known stakes, see indexStake
+	lock               sync.RWMutex
+}
+
+// Options are the optional settings of the engine.
+type Options struct {
+	// RecordsKey is the AES key (16, 24 or 32 bytes) the engine's own records
+	// are encrypted with at rest. The records are stored in plaintext if empty.
+	RecordsKey []byte
+
+	// VerificationEventSampling limits the posted verification events to one
+	// in that many accepted headers, rejections are always posted. Every
+	// accepted header is posted if 0.
+	VerificationEventSampling uint64
+
+	// CoinAgeCheckpointInterval is the number of blocks between two coin age
+	// checkpoints, which spare walking the block bodies before them. No
+	// checkpoints are written if 0.
+	CoinAgeCheckpointInterval uint64
+
+	// RPCBudget limits the cost of the expensive API calls, which walk many
+	// blocks. The calls aren't limited if its rate is 0.
+	RPCBudget RPCBudget
+
+	// PrepareBudget is the time the coin age computation of a block being
+	// prepared may take. Past it, the stake is approximated from the latest
+	// coin age checkpoint. Until the signer has one, the computation isn't
+	// bounded, so that it can record the first one. Defaults to half the block
+	// period if 0.
+	PrepareBudget time.Duration
+
+	// EpochLength is the number of blocks summarized by a single epoch
+	// summary, see StartEpochSummaries. No summaries are kept if 0.
+	EpochLength uint64
+
+	// SealRetry is the time Seal keeps waiting for later timestamps to find a
+	// kernel at once it missed one, every second adding a timestamp with more
+	// time weight. Seal fails right away if 0.
+	SealRetry time.Duration
+
+	// LightClient makes the engine verify headers the way a light client has
+	// to, without block bodies, states and the known stakes: duplicate stakes
+	// and stake balances are left out. Full nodes must leave it unset, their
+	// header chains are verified in full even when fast syncing.
+	LightClient bool
+}
+
+// DefaultSealRetry is the suggested time sealing retries to find a kernel.
+const DefaultSealRetry = time.Minute
+
+// New creates the engine with the signers set to the ones provided by the
+// user. An error is returned if the configuration is invalid.
+func New(config *params.SproutsConfig, db ethdb.Database) (*PoS, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return newEngine(config, db, nil, Options{}), nil
+}
+
+// NewWithOptions validates the configuration and creates the engine like New
+// does, applying the given options. If a records key is set, plaintext records
+// are encrypted with it in place. ErrRecordsKey is returned if the records are
+// encrypted with another key, or with one while none has been set.
+func NewWithOptions(config *params.SproutsConfig, db ethdb.Database, opts Options) (*PoS, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	if len(opts.RecordsKey) == 0 || db == nil {
+		if db != nil {
+			if encrypted, err := recordsEncrypted(db); err != nil {
+				return nil, err
+			} else if encrypted {
+				return nil, ErrRecordsKey
+			}
+		}
+		return newEngine(config, db, nil, opts), nil
+	}
+	c, err := newRecordsCipher(opts.RecordsKey)
+	if err != nil {
+		return nil, err
+	}
+	if err := migrateRecords(db, c); err != nil {
+		return nil, err
+	}
+	return newEngine(config, db, c, opts), nil
+}
+
+// NewFaker creates an engine for tests which accepts any kernel and stake and
+// seals without searching a kernel. The headers are still checked for their
+// layout and linkage, and blocks are finalized and their coin age recorded
+// like the real engine does.
+func NewFaker(config *params.SproutsConfig, db ethdb.Database) (*PoS, error) {
+	engine, err := New(config, db)
+	if err != nil {
+		return nil, err
+	}
+	engine.fakeMode = true
+	return engine, nil
 }
 
-// signers set to the ones provided by the user.
-func New(config *params.SproutsConfig, db ethdb.Database) *PoS {
+// NewFakeFailer creates an engine like NewFaker, except that the block with
+// the given number fails the kernel check.
+func NewFakeFailer(config *params.SproutsConfig, db ethdb.Database, fail uint64) (*PoS, error) {
+	engine, err := NewFaker(config, db)
+	if err != nil {
+		return nil, err
+	}
+	engine.fakeFail = fail
+	return engine, nil
+}
+
+// newEngine creates the engine storing its records in db with the given
+// cipher, in plaintext if it is nil.
+func newEngine(config *params.SproutsConfig, db ethdb.Database, c *recordsCipher, opts Options) *PoS {
 	signatures, _ := lru.NewARC(inMemorySignatures)
+	extras, _ := lru.NewARC(inMemoryExtras)
+	migrations, _ := lru.NewARC(inMemoryMigrations)
+	recents, _ := lru.NewARC(inMemoryRecents)
+	weights, _ := lru.NewARC(inMemoryWeights)
+	minted, _ := lru.NewARC(inMemoryMinted)
+	if db != nil {
+		db = &recordsDatabase{Database: db, cipher: c}
+	}
 	conf := *config
-	return &PoS{
-		config:        &conf,
-		db:            db,
-		signatures:    signatures,
-		stakeModifier: new(big.Int).SetInt64(0),
-		lock:          sync.RWMutex{},
+	engine := &PoS{
+		config:             &conf,
+		db:                 db,
+		signatures:         signatures,
+		extras:             extras,
+		migrations:         migrations,
+		recents:            recents,
+		weights:            weights,
+		minted:             minted,
+		stakeModifier:      new(big.Int).SetInt64(0),
+		rejections:         newRejectionStats(),
+		lastSnapshot:       time.Now(),
+		life:               newLifecycle(),
+		verifications:      &verificationEvents{sampling: opts.VerificationEventSampling},
+		checkpointInterval: opts.CoinAgeCheckpointInterval,
+		limiter:            newCostLimiter(opts.RPCBudget),
+		budget:             opts.PrepareBudget,
+		epochLength:        opts.EpochLength,
+		sealRetry:          opts.SealRetry,
+		lightClient:        opts.LightClient,
+		clock:              systemClock{},
+		lock:               sync.RWMutex{},
 	}
+	if db != nil {
+		if err := engine.loadCacheSnapshot(); err != nil {
+			log.Debug("Discarded cache snapshot", "err", err)
+		}
+	}
+	return engine
 }
 
 // Authorize injects a private key into the consensus engine to mint new blocks
-// with.
+// with, replacing any signers authorized before. It becomes the primary
+// signer, see AddSigner for more.
 func (engine *PoS) Authorize(signer common.Address, signFn func(account accounts.Account, hash []byte) ([]byte, error)) {
 	engine.lock.Lock()
 	defer engine.lock.Unlock()
 
-	engine.signer = signer
-	engine.signerFn = signFn
+	engine.signers = []localSigner{{address: signer, signFn: signFn}}
+	engine.life.bump()
+}
+
+// Deauthorize removes all signers from the consensus engine, stopping any
+// minting work done on their behalf.
+func (engine *PoS) Deauthorize() {
+	engine.lock.Lock()
+	defer engine.lock.Unlock()
+
+	engine.signers = nil
+	engine.life.bump()
+}
+
+// Close terminates all background goroutines of the engine, waiting for them
+// to finish, and flushes the pending writes of its records. Nothing is written
+// afterwards, so the database can be closed. It is safe to call it multiple
+// times.
+func (engine *PoS) Close() error {
+	// end the subscriptions first, so no verification waits for a subscriber
+	engine.verifications.close()
+	engine.life.close()
+
+	// stakes verified one by one may still be pending
+	if err := engine.saveStakes(); err != nil {
+		log.Warn("Failed to write the known stakes", "err", err)
+	}
+	engine.writeLock.Lock()
+	engine.writesClosed = true
+	engine.writeLock.Unlock()
+	return nil
 }
 
 // Author retrieves the Ethereum address of the account that minted the given
@@ -109,7 +358,14 @@ func (engine *PoS) Author(header *types.Header) (common.Address, error) {
 // given engine. Verifying the seal may be done optionally here, or explicitly
 // via the VerifySeal method.
 func (engine *PoS) VerifyHeader(chain consensus.ChainReader, header *types.Header, seal bool) error {
-	return engine.verifyHeader(chain, header, nil)
+	start := time.Now()
+	err := engine.verifyHeader(chain, header, nil, seal, false)
+
+	source := sourceOf(chain)
+	engine.rejections.record(source, err)
+	engine.verifications.post(header, source, err, time.Since(start))
+	markVerification(err)
+	return err
 }
 
 // VerifyHeaders is similar to VerifyHeader, but verifies a batch of headers
@@ -121,17 +377,55 @@ func (engine *PoS) VerifyHeaders(chain consensus.ChainReader, headers []*types.H
 	abort := make(chan struct{})
 	results := make(chan error, len(headers))
 
-	go func() {
+	source := sourceOf(chain)
+	light := engine.lightClient
+	spawned := engine.life.spawn(func(quit <-chan struct{}, generation uint64) {
+		// the stakes of the batch are written once at its end
+		verified := 0
+		defer func() {
+			if verified > 0 && !light {
+				engine.saveStakes()
+			}
+			engine.maybeSaveCacheSnapshot()
+		}()
+
 		for i, header := range headers {
-			err := engine.verifyHeader(chain, header, headers[:i])
+			// stop before the next header rather than only when delivering
+			select {
+			case <-abort:
+				return
+			case <-quit:
+				return
+			default:
+			}
+			start := time.Now()
+			var err error
+			if light {
+				err = engine.verifyHeaderLight(chain, header, headers[:i], seals[i])
+			} else {
+				err = engine.verifyHeader(chain, header, headers[:i], seals[i], true)
+			}
+			engine.rejections.record(source, err)
+			engine.verifications.post(header, source, err, time.Since(start))
+			markVerification(err)
+			if err == nil {
+				verified++
+			}
 
 			select {
 			case <-abort:
 				return
+			case <-quit:
+				return
 			case results <- err:
 			}
 		}
-	}()
+	})
+	if !spawned {
+		for range headers {
+			results <- errEngineClosed
+		}
+	}
 	return abort, results
 }
 
@@ -139,57 +433,130 @@ func (engine *PoS) VerifyHeaders(chain consensus.ChainReader, headers []*types.H
 // rules of a given engine.
 func (engine *PoS) VerifyUncles(chain consensus.ChainReader, block *types.Block) error {
 	if len(block.Uncles()) > 0 {
-		return errors.New("uncles not allowed")
+		return errUnclesNotAllowed
+	}
+	return nil
+}
+
+// ValidateBody checks that the body of the block matches its header: there
+// must be no uncles and the transactions must hash to the transaction root.
+func (engine *PoS) ValidateBody(block *types.Block) error {
+	if len(block.Uncles()) > 0 {
+		return errUnclesNotAllowed
+	}
+	if types.DeriveSha(block.Transactions()) != block.TxHash() {
+		return errTxHashMismatch
 	}
 	return nil
 }
 
 // VerifySeal checks whether the crypto seal on a header is valid according to
-// the consensus rules of the given engine.
+// the consensus rules of the given engine. A valid stake is added to the known
+// stakes right away, the header is rejected if they can't be loaded.
 func (engine *PoS) VerifySeal(chain consensus.ChainReader, header *types.Header) error {
+	if engine.fakeMode {
+		return engine.fakeVerify(header)
+	}
+	if engine.db == nil {
+		// without records only the stake itself can be checked
+		empty := make(mappedStakes)
+		return engine.verifyStake(header, &empty)
+	}
+	// check for stake duplicates and add the stake under the same lock, so
+	// concurrent verifications of the same stake can't both pass
+	return engine.indexStake(header, false)
+}
+
+// fakeVerify stands in for the kernel and stake checks in fake mode, failing
+// only the configured block.
+func (engine *PoS) fakeVerify(header *types.Header) error {
+	if engine.fakeFail != 0 && engine.fakeFail == header.Number.Uint64() {
+		return errWrongKernel
+	}
+	return nil
+}
+
+// verifyStake checks the stake of the header against the known stakes and
+// adds it to them on success. The stakes are only updated in memory, so a
+// batch of headers can be checked against a single copy.
+func (engine *PoS) verifyStake(header *types.Header, stakeMap *mappedStakes) error {
 	// Verifying the genesis block is not supported
 	number := header.Number.Uint64()
 	if number == 0 {
 		return errUnknownBlock
 	}
-	stake, err := extractStake(header)
+	stake, kernel, err := engine.stakeAndKernel(header)
 	if err != nil {
 		return err
 	}
-
-	// check for stake duplicates
-	stakeMap, err := engine.getMappedStakes()
-	if err != nil {
-		return nil
+	if err := checkStakeConsistency(engine.config, stake); err != nil {
+		return err
 	}
-	if ok := stakeMap.isDuplicate(stake, extractKernel(header)); ok {
+	if ok := stakeMap.isDuplicate(header.Hash(), stake, kernel); ok {
+		duplicateCounter.Inc(1)
 		return errDuplicateStake
 	}
+	stakeMap.add(header, stake, kernel)
 
-	// update stored stakes
-	engine.addStake(header, stake)
+	return nil
+}
 
+// VerifyStakeBalance checks the stake claimed by the header against the
+// balance of its coinbase in the parent state. The value of the stake can't
+// exceed the balance and its age can't exceed the age the balance backs, see
+// maxStakeAge.
+func (engine *PoS) VerifyStakeBalance(chain consensus.ChainReader, header *types.Header, parent *state.StateDB) error {
+	if header.Number.Sign() == 0 {
+		return nil
+	}
+	stake, err := engine.headerStake(header)
+	if err != nil {
+		return err
+	}
+	balance := parent.GetBalance(header.Coinbase)
+	if stake.Value.Cmp(balance) > 0 {
+		return errStakeTooLarge
+	}
+	if engine.config.CoinAgeLifetime == nil {
+		return nil
+	}
+	premine := engine.premineCoinAgeOf(chain, stake.Time, header.Coinbase)
+	if stake.Age.Cmp(maxStakeAge(engine.config, balance, premine)) > 0 {
+		return errStakeTooLarge
+	}
 	return nil
 }
 
+// maxStakeAge returns the most coin age in coin-days the balance can back: the
+// age it accrues when received from the distribution account for the whole
+// coin age lifetime, plus the age of the premine in coin-seconds, which is
+// counted whatever the balance.
+func maxStakeAge(config *params.SproutsConfig, balance, premine *big.Int) *big.Int {
+	maxAge := new(big.Int).Mul(balance, config.CoinAgeLifetime)
+	maxAge.Mul(maxAge, big.NewInt(distributionAgeFactor))
+	maxAge.Add(maxAge, premine)
+
+	numerator, denominator := coinDayRatio(config)
+	maxAge.Mul(maxAge, numerator)
+	return maxAge.Div(maxAge, denominator)
+}
+
 // Prepare initializes the consensus fields of a block header according to the
 // rules of a particular engine. The changes are executed inline.
 func (engine *PoS) Prepare(chain consensus.ChainReader, header *types.Header) error {
-	header.Coinbase.Set(engine.signer)
 	header.Nonce = types.BlockNonce{}
 
-	header.Difficulty = computeDifficulty(chain, header.Number.Uint64())
-
-	if header.Time.Int64() < time.Now().Unix() {
-		header.Time = big.NewInt(time.Now().Unix())
+	if now := engine.clock.Now().Unix(); header.Time.Int64() < now {
+		header.Time = big.NewInt(now)
 	}
 
 	header.MixDigest = common.Hash{}
 
-	if len(header.Extra) < extraDefault+extraSeal+extraKernel+extraCoinAge {
-		header.Extra = append(header.Extra, bytes.Repeat([]byte{0x00}, extraDefault+extraSeal+extraKernel+extraCoinAge-len(header.Extra))...)
+	// the extra-data given is the vanity, the consensus regions follow it
+	if len(header.Extra) > MaxVanityLength && len(header.Extra) <= extraDefault {
+		log.Warn("Truncating the vanity of the block", "vanity", hexutil.Bytes(header.Extra), "limit", MaxVanityLength)
 	}
-	header.Extra = header.Extra[:extraDefault+extraSeal+extraKernel+extraCoinAge]
+	extra := newHeaderExtra(header.Extra)
 
 	number := header.Number.Uint64()
 
@@ -198,13 +565,23 @@ func (engine *PoS) Prepare(chain consensus.ChainReader, header *types.Header) er
 	if parent == nil {
 		return consensus.ErrUnknownAncestor
 	}
+	header.Difficulty = engine.CalcDifficulty(chain, header.Time.Uint64(), parent)
+	difficultyGauge.Update(gaugeValue(header.Difficulty))
 	header.Time = new(big.Int).Add(parent.Time, new(big.Int).SetUint64(engine.config.BlockPeriod))
-	if header.Time.Int64() < time.Now().Unix() {
-		header.Time = big.NewInt(time.Now().Unix())
+	if now := engine.clock.Now().Unix(); header.Time.Int64() < now {
+		header.Time = big.NewInt(now)
 	}
 
-	coinAge := engine.coinAge(chain)
-	copy(header.Extra[len(header.Extra)-extraSeal-extraCoinAge:len(header.Extra)-extraSeal], coinAge.bytes())
+	// the local signer with the most coin age mints the block
+	signer, coinAge, err := engine.bestSigner(chain, header, parent)
+	if err != nil {
+		return err
+	}
+	header.Coinbase = signer
+	if extra.Stake, err = coinAge.encode(); err != nil {
+		return err
+	}
+	header.Extra = extra.encode()
 
 	return nil
 }
@@ -215,20 +592,67 @@ func (engine *PoS) Prepare(chain consensus.ChainReader, header *types.Header) er
 // consensus rules that happen at finalization (e.g. block rewards).
 func (engine *PoS) Finalize(chain consensus.ChainReader, header *types.Header, state *state.StateDB, txs []*types.Transaction,
 	uncles []*types.Header, receipts []*types.Receipt) (*types.Block, error) {
+	paid := engine.finalize(chain, header, state)
+	markRewards(paid)
+
+	// blocks being minted are recorded once sealed, their hash isn't final yet
+	if hasSeal(header) {
+		engine.recordBlockReward(header, paid)
+	} else {
+		engine.minted.Add(header.ParentHash, paid)
+	}
+
+	// only the local signers' coin ages are tracked, so stakes minted by
+	// others leave them untouched
+	if engine.isItMe(header.Coinbase) {
+		if stake, err := engine.headerStake(header); err == nil {
+			engine.persist(func() error {
+				reduceCoinAge(engine.db, header, stake.Age, engine.unixNow())
+				return nil
+			})
+		}
+	}
+	// contributions aged past the lifetime are dropped as time goes by
+	engine.pruneCoinAgeLogs(engine.unixNow())
+
+	return types.NewBlock(header, txs, nil, receipts), nil
+}
+
+// finalize runs the finalization pipeline shared by Finalize and FinalizeDryRun
+// and returns the rewards it paid.
+func (engine *PoS) finalize(chain consensus.ChainReader, header *types.Header, state *state.StateDB) RewardSplit {
 	// no uncles
 	header.UncleHash = types.CalcUncleHash(nil)
 
-	accumulateRewards(engine.config, header, state)
-
-	header.Root = state.IntermediateRoot(chain.Config().IsEIP158(header.Number))
+	return finalizeState(engine.config, chain.Config(), header, state)
+}
 
-	reduceCoinAge(state, engine.db, header, nil)
+// FinalizeDryRun runs the finalization of a block against a copy of the state
+// and reports the resulting state root together with the rewards the block
+// would pay. Neither the passed header and state nor the engine's database
+// are modified.
+func (engine *PoS) FinalizeDryRun(chain consensus.ChainReader, header *types.Header, state *state.StateDB, txs []*types.Transaction,
+	receipts []*types.Receipt) (common.Hash, RewardSplit, error) {
+	if len(txs) != len(receipts) {
+		return common.Hash{}, RewardSplit{}, errReceiptsMismatch
+	}
+	gasUsed := new(big.Int)
+	if len(receipts) > 0 {
+		gasUsed = receipts[len(receipts)-1].CumulativeGasUsed
+	}
+	if header.GasUsed != nil && gasUsed.Cmp(header.GasUsed) != 0 {
+		return common.Hash{}, RewardSplit{}, errGasUsedMismatch
+	}
+	header = types.CopyHeader(header)
+	paid := engine.finalize(chain, header, state.Copy())
 
-	return types.NewBlock(header, txs, nil, receipts), nil
+	return header.Root, paid, nil
 }
 
 // Seal generates a new block for the given input block with the local miner's
-// seal place on top.
+// seal place on top. If no kernel is found, later timestamps are tried once a
+// second until the configured retry time is up. If sealing is aborted via stop,
+// neither a block nor an error is returned.
 func (engine *PoS) Seal(chain consensus.ChainReader, block *types.Block, stop <-chan struct{}) (*types.Block, error) {
 	header := block.Header()
 
@@ -243,9 +667,46 @@ func (engine *PoS) Seal(chain consensus.ChainReader, block *types.Block, stop <-
 		return nil, errWaitTransactions
 	}
 
-	// As Seal method is alwayd called after Prepare, extractStake here
-	// can be guaranteed to work here
-	stake, _ := extractStake(header)
+	// the block is signed by the local signer Prepare picked as its coinbase
+	signer, _ := engine.signerOf(header.Coinbase)
+	signerFn := signer.signFn
+
+	extra, err := decodeHeaderExtra(header.Extra)
+	if err != nil {
+		return nil, err
+	}
+	if engine.fakeMode {
+		// no kernel and no waiting, the seal is only added if authorized
+		if signerFn != nil {
+			signature, err := signerFn(accounts.Account{Address: signer.address}, sigHash(header).Bytes())
+			if err != nil {
+				return nil, err
+			}
+			extra.Seal = signature
+			header.Extra = extra.encode()
+		}
+		sealedCounter.Inc(1)
+		return block.WithSeal(header), nil
+	}
+	if signerFn == nil {
+		return nil, errUnauthorized
+	}
+	// Bail out if sealing was aborted before it even started
+	select {
+	case <-stop:
+		return nil, nil
+	default:
+	}
+
+	// As Seal method is always called after Prepare, the stake is expected
+	// to be in place
+	stake, err := parseStake(extra.Stake)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkMinStakeAge(engine.config, stake); err != nil {
+		return nil, err
+	}
 	age := stake.Age
 	// block coin age minimum 1 coin-day
 	if age.Cmp(big0) == 0 {
@@ -253,37 +714,114 @@ func (engine *PoS) Seal(chain consensus.ChainReader, block *types.Block, stop <-
 	}
 
 	// Try to find kernel
-	hash, timestamp, err := engine.computeKernel(chain.GetHeaderByNumber(header.Number.Uint64()-1), age, block.Header())
+	parent := chain.GetHeader(header.ParentHash, number-1)
+	if parent == nil {
+		return nil, consensus.ErrUnknownAncestor
+	}
+	// assembling the transactions may have taken a while since Prepare, the
+	// timestamp, difficulty and stake are covered by the seal, so they are
+	// finalized before the kernel is searched for
+	engine.restamp(chain, header, parent)
+	if err := checkStakeTime(engine.config, header, stake); err != nil {
+		return nil, err
+	}
+	if extra.Stake, err = stake.encode(); err != nil {
+		return nil, err
+	}
+	// leave the block to others if we sealed one too recently
+	if err := engine.checkSignerGap(chain, header, parent, nil); err != nil {
+		return nil, err
+	}
+	deadline := engine.clock.Now().Add(engine.sealRetry)
+	hash, timestamp, err := engine.computeKernel(parent, age, header)
+	for err == errCantFindKernel && engine.clock.Now().Before(deadline) {
+		// every second adds a timestamp with more time weight, the header is
+		// moved on to it like Prepare would
+		next := new(big.Int).Add(header.Time, big1)
+		select {
+		case <-stop:
+			return nil, nil
+		case <-engine.clock.After(time.Unix(next.Int64(), 0).Sub(engine.clock.Now())):
+		}
+		if now := engine.clock.Now().Unix(); next.Int64() < now {
+			next.SetInt64(now)
+		}
+		header.Time = next
+		header.Difficulty = engine.CalcDifficulty(chain, next.Uint64(), parent)
+		hash, timestamp, err = engine.computeKernel(parent, age, header)
+	}
 	if err != nil {
 		return nil, err
 	}
 
 	h := sha3.NewShake256()
 	h.Write(timestamp.Bytes())
-	hashedTimestamp := make([]byte, 32)
-	h.Read(hashedTimestamp)
-
-	copy(header.Extra[len(header.Extra)-extraSeal-extraCoinAge-extraKernel:len(header.Extra)-extraSeal-extraCoinAge-extraKernel/2], hash.Bytes())
-	copy(header.Extra[len(header.Extra)-extraSeal-extraCoinAge-extraKernel/2:len(header.Extra)-extraSeal-extraCoinAge], hashedTimestamp)
-
-	engine.lock.RLock()
-	signer, signerFn := engine.signer, engine.signerFn
-	engine.lock.RUnlock()
+	extra.HashedTimestamp = make([]byte, extraKernel/2)
+	h.Read(extra.HashedTimestamp)
+
+	extra.Kernel = hash.Bytes()
+	header.Extra = extra.encode()
+
+	// Wait until the block's timestamp is reached, so it is never ahead of the
+	// local clock and peers with slower clocks accept it within their allowance
+	delay := time.Unix(header.Time.Int64(), 0).Sub(engine.clock.Now())
+	select {
+	case <-stop:
+		return nil, nil
+	case <-engine.clock.After(delay):
+	}
 
-	signature, err := signerFn(accounts.Account{Address: signer}, sigHash(header).Bytes())
+	signature, err := signerFn(accounts.Account{Address: signer.address}, sigHash(header).Bytes())
 	if err != nil {
 		return nil, err
 	}
-	copy(header.Extra[len(header.Extra)-extraSeal:], signature)
+	extra.Seal = signature
+	header.Extra = extra.encode()
+	sealedCounter.Inc(1)
+	engine.recordMintedReward(header)
 	return block.WithSeal(header), nil
 }
 
+// restamp moves the timestamp of a prepared header on to the current time if
+// it fell behind, keeping it at least the block period after its parent and
+// at most the allowed clock drift ahead of now unless the parent is already
+// further ahead. The difficulty is recomputed for the final timestamp.
+func (engine *PoS) restamp(chain consensus.ChainReader, header, parent *types.Header) {
+	now := engine.unixNow()
+	stamp := header.Time.Uint64()
+	if stamp < now {
+		stamp = now
+	}
+	if latest := now + engine.config.FutureBlockTime(); stamp > latest {
+		stamp = latest
+	}
+	if earliest := parent.Time.Uint64() + engine.config.BlockPeriod; stamp < earliest {
+		stamp = earliest
+	}
+	header.Time = new(big.Int).SetUint64(stamp)
+	header.Difficulty = engine.CalcDifficulty(chain, stamp, parent)
+}
+
 // APIs returns the RPC APIs this consensus engine provides.
 func (engine *PoS) APIs(chain consensus.ChainReader) []rpc.API {
-	return nil
+	return []rpc.API{{
+		Namespace: "sprouts",
+		Version:   "1.0",
+		Service:   &API{chain: chain, sprouts: engine},
+		Public:    false,
+	}, {
+		Namespace: "admin",
+		Version:   "1.0",
+		Service:   &AdminAPI{sprouts: engine},
+		Public:    false,
+	}}
 }
 
-func (engine *PoS) verifyHeader(chain consensus.ChainReader, header *types.Header, parents []*types.Header) error {
+// verifyHeader checks the header against its parent, which is either the last
+// of the given parents or looked up in the chain. The kernel and the stake are
+// only checked if seal is set. Stakes verified as part of a batch are written
+// once at its end rather than as they are added.
+func (engine *PoS) verifyHeader(chain consensus.ChainReader, header *types.Header, parents []*types.Header, seal bool, batch bool) error {
 	// who is this?
 	if header.Number == nil {
 		return consensus.ErrInvalidNumber
@@ -295,8 +833,8 @@ func (engine *PoS) verifyHeader(chain consensus.ChainReader, header *types.Heade
 		return nil
 	}
 
-	// no future blocks
-	if header.Time.Cmp(big.NewInt(time.Now().Unix())) > 0 {
+	// no future blocks beyond the clock drift allowance, they are queued
+	if header.Time.Cmp(new(big.Int).SetUint64(engine.unixNow()+engine.config.FutureBlockTime())) > 0 {
 		return consensus.ErrFutureBlock
 	}
 
@@ -305,8 +843,13 @@ func (engine *PoS) verifyHeader(chain consensus.ChainReader, header *types.Heade
 		return errUnclesAreInvalid
 	}
 
+	// the regions are counted from the end, so nothing but a bounded vanity
+	// may precede them
+	if len(header.Extra) > extraMax {
+		return errExtraTooLong
+	}
 	// signature check
-	if len(header.Extra) < extraSeal+extraKernel+extraCoinAge {
+	if _, err := decodeHeaderExtra(header.Extra); err != nil {
 		return errInvalidSignature
 	}
 
@@ -325,23 +868,112 @@ func (engine *PoS) verifyHeader(chain consensus.ChainReader, header *types.Heade
 		return consensus.ErrUnknownAncestor
 	}
 
-	if parent.Time.Uint64()+engine.config.BlockPeriod > header.Time.Uint64() {
+	if header.Time.Cmp(parent.Time) <= 0 || parent.Time.Uint64()+engine.config.BlockPeriod > header.Time.Uint64() {
 		return errInvalidTimestamp
 	}
+	if err := checkGasLimit(parent, header); err != nil {
+		return err
+	}
 
-	stake, err := extractStake(header)
+	// header-only sync skips the costly kernel and stake checks
+	if !seal {
+		return nil
+	}
+	if err := engine.checkSignerGap(chain, header, parent, parents); err != nil {
+		return err
+	}
+	if engine.fakeMode {
+		return engine.fakeVerify(header)
+	}
+
+	stake, kernel, err := engine.stakeAndKernel(header)
 	if err != nil {
 		return err
 	}
+	if err := checkMinStakeAge(engine.config, stake); err != nil {
+		return err
+	}
+	if err := checkStakeTime(engine.config, header, stake); err != nil {
+		return err
+	}
+	// reject stakes already used before the costlier kernel check
+	if engine.db != nil {
+		known, err := engine.isKnownStake(header.Hash(), stake, kernel)
+		if err != nil {
+			return err
+		}
+		if known {
+			duplicateCounter.Inc(1)
+			return errDuplicateStake
+		}
+	}
 
 	if err := engine.checkKernelHash(parent, header, stake); err != nil {
 		return err
 	}
 
-	return engine.VerifySeal(chain, header)
+	if !batch || engine.db == nil {
+		return engine.VerifySeal(chain, header)
+	}
+	return engine.indexStake(header, true)
+}
+
+// gasLimitError is returned if the gas limit of a block moved away from its
+// parent's by the bound divisor's share or more, or fell below the minimum gas
+// limit.
+type gasLimitError struct {
+	have, parent, bound *big.Int
+}
+
+func (e *gasLimitError) Error() string {
+	return fmt.Sprintf("invalid gas limit: have %v, want %v += %v", e.have, e.parent, e.bound)
+}
+
+// checkGasLimit bounds the change of the gas limit from the parent's like the
+// other engines do, so peers can't announce arbitrary gas limits.
+func checkGasLimit(parent, header *types.Header) error {
+	if header.GasLimit == nil || parent.GasLimit == nil {
+		return errInvalidGasLimit
+	}
+	diff := new(big.Int).Sub(parent.GasLimit, header.GasLimit)
+	diff.Abs(diff)
+
+	limit := new(big.Int).Div(parent.GasLimit, params.GasLimitBoundDivisor)
+	if diff.Cmp(limit) >= 0 || header.GasLimit.Cmp(params.MinGasLimit) < 0 {
+		return &gasLimitError{have: header.GasLimit, parent: parent.GasLimit, bound: limit}
+	}
+	return nil
+}
+
+// SetGenesis sets the genesis specification of the network, which is needed
+// to account for pre-allocated funds of custom networks.
+func (engine *PoS) SetGenesis(genesis *core.Genesis) {
+	engine.lock.Lock()
+	defer engine.lock.Unlock()
+
+	engine.genesis = genesis
 }
 
-func (engine *PoS) getGenesis() *core.Genesis {
-	// TODO return main net as well
-	return core.DefaultSproutsTestnetGenesisBlock()
+// getGenesis returns the genesis specification of the network the chain
+// belongs to. Unless set explicitly, the default networks are told apart by
+// their chain id. A default genesis without a timestamp takes the one of the
+// chain's genesis block, so premines never accrue from time zero.
+func (engine *PoS) getGenesis(chain consensus.ChainReader) *core.Genesis {
+	engine.lock.RLock()
+	genesis := engine.genesis
+	engine.lock.RUnlock()
+
+	if genesis != nil {
+		return genesis
+	}
+	genesis = core.DefaultSproutsTestnetGenesisBlock()
+	if config := chain.Config(); config.ChainId != nil && config.ChainId.Cmp(params.SproutsChainConfig.ChainId) == 0 {
+		genesis = core.DefaultSproutsGenesisBlock()
+	}
+	if genesis.Timestamp == 0 {
+		if header := chain.GetHeaderByNumber(0); header != nil {
+			genesis.Timestamp = header.Time.Uint64()
+		}
+	}
+	return genesis
 }
@@ -0,0 +1,927 @@
+package sprouts
+
+import (
+	"crypto/ecdsa"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/applicature/sprouts-plus/common"
+	"github.com/applicature/sprouts-plus/consensus"
+	"github.com/applicature/sprouts-plus/core"
+	"github.com/applicature/sprouts-plus/core/state"
+	"github.com/applicature/sprouts-plus/core/types"
+	"github.com/applicature/sprouts-plus/core/vm"
+	"github.com/applicature/sprouts-plus/crypto"
+	"github.com/applicature/sprouts-plus/crypto/sha3"
+	"github.com/applicature/sprouts-plus/ethdb"
+	"github.com/applicature/sprouts-plus/params"
+)
+
+// testStakeAge is large enough for a kernel to be found on the first attempt
+// regardless of the difficulty.
+var testStakeAge = new(big.Int).Set(stakeMaxAge)
+
+// testStakeBalance is a balance large enough to back testStakeAge.
+var testStakeBalance = new(big.Int).Exp(big.NewInt(10), big.NewInt(51), nil)
+
+// fundTestStaker allocates testStakeBalance to the signer of the test chains.
+func fundTestStaker(genesis *core.Genesis) {
+	genesis.Alloc[rewardsAddr] = core.GenesisAccount{Balance: testStakeBalance}
+}
+
+// sealTestBlock embeds the stake together with a matching kernel into the
+// generated block, so it passes the kernel verification.
+func sealTestBlock(t testing.TB, engine *PoS, b *BlockGen, ca *coinAge) {
+	if err := b.sealWith(engine, ca); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newTestEngine creates an engine, failing the test if the configuration is
+// invalid.
+func newTestEngine(t testing.TB, config *params.SproutsConfig, db ethdb.Database) *PoS {
+	engine, err := New(config, db)
+	if err != nil {
+		t.Fatalf("failed to create engine: %v", err)
+	}
+	return engine
+}
+
+// newTestFaker creates a fake engine like newTestEngine.
+func newTestFaker(t testing.TB, config *params.SproutsConfig, db ethdb.Database) *PoS {
+	engine, err := NewFaker(config, db)
+	if err != nil {
+		t.Fatalf("failed to create engine: %v", err)
+	}
+	return engine
+}
+
+// testExtra decodes the extra-data of the header, or starts extra-data of the
+// current layout if it is too short.
+func testExtra(header *types.Header) *headerExtra {
+	extra, err := decodeHeaderExtra(header.Extra)
+	if err != nil {
+		return newHeaderExtra(header.Extra)
+	}
+	return extra
+}
+
+// setTestStake embeds the stake into the extra-data of the header.
+func setTestStake(header *types.Header, stake *coinAge) {
+	extra := testExtra(header)
+	extra.Stake = stake.bytes()
+	header.Extra = extra.encode()
+}
+
+// setTestKernel embeds the kernel hash found at the given step into the
+// extra-data of the header.
+func setTestKernel(header *types.Header, hash []byte, step uint64) {
+	extra := testExtra(header)
+	extra.Kernel, extra.HashedTimestamp = hash, make([]byte, extraKernel/2)
+
+	h := sha3.NewShake256()
+	h.Write(new(big.Int).SetUint64(step).Bytes())
+	h.Read(extra.HashedTimestamp)
+	header.Extra = extra.encode()
+}
+
+// signTestHeader seals the header with the given key.
+func signTestHeader(t testing.TB, header *types.Header, key *ecdsa.PrivateKey) {
+	signature, err := crypto.Sign(sigHash(header).Bytes(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	extra := testExtra(header)
+	extra.Seal = signature
+	header.Extra = extra.encode()
+}
+
+// newTestChain creates a blockchain and generates n valid blocks on top of its
+// genesis. The blocks are not inserted into the chain.
+func newTestChain(t testing.TB, n int) (*core.BlockChain, []*types.Block, *PoS) {
+	db, genesis, engine := initBlockchainStructures(t)
+	fundTestStaker(genesis)
+	genesisBlock := genesis.MustCommit(db)
+	blockchain, err := core.NewBlockChain(db, genesis.Config, engine, vm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks, _ := GenerateChain(&sproutsConfig, params.TestSproutsChainConfig, genesisBlock, db, n, func(i int, b *BlockGen) {
+		b.SetCoinbase(rewardsAddr)
+		sealTestBlock(t, engine, b, &coinAge{
+			Time:  b.Header().Time.Uint64(),
+			Age:   testStakeAge,
+			Value: big.NewInt(1000),
+		})
+	})
+	return blockchain, blocks, engine
+}
+
+func TestGeneratedChainInsertion(t *testing.T) {
+	blockchain, blocks, _ := newTestChain(t, 8)
+	defer blockchain.Stop()
+
+	if _, err := blockchain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+}
+
+// Tests that blocks sealed with SealWith are accepted, claiming the given age
+// at their own time.
+func TestSealWith(t *testing.T) {
+	db, genesis, engine := initBlockchainStructures(t)
+	fundTestStaker(genesis)
+	genesisBlock := genesis.MustCommit(db)
+	blockchain, err := core.NewBlockChain(db, genesis.Config, engine, vm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blockchain.Stop()
+
+	abort := make(chan struct{})
+	var sealErr error
+	blocks, _ := GenerateChainWithAbort(&sproutsConfig, params.TestSproutsChainConfig, genesisBlock, db, 4, abort, func(i int, b *BlockGen) {
+		b.SetCoinbase(rewardsAddr)
+		if sealErr = b.SealWith(engine, testStakeAge); sealErr != nil {
+			close(abort)
+		}
+	})
+	if sealErr != nil {
+		t.Fatalf("failed to seal block %d: %v", len(blocks), sealErr)
+	}
+	if _, err := blockchain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	for _, block := range blocks {
+		stake, err := extractStake(block.Header())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stake.Time != block.Time().Uint64() || stake.Age.Cmp(testStakeAge) != 0 || stake.Value.Sign() != 0 {
+			t.Errorf("block %d: stake mismatch: %+v", block.NumberU64(), stake)
+		}
+	}
+}
+
+// Tests that blocks claiming a stake their minter's balance can't back are
+// rejected on import.
+func TestStakeBalanceInsertion(t *testing.T) {
+	db, genesis, engine := initBlockchainStructures(t)
+	genesisBlock := genesis.MustCommit(db)
+	blockchain, err := core.NewBlockChain(db, genesis.Config, engine, vm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blockchain.Stop()
+
+	blocks, _ := GenerateChain(&sproutsConfig, params.TestSproutsChainConfig, genesisBlock, db, 1, func(i int, b *BlockGen) {
+		b.SetCoinbase(rewardsAddr)
+		sealTestBlock(t, engine, b, &coinAge{
+			Time:  b.Header().Time.Uint64(),
+			Age:   testStakeAge,
+			Value: big.NewInt(1000),
+		})
+	})
+	if _, err := blockchain.InsertChain(blocks); err != errStakeTooLarge {
+		t.Fatalf("error mismatch: have %v, want %v", err, errStakeTooLarge)
+	}
+}
+
+// Tests that blocks are only imported with stakes computed within the coin age
+// lifetime before their timestamp and not after it.
+func TestStakeTimeInsertion(t *testing.T) {
+	tests := []struct {
+		offset int64 // time of the stake relative to the block's, unless zero
+		err    error
+	}{
+		{-1, errInvalidStake}, // Time 0
+		{24 * 60 * 60, errInvalidStake},
+		{0, nil},
+	}
+	for i, tt := range tests {
+		db, genesis, engine := initBlockchainStructures(t)
+		fundTestStaker(genesis)
+		genesisBlock := genesis.MustCommit(db)
+		blockchain, err := core.NewBlockChain(db, genesis.Config, engine, vm.Config{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		blocks, _ := GenerateChain(&sproutsConfig, params.TestSproutsChainConfig, genesisBlock, db, 1, func(_ int, b *BlockGen) {
+			stake := &coinAge{Time: 0, Age: testStakeAge, Value: big.NewInt(1000)}
+			if tt.offset >= 0 {
+				stake.Time = uint64(int64(b.Header().Time.Uint64()) + tt.offset)
+			}
+			b.SetCoinbase(rewardsAddr)
+			sealTestBlock(t, engine, b, stake)
+		})
+		if _, err := blockchain.InsertChain(blocks); err != tt.err {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, tt.err)
+		}
+		blockchain.Stop()
+	}
+}
+
+// Tests that block bodies not matching their headers are rejected before they
+// are persisted, on the full and on the fast sync import paths.
+func TestBodyValidation(t *testing.T) {
+	blockchain, blocks, _ := newTestChain(t, 2)
+	defer blockchain.Stop()
+
+	if _, err := blockchain.InsertChain(blocks[:1]); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	// the header still commits to the empty uncle list and no transactions,
+	// it is signed as header-only verification recovers the signer
+	header := blocks[1].Header()
+	signTestHeader(t, header, rewardsKey)
+	uncled := types.NewBlockWithHeader(header).WithBody(nil, []*types.Header{blocks[0].Header()})
+	tx, _ := types.SignTx(types.NewTransaction(0, testAddr, big.NewInt(1), big.NewInt(21000), new(big.Int), nil), types.HomesteadSigner{}, rewardsKey)
+	stuffed := types.NewBlockWithHeader(header).WithBody([]*types.Transaction{tx}, nil)
+
+	for _, test := range []struct {
+		block *types.Block
+		err   error
+	}{
+		{uncled, errUnclesNotAllowed},
+		{stuffed, errTxHashMismatch},
+	} {
+		if _, err := blockchain.InsertChain(types.Blocks{test.block}); err != test.err {
+			t.Errorf("error mismatch: have %v, want %v", err, test.err)
+		}
+		if _, err := blockchain.InsertHeaderChain([]*types.Header{header}, 1); err != nil {
+			t.Fatalf("failed to insert header: %v", err)
+		}
+		if _, err := blockchain.InsertReceiptChain(types.Blocks{test.block}, []types.Receipts{nil}); err == nil {
+			t.Errorf("receipt chain with %v accepted", test.err)
+		}
+		if blockchain.HasBlock(header.Hash(), header.Number.Uint64()) {
+			t.Errorf("body with %v persisted", test.err)
+		}
+	}
+	matching := types.NewBlockWithHeader(header).WithBody(blocks[1].Transactions(), nil)
+	if _, err := blockchain.InsertChain(types.Blocks{matching}); err != nil {
+		t.Fatalf("failed to insert matching body: %v", err)
+	}
+}
+
+// Tests that the gas limit may move away from the parent's by less than the
+// bound divisor's share only, and never below the minimum.
+func TestVerifyGasLimit(t *testing.T) {
+	blockchain, blocks, engine := newTestChain(t, 1)
+	defer blockchain.Stop()
+
+	parent := blockchain.Genesis().GasLimit()
+	bound := new(big.Int).Div(parent, params.GasLimitBoundDivisor)
+	for _, test := range []struct {
+		delta   *big.Int
+		invalid bool
+	}{
+		{new(big.Int), false},
+		{new(big.Int).Sub(bound, big1), false},
+		{new(big.Int).Sub(big1, bound), false},
+		{bound, true},
+		{new(big.Int).Neg(bound), true},
+		{new(big.Int).Mul(bound, big.NewInt(1000)), true},
+	} {
+		header := blocks[0].Header()
+		header.GasLimit = new(big.Int).Add(parent, test.delta)
+		err := engine.VerifyHeader(blockchain, header, false)
+		if _, invalid := err.(*gasLimitError); invalid != test.invalid || (!invalid && err != nil) {
+			t.Errorf("delta %v: error mismatch: have %v, want invalid %v", test.delta, err, test.invalid)
+		}
+	}
+	// small gas limits hit the minimum before their bound
+	low := &types.Header{GasLimit: new(big.Int).Set(params.MinGasLimit)}
+	header := &types.Header{GasLimit: new(big.Int).Sub(params.MinGasLimit, big1)}
+	err := checkGasLimit(low, header)
+	if gasErr, ok := err.(*gasLimitError); !ok || gasErr.have.Cmp(header.GasLimit) != 0 || gasErr.parent.Cmp(low.GasLimit) != 0 {
+		t.Errorf("gas limit below the minimum: error mismatch: have %v", err)
+	}
+	if err := checkGasLimit(low, &types.Header{}); err != errInvalidGasLimit {
+		t.Errorf("missing gas limit: error mismatch: have %v, want %v", err, errInvalidGasLimit)
+	}
+}
+
+func TestVerifyStakeBalance(t *testing.T) {
+	engine := newTestEngine(t, &sproutsConfig, nil)
+	chain := &configChainReader{config: params.TestSproutsChainConfig}
+
+	db, _ := ethdb.NewMemDatabase()
+	statedb, _ := state.New(common.Hash{}, state.NewDatabase(db))
+	statedb.SetBalance(rewardsAddr, big.NewInt(1000))
+
+	// Age accumulated by the whole balance received from the distribution
+	// account over the coin age lifetime
+	maxAge := new(big.Int).Mul(big.NewInt(1000), sproutsConfig.CoinAgeLifetime)
+	maxAge.Mul(maxAge, big.NewInt(distributionAgeFactor))
+	numerator, denominator := coinDayRatio(&sproutsConfig)
+	maxAge.Mul(maxAge, numerator)
+	maxAge.Div(maxAge, denominator)
+
+	tests := []struct {
+		number int64
+		stake  *coinAge
+		err    error
+	}{
+		{1, &coinAge{Age: maxAge, Value: big.NewInt(1000)}, nil},
+		{1, &coinAge{Age: big.NewInt(1), Value: big.NewInt(1001)}, errStakeTooLarge},
+		{1, &coinAge{Age: new(big.Int).Add(maxAge, big1), Value: big.NewInt(1)}, errStakeTooLarge},
+		{1, &coinAge{Age: new(big.Int).Exp(big.NewInt(10), big.NewInt(30), nil), Value: big.NewInt(1)}, errStakeTooLarge},
+		{0, &coinAge{Age: new(big.Int).Add(maxAge, big1), Value: big.NewInt(1001)}, nil},
+	}
+	for i, tt := range tests {
+		header := &types.Header{
+			Number:   big.NewInt(tt.number),
+			Coinbase: rewardsAddr,
+		}
+		setTestStake(header, tt.stake)
+		if err := engine.VerifyStakeBalance(chain, header, statedb); err != tt.err {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, tt.err)
+		}
+	}
+}
+
+// Tests that the stake of a minter funded by the distribution account, which
+// accrues faster than the balance held alone would, passes the balance check.
+func TestVerifyStakeBalanceDistributed(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	minter := crypto.PubkeyToAddress(key.PublicKey)
+
+	config := sproutsConfig
+	config.DistributionAccount = testAddr
+
+	db, genesis, _ := initBlockchainStructures(t)
+	engine := newTestEngine(t, &config, db)
+	engine.Authorize(rewardsAddr, nil)
+	genesis.Timestamp = uint64(time.Now().Add(-10 * 24 * time.Hour).Unix())
+	fundTestStaker(genesis)
+	genesis.Alloc[testAddr] = core.GenesisAccount{Balance: new(big.Int).Mul(big.NewInt(10), big.NewInt(coinValue))}
+	genesisBlock := genesis.MustCommit(db)
+
+	blockchain, err := core.NewBlockChain(db, genesis.Config, engine, vm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blockchain.Stop()
+
+	// the head is excluded from the walk, so the funds arrive before it
+	signer := types.NewEIP155Signer(genesis.Config.ChainId)
+	blocks, _ := GenerateChain(&config, params.TestSproutsChainConfig, genesisBlock, db, 2, func(i int, b *BlockGen) {
+		b.SetCoinbase(rewardsAddr)
+		if i == 0 {
+			tx, _ := types.SignTx(types.NewTransaction(b.TxNonce(testAddr), minter, big.NewInt(coinValue), big.NewInt(21000), new(big.Int), nil), signer, testKey)
+			b.AddTx(tx)
+		}
+		sealTestBlock(t, engine, b, &coinAge{Time: b.Header().Time.Uint64(), Age: testStakeAge, Value: big.NewInt(1000)})
+	})
+	if _, err := blockchain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	engine.Authorize(minter, nil)
+
+	head := blockchain.CurrentBlock()
+	header := &types.Header{
+		ParentHash: head.Hash(),
+		Number:     new(big.Int).Add(head.Number(), big1),
+		Time:       new(big.Int),
+	}
+	if err := engine.Prepare(blockchain, header); err != nil {
+		t.Fatalf("failed to prepare header: %v", err)
+	}
+	stake, err := engine.headerStake(header)
+	if err != nil {
+		t.Fatalf("failed to decode stake: %v", err)
+	}
+	// ten days of the distribution factor exceed the balance held for the
+	// whole lifetime
+	numerator, denominator := coinDayRatio(&config)
+	held := new(big.Int).Mul(big.NewInt(coinValue), config.CoinAgeLifetime)
+	held.Mul(held, numerator)
+	held.Div(held, denominator)
+	if stake.Age.Cmp(held) <= 0 {
+		t.Fatalf("stake age %v doesn't exceed the balance held for the lifetime %v", stake.Age, held)
+	}
+	statedb, err := blockchain.StateAt(head.Root())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := engine.VerifyStakeBalance(blockchain, header, statedb); err != nil {
+		t.Errorf("distributed stake rejected: %v", err)
+	}
+}
+
+// configChainReader is a chain reader with a custom chain configuration.
+type configChainReader struct {
+	testerChainReader
+	config *params.ChainConfig
+}
+
+func (r *configChainReader) Config() *params.ChainConfig { return r.config }
+
+// Tests that the genesis of the network is selected by the chain id, and that
+// its timestamp and allocations are the ones premines accrue from.
+func TestGetGenesis(t *testing.T) {
+	engine := newTestEngine(t, &sproutsConfig, nil)
+
+	// the testnet genesis is fully defined
+	db, _ := ethdb.NewMemDatabase()
+	core.DefaultSproutsTestnetGenesisBlock().MustCommit(db)
+	genesis := engine.getGenesis(&configChainReader{testerChainReader: testerChainReader{db: db}, config: params.TestSproutsChainConfig})
+	if genesis.Config.ChainId.Cmp(params.TestSproutsChainConfig.ChainId) != 0 {
+		t.Errorf("testnet chain id mismatch: have %v, want %v", genesis.Config.ChainId, params.TestSproutsChainConfig.ChainId)
+	}
+	if genesis.Timestamp != 1514520146 {
+		t.Errorf("testnet timestamp mismatch: have %d, want 1514520146", genesis.Timestamp)
+	}
+	distribution := params.TestSproutsChainConfig.Sprouts.DistributionAccount
+	if account, ok := genesis.Alloc[distribution]; !ok || account.Balance.Sign() <= 0 {
+		t.Errorf("testnet premine of %x missing: %v", distribution, genesis.Alloc)
+	}
+
+	// the mainnet genesis takes its timestamp from the chain
+	db, _ = ethdb.NewMemDatabase()
+	mainnet := core.DefaultSproutsGenesisBlock()
+	mainnet.Timestamp = uint64(startDate.Unix())
+	mainnet.MustCommit(db)
+	genesis = engine.getGenesis(&configChainReader{testerChainReader: testerChainReader{db: db}, config: params.SproutsChainConfig})
+	if genesis.Config.ChainId.Cmp(params.SproutsChainConfig.ChainId) != 0 {
+		t.Errorf("mainnet chain id mismatch: have %v, want %v", genesis.Config.ChainId, params.SproutsChainConfig.ChainId)
+	}
+	if genesis.Timestamp != mainnet.Timestamp {
+		t.Errorf("mainnet timestamp mismatch: have %d, want %d", genesis.Timestamp, mainnet.Timestamp)
+	}
+	if want := core.DefaultSproutsGenesisBlock().Alloc; len(genesis.Alloc) != len(want) {
+		t.Errorf("mainnet allocations mismatch: have %v, want %v", genesis.Alloc, want)
+	}
+}
+
+// newFinalizeTestState creates a state with a few funded accounts along with a
+// header carrying the given stake.
+func newFinalizeTestState(t testing.TB, db ethdb.Database, ca *coinAge) (*state.StateDB, *types.Header) {
+	statedb, err := state.New(common.Hash{}, state.NewDatabase(db))
+	if err != nil {
+		t.Fatal(err)
+	}
+	statedb.AddBalance(testAddr, big.NewInt(1000000))
+	statedb.AddBalance(rewardsAddr, big.NewInt(10))
+
+	extra := newHeaderExtra(nil)
+	extra.Stake = ca.bytes()
+	header := &types.Header{
+		Number:     big.NewInt(1),
+		Time:       big.NewInt(startDate.Unix()),
+		Difficulty: big.NewInt(1),
+		GasLimit:   big.NewInt(4700000),
+		GasUsed:    new(big.Int),
+		Coinbase:   testAddr,
+		Extra:      extra.encode(),
+	}
+	return statedb, header
+}
+
+// Tests that the end-of-block state modifications are applied in their
+// canonical order. Any change to the order or to the steps themselves alters
+// the golden state root.
+func TestFinalizeGoldenRoot(t *testing.T) {
+	db, _ := ethdb.NewMemDatabase()
+	engine := newTestEngine(t, &sproutsConfig, db)
+	chain := &configChainReader{config: params.TestSproutsChainConfig}
+
+	statedb, header := newFinalizeTestState(t, db, &coinAge{
+		Time:  uint64(startDate.Unix()),
+		Age:   big.NewInt(1000),
+		Value: big.NewInt(123456789),
+	})
+	block, err := engine.Finalize(chain, header, statedb, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	golden := common.HexToHash("0xa4ac83fee780c5ae94815dbf5bfe0b8a2bc47cca3f60f08ed9305aa4e1dd7b68")
+	if block.Root() != golden {
+		t.Fatalf("state root mismatch: have %x, want %x", block.Root(), golden)
+	}
+	// 1000 coin-days earn 58043640587405625 wei, 8% of it go to charity and r&d each
+	if balance := statedb.GetBalance(testAddr); balance.Cmp(big.NewInt(1000000+48756658093420725)) != 0 {
+		t.Errorf("coinbase balance mismatch: have %v, want %v", balance, 1000000+48756658093420725)
+	}
+	if balance := statedb.GetBalance(rewardsAddr); balance.Cmp(big.NewInt(10+2*4643491246992450)) != 0 {
+		t.Errorf("charity and r&d balance mismatch: have %v, want %v", balance, 10+2*4643491246992450)
+	}
+}
+
+// Tests the golden state root of a block finalized with all optional reward
+// features enabled: a premined stake, a custom annual reward, a reward cap and
+// custom charity and r&d shares switched by a reward split fork.
+func TestFinalizeGoldenRootAllFeatures(t *testing.T) {
+	charity, rd := uint64(500), uint64(1000)
+
+	config := sproutsConfig
+	config.AnnualRewardNumerator = big.NewInt(12)
+	config.AnnualRewardDenominator = big.NewInt(100)
+	config.MaxBlockReward = new(big.Int).Mul(big.NewInt(2), new(big.Int).SetUint64(coinValue))
+	config.RewardsCharityAccount = common.BytesToAddress([]byte("charity"))
+	config.RewardsRDAccount = common.BytesToAddress([]byte("r&d"))
+	config.RewardsCharityBasisPoints = &charity
+	config.RewardsRDBasisPoints = &rd
+	config.RewardSplitForks = []params.RewardSplitFork{{Block: big.NewInt(1), CharityBasisPoints: 300, RDBasisPoints: 200}}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("invalid config: %v", err)
+	}
+	db, _ := ethdb.NewMemDatabase()
+	engine := newTestEngine(t, &config, db)
+	chain := &configChainReader{config: params.TestSproutsChainConfig}
+
+	// the coinbase stakes the age its premine accrued over the lifetime
+	genesis := &core.Genesis{
+		Timestamp: uint64(startDate.Unix()) - config.CoinAgeLifetime.Uint64(),
+		Alloc:     core.GenesisAlloc{testAddr: {Balance: new(big.Int).Mul(big.NewInt(1000), new(big.Int).SetUint64(coinValue))}},
+	}
+	statedb, header := newFinalizeTestState(t, db, &coinAge{
+		Time:  uint64(startDate.Unix()),
+		Age:   GenesisStake(&config, genesis, testAddr, uint64(startDate.Unix())),
+		Value: big.NewInt(123456789),
+	})
+	statedb.AddBalance(testAddr, genesis.Alloc[testAddr].Balance)
+
+	block, err := engine.Finalize(chain, header, statedb, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	golden := common.HexToHash("0xc1e29469d9fbf78385b5ed0fe9732afbb30b73e74ecd97df18a04bee3401051e")
+	if block.Root() != golden {
+		t.Fatalf("state root mismatch: have %x, want %x", block.Root(), golden)
+	}
+	// the reward is capped at 2 coins, 3% and 2% of it go to charity and r&d
+	minter := new(big.Int).Mul(big.NewInt(190), new(big.Int).SetUint64(coinValue/100))
+	if balance := statedb.GetBalance(testAddr); balance.Cmp(new(big.Int).Add(big.NewInt(1000000), new(big.Int).Add(genesis.Alloc[testAddr].Balance, minter))) != 0 {
+		t.Errorf("coinbase balance mismatch: have %v, want premine plus %v", balance, minter)
+	}
+	if balance := statedb.GetBalance(config.RewardsCharityAccount); balance.Cmp(new(big.Int).Mul(big.NewInt(6), new(big.Int).SetUint64(coinValue/100))) != 0 {
+		t.Errorf("charity balance mismatch: have %v, want %v", balance, 6*coinValue/100)
+	}
+	if balance := statedb.GetBalance(config.RewardsRDAccount); balance.Cmp(new(big.Int).Mul(big.NewInt(4), new(big.Int).SetUint64(coinValue/100))) != 0 {
+		t.Errorf("r&d balance mismatch: have %v, want %v", balance, 4*coinValue/100)
+	}
+}
+
+// Tests that Finalize pays the configured shares of the reward, switching to
+// the shares of a reward split fork at its activation block.
+func TestFinalizeCustomRewardSplit(t *testing.T) {
+	charity, rd := uint64(500), uint64(1000)
+
+	config := sproutsConfig
+	config.RewardsCharityAccount = common.BytesToAddress([]byte("charity"))
+	config.RewardsRDAccount = common.BytesToAddress([]byte("r&d"))
+	config.RewardsCharityBasisPoints = &charity
+	config.RewardsRDBasisPoints = &rd
+	config.RewardSplitForks = []params.RewardSplitFork{{Block: big.NewInt(2), CharityBasisPoints: 300, RDBasisPoints: 200}}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("invalid config: %v", err)
+	}
+	chain := &configChainReader{config: params.TestSproutsChainConfig}
+
+	// 1000 coin-days earn 58043640587405625 wei
+	tests := []struct {
+		number              int64
+		minter, charity, rd int64
+	}{
+		{1, 49337094499294782, 2902182029370281, 5804364058740562},
+		{2, 55141458558035345, 1741309217622168, 1160872811748112},
+	}
+	for _, tt := range tests {
+		db, _ := ethdb.NewMemDatabase()
+		engine := newTestEngine(t, &config, db)
+
+		statedb, header := newFinalizeTestState(t, db, &coinAge{
+			Time:  uint64(startDate.Unix()),
+			Age:   big.NewInt(1000),
+			Value: big.NewInt(123456789),
+		})
+		header.Number = big.NewInt(tt.number)
+		if _, err := engine.Finalize(chain, header, statedb, nil, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+		if balance := statedb.GetBalance(testAddr); balance.Cmp(big.NewInt(1000000+tt.minter)) != 0 {
+			t.Errorf("block %d: coinbase balance mismatch: have %v, want %v", tt.number, balance, 1000000+tt.minter)
+		}
+		if balance := statedb.GetBalance(config.RewardsCharityAccount); balance.Cmp(big.NewInt(tt.charity)) != 0 {
+			t.Errorf("block %d: charity balance mismatch: have %v, want %v", tt.number, balance, tt.charity)
+		}
+		if balance := statedb.GetBalance(config.RewardsRDAccount); balance.Cmp(big.NewInt(tt.rd)) != 0 {
+			t.Errorf("block %d: r&d balance mismatch: have %v, want %v", tt.number, balance, tt.rd)
+		}
+	}
+}
+
+// Tests that a split given in whole percents is paid by Finalize.
+func TestFinalizePercentRewardSplit(t *testing.T) {
+	percent := uint64(5)
+
+	config := sproutsConfig
+	config.RewardsCharityAccount = common.BytesToAddress([]byte("charity"))
+	config.RewardsRDAccount = common.BytesToAddress([]byte("r&d"))
+	config.CharityPercent = &percent
+	config.RDPercent = &percent
+
+	db, _ := ethdb.NewMemDatabase()
+	engine := newTestEngine(t, &config, db)
+	chain := &configChainReader{config: params.TestSproutsChainConfig}
+
+	statedb, header := newFinalizeTestState(t, db, &coinAge{
+		Time:  uint64(startDate.Unix()),
+		Age:   big.NewInt(1000),
+		Value: big.NewInt(123456789),
+	})
+	if _, err := engine.Finalize(chain, header, statedb, nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	// 1000 coin-days earn 58043640587405625 wei, 5% of it go to charity and r&d each
+	if balance := statedb.GetBalance(testAddr); balance.Cmp(big.NewInt(1000000+52239276528665063)) != 0 {
+		t.Errorf("coinbase balance mismatch: have %v, want %v", balance, 1000000+52239276528665063)
+	}
+	for _, account := range []common.Address{config.RewardsCharityAccount, config.RewardsRDAccount} {
+		if balance := statedb.GetBalance(account); balance.Cmp(big.NewInt(2902182029370281)) != 0 {
+			t.Errorf("account %x: balance mismatch: have %v, want %v", account, balance, 2902182029370281)
+		}
+	}
+}
+
+// Tests that engines can't be created with reward shares of 50% or more,
+// given in basis points or in whole percents.
+func TestNewInvalidRewardSplit(t *testing.T) {
+	points, percent := uint64(2500), uint64(25)
+
+	basisPointsConfig := sproutsConfig
+	basisPointsConfig.RewardsCharityBasisPoints = &points
+	basisPointsConfig.RewardsRDBasisPoints = &points
+
+	percentConfig := sproutsConfig
+	percentConfig.CharityPercent = &percent
+	percentConfig.RDPercent = &percent
+
+	for name, config := range map[string]*params.SproutsConfig{"basis points": &basisPointsConfig, "percents": &percentConfig} {
+		if _, err := New(config, nil); err == nil {
+			t.Errorf("%s: New accepted 50%% charity and r&d shares", name)
+		}
+		if _, err := NewWithOptions(config, nil, Options{}); err == nil {
+			t.Errorf("%s: NewWithOptions accepted 50%% charity and r&d shares", name)
+		}
+	}
+}
+
+func TestFinalizeReducesLocalCoinAge(t *testing.T) {
+	stake := &coinAge{Time: uint64(startDate.Unix()), Age: big.NewInt(1000), Value: big.NewInt(10)}
+
+	// A block minted by someone else leaves all coin age records untouched
+	db, _ := ethdb.NewMemDatabase()
+	engine := newTestEngine(t, &sproutsConfig, db)
+	engine.Authorize(rewardsAddr, nil)
+
+	for _, addr := range []common.Address{rewardsAddr, testAddr} {
+		(&coinAge{Time: 1, Age: big.NewInt(5000), Value: big.NewInt(0)}).saveCoinAge(db, addr)
+	}
+	statedb, header := newFinalizeTestState(t, db, stake)
+	if _, err := engine.Finalize(&configChainReader{config: params.TestSproutsChainConfig}, header, statedb, nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, addr := range []common.Address{rewardsAddr, testAddr} {
+		ca, err := loadCoinAge(db, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ca.Age.Cmp(big.NewInt(5000)) != 0 || ca.Time != 1 {
+			t.Errorf("coin age of %x changed by foreign block: %v", addr, ca)
+		}
+	}
+
+	// A block minted locally consumes its stake
+	engine.Authorize(testAddr, nil)
+	statedb, header = newFinalizeTestState(t, db, stake)
+	if _, err := engine.Finalize(&configChainReader{config: params.TestSproutsChainConfig}, header, statedb, nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	ca, err := loadCoinAge(db, testAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ca.Age.Cmp(big.NewInt(4000)) != 0 {
+		t.Errorf("coin age not reduced by the stake: have %v, want 4000", ca.Age)
+	}
+}
+
+func TestPremineCoinAgeCustomGenesis(t *testing.T) {
+	engine := newTestEngine(t, &sproutsConfig, nil)
+	chain := &configChainReader{config: params.TestSproutsChainConfig}
+	now := uint64(time.Now().Unix())
+
+	// The signer holds nothing in the default testnet genesis
+	if age := engine.premineCoinAgeOf(chain, now, testAddr); age.Sign() != 0 {
+		t.Fatalf("premine coin age without allocation: have %v, want 0", age)
+	}
+	// but the custom genesis allocates funds to it, which accrue age from the
+	// genesis timestamp up to the coin age lifetime
+	genesis := &core.Genesis{
+		Config:    params.TestSproutsChainConfig,
+		Timestamp: now - 86400,
+		Alloc:     core.GenesisAlloc{testAddr: {Balance: big.NewInt(1000000)}},
+	}
+	engine.SetGenesis(genesis)
+
+	lifetime := sproutsConfig.CoinAgeLifetime.Uint64()
+	tests := []struct {
+		at   uint64
+		want *big.Int
+	}{
+		{genesis.Timestamp, big.NewInt(0)},
+		{now, big.NewInt(1000000 * 86400)},
+		{genesis.Timestamp + lifetime, new(big.Int).Mul(big.NewInt(1000000), sproutsConfig.CoinAgeLifetime)},
+		{genesis.Timestamp + 2*lifetime, new(big.Int).Mul(big.NewInt(1000000), sproutsConfig.CoinAgeLifetime)},
+	}
+	for i, tt := range tests {
+		if age := engine.premineCoinAgeOf(chain, tt.at, testAddr); age.Cmp(tt.want) != 0 {
+			t.Errorf("test %d: premine coin age mismatch: have %v, want %v", i, age, tt.want)
+		}
+	}
+}
+
+// Tests that the holders of a fresh network's genesis allocations can mint
+// with the coin age of their allocations alone, and that their stakes can be
+// verified from the genesis.
+func TestGenesisHoldersMint(t *testing.T) {
+	balance := new(big.Int).Mul(big.NewInt(1000000), new(big.Int).SetUint64(coinValue))
+	genesis := &core.Genesis{
+		Config:     params.TestSproutsChainConfig,
+		Timestamp:  uint64(time.Now().AddDate(0, 0, -30).Unix()),
+		Difficulty: big0,
+		ExtraData:  make([]byte, extraDefault+extraSeal+extraKernel+extraCoinAge),
+		Alloc: core.GenesisAlloc{
+			testAddr:    {Balance: balance},
+			rewardsAddr: {Balance: balance},
+		},
+	}
+	db, _ := ethdb.NewMemDatabase()
+	genesisBlock := genesis.MustCommit(db)
+
+	// the stakes are computed a month after the blocks they are minted with,
+	// so the allowed clock skew has to span the month
+	config := sproutsConfig
+	skew := uint64(31 * 24 * 60 * 60)
+	config.AllowedFutureBlockTime = &skew
+
+	holders := []common.Address{testAddr, rewardsAddr}
+	engines := make([]*PoS, len(holders))
+	stakes := make([]*coinAge, len(holders))
+	for i, holder := range holders {
+		engines[i] = newTestEngine(t, &config, db)
+		engines[i].SetGenesis(genesis)
+		engines[i].Authorize(holder, nil)
+	}
+	blockchain, err := core.NewBlockChain(db, genesis.Config, engines[0], vm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blockchain.Stop()
+
+	for i, holder := range holders {
+		if stakes[i], err = engines[i].coinAge(blockchain, uint64(time.Now().Unix())); err != nil {
+			t.Fatalf("holder %d: %v", i, err)
+		}
+		if want := GenesisStake(&config, genesis, holder, stakes[i].Time); stakes[i].Age.Cmp(want) != 0 {
+			t.Fatalf("holder %d: stake mismatch: have %v, want %v", i, stakes[i].Age, want)
+		}
+		if stakes[i].Age.Sign() == 0 {
+			t.Fatalf("holder %d: no coin age", i)
+		}
+	}
+	// the holders take turns minting the first blocks
+	blocks, _ := GenerateChain(&config, params.TestSproutsChainConfig, genesisBlock, db, 4, func(i int, b *BlockGen) {
+		b.SetCoinbase(holders[i%len(holders)])
+		sealTestBlock(t, engines[i%len(holders)], b, stakes[i%len(holders)])
+	})
+	if _, err := blockchain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert blocks minted by genesis holders: %v", err)
+	}
+}
+
+func TestFinalizeDryRun(t *testing.T) {
+	db, _ := ethdb.NewMemDatabase()
+	engine := newTestEngine(t, &sproutsConfig, db)
+	engine.Authorize(testAddr, nil)
+	chain := &configChainReader{config: params.TestSproutsChainConfig}
+
+	(&coinAge{Time: 1, Age: big.NewInt(5000), Value: big.NewInt(0)}).saveCoinAge(db, testAddr)
+	stake := &coinAge{Time: uint64(startDate.Unix()), Age: big.NewInt(1000), Value: big.NewInt(123456789)}
+
+	statedb, header := newFinalizeTestState(t, db, stake)
+	before := statedb.IntermediateRoot(true)
+	root, rewards, err := engine.FinalizeDryRun(chain, header, statedb, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Neither the state nor the coin age records are touched
+	if after := statedb.IntermediateRoot(true); after != before {
+		t.Fatalf("dry run modified the state: root %x, want %x", after, before)
+	}
+	if header.Root != (common.Hash{}) {
+		t.Fatalf("dry run modified the header: root %x", header.Root)
+	}
+	if ca, err := loadCoinAge(db, testAddr); err != nil || ca.Age.Cmp(big.NewInt(5000)) != 0 {
+		t.Fatalf("dry run modified the coin age: %v, %v", ca, err)
+	}
+
+	// The real finalization produces the same root and credits the reported rewards
+	block, err := engine.Finalize(chain, header, statedb, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if block.Root() != root {
+		t.Fatalf("state root mismatch: have %x, want %x", root, block.Root())
+	}
+	if balance := statedb.GetBalance(testAddr); balance.Cmp(new(big.Int).Add(big.NewInt(1000000), rewards.Minter)) != 0 {
+		t.Errorf("minter balance mismatch: have %v, reward %v", balance, rewards.Minter)
+	}
+	// charity and r&d share the same test account
+	want := new(big.Int).Add(rewards.Charity, rewards.RD)
+	if balance := statedb.GetBalance(rewardsAddr); balance.Cmp(want.Add(want, big.NewInt(10))) != 0 {
+		t.Errorf("charity and r&d balance mismatch: have %v, want %v", balance, want)
+	}
+}
+
+func TestFinalizeDryRunReceiptsMismatch(t *testing.T) {
+	db, _ := ethdb.NewMemDatabase()
+	engine := newTestEngine(t, &sproutsConfig, db)
+	chain := &configChainReader{config: params.TestSproutsChainConfig}
+
+	statedb, header := newFinalizeTestState(t, db, &coinAge{Time: 1, Age: big.NewInt(1000), Value: big.NewInt(10)})
+	tx := types.NewTransaction(0, testAddr, big.NewInt(1), big.NewInt(21000), big.NewInt(1), nil)
+	if _, _, err := engine.FinalizeDryRun(chain, header, statedb, []*types.Transaction{tx}, nil); err != errReceiptsMismatch {
+		t.Errorf("receipts mismatch error: have %v, want %v", err, errReceiptsMismatch)
+	}
+	receipt := types.NewReceipt(nil, false, big.NewInt(21000))
+	if _, _, err := engine.FinalizeDryRun(chain, header, statedb, []*types.Transaction{tx}, []*types.Receipt{receipt}); err != errGasUsedMismatch {
+		t.Errorf("gas used mismatch error: have %v, want %v", err, errGasUsedMismatch)
+	}
+}
+
+// Tests that the premine coin age is read from the genesis state, even if the
+// engine doesn't know the genesis specification.
+func TestPremineCoinAgeFromState(t *testing.T) {
+	db, _ := ethdb.NewMemDatabase()
+	genesis := &core.Genesis{
+		Config:    params.TestSproutsChainConfig,
+		Timestamp: uint64(startDate.Unix()),
+		ExtraData: make([]byte, extraDefault+extraSeal+extraKernel+extraCoinAge),
+		Alloc:     core.GenesisAlloc{testAddr: {Balance: big.NewInt(1000000)}},
+	}
+	genesis.MustCommit(db)
+	chain := &testerChainReader{db: db}
+
+	engine := newTestEngine(t, &sproutsConfig, db)
+
+	lifetime := sproutsConfig.CoinAgeLifetime.Uint64()
+	if age := engine.premineCoinAgeOf(chain, genesis.Timestamp+86400, testAddr); age.Cmp(big.NewInt(1000000*86400)) != 0 {
+		t.Errorf("premine coin age mismatch: have %v, want %v", age, 1000000*86400)
+	}
+	want := new(big.Int).Mul(big.NewInt(1000000), sproutsConfig.CoinAgeLifetime)
+	if age := engine.premineCoinAgeOf(chain, genesis.Timestamp+2*lifetime, testAddr); age.Cmp(want) != 0 {
+		t.Errorf("premine coin age beyond lifetime mismatch: have %v, want %v", age, want)
+	}
+	// other accounts have no allocation
+	if age := engine.premineCoinAgeOf(chain, genesis.Timestamp+86400, rewardsAddr); age.Sign() != 0 {
+		t.Errorf("premine coin age without allocation: have %v, want 0", age)
+	}
+}
+
+// Tests that headers slightly ahead of the local clock are accepted within the
+// allowed clock drift, and queued as future blocks beyond it.
+func TestFutureBlockTime(t *testing.T) {
+	blockchain, _, engine := newTestChain(t, 0)
+	defer blockchain.Stop()
+
+	genesis := blockchain.Genesis().Header()
+	engine.SetClock(newFakeClock(genesis.Time.Int64() + 100))
+	header := &types.Header{
+		ParentHash: genesis.Hash(),
+		UncleHash:  types.EmptyUncleHash,
+		Number:     big1,
+		Time:       new(big.Int).Add(genesis.Time, big.NewInt(105)),
+		GasLimit:   genesis.GasLimit,
+		Extra:      make([]byte, extraDefault+extraKernel+extraCoinAge+extraSeal),
+	}
+	tests := []struct {
+		allowance uint64
+		err       error
+	}{
+		{15, nil},
+		{0, consensus.ErrFutureBlock},
+	}
+	for _, tt := range tests {
+		allowance := tt.allowance
+		engine.config.AllowedFutureBlockTime = &allowance
+
+		if err := engine.VerifyHeader(blockchain, header, false); err != tt.err {
+			t.Errorf("allowance %ds: error mismatch: have %v, want %v", tt.allowance, err, tt.err)
+		}
+	}
+}
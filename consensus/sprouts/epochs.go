@@ -0,0 +1,246 @@
+package sprouts
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"sort"
+
+	"github.com/applicature/sprouts-plus/common"
+	"github.com/applicature/sprouts-plus/consensus"
+	"github.com/applicature/sprouts-plus/core"
+	"github.com/applicature/sprouts-plus/core/types"
+	"github.com/applicature/sprouts-plus/event"
+	"github.com/applicature/sprouts-plus/log"
+)
+
+// DefaultEpochLength is the suggested number of blocks summarized by a single
+// epoch summary, about a week of blocks two minutes apart.
+const DefaultEpochLength = 5040
+
+// epochSummaryVersion identifies the layout of the stored epoch summaries.
+// Summaries of another version are recomputed.
+const epochSummaryVersion = 1
+
+var (
+	epochSummaryPrefix = []byte("sprouts-epoch-summary-") // Prefix of the summaries, followed by the epoch index
+	latestEpochKey     = []byte("sprouts-latest-epoch")   // Key of the index of the latest summary, open or sealed
+)
+
+// maxEpochRange is the number of summaries returned by a single range query
+// at most.
+const maxEpochRange = 256
+
+var (
+	errNoEpochSummaries  = errors.New("epoch summaries not kept")
+	errUnknownEpoch      = errors.New("unknown epoch")
+	errInvalidEpochRange = errors.New("invalid epoch range")
+)
+
+// epochSummary sums up the blocks of an epoch, the blocks from index*length+1
+// to (index+1)*length. It is sealed once its last block is summarized. The
+// summaries are informational only, consensus doesn't depend on them.
+type epochSummary struct {
+	Version    uint64           `json:"version"`
+	Index      uint64           `json:"index"`
+	Last       uint64           `json:"last"`     // Last block summarized
+	LastHash   common.Hash      `json:"lastHash"` // Hash of the last block summarized
+	Sealed     bool             `json:"sealed"`
+	Blocks     uint64           `json:"blocks"`
+	Difficulty *big.Int         `json:"difficulty"` // Sum of the difficulties
+	Stake      *big.Int         `json:"stake"`      // Sum of the staked coin-days
+	Rewards    *big.Int         `json:"rewards"`    // Sum of the rewards paid, including charity and r&d
+	Minters    []common.Address `json:"minters"`    // Coinbases of the blocks, sorted and unique
+}
+
+func newEpochSummary(index uint64) *epochSummary {
+	return &epochSummary{
+		Version:    epochSummaryVersion,
+		Index:      index,
+		Difficulty: new(big.Int),
+		Stake:      new(big.Int),
+		Rewards:    new(big.Int),
+		Minters:    []common.Address{},
+	}
+}
+
+// addToEpoch summarizes the header, which must be the successor of the last
+// block summarized.
+func (engine *PoS) addToEpoch(summary *epochSummary, header *types.Header) {
+	summary.Last, summary.LastHash = header.Number.Uint64(), header.Hash()
+	summary.Blocks++
+	summary.Difficulty.Add(summary.Difficulty, header.Difficulty)
+	if stake, err := extractStake(header); err == nil {
+		summary.Stake.Add(summary.Stake, stake.Age)
+		summary.Rewards.Add(summary.Rewards, blockReward(engine.config, stake))
+	}
+	i := sort.Search(len(summary.Minters), func(i int) bool {
+		return bytes.Compare(summary.Minters[i][:], header.Coinbase[:]) >= 0
+	})
+	if i == len(summary.Minters) || summary.Minters[i] != header.Coinbase {
+		summary.Minters = append(summary.Minters, common.Address{})
+		copy(summary.Minters[i+1:], summary.Minters[i:])
+		summary.Minters[i] = header.Coinbase
+	}
+	summary.Sealed = summary.Last == (summary.Index+1)*engine.epochLength
+}
+
+func epochSummaryKey(index uint64) []byte {
+	key := make([]byte, len(epochSummaryPrefix)+8)
+	copy(key, epochSummaryPrefix)
+	binary.BigEndian.PutUint64(key[len(epochSummaryPrefix):], index)
+	return key
+}
+
+// latestEpoch returns the index of the latest stored summary.
+func (engine *PoS) latestEpoch() (uint64, bool) {
+	if engine.db == nil {
+		return 0, false
+	}
+	blob, err := engine.db.Get(latestEpochKey)
+	if err != nil || len(blob) != 8 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint64(blob), true
+}
+
+// loadEpochSummary retrieves the summary of the epoch with the given index,
+// failing for epochs past the latest one and for summaries of another version.
+func (engine *PoS) loadEpochSummary(index uint64) (*epochSummary, error) {
+	if latest, ok := engine.latestEpoch(); !ok || index > latest {
+		return nil, errUnknownEpoch
+	}
+	blob, err := engine.db.Get(epochSummaryKey(index))
+	if err != nil {
+		return nil, errUnknownEpoch
+	}
+	summary := new(epochSummary)
+	if err := json.Unmarshal(blob, summary); err != nil {
+		return nil, err
+	}
+	if summary.Version != epochSummaryVersion || summary.Index != index {
+		return nil, errUnknownEpoch
+	}
+	return summary, nil
+}
+
+// storeEpochSummary persists the summary and makes it the latest one.
+func (engine *PoS) storeEpochSummary(summary *epochSummary) error {
+	blob, err := json.Marshal(summary)
+	if err != nil {
+		return err
+	}
+	if err := engine.db.Put(epochSummaryKey(summary.Index), blob); err != nil {
+		return err
+	}
+	index := make([]byte, 8)
+	binary.BigEndian.PutUint64(index, summary.Index)
+	return engine.db.Put(latestEpochKey, index)
+}
+
+// resumeEpoch returns the latest stored summary which is still part of the
+// canonical chain, to continue summarizing from. Summaries of blocks reorged
+// away are dropped, so their epochs are summarized again. A new summary of the
+// first epoch is returned if there is none to resume.
+func (engine *PoS) resumeEpoch(chain consensus.ChainReader) *epochSummary {
+	latest, ok := engine.latestEpoch()
+	if !ok {
+		return newEpochSummary(0)
+	}
+	for index := int64(latest); index >= 0; index-- {
+		summary, err := engine.loadEpochSummary(uint64(index))
+		if err == nil && summary.Blocks == 0 {
+			continue
+		}
+		if err == nil {
+			if header := chain.GetHeaderByNumber(summary.Last); header != nil && header.Hash() == summary.LastHash {
+				if summary.Sealed {
+					return newEpochSummary(summary.Index + 1)
+				}
+				return summary
+			}
+		}
+		log.Debug("Reopening epoch summary", "index", index)
+	}
+	return newEpochSummary(0)
+}
+
+// updateEpochSummaries summarizes the canonical blocks up to the current head
+// which aren't yet, reopening the epochs affected by reorgs. Every sealed
+// summary is persisted as soon as it is complete, so an interrupted backfill
+// resumes where it stopped. It returns errEngineClosed if quit is closed
+// first.
+func (engine *PoS) updateEpochSummaries(chain consensus.ChainReader, quit <-chan struct{}) error {
+	if engine.epochLength == 0 || engine.db == nil {
+		return errNoEpochSummaries
+	}
+	engine.epochLock.Lock()
+	defer engine.epochLock.Unlock()
+
+	head := chain.CurrentHeader().Number.Uint64()
+	summary := engine.resumeEpoch(chain)
+	for number := summary.Index*engine.epochLength + summary.Blocks + 1; number <= head; number++ {
+		select {
+		case <-quit:
+			return errEngineClosed
+		default:
+		}
+		header := chain.GetHeaderByNumber(number)
+		if header == nil {
+			break
+		}
+		engine.addToEpoch(summary, header)
+		if summary.Sealed {
+			if err := engine.persist(func() error { return engine.storeEpochSummary(summary) }); err != nil {
+				return err
+			}
+			summary = newEpochSummary(summary.Index + 1)
+		}
+	}
+	// the open summary is stored even if empty, it replaces any summaries of
+	// blocks reorged away
+	return engine.persist(func() error { return engine.storeEpochSummary(summary) })
+}
+
+// chainHeadSubscriber is a chain announcing its new heads, like core.BlockChain.
+type chainHeadSubscriber interface {
+	consensus.ChainReader
+	SubscribeChainHeadEvent(ch chan<- core.ChainHeadEvent) event.Subscription
+}
+
+// StartEpochSummaries keeps the epoch summaries of the chain up to date until
+// the engine is closed. The history is summarized first, then every new head
+// extends or corrects the summaries. Nothing is done unless an epoch length
+// is set in the options.
+func (engine *PoS) StartEpochSummaries(chain chainHeadSubscriber) {
+	if engine.epochLength == 0 || engine.db == nil {
+		return
+	}
+	heads := make(chan core.ChainHeadEvent, 16)
+	sub := chain.SubscribeChainHeadEvent(heads)
+
+	spawned := engine.life.spawn(func(quit <-chan struct{}, _ uint64) {
+		defer sub.Unsubscribe()
+
+		if err := engine.updateEpochSummaries(chain, quit); err != nil {
+			log.Warn("Failed to backfill epoch summaries", "err", err)
+		}
+		for {
+			select {
+			case <-heads:
+				if err := engine.updateEpochSummaries(chain, quit); err != nil {
+					log.Warn("Failed to update epoch summaries", "err", err)
+				}
+			case <-sub.Err():
+				return
+			case <-quit:
+				return
+			}
+		}
+	})
+	if !spawned {
+		sub.Unsubscribe()
+	}
+}
@@ -0,0 +1,98 @@
+package sprouts
+
+import (
+	"math/big"
+	"reflect"
+	"testing"
+
+	"github.com/applicature/sprouts-plus/common/hexutil"
+	"github.com/applicature/sprouts-plus/core"
+	"github.com/applicature/sprouts-plus/core/vm"
+	"github.com/applicature/sprouts-plus/ethdb"
+	"github.com/applicature/sprouts-plus/params"
+)
+
+// Tests that the epoch summaries are corrected after a reorg across an epoch
+// boundary, matching the ones summarized from scratch.
+func TestEpochSummariesReorg(t *testing.T) {
+	db, genesis, _ := initBlockchainStructures(t)
+	engine := newTestFaker(t, &sproutsConfig, db)
+	engine.epochLength = 4
+	genesisBlock := genesis.MustCommit(db)
+	blockchain, err := core.NewBlockChain(db, genesis.Config, engine, vm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blockchain.Stop()
+
+	blocks, _ := GenerateFakeChain(&sproutsConfig, params.TestSproutsChainConfig, genesisBlock, db, 10, func(i int, b *BlockGen) {
+		b.SetCoinbase(rewardsAddr)
+	})
+	if _, err := blockchain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	if err := engine.updateEpochSummaries(blockchain, nil); err != nil {
+		t.Fatalf("failed to summarize epochs: %v", err)
+	}
+	api := &API{chain: blockchain, sprouts: engine}
+	summaries, err := api.EpochRange(0, 10)
+	if err != nil {
+		t.Fatalf("failed to retrieve summaries: %v", err)
+	}
+	if len(summaries) != 3 || !summaries[1].Sealed || summaries[2].Sealed || summaries[2].Blocks != 2 {
+		t.Fatalf("summaries mismatch: %+v", summaries)
+	}
+
+	// A longer fork from block 3 minted by another signer replaces epoch 0
+	// partially and epochs 1 and 2 entirely
+	fork, _ := GenerateFakeChain(&sproutsConfig, params.TestSproutsChainConfig, blocks[2], db, 11, func(i int, b *BlockGen) {
+		b.SetCoinbase(testAddr)
+		b.SetDifficulty(big.NewInt(2))
+	})
+	if _, err := blockchain.InsertChain(fork); err != nil {
+		t.Fatalf("failed to insert fork: %v", err)
+	}
+	if err := engine.updateEpochSummaries(blockchain, nil); err != nil {
+		t.Fatalf("failed to summarize epochs: %v", err)
+	}
+
+	freshDb, _ := ethdb.NewMemDatabase()
+	fresh := newTestFaker(t, &sproutsConfig, freshDb)
+	fresh.epochLength = 4
+	if err := fresh.updateEpochSummaries(blockchain, nil); err != nil {
+		t.Fatalf("failed to summarize epochs from scratch: %v", err)
+	}
+	have, err := api.EpochRange(0, 10)
+	if err != nil {
+		t.Fatalf("failed to retrieve summaries: %v", err)
+	}
+	want, _ := (&API{chain: blockchain, sprouts: fresh}).EpochRange(0, 10)
+	if len(want) != 4 {
+		t.Fatalf("summary count mismatch: have %d, want 4", len(want))
+	}
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("summaries mismatch:\nhave %+v\nwant %+v", have, want)
+	}
+	if len(have[0].Minters) != 2 || have[1].Minters[0] != testAddr || uint64(have[1].AverageDifficulty.ToInt().Int64()) != 2 {
+		t.Errorf("reorged epoch mismatch: %+v", have[0:2])
+	}
+
+	// Summaries of another schema version are recomputed
+	summary, err := engine.loadEpochSummary(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	summary.Version, summary.Blocks = 0, 1
+	if err := engine.storeEpochSummary(summary); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := api.EpochSummary(hexutil.Uint64(1)); err != errUnknownEpoch {
+		t.Errorf("error mismatch: have %v, want %v", err, errUnknownEpoch)
+	}
+	if err := engine.updateEpochSummaries(blockchain, nil); err != nil {
+		t.Fatalf("failed to summarize epochs: %v", err)
+	}
+	if have, _ := api.EpochRange(0, 10); !reflect.DeepEqual(have, want) {
+		t.Errorf("recomputed summaries mismatch:\nhave %+v\nwant %+v", have, want)
+	}
+}
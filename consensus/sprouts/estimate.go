@@ -0,0 +1,148 @@
+package sprouts
+
+import (
+	"math"
+	"math/big"
+
+	"github.com/applicature/sprouts-plus/common/hexutil"
+	"github.com/applicature/sprouts-plus/consensus"
+	"github.com/applicature/sprouts-plus/core/types"
+	"github.com/applicature/sprouts-plus/params"
+)
+
+// stakeEstimateWindow is the number of seconds ahead the chances of finding a
+// kernel are estimated for.
+const stakeEstimateWindow = 24 * 60 * 60
+
+// kernelSpace is the number of values the compared part of a kernel hash
+// can take.
+var kernelSpace = new(big.Float).SetUint64(1 << 32)
+
+// StakeEstimate reports the chances of the local signer to mint the next block.
+// Its numbers are copies owned by the caller.
+type StakeEstimate struct {
+	CoinAge      *hexutil.Big    `json:"coinAge"`      // Coin age available for staking
+	Difficulty   *hexutil.Big    `json:"difficulty"`   // Difficulty of the next block
+	Target       *hexutil.Big    `json:"target"`       // Kernel target at the earliest possible timestamp
+	Probability  float64         `json:"probability"`  // Chance of finding a kernel within the next block period
+	ExpectedWait *hexutil.Uint64 `json:"expectedWait"` // Seconds until a kernel is more likely found than not, nil if not within a day
+}
+
+// EstimateNextStake estimates when the primary signer can mint the next block on
+// top of the current head, without sealing or recording anything.
+func (engine *PoS) EstimateNextStake(chain consensus.ChainReader) (*StakeEstimate, error) {
+	parent := chain.CurrentHeader()
+	if parent == nil {
+		return nil, errUnknownBlock
+	}
+	now := engine.unixNow()
+	difficulty := engine.CalcDifficulty(chain, now, parent)
+	ca, err := engine.ComputeCoinAge(chain, engine.primarySigner().address, now)
+	if err != nil {
+		return nil, err
+	}
+	return estimateStake(engine.config, parent, difficulty, ca.Age, now), nil
+}
+
+// CanSeal reports whether the primary signer would find a kernel for a block on
+// top of the current head right now, and if so at which timestamp step. Like
+// Seal, a stake below the minimum stake age can't mint, nor can a signer within
+// the minimum signer gap. Nothing is sealed or recorded.
+func (engine *PoS) CanSeal(chain consensus.ChainReader) (bool, *big.Int, error) {
+	primary := engine.primarySigner()
+	signer, signerFn := primary.address, primary.signFn
+
+	if signerFn == nil {
+		return false, nil, errUnauthorized
+	}
+	parent := chain.CurrentHeader()
+	if parent == nil {
+		return false, nil, errUnknownBlock
+	}
+	header := &types.Header{
+		ParentHash: parent.Hash(),
+		Coinbase:   signer,
+		Number:     new(big.Int).Add(parent.Number, big1),
+		Time:       new(big.Int).SetUint64(parent.Time.Uint64() + engine.config.BlockPeriod),
+	}
+	if now := engine.clock.Now().Unix(); header.Time.Int64() < now {
+		header.Time.SetInt64(now)
+	}
+	header.Difficulty = engine.CalcDifficulty(chain, header.Time.Uint64(), parent)
+	err := engine.checkSignerGap(chain, header, parent, nil)
+	if err == errRecentlySigned {
+		return false, nil, nil
+	}
+	if err != nil {
+		return false, nil, err
+	}
+
+	stake, err := engine.ComputeCoinAge(chain, signer, header.Time.Uint64())
+	if err != nil {
+		return false, nil, err
+	}
+	if checkMinStakeAge(engine.config, stake) != nil {
+		return false, nil, nil
+	}
+	age := stake.Age
+	if age.Sign() == 0 {
+		age = big1
+	}
+	// the kernel search itself, computeKernel would count it as sealing
+	attempt, err := engine.findKernel(parent, age, header)
+	if err == errCantFindKernel {
+		return false, nil, nil
+	}
+	if err != nil {
+		return false, nil, err
+	}
+	return true, new(big.Int).SetUint64(attempt.Offset), nil
+}
+
+// estimateStake runs the kernel target math over the timestamps following now
+// to estimate the chances of a stake of the given age.
+func estimateStake(config *params.SproutsConfig, parent *types.Header, difficulty, age *big.Int, now uint64) *StakeEstimate {
+	start := parent.Time.Uint64() + config.BlockPeriod
+	if start < now {
+		start = now
+	}
+	estimate := &StakeEstimate{
+		CoinAge:    (*hexutil.Big)(new(big.Int).Set(age)),
+		Difficulty: (*hexutil.Big)(new(big.Int).Set(difficulty)),
+	}
+	// every second a new kernel timestamp can be tried
+	miss := 1.0
+	for offset := uint64(0); offset < stakeEstimateWindow; offset++ {
+		timeWeight := start + offset - parent.Time.Uint64()
+		if timeWeight > stakeMaxTime {
+			timeWeight = stakeMaxTime
+		}
+		target := kernelTarget(config, difficulty, age, timeWeight)
+		if offset == 0 {
+			estimate.Target = (*hexutil.Big)(target)
+		}
+		miss *= 1 - kernelChance(target)
+
+		if offset+1 == config.BlockPeriod {
+			estimate.Probability = 1 - miss
+		}
+		if miss <= 0.5 && estimate.ExpectedWait == nil {
+			wait := hexutil.Uint64(start + offset - now)
+			estimate.ExpectedWait = &wait
+		}
+		if estimate.ExpectedWait != nil && offset+1 >= config.BlockPeriod {
+			break
+		}
+	}
+	if config.BlockPeriod == 0 || config.BlockPeriod > stakeEstimateWindow {
+		estimate.Probability = 1 - miss
+	}
+	return estimate
+}
+
+// kernelChance returns the probability of a single kernel hash beating the
+// target.
+func kernelChance(target *big.Int) float64 {
+	chance, _ := new(big.Float).Quo(new(big.Float).SetInt(target), kernelSpace).Float64()
+	return math.Min(chance, 1)
+}
@@ -0,0 +1,90 @@
+package sprouts
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/applicature/sprouts-plus/accounts"
+	"github.com/applicature/sprouts-plus/core/types"
+	"github.com/applicature/sprouts-plus/crypto"
+)
+
+func TestEstimateStakeZero(t *testing.T) {
+	parent := &types.Header{Number: big.NewInt(10), Time: big.NewInt(startDate.Unix())}
+	now := uint64(startDate.Unix()) + 5
+
+	estimate := estimateStake(&sproutsConfig, parent, big.NewInt(1000), big.NewInt(0), now)
+	if estimate.Target.ToInt().Sign() != 0 {
+		t.Errorf("target of no stake mismatch: have %v, want 0", estimate.Target)
+	}
+	if estimate.Probability != 0 {
+		t.Errorf("probability of no stake mismatch: have %v, want 0", estimate.Probability)
+	}
+	if estimate.ExpectedWait != nil {
+		t.Errorf("no stake expected to mint after %d seconds", *estimate.ExpectedWait)
+	}
+}
+
+func TestEstimateStakeLarge(t *testing.T) {
+	parent := &types.Header{Number: big.NewInt(10), Time: big.NewInt(startDate.Unix())}
+	now := uint64(startDate.Unix()) + 5
+
+	estimate := estimateStake(&sproutsConfig, parent, big.NewInt(10), testStakeAge, now)
+	if estimate.ExpectedWait == nil || *estimate.ExpectedWait > 60 {
+		t.Fatalf("large stake not expected to mint within a minute: %v", estimate.ExpectedWait)
+	}
+	// minting isn't possible before the block period elapsed
+	if min := parent.Time.Uint64() + sproutsConfig.BlockPeriod - now; uint64(*estimate.ExpectedWait) < min {
+		t.Errorf("expected wait below the block period: have %d, want at least %d", *estimate.ExpectedWait, min)
+	}
+	if estimate.Probability <= 0.5 {
+		t.Errorf("probability of a large stake too low: %v", estimate.Probability)
+	}
+}
+
+// Tests that CanSeal requires an authorized signer and holds back stakes below
+// the minimum stake age.
+func TestCanSeal(t *testing.T) {
+	blockchain, _, engine := newTestChain(t, 0)
+	defer blockchain.Stop()
+
+	if _, _, err := engine.CanSeal(blockchain); err != errUnauthorized {
+		t.Fatalf("error mismatch: have %v, want %v", err, errUnauthorized)
+	}
+	engine.Authorize(rewardsAddr, func(account accounts.Account, hash []byte) ([]byte, error) {
+		return crypto.Sign(hash, rewardsKey)
+	})
+	// the premine is old enough to mint right away
+	eligible, step, err := engine.CanSeal(blockchain)
+	if err != nil {
+		t.Fatalf("failed to check eligibility: %v", err)
+	}
+	if !eligible || step == nil || step.Uint64() > 60 {
+		t.Errorf("eligibility mismatch: have %v at step %v, want eligible", eligible, step)
+	}
+	config := sproutsConfig
+	config.MinStakeAge = new(big.Int).Add(stakeMaxAge, big1)
+	engine.config = &config
+	if eligible, step, err := engine.CanSeal(blockchain); err != nil || eligible || step != nil {
+		t.Errorf("eligibility below the minimum stake age mismatch: have %v at step %v, %v, want not eligible", eligible, step, err)
+	}
+}
+
+// Tests that estimating the next stake leaves the signer's records untouched.
+func TestEstimateNextStakeRecordsNothing(t *testing.T) {
+	blockchain, blocks, engine := newTestChain(t, 2)
+	defer blockchain.Stop()
+
+	if _, err := blockchain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	if _, err := engine.EstimateNextStake(blockchain); err != nil {
+		t.Fatalf("failed to estimate the next stake: %v", err)
+	}
+	if ca, err := loadCoinAge(engine.db, rewardsAddr); err == nil {
+		t.Errorf("coin age recorded: %+v", ca)
+	}
+	if _, err := engine.loadCoinAgeLog(rewardsAddr); err != errNoCoinAgeLog {
+		t.Errorf("coin age log error mismatch: have %v, want %v", err, errNoCoinAgeLog)
+	}
+}
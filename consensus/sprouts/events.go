@@ -0,0 +1,82 @@
+package sprouts
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/applicature/sprouts-plus/common"
+	"github.com/applicature/sprouts-plus/consensus"
+	"github.com/applicature/sprouts-plus/core/types"
+	"github.com/applicature/sprouts-plus/event"
+)
+
+// Outcomes of a header verification.
+const (
+	OutcomeAccepted = "accepted" // header conforms to the consensus rules
+	OutcomeRejected = "rejected" // header violates the consensus rules
+	OutcomeDeferred = "deferred" // parent is not known (yet), header can't be judged
+)
+
+// VerificationEvent is posted for every header verified through VerifyHeader
+// or VerifyHeaders. Accepted headers are subject to sampling, see Options.
+type VerificationEvent struct {
+	Number   uint64        `json:"number"`
+	Hash     common.Hash   `json:"hash"`
+	Source   string        `json:"source,omitempty"` // Source the header is attributed to, see WithSource
+	Outcome  string        `json:"outcome"`
+	Class    string        `json:"class,omitempty"` // Class of the rejection
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"duration"` // Time the verification took
+}
+
+// verificationEvents publishes the outcomes of header verifications.
+type verificationEvents struct {
+	accepted uint64 // Number of acceptances seen, accessed atomically and first for alignment
+	sampling uint64 // Post one in that many acceptances, all of them if 0
+	feed     event.Feed
+	scope    event.SubscriptionScope
+}
+
+// post publishes the outcome of the verification of the header unless it is
+// an acceptance skipped by the sampling. It blocks until all subscribers
+// received the event.
+func (e *verificationEvents) post(header *types.Header, source string, err error, duration time.Duration) {
+	if e == nil || e.scope.Count() == 0 {
+		return
+	}
+	ev := VerificationEvent{
+		Hash:     header.Hash(),
+		Source:   source,
+		Duration: duration,
+	}
+	if header.Number != nil {
+		ev.Number = header.Number.Uint64()
+	}
+	switch err {
+	case nil:
+		if e.sampling > 1 && (atomic.AddUint64(&e.accepted, 1)-1)%e.sampling != 0 {
+			return
+		}
+		ev.Outcome = OutcomeAccepted
+	case consensus.ErrUnknownAncestor:
+		ev.Outcome, ev.Error = OutcomeDeferred, err.Error()
+	default:
+		ev.Outcome, ev.Class, ev.Error = OutcomeRejected, errorClass(err), err.Error()
+	}
+	e.feed.Send(ev)
+}
+
+// close ends all subscriptions.
+func (e *verificationEvents) close() {
+	if e != nil {
+		e.scope.Close()
+	}
+}
+
+// SubscribeVerificationEvents registers a subscription for the outcomes of
+// header verifications. Subscribers must keep up with the events, as the
+// verification waits for them to be delivered. The subscription ends when
+// the engine is closed.
+func (engine *PoS) SubscribeVerificationEvents(ch chan<- VerificationEvent) event.Subscription {
+	return engine.verifications.scope.Track(engine.verifications.feed.Subscribe(ch))
+}
@@ -0,0 +1,175 @@
+package sprouts
+
+import (
+	"context"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/applicature/sprouts-plus/consensus"
+	"github.com/applicature/sprouts-plus/core/types"
+	"github.com/applicature/sprouts-plus/rpc"
+)
+
+// verifyTestBatch verifies the headers in a single batch and returns the
+// verification results.
+func verifyTestBatch(t *testing.T, engine *PoS, chain consensus.ChainReader, headers []*types.Header) []error {
+	seals := make([]bool, len(headers))
+	for i := range seals {
+		seals[i] = true
+	}
+	_, results := engine.VerifyHeaders(chain, headers, seals)
+
+	errs := make([]error, len(headers))
+	for i := range headers {
+		select {
+		case errs[i] = <-results:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("header %d: verification timed out", i)
+		}
+	}
+	return errs
+}
+
+// checkVerificationEvent verifies that the event reports the given result of
+// the header's verification.
+func checkVerificationEvent(t *testing.T, ev VerificationEvent, header *types.Header, err error) {
+	if ev.Hash != header.Hash() || ev.Number != header.Number.Uint64() {
+		t.Errorf("event of header %d mismatch: have %d %x, want %x", header.Number, ev.Number, ev.Hash, header.Hash())
+	}
+	switch err {
+	case nil:
+		if ev.Outcome != OutcomeAccepted {
+			t.Errorf("header %d: outcome mismatch: have %s, want %s", header.Number, ev.Outcome, OutcomeAccepted)
+		}
+	case consensus.ErrUnknownAncestor:
+		if ev.Outcome != OutcomeDeferred {
+			t.Errorf("header %d: outcome mismatch: have %s, want %s", header.Number, ev.Outcome, OutcomeDeferred)
+		}
+	default:
+		if ev.Outcome != OutcomeRejected || ev.Class != errorClass(err) || ev.Error != err.Error() {
+			t.Errorf("header %d: rejection mismatch: have %s/%s/%s, want %s/%s/%v", header.Number, ev.Outcome, ev.Class, ev.Error, OutcomeRejected, errorClass(err), err)
+		}
+	}
+}
+
+// Tests that the verification events of a mixed batch match the returned
+// verification results.
+func TestVerificationEvents(t *testing.T) {
+	blockchain, blocks, engine := newTestChain(t, 4)
+	defer blockchain.Stop()
+
+	headers := make([]*types.Header, len(blocks))
+	for i, block := range blocks {
+		headers[i] = block.Header()
+	}
+	// Move the third header into the future, orphaning the fourth
+	engine.SetClock(newFakeClock(headers[3].Time.Int64()))
+	headers[2].Time = new(big.Int).Add(headers[3].Time, big.NewInt(3600))
+
+	events := make(chan VerificationEvent, len(headers))
+	sub := engine.SubscribeVerificationEvents(events)
+	defer sub.Unsubscribe()
+
+	errs := verifyTestBatch(t, engine, WithSource(blockchain, "peer"), headers)
+	for i, header := range headers {
+		select {
+		case ev := <-events:
+			checkVerificationEvent(t, ev, header, errs[i])
+			if ev.Source != "peer" {
+				t.Errorf("header %d: source mismatch: have %q, want %q", i, ev.Source, "peer")
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("header %d: event missing", i)
+		}
+	}
+	// Single header verification posts events too
+	err := engine.VerifyHeader(blockchain, headers[2], true)
+	select {
+	case ev := <-events:
+		checkVerificationEvent(t, ev, headers[2], err)
+	case <-time.After(time.Second):
+		t.Fatal("single header event missing")
+	}
+}
+
+// Tests that only every n-th acceptance is posted while all rejections are.
+func TestVerificationEventsSampling(t *testing.T) {
+	blockchain, blocks, engine := newTestChain(t, 8)
+	defer blockchain.Stop()
+
+	configured, err := NewWithOptions(&sproutsConfig, nil, Options{VerificationEventSampling: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if configured.verifications.sampling != 3 {
+		t.Fatalf("sampling mismatch: have %d, want 3", configured.verifications.sampling)
+	}
+	engine.verifications = &verificationEvents{sampling: 3}
+
+	headers := make([]*types.Header, len(blocks))
+	for i, block := range blocks {
+		headers[i] = block.Header()
+	}
+	engine.SetClock(newFakeClock(headers[7].Time.Int64()))
+	headers[7].Time = new(big.Int).Add(headers[7].Time, big.NewInt(3600))
+
+	events := make(chan VerificationEvent, len(headers))
+	sub := engine.SubscribeVerificationEvents(events)
+	defer sub.Unsubscribe()
+
+	errs := verifyTestBatch(t, engine, blockchain, headers)
+	for _, i := range []int{0, 3, 6, 7} {
+		select {
+		case ev := <-events:
+			checkVerificationEvent(t, ev, headers[i], errs[i])
+		case <-time.After(time.Second):
+			t.Fatalf("header %d: event missing", i)
+		}
+	}
+	select {
+	case ev := <-events:
+		t.Errorf("unexpected event of header %d", ev.Number)
+	default:
+	}
+}
+
+// Tests that the verification events are delivered through the RPC pub/sub
+// channel. Closing the engine waits for the forwarding to end.
+func TestVerificationEventsSubscription(t *testing.T) {
+	blockchain, blocks, engine := newTestChain(t, 1)
+	defer blockchain.Stop()
+
+	server := rpc.NewServer()
+	defer server.Stop()
+	for _, api := range engine.APIs(blockchain) {
+		if err := server.RegisterName(api.Namespace, api.Service); err != nil {
+			t.Fatal(err)
+		}
+	}
+	client := rpc.DialInProc(server)
+	defer client.Close()
+
+	events := make(chan VerificationEvent)
+	sub, err := client.Subscribe(context.Background(), "sprouts", events, "verificationEvents")
+	if err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+	defer sub.Unsubscribe()
+
+	// notifications are delivered asynchronously
+	header := blocks[0].Header()
+	deadline := time.After(10 * time.Second)
+	for {
+		err := engine.VerifyHeader(blockchain, header, false)
+		select {
+		case ev := <-events:
+			checkVerificationEvent(t, ev, header, err)
+			engine.Close()
+			return
+		case <-time.After(10 * time.Millisecond):
+		case <-deadline:
+			t.Fatal("event not delivered")
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package sprouts
+
+// headerExtraVersion is the version of the extra-data layout written by
+// Prepare, kept in the last reserved byte. Extras without it are legacy ones,
+// whose regions are counted from the end, after reserved bytes of any length.
+const headerExtraVersion = 1
+
+// headerExtra is the extra-data of a header split into its regions:
+//
+//	reserved (32) | kernel hash (32) | hashed timestamp (32) | stake (52) | seal (65)
+//
+// Decoded regions share the memory of the decoded extra-data, encode always
+// returns a fresh copy.
+type headerExtra struct {
+	Version         byte   // Layout version, 0 for legacy extras
+	Reserved        []byte // Vanity, ending with the version byte unless legacy
+	Kernel          []byte // Kernel hash found by the sealer
+	HashedTimestamp []byte // Hash of the step the kernel was found at
+	Stake           []byte // Encoded stake, see coinAge.bytes
+	Seal            []byte // Signature of the sealer
+}
+
+// newHeaderExtra returns the extra-data of the current layout with the given
+// vanity, truncated to the reserved bytes before the version byte, and all
+// other regions empty.
+func newHeaderExtra(vanity []byte) *headerExtra {
+	reserved := make([]byte, extraDefault)
+	copy(reserved[:extraDefault-1], vanity)
+	reserved[extraDefault-1] = headerExtraVersion
+
+	return &headerExtra{
+		Version:         headerExtraVersion,
+		Reserved:        reserved,
+		Kernel:          make([]byte, extraKernel/2),
+		HashedTimestamp: make([]byte, extraKernel/2),
+		Stake:           make([]byte, extraCoinAge),
+		Seal:            make([]byte, extraSeal),
+	}
+}
+
+// decodeHeaderExtra splits the extra-data into its regions. It fails with
+// errMissingSignature if the extra-data is too short to hold all regions but
+// the reserved ones. The stake is left encoded.
+func decodeHeaderExtra(extra []byte) (*headerExtra, error) {
+	if len(extra) < extraKernel+extraCoinAge+extraSeal {
+		return nil, errMissingSignature
+	}
+	// versioned extras have the exact length, so their regions are the same
+	// whether counted from the start or the end
+	reserved := len(extra) - extraKernel - extraCoinAge - extraSeal
+
+	decoded := &headerExtra{
+		Reserved:        extra[:reserved],
+		Kernel:          extra[reserved : reserved+extraKernel/2],
+		HashedTimestamp: extra[reserved+extraKernel/2 : reserved+extraKernel],
+		Stake:           extra[reserved+extraKernel : reserved+extraKernel+extraCoinAge],
+		Seal:            extra[reserved+extraKernel+extraCoinAge:],
+	}
+	if reserved == extraDefault && extra[extraDefault-1] == headerExtraVersion {
+		decoded.Version = headerExtraVersion
+	}
+	return decoded, nil
+}
+
+// encode joins the regions into extra-data. Regions shorter than their size
+// are padded with zeroes at the end, longer ones truncated; only the reserved
+// bytes are kept as they are.
+func (e *headerExtra) encode() []byte {
+	extra := make([]byte, len(e.Reserved)+extraKernel+extraCoinAge+extraSeal)
+
+	offset := copy(extra, e.Reserved)
+	for _, region := range []struct {
+		data []byte
+		size int
+	}{
+		{e.Kernel, extraKernel / 2},
+		{e.HashedTimestamp, extraKernel / 2},
+		{e.Stake, extraCoinAge},
+		{e.Seal, extraSeal},
+	} {
+		copy(extra[offset:offset+region.size], region.data)
+		offset += region.size
+	}
+	return extra
+}
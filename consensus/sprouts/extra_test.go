@@ -0,0 +1,168 @@
+package sprouts
+
+import (
+	"bytes"
+	"math/big"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"github.com/applicature/sprouts-plus/core"
+	"github.com/applicature/sprouts-plus/core/types"
+)
+
+// Tests that random extras of the current layout survive encoding and
+// decoding, and that legacy extras are reproduced byte for byte.
+func TestHeaderExtraRoundTrip(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	random := func(n int) []byte {
+		b := make([]byte, n)
+		rnd.Read(b)
+		return b
+	}
+	for i := 0; i < 1000; i++ {
+		extra := newHeaderExtra(random(rnd.Intn(2 * extraDefault)))
+		extra.Kernel, extra.HashedTimestamp = random(extraKernel/2), random(extraKernel/2)
+		extra.Stake, extra.Seal = random(extraCoinAge), random(extraSeal)
+
+		decoded, err := decodeHeaderExtra(extra.encode())
+		if err != nil {
+			t.Fatalf("extra %d: failed to decode: %v", i, err)
+		}
+		if !reflect.DeepEqual(decoded, extra) {
+			t.Fatalf("extra %d: round trip mismatch: have %+v, want %+v", i, decoded, extra)
+		}
+	}
+	for i := 0; i < 1000; i++ {
+		blob := random(extraKernel + extraCoinAge + extraSeal + rnd.Intn(2*extraDefault))
+		if len(blob) >= extraDefault && blob[extraDefault-1] == headerExtraVersion {
+			blob[extraDefault-1]++
+		}
+		decoded, err := decodeHeaderExtra(blob)
+		if err != nil {
+			t.Fatalf("legacy extra %d: failed to decode: %v", i, err)
+		}
+		if decoded.Version != 0 {
+			t.Errorf("legacy extra %d: version mismatch: have %d, want 0", i, decoded.Version)
+		}
+		if encoded := decoded.encode(); !bytes.Equal(encoded, blob) {
+			t.Fatalf("legacy extra %d: round trip mismatch: have %x, want %x", i, encoded, blob)
+		}
+	}
+}
+
+// Tests that legacy extras, whose regions are counted from the end, decode to
+// the same regions as the current layout.
+func TestHeaderExtraLegacy(t *testing.T) {
+	stake := &coinAge{Time: 1, Age: big.NewInt(100), Value: big.NewInt(10)}
+
+	for _, reserved := range []int{0, extraDefault - 1, extraDefault, extraDefault + 10} {
+		blob := make([]byte, reserved+extraKernel+extraCoinAge+extraSeal)
+		copy(blob[len(blob)-extraSeal-extraCoinAge:], stake.bytes())
+		blob[len(blob)-extraSeal-extraCoinAge-extraKernel] = 0x01
+
+		extra, err := decodeHeaderExtra(blob)
+		if err != nil {
+			t.Fatalf("reserved %d: failed to decode: %v", reserved, err)
+		}
+		if extra.Version != 0 || len(extra.Reserved) != reserved {
+			t.Errorf("reserved %d: layout mismatch: version %d, reserved %d bytes", reserved, extra.Version, len(extra.Reserved))
+		}
+		if !bytes.Equal(extra.Stake, stake.bytes()) || extra.Kernel[0] != 0x01 {
+			t.Errorf("reserved %d: regions mismatch: stake %x, kernel %x", reserved, extra.Stake, extra.Kernel)
+		}
+	}
+}
+
+// Tests that malformed extras fail with the documented errors instead of
+// panicking, whichever their length and content.
+func TestHeaderExtraMalformed(t *testing.T) {
+	engine := newTestEngine(t, &sproutsConfig, nil)
+	rnd := rand.New(rand.NewSource(2))
+
+	for i := 0; i < 2000; i++ {
+		blob := make([]byte, rnd.Intn(2*(extraDefault+extraKernel+extraCoinAge+extraSeal)))
+		rnd.Read(blob)
+		header := &types.Header{Number: big1, Extra: blob}
+
+		short := len(blob) < extraKernel+extraCoinAge+extraSeal
+		if _, err := decodeHeaderExtra(blob); short != (err == errMissingSignature) {
+			t.Fatalf("extra of %d bytes: error mismatch: %v", len(blob), err)
+		}
+		if _, err := extractStake(header); err != nil && err != errInvalidStake {
+			t.Fatalf("extra of %d bytes: stake error mismatch: have %v, want %v", len(blob), err, errInvalidStake)
+		}
+		if _, err := extractKernel(header); err != nil && err != errMissingSignature {
+			t.Fatalf("extra of %d bytes: kernel error mismatch: have %v, want %v", len(blob), err, errMissingSignature)
+		}
+		if _, err := engine.Author(header); short && err != errMissingSignature {
+			t.Fatalf("extra of %d bytes: author error mismatch: have %v, want %v", len(blob), err, errMissingSignature)
+		}
+	}
+}
+
+// Tests that headers with more than a vanity before their consensus regions
+// are rejected.
+func TestHeaderExtraTooLong(t *testing.T) {
+	blockchain, blocks, engine := newTestChain(t, 1)
+	defer blockchain.Stop()
+
+	header := blocks[0].Header()
+	if err := engine.VerifyHeader(blockchain, header, false); err != nil {
+		t.Fatalf("header rejected: %v", err)
+	}
+	header.Extra = append(make([]byte, 1024*1024), header.Extra...)
+	if err := engine.VerifyHeader(blockchain, header, false); err != errExtraTooLong {
+		t.Errorf("error mismatch: have %v, want %v", err, errExtraTooLong)
+	}
+	// a single byte beyond the reserved ones is too long as well
+	header = blocks[0].Header()
+	header.Extra = append([]byte{0}, header.Extra...)
+	if err := engine.VerifyHeader(blockchain, header, false); err != errExtraTooLong {
+		t.Errorf("error mismatch: have %v, want %v", err, errExtraTooLong)
+	}
+}
+
+// Tests that the vanity a miner sets survives Prepare and Seal.
+func TestHeaderExtraVanity(t *testing.T) {
+	blockchain, engine := newConformanceChain(t, 4)
+	defer blockchain.Stop()
+
+	parent := blockchain.CurrentBlock()
+	header := &types.Header{
+		ParentHash: parent.Hash(),
+		Number:     new(big.Int).Add(parent.Number(), big1),
+		GasLimit:   core.CalcGasLimit(parent),
+		GasUsed:    new(big.Int),
+		Time:       new(big.Int),
+		Extra:      []byte("hello"),
+	}
+	if err := engine.Prepare(blockchain, header); err != nil {
+		t.Fatalf("failed to prepare header: %v", err)
+	}
+	setTestStake(header, &coinAge{Time: header.Time.Uint64(), Age: testStakeAge, Value: big.NewInt(1000)})
+
+	statedb, err := blockchain.StateAt(parent.Root())
+	if err != nil {
+		t.Fatal(err)
+	}
+	txs := []*types.Transaction{types.NewTransaction(0, rewardsAddr, new(big.Int), big.NewInt(21000), new(big.Int), nil)}
+	block, err := engine.Finalize(blockchain, header, statedb, txs, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := engine.Seal(blockchain, block, make(chan struct{}))
+	if err != nil {
+		t.Fatalf("failed to seal block: %v", err)
+	}
+	if err := engine.VerifyHeader(blockchain, sealed.Header(), true); err != nil {
+		t.Fatalf("sealed header rejected: %v", err)
+	}
+	extra, err := decodeHeaderExtra(sealed.Extra())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vanity := bytes.TrimRight(extra.Reserved[:MaxVanityLength], "\x00"); string(vanity) != "hello" {
+		t.Errorf("vanity mismatch: have %q, want %q", vanity, "hello")
+	}
+}
@@ -0,0 +1,101 @@
+package sprouts
+
+import (
+	"math/big"
+
+	"github.com/applicature/sprouts-plus/common"
+	"github.com/applicature/sprouts-plus/consensus"
+	"github.com/applicature/sprouts-plus/core/types"
+	"github.com/applicature/sprouts-plus/log"
+)
+
+// inMemoryWeights is the number of cumulative chain weights to keep in memory.
+const inMemoryWeights = 4096
+
+// chainWeightPrefix is the prefix of the stored cumulative chain weights,
+// followed by the block hash.
+var chainWeightPrefix = []byte("sprouts-chain-weight-")
+
+func chainWeightKey(hash common.Hash) []byte {
+	return append(append([]byte{}, chainWeightPrefix...), hash[:]...)
+}
+
+// BlockWeight returns the weight of the header in the fork choice: its
+// difficulty plus the base 2 logarithm of the value of its stake, so the
+// branch backed by more stake is the heavier of two otherwise equal ones.
+// Headers without a valid stake, like the genesis, weigh their difficulty.
+func (engine *PoS) BlockWeight(header *types.Header) *big.Int {
+	weight := new(big.Int).Set(header.Difficulty)
+	if header.Number.Sign() == 0 {
+		return weight
+	}
+	stake, err := engine.headerStake(header)
+	if err != nil || stake.Value.Sign() <= 0 {
+		return weight
+	}
+	return weight.Add(weight, big.NewInt(int64(stake.Value.BitLen()-1)))
+}
+
+// ChainWeight implements consensus.ChainWeigher, returning the sum of the
+// block weights up to the header. Without StakeWeightedForkChoice it returns
+// nil, so the chain falls back to the total difficulty and breaks ties as
+// before.
+func (engine *PoS) ChainWeight(chain consensus.ChainReader, header *types.Header) *big.Int {
+	if !engine.config.StakeWeightedForkChoice {
+		return nil
+	}
+	var (
+		total   *big.Int
+		pending []*types.Header
+	)
+	for total == nil {
+		if header.Number.Sign() == 0 {
+			total = engine.BlockWeight(header)
+			break
+		}
+		if total = engine.loadChainWeight(header.Hash()); total != nil {
+			break
+		}
+		pending = append(pending, header)
+
+		if header = chain.GetHeader(header.ParentHash, header.Number.Uint64()-1); header == nil {
+			log.Warn("Missing ancestor for the chain weight", "hash", pending[len(pending)-1].ParentHash)
+			return nil
+		}
+	}
+	for i := len(pending) - 1; i >= 0; i-- {
+		total = new(big.Int).Add(total, engine.BlockWeight(pending[i]))
+		engine.storeChainWeight(pending[i].Hash(), total)
+	}
+	return total
+}
+
+// loadChainWeight retrieves the cumulative weight up to the block with the
+// given hash from memory or the database, nil if it isn't known.
+func (engine *PoS) loadChainWeight(hash common.Hash) *big.Int {
+	if cached, ok := engine.weights.Get(hash); ok {
+		return cached.(*big.Int)
+	}
+	if engine.db == nil {
+		return nil
+	}
+	blob, err := engine.db.Get(chainWeightKey(hash))
+	if err != nil || len(blob) == 0 {
+		return nil
+	}
+	total := new(big.Int).SetBytes(blob)
+	engine.weights.Add(hash, total)
+	return total
+}
+
+// storeChainWeight remembers the cumulative weight up to the block with the
+// given hash, persisting it so restarts don't walk the chain again.
+func (engine *PoS) storeChainWeight(hash common.Hash, total *big.Int) {
+	engine.weights.Add(hash, total)
+	if engine.db == nil {
+		return
+	}
+	if err := engine.persist(func() error { return engine.db.Put(chainWeightKey(hash), total.Bytes()) }); err != nil {
+		log.Debug("Failed to store chain weight", "hash", hash, "err", err)
+	}
+}
@@ -0,0 +1,120 @@
+package sprouts
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/applicature/sprouts-plus/core"
+	"github.com/applicature/sprouts-plus/core/types"
+	"github.com/applicature/sprouts-plus/core/vm"
+	"github.com/applicature/sprouts-plus/params"
+)
+
+// newForkChoiceTest creates a blockchain choosing forks by stake weight or by
+// total difficulty, along with two forks of n blocks on top of its genesis,
+// equal but for the value of their stakes.
+func newForkChoiceTest(t *testing.T, weighted bool, n int) (*core.BlockChain, *PoS, []*types.Block, []*types.Block) {
+	config := sproutsConfig
+	config.StakeWeightedForkChoice = weighted
+
+	db, genesis, _ := initBlockchainStructures(t)
+	fundTestStaker(genesis)
+	genesisBlock := genesis.MustCommit(db)
+
+	engine := newTestEngine(t, &config, db)
+	engine.Authorize(rewardsAddr, nil)
+	blockchain, err := core.NewBlockChain(db, genesis.Config, engine, vm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fork := func(age, value *big.Int) []*types.Block {
+		blocks, _ := GenerateChain(&config, params.TestSproutsChainConfig, genesisBlock, db, n, func(i int, b *BlockGen) {
+			b.SetCoinbase(rewardsAddr)
+			sealTestBlock(t, engine, b, &coinAge{Time: b.Header().Time.Uint64(), Age: age, Value: value})
+		})
+		return blocks
+	}
+	// the ages differ too, so the stakes aren't taken for duplicates
+	low := fork(new(big.Int).Sub(testStakeAge, big1), big.NewInt(1000))
+	high := fork(testStakeAge, big.NewInt(1000000))
+	return blockchain, engine, low, high
+}
+
+// Tests that the block weight adds the logarithm of the stake value to the
+// difficulty, and that the genesis weighs its difficulty alone.
+func TestBlockWeight(t *testing.T) {
+	blockchain, engine, low, high := newForkChoiceTest(t, true, 1)
+	defer blockchain.Stop()
+
+	if weight := engine.BlockWeight(blockchain.Genesis().Header()); weight.Cmp(blockchain.Genesis().Difficulty()) != 0 {
+		t.Errorf("genesis weight mismatch: have %v, want %v", weight, blockchain.Genesis().Difficulty())
+	}
+	for _, test := range []struct {
+		block *types.Block
+		log2  int64
+	}{
+		{low[0], 9},
+		{high[0], 19},
+	} {
+		want := new(big.Int).Add(test.block.Difficulty(), big.NewInt(test.log2))
+		if weight := engine.BlockWeight(test.block.Header()); weight.Cmp(want) != 0 {
+			t.Errorf("block %x: weight mismatch: have %v, want %v", test.block.Hash(), weight, want)
+		}
+	}
+}
+
+// Tests that of two forks of equal length and difficulty the one backed by
+// more stake becomes canonical, whichever is imported first.
+func TestStakeWeightedForkChoice(t *testing.T) {
+	for _, highFirst := range []bool{false, true} {
+		blockchain, engine, low, high := newForkChoiceTest(t, true, 4)
+
+		first, second := low, high
+		if highFirst {
+			first, second = high, low
+		}
+		if _, err := blockchain.InsertChain(first); err != nil {
+			t.Fatalf("high first %v: failed to insert first fork: %v", highFirst, err)
+		}
+		if _, err := blockchain.InsertChain(second); err != nil {
+			t.Fatalf("high first %v: failed to insert second fork: %v", highFirst, err)
+		}
+		lowHead, highHead := low[len(low)-1], high[len(high)-1]
+		lowTd, highTd := blockchain.GetTdByHash(lowHead.Hash()), blockchain.GetTdByHash(highHead.Hash())
+		if lowTd.Cmp(highTd) != 0 {
+			t.Fatalf("high first %v: forks differ in total difficulty: %v and %v", highFirst, lowTd, highTd)
+		}
+		if head := blockchain.CurrentBlock().Hash(); head != highHead.Hash() {
+			t.Errorf("high first %v: head mismatch: have %x, want %x", highFirst, head, highHead.Hash())
+		}
+		lowWeight, highWeight := engine.ChainWeight(blockchain, lowHead.Header()), engine.ChainWeight(blockchain, highHead.Header())
+		if highWeight.Cmp(lowWeight) <= 0 {
+			t.Errorf("high first %v: weight of the high stake fork %v not above %v", highFirst, highWeight, lowWeight)
+		}
+		blockchain.Stop()
+	}
+}
+
+// Tests that the chain weight is left to the total difficulty unless stake
+// weighted fork choice is enabled, and that stored weights survive restarts.
+func TestChainWeightFallback(t *testing.T) {
+	blockchain, engine, low, _ := newForkChoiceTest(t, false, 2)
+	defer blockchain.Stop()
+
+	if _, err := blockchain.InsertChain(low); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	if weight := engine.ChainWeight(blockchain, low[1].Header()); weight != nil {
+		t.Fatalf("weight without stake weighted fork choice: have %v, want nil", weight)
+	}
+	engine.config.StakeWeightedForkChoice = true
+	want := new(big.Int).Add(engine.BlockWeight(blockchain.Genesis().Header()), engine.BlockWeight(low[0].Header()))
+	want.Add(want, engine.BlockWeight(low[1].Header()))
+	if weight := engine.ChainWeight(blockchain, low[1].Header()); weight == nil || weight.Cmp(want) != 0 {
+		t.Fatalf("weight mismatch: have %v, want %v", weight, want)
+	}
+	engine.weights.Purge()
+	if weight := engine.loadChainWeight(low[1].Hash()); weight == nil || weight.Cmp(want) != 0 {
+		t.Fatalf("stored weight mismatch: have %v, want %v", weight, want)
+	}
+}
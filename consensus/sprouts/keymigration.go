@@ -0,0 +1,169 @@
+package sprouts
+
+import (
+	"bytes"
+	"context"
+	"math/big"
+	"time"
+
+	"github.com/applicature/sprouts-plus/common"
+	"github.com/applicature/sprouts-plus/consensus"
+	"github.com/applicature/sprouts-plus/core/types"
+	"github.com/applicature/sprouts-plus/crypto"
+)
+
+// inMemoryMigrations is the number of blocks to keep the key migration
+// senders of their ancestry in memory for.
+const inMemoryMigrations = 1024
+
+// keyMigrationPrefix starts the data of a key migration transaction, followed
+// by the consent signature of its recipient.
+var keyMigrationPrefix = []byte("sprouts-key-migration")
+
+// KeyMigrationHash returns the hash the new key signs to consent to taking
+// over the coin age of the old one.
+func KeyMigrationHash(chainID *big.Int, from, to common.Address) common.Hash {
+	return crypto.Keccak256Hash(keyMigrationPrefix, common.BigToHash(chainID).Bytes(), from.Bytes(), to.Bytes())
+}
+
+// KeyMigrationData returns the data of a transaction from the old key to the
+// new one carrying over the coin age of the old key, given the signature of
+// the new key over KeyMigrationHash. The old key should send its whole
+// balance, its coin age ends with the migration either way. Only the first
+// migration of a key carries over its coin age, later ones are ordinary
+// transfers.
+func KeyMigrationData(consent []byte) []byte {
+	return append(common.CopyBytes(keyMigrationPrefix), consent...)
+}
+
+// keyMigrationSender returns the sender of the transaction if it is a key
+// migration its recipient consented to.
+func keyMigrationSender(chainID *big.Int, tx *types.Transaction) (common.Address, bool) {
+	data := tx.Data()
+	if tx.To() == nil || len(data) != len(keyMigrationPrefix)+extraSeal || !bytes.HasPrefix(data, keyMigrationPrefix) {
+		return common.Address{}, false
+	}
+	from, err := From(tx)
+	if err != nil || from == *tx.To() {
+		return common.Address{}, false
+	}
+	pubkey, err := crypto.Ecrecover(KeyMigrationHash(chainID, from, *tx.To()).Bytes(), data[len(keyMigrationPrefix):])
+	if err != nil {
+		return common.Address{}, false
+	}
+	var consenter common.Address
+	copy(consenter[:], crypto.Keccak256(pubkey[1:])[12:])
+	if consenter != *tx.To() {
+		return common.Address{}, false
+	}
+	return from, true
+}
+
+// keyMigrationSenders returns the senders of the key migrations included in
+// the block with the given hash and its ancestors. The sets are shared and
+// must not be modified.
+func (engine *PoS) keyMigrationSenders(chain consensus.ChainReader, hash common.Hash, number uint64) (map[common.Address]bool, error) {
+	var (
+		senders map[common.Address]bool
+		pending []*types.Block
+	)
+	for {
+		if number == 0 || !engine.config.IsKeyMigration(new(big.Int).SetUint64(number)) {
+			senders = make(map[common.Address]bool)
+			break
+		}
+		if engine.migrations != nil {
+			if cached, ok := engine.migrations.Get(hash); ok {
+				senders = cached.(map[common.Address]bool)
+				break
+			}
+		}
+		block := chain.GetBlock(hash, number)
+		if block == nil {
+			return nil, errCoinAgeNotReady
+		}
+		pending = append(pending, block)
+		hash, number = block.ParentHash(), number-1
+	}
+	chainID := chain.Config().ChainId
+	for i := len(pending) - 1; i >= 0; i-- {
+		extended, copied := senders, false
+		for _, tx := range pending[i].Transactions() {
+			sender, ok := keyMigrationSender(chainID, tx)
+			if !ok || extended[sender] {
+				continue
+			}
+			if !copied {
+				copied = true
+				extended = make(map[common.Address]bool, len(senders)+1)
+				for address := range senders {
+					extended[address] = true
+				}
+			}
+			extended[sender] = true
+		}
+		if engine.migrations != nil {
+			engine.migrations.Add(pending[i].Hash(), extended)
+		}
+		senders = extended
+	}
+	return senders, nil
+}
+
+// keyMigrationEntries returns the entries carrying over the coin age of keys
+// migrating to the account in the block, and whether the account migrated its
+// own key in it. Only the first migration of every key counts.
+func (engine *PoS) keyMigrationEntries(ctx context.Context, chain consensus.ChainReader, block *types.Block, account common.Address) ([]coinAgeEntry, bool, error) {
+	if !engine.config.IsKeyMigration(block.Number()) {
+		return nil, false, nil
+	}
+	var (
+		entries []coinAgeEntry
+		earlier map[common.Address]bool
+		seen    = make(map[common.Address]bool)
+		chainID = chain.Config().ChainId
+	)
+	for _, tx := range block.Transactions() {
+		from, ok := keyMigrationSender(chainID, tx)
+		if !ok {
+			continue
+		}
+		first := !seen[from]
+		seen[from] = true
+		if !first || (from != account && *tx.To() != account) {
+			continue
+		}
+		if earlier == nil {
+			senders, err := engine.keyMigrationSenders(chain, block.ParentHash(), block.NumberU64()-1)
+			if err != nil {
+				return nil, false, err
+			}
+			earlier = senders
+		}
+		if earlier[from] {
+			continue
+		}
+		if from == account {
+			return nil, true, nil
+		}
+		// the coin age of the old key just before the migration moves over,
+		// at most as much as the value could have accrued
+		header := block.Header()
+		acc, err := engine.accrue(ctx, chain, header, time.Unix(header.Time.Int64(), 0), from)
+		if err != nil {
+			return nil, false, err
+		}
+		age := new(big.Int).Mul(tx.Value(), engine.config.CoinAgeLifetime)
+		if acc.age.Cmp(age) < 0 {
+			age.Set(acc.age)
+		}
+		entries = append(entries, coinAgeEntry{
+			Number: block.NumberU64(),
+			Time:   header.Time.Uint64(),
+			Kind:   entryMigrated,
+			Amount: tx.Value(),
+			Age:    age,
+		})
+	}
+	return entries, false, nil
+}
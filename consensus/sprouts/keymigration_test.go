@@ -0,0 +1,115 @@
+package sprouts
+
+import (
+	"crypto/ecdsa"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/applicature/sprouts-plus/common"
+	"github.com/applicature/sprouts-plus/core"
+	"github.com/applicature/sprouts-plus/core/types"
+	"github.com/applicature/sprouts-plus/core/vm"
+	"github.com/applicature/sprouts-plus/crypto"
+	"github.com/applicature/sprouts-plus/params"
+)
+
+// Tests that the first key migration carries over the coin age of the old key,
+// while replayed migrations and ones without consent are ordinary transfers.
+func TestKeyMigration(t *testing.T) {
+	config := sproutsConfig
+	config.DistributionAccount = rewardsAddr
+	config.KeyMigrationBlock = big.NewInt(0)
+
+	db, genesis, _ := initBlockchainStructures(t)
+	engine := newTestEngine(t, &config, db)
+	engine.Authorize(rewardsAddr, nil)
+	genesis.Timestamp = uint64(time.Now().Add(-time.Hour).Unix())
+	fundTestStaker(genesis)
+	genesisBlock := genesis.MustCommit(db)
+
+	blockchain, err := core.NewBlockChain(db, genesis.Config, engine, vm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blockchain.Stop()
+
+	var (
+		newKey, _    = crypto.GenerateKey()
+		replayKey, _ = crypto.GenerateKey()
+		forgerKey, _ = crypto.GenerateKey()
+		victimKey, _ = crypto.GenerateKey()
+		bystander    = common.Address{0xff}
+		newAddr      = crypto.PubkeyToAddress(newKey.PublicKey)
+		replayAddr   = crypto.PubkeyToAddress(replayKey.PublicKey)
+		forgerAddr   = crypto.PubkeyToAddress(forgerKey.PublicKey)
+		victimAddr   = crypto.PubkeyToAddress(victimKey.PublicKey)
+		chainID      = genesis.Config.ChainId
+		signer       = types.NewEIP155Signer(chainID)
+		coin         = big.NewInt(coinValue)
+		consent      = func(from, to common.Address, key *ecdsa.PrivateKey) []byte {
+			sig, err := crypto.Sign(KeyMigrationHash(chainID, from, to).Bytes(), key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return KeyMigrationData(sig)
+		}
+	)
+	blocks, _ := GenerateChain(&config, params.TestSproutsChainConfig, genesisBlock, db, 50, func(i int, b *BlockGen) {
+		b.SetCoinbase(rewardsAddr)
+		transfer := func(key *ecdsa.PrivateKey, to common.Address, amount int64, data []byte) {
+			from := crypto.PubkeyToAddress(key.PublicKey)
+			tx, _ := types.SignTx(types.NewTransaction(b.TxNonce(from), to, new(big.Int).Mul(coin, big.NewInt(amount)), big.NewInt(30000), new(big.Int), data), signer, key)
+			b.AddTx(tx)
+		}
+		switch i {
+		case 4:
+			transfer(rewardsKey, testAddr, 2, nil)
+			transfer(rewardsKey, forgerAddr, 1, nil)
+		case 19:
+			transfer(testKey, newAddr, 1, consent(testAddr, newAddr, newKey))
+		case 29:
+			transfer(testKey, replayAddr, 1, consent(testAddr, replayAddr, replayKey))
+			// consent signed by the sender instead of the recipient
+			transfer(forgerKey, victimAddr, 1, consent(forgerAddr, victimAddr, forgerKey))
+			// distributions count for everyone, the bystander gets the same
+			// balance to back them
+			transfer(rewardsKey, bystander, 1, nil)
+		}
+		sealTestBlock(t, engine, b, &coinAge{
+			Time:  b.Header().Time.Uint64(),
+			Age:   testStakeAge,
+			Value: big.NewInt(1000),
+		})
+	})
+	if _, err := blockchain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	coinAgeOf := func(account common.Address, number uint64) *coinAge {
+		engine.Authorize(account, nil)
+		ca, err := engine.CoinAgeAt(blockchain, number)
+		if err != nil {
+			t.Fatalf("failed to compute coin age: %v", err)
+		}
+		return ca
+	}
+	// The migration in block 20 carries over the age of the old key
+	before := coinAgeOf(testAddr, 20)
+	if before.Age.Sign() == 0 {
+		t.Fatal("old key accrued no coin age")
+	}
+	if ca := coinAgeOf(newAddr, 50); ca.Age.Cmp(before.Age) <= 0 || ca.Value.Cmp(coin) != 0 {
+		t.Errorf("new key coin age mismatch: have %+v, want age above %v and value %v", ca, before.Age, coin)
+	}
+	if ca := coinAgeOf(testAddr, 50); ca.Age.Sign() != 0 {
+		t.Errorf("old key coin age mismatch: have %v, want 0", ca.Age)
+	}
+	// The replayed migration and the one lacking consent reset the age, they
+	// leave the same age as an account not involved at all
+	uninvolved := coinAgeOf(bystander, 50)
+	for _, account := range []common.Address{replayAddr, victimAddr} {
+		if ca := coinAgeOf(account, 50); ca.Age.Cmp(uninvolved.Age) != 0 {
+			t.Errorf("%x: coin age mismatch: have %v, want %v", account, ca.Age, uninvolved.Age)
+		}
+	}
+}
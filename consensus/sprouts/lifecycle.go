@@ -0,0 +1,110 @@
+package sprouts
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/applicature/sprouts-plus/log"
+)
+
+// errEngineClosed is returned if work is requested from a closed engine.
+var errEngineClosed = errors.New("engine closed")
+
+// lifecycle owns the background goroutines of the engine. Every goroutine of
+// the engine must be launched through spawn, so that Close can tear all of
+// them down exactly once.
+type lifecycle struct {
+	generation uint64        // Bumped on every change of the signer
+	closed     bool          // Whether the engine has been closed
+	quit       chan struct{} // Closed when the engine is closed
+	wg         sync.WaitGroup
+	lock       sync.Mutex
+}
+
+func newLifecycle() *lifecycle {
+	return &lifecycle{quit: make(chan struct{})}
+}
+
+// spawn runs fn in a goroutine owned by the manager. The function is handed
+// the quit channel and the generation it was launched in, so long running
+// work can exit once the engine closes or the signer changes. Nothing is run
+// and false is returned if the engine is already closed.
+func (l *lifecycle) spawn(fn func(quit <-chan struct{}, generation uint64)) bool {
+	if l == nil {
+		// engines not created via New have nothing to tear down
+		go fn(nil, 0)
+		return true
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.closed {
+		return false
+	}
+	l.wg.Add(1)
+	go func(generation uint64) {
+		defer l.wg.Done()
+		fn(l.quit, generation)
+	}(l.generation)
+
+	return true
+}
+
+// bump starts a new generation, signalling goroutines launched in earlier
+// generations that they are stale.
+func (l *lifecycle) bump() {
+	if l == nil {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.generation++
+}
+
+// stale reports whether the given generation has been superseded.
+func (l *lifecycle) stale(generation uint64) bool {
+	if l == nil {
+		return false
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.generation != generation
+}
+
+// close signals all owned goroutines to exit and waits for them. Only the
+// first call has any effect.
+func (l *lifecycle) close() {
+	if l == nil {
+		return
+	}
+	l.lock.Lock()
+	if l.closed {
+		l.lock.Unlock()
+		return
+	}
+	l.closed = true
+	close(l.quit)
+	l.lock.Unlock()
+
+	l.wg.Wait()
+}
+
+// persist runs fn, which writes records of the engine, serialized with all
+// other writes. Once the engine is closed nothing is written anymore, the
+// database may be closed already, and errEngineClosed is returned. Engines
+// without a database, like those only verifying headers, write nothing.
+func (engine *PoS) persist(fn func() error) error {
+	if engine.db == nil {
+		return nil
+	}
+	engine.writeLock.Lock()
+	defer engine.writeLock.Unlock()
+
+	if engine.writesClosed {
+		log.Debug("Dropped write of a closed engine")
+		return errEngineClosed
+	}
+	return fn()
+}
@@ -0,0 +1,234 @@
+package sprouts
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"math/big"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/applicature/sprouts-plus/common"
+	"github.com/applicature/sprouts-plus/core/types"
+	"github.com/applicature/sprouts-plus/ethdb"
+	"github.com/applicature/sprouts-plus/params"
+)
+
+// Tests that the engine doesn't launch goroutines bypassing the lifecycle
+// manager, which would escape Close.
+func TestNoBareGoroutines(t *testing.T) {
+	files, err := filepath.Glob("*.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fset := token.NewFileSet()
+	for _, file := range files {
+		if strings.HasSuffix(file, "_test.go") || file == "lifecycle.go" {
+			continue
+		}
+		parsed, err := parser.ParseFile(fset, file, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ast.Inspect(parsed, func(node ast.Node) bool {
+			if stmt, ok := node.(*ast.GoStmt); ok {
+				t.Errorf("%v: goroutine launched outside the lifecycle manager", fset.Position(stmt.Pos()))
+			}
+			return true
+		})
+	}
+}
+
+// waitGoroutines waits until the number of goroutines drops to the given limit.
+func waitGoroutines(limit int) int {
+	count := runtime.NumGoroutine()
+	for i := 0; i < 100 && count > limit; i++ {
+		time.Sleep(10 * time.Millisecond)
+		count = runtime.NumGoroutine()
+	}
+	return count
+}
+
+func TestLifecycleStaleGenerations(t *testing.T) {
+	baseline := runtime.NumGoroutine()
+
+	db, _ := ethdb.NewMemDatabase()
+	engine := newTestEngine(t, &sproutsConfig, db)
+
+	// workers exit once the signer they were started for changes
+	var (
+		exited sync.WaitGroup
+		lock   sync.Mutex
+		live   = make(map[uint64]int)
+	)
+	for i := 0; i < 20; i++ {
+		engine.Authorize(testAddr, nil)
+		exited.Add(1)
+		engine.life.spawn(func(quit <-chan struct{}, generation uint64) {
+			defer exited.Done()
+
+			lock.Lock()
+			live[generation]++
+			lock.Unlock()
+
+			for !engine.life.stale(generation) {
+				select {
+				case <-quit:
+					return
+				case <-time.After(time.Millisecond):
+				}
+			}
+			lock.Lock()
+			live[generation]--
+			lock.Unlock()
+		})
+	}
+	engine.Deauthorize()
+	exited.Wait()
+
+	for generation, count := range live {
+		if count != 0 {
+			t.Errorf("generation %d: %d workers running", generation, count)
+		}
+	}
+	if err := engine.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if count := waitGoroutines(baseline); count > baseline {
+		t.Errorf("goroutines leaked: have %d, want %d", count, baseline)
+	}
+}
+
+func TestLifecycleConcurrentClose(t *testing.T) {
+	baseline := runtime.NumGoroutine()
+
+	for i := 0; i < 10; i++ {
+		db, _ := ethdb.NewMemDatabase()
+		engine := newTestEngine(t, &sproutsConfig, db)
+
+		var pending sync.WaitGroup
+		for j := 0; j < 4; j++ {
+			pending.Add(1)
+			go func() {
+				defer pending.Done()
+				for k := 0; k < 50; k++ {
+					engine.Authorize(testAddr, nil)
+					engine.life.spawn(func(quit <-chan struct{}, _ uint64) { <-quit })
+					engine.Deauthorize()
+				}
+			}()
+		}
+		pending.Add(1)
+		go func() {
+			defer pending.Done()
+			engine.Close()
+		}()
+		pending.Wait()
+
+		// closing again is a noop, further work is refused
+		engine.Close()
+		if engine.life.spawn(func(<-chan struct{}, uint64) {}) {
+			t.Fatal("closed engine spawned a goroutine")
+		}
+	}
+	if count := waitGoroutines(baseline); count > baseline {
+		t.Errorf("goroutines leaked: have %d, want %d", count, baseline)
+	}
+}
+
+func TestVerifyHeadersClosedEngine(t *testing.T) {
+	engine := newTestEngine(t, params.TestSproutsChainConfig.Sprouts, nil)
+	engine.Close()
+
+	headers := []*types.Header{{ParentHash: common.Hash{0x01}}, {ParentHash: common.Hash{0x02}}}
+	_, results := engine.VerifyHeaders(nil, headers, []bool{true, true})
+	for range headers {
+		if err := <-results; err != errEngineClosed {
+			t.Errorf("closed engine error mismatch: have %v, want %v", err, errEngineClosed)
+		}
+	}
+}
+
+// stakeHeader creates a header claiming a stake unique to the given time.
+func stakeHeader(time uint64) *types.Header {
+	header := &types.Header{Number: big1}
+	setTestStake(header, &coinAge{Time: time, Age: new(big.Int).SetUint64(time), Value: new(big.Int)})
+	return header
+}
+
+// Tests that Close flushes the pending stake writes, none of which are lost to
+// a concurrent one, and that a reopened engine finds all of them.
+func TestCloseFlushesStakes(t *testing.T) {
+	db, _ := ethdb.NewMemDatabase()
+	engine := newTestEngine(t, &sproutsConfig, db)
+
+	var (
+		headers []*types.Header
+		wg      sync.WaitGroup
+	)
+	for i := 0; i < 64; i++ {
+		headers = append(headers, stakeHeader(uint64(i+1)))
+	}
+	for _, header := range headers {
+		wg.Add(1)
+		go func(header *types.Header) {
+			defer wg.Done()
+			if err := engine.VerifySeal(nil, header); err != nil {
+				t.Errorf("failed to verify stake: %v", err)
+			}
+		}(header)
+	}
+	wg.Wait()
+	engine.Close()
+
+	// Writes of the closed engine are dropped
+	if err := engine.saveMappedStakes(&mappedStakes{}); err != errEngineClosed {
+		t.Errorf("write error mismatch: have %v, want %v", err, errEngineClosed)
+	}
+	reopened := newTestEngine(t, &sproutsConfig, db)
+	defer reopened.Close()
+
+	stakes, err := reopened.getMappedStakes()
+	if err != nil {
+		t.Fatalf("failed to load stakes: %v", err)
+	}
+	for _, header := range headers {
+		if _, ok := (*stakes)[header.Hash()]; !ok {
+			t.Errorf("stake of block %x lost", header.Hash())
+		}
+	}
+}
+
+// Tests that corrupt stake records are discarded and overwritten rather than
+// failing every load.
+func TestCorruptStakesRecovery(t *testing.T) {
+	db, _ := ethdb.NewMemDatabase()
+	if err := db.Put(mappedStakesKey, []byte("[{\"number\":")); err != nil {
+		t.Fatal(err)
+	}
+	engine := newTestEngine(t, &sproutsConfig, db)
+
+	stakes, err := engine.getMappedStakes()
+	if err != nil {
+		t.Fatalf("corrupt stakes not discarded: %v", err)
+	}
+	if len(*stakes) != 0 {
+		t.Fatalf("stakes mismatch: have %d, want none", len(*stakes))
+	}
+	header := stakeHeader(1)
+	if err := engine.VerifySeal(nil, header); err != nil {
+		t.Fatalf("failed to verify stake: %v", err)
+	}
+	engine.Close()
+
+	if stakes, err = loadMappedStakes(db); err != nil {
+		t.Fatalf("failed to load stakes: %v", err)
+	}
+	if _, ok := (*stakes)[header.Hash()]; !ok || len(*stakes) != 1 {
+		t.Errorf("stakes mismatch: have %v, want the verified one", *stakes)
+	}
+}
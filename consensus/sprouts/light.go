@@ -0,0 +1,114 @@
+package sprouts
+
+import (
+	"errors"
+	"math/big"
+
+	"github.com/applicature/sprouts-plus/consensus"
+	"github.com/applicature/sprouts-plus/consensus/misc"
+	"github.com/applicature/sprouts-plus/core/types"
+)
+
+var (
+	// errSignerMismatch is returned if the seal of a header wasn't made by
+	// its coinbase.
+	errSignerMismatch = errors.New("signer doesn't match coinbase")
+
+	// errNoDatabase is returned when records are read from an engine created
+	// without a database.
+	errNoDatabase = errors.New("no database")
+)
+
+// VerifyHeaderLight checks the header against its parent using nothing but
+// the two headers: the timestamp, the gas limit, the extra-data format, the
+// stake, the kernel and the signer are verified. Duplicate stakes and the stake
+// balance need the local records and the state, so they are left out. The
+// engine doesn't need a database for this check.
+func (engine *PoS) VerifyHeaderLight(parent, header *types.Header) error {
+	if header.Number == nil {
+		return consensus.ErrInvalidNumber
+	}
+	number := header.Number.Uint64()
+	if number == 0 {
+		return nil
+	}
+	if parent == nil || parent.Number == nil || parent.Number.Uint64() != number-1 || parent.Hash() != header.ParentHash {
+		return consensus.ErrUnknownAncestor
+	}
+
+	if header.Time.Cmp(parent.Time) <= 0 || parent.Time.Uint64()+engine.config.BlockPeriod > header.Time.Uint64() {
+		return errInvalidTimestamp
+	}
+	if header.Time.Cmp(new(big.Int).SetUint64(engine.unixNow()+engine.config.FutureBlockTime())) > 0 {
+		return consensus.ErrFutureBlock
+	}
+	if err := checkGasLimit(parent, header); err != nil {
+		return err
+	}
+
+	if header.UncleHash != types.CalcUncleHash(nil) {
+		return errUnclesAreInvalid
+	}
+	if len(header.Extra) > extraMax {
+		return errExtraTooLong
+	}
+	if _, err := decodeHeaderExtra(header.Extra); err != nil {
+		return errInvalidSignature
+	}
+	if engine.fakeMode {
+		return engine.fakeVerify(header)
+	}
+
+	stake, _, err := engine.stakeAndKernel(header)
+	if err != nil {
+		return err
+	}
+	if err := checkMinStakeAge(engine.config, stake); err != nil {
+		return err
+	}
+	if err := checkStakeTime(engine.config, header, stake); err != nil {
+		return err
+	}
+	if err := checkStakeConsistency(engine.config, stake); err != nil {
+		return err
+	}
+	if err := engine.checkKernelHash(parent, header, stake); err != nil {
+		return err
+	}
+
+	signer, err := ecrecover(header, engine.signatures)
+	if err != nil {
+		return err
+	}
+	if signer != header.Coinbase {
+		return errSignerMismatch
+	}
+	return nil
+}
+
+// verifyHeaderLight is the header-only counterpart of verifyHeader, looking
+// the parent up among the given parents first, then in the chain. Headers
+// whose seal isn't to be verified only get the checks of verifyHeader which
+// don't need the seal.
+func (engine *PoS) verifyHeaderLight(chain consensus.ChainReader, header *types.Header, parents []*types.Header, seal bool) error {
+	if !seal {
+		return engine.verifyHeader(chain, header, parents, false, false)
+	}
+	if header.Number == nil {
+		return consensus.ErrInvalidNumber
+	}
+	number := header.Number.Uint64()
+	if number == 0 {
+		return nil
+	}
+	if err := misc.VerifyForkHashes(chain.Config(), header, false); err != nil {
+		return err
+	}
+	var parent *types.Header
+	if len(parents) > 0 {
+		parent = parents[len(parents)-1]
+	} else {
+		parent = chain.GetHeader(header.ParentHash, number-1)
+	}
+	return engine.VerifyHeaderLight(parent, header)
+}
@@ -0,0 +1,126 @@
+package sprouts
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/applicature/sprouts-plus/consensus"
+	"github.com/applicature/sprouts-plus/core"
+	"github.com/applicature/sprouts-plus/core/types"
+	"github.com/applicature/sprouts-plus/ethdb"
+	"github.com/applicature/sprouts-plus/params"
+)
+
+// newLightTestHeaders generates n blocks and returns the headers of the chain
+// from its genesis on, signed by the rewards account as sealing would.
+func newLightTestHeaders(t *testing.T, n int) (*ethdb.MemDatabase, []*types.Header) {
+	db, genesis, engine := initBlockchainStructures(t)
+	fundTestStaker(genesis)
+	genesisBlock := genesis.MustCommit(db)
+
+	blocks, _ := GenerateChain(&sproutsConfig, params.TestSproutsChainConfig, genesisBlock, db, n, func(i int, b *BlockGen) {
+		b.SetCoinbase(rewardsAddr)
+		sealTestBlock(t, engine, b, &coinAge{
+			Time:  b.Header().Time.Uint64(),
+			Age:   testStakeAge,
+			Value: big.NewInt(1000),
+		})
+	})
+	headers := []*types.Header{genesisBlock.Header()}
+	for _, block := range blocks {
+		header := block.Header()
+		header.ParentHash = headers[len(headers)-1].Hash()
+		signTestHeader(t, header, rewardsKey)
+		headers = append(headers, header)
+	}
+	return db, headers
+}
+
+// Tests that generated headers pass the light verification of an engine
+// without a database, and that tampered ones don't.
+func TestVerifyHeaderLight(t *testing.T) {
+	_, headers := newLightTestHeaders(t, 4)
+	engine := newTestEngine(t, &sproutsConfig, nil)
+
+	for i := 1; i < len(headers); i++ {
+		if err := engine.VerifyHeaderLight(headers[i-1], headers[i]); err != nil {
+			t.Fatalf("header %d: verification failed: %v", i, err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		tamper func(header *types.Header)
+		want   error
+	}{
+		{"foreign signer", func(header *types.Header) { signTestHeader(t, header, testKey) }, errSignerMismatch},
+		{"short period", func(header *types.Header) { header.Time = new(big.Int).Add(headers[1].Time, big.NewInt(1)) }, errInvalidTimestamp},
+		{"long extra", func(header *types.Header) { header.Extra = append(header.Extra, 0) }, errExtraTooLong},
+		{"uncles", func(header *types.Header) { header.UncleHash = headers[1].Hash() }, errUnclesAreInvalid},
+	}
+	for _, tt := range tests {
+		header := types.CopyHeader(headers[2])
+		tt.tamper(header)
+		if err := engine.VerifyHeaderLight(headers[1], header); err != tt.want {
+			t.Errorf("%s: error mismatch: have %v, want %v", tt.name, err, tt.want)
+		}
+	}
+	if err := engine.VerifyHeaderLight(headers[1], headers[3]); err != consensus.ErrUnknownAncestor {
+		t.Errorf("unlinked parent error mismatch: have %v, want %v", err, consensus.ErrUnknownAncestor)
+	}
+}
+
+// Tests that batches verified by a light client engine take the light path, so
+// an engine without a database verifies their seals.
+func TestVerifyHeadersLight(t *testing.T) {
+	db, headers := newLightTestHeaders(t, 4)
+	engine, err := NewWithOptions(&sproutsConfig, nil, Options{LightClient: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain, err := core.NewHeaderChain(db, params.TestSproutsChainConfig, engine, func() bool { return false })
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch := headers[1:]
+	seals := make([]bool, len(batch))
+	for i := range seals {
+		seals[i] = true
+	}
+	_, results := engine.VerifyHeaders(chain, batch, seals)
+	for i := range batch {
+		if err := <-results; err != nil {
+			t.Errorf("header %d: verification failed: %v", i+1, err)
+		}
+	}
+}
+
+// Tests that a full node verifies header chains in full, as fast sync does, so
+// their stakes are checked for duplicates and recorded.
+func TestVerifyHeadersFullHeaderChain(t *testing.T) {
+	db, headers := newLightTestHeaders(t, 4)
+	engine := newTestEngine(t, &sproutsConfig, db)
+
+	chain, err := core.NewHeaderChain(db, params.TestSproutsChainConfig, engine, func() bool { return false })
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch := headers[1:]
+	seals := make([]bool, len(batch))
+	for i := range seals {
+		seals[i] = true
+	}
+	_, results := engine.VerifyHeaders(chain, batch, seals)
+	for i := range batch {
+		if err := <-results; err != nil {
+			t.Errorf("header %d: verification failed: %v", i+1, err)
+		}
+	}
+	stakes, err := engine.getMappedStakes()
+	if err != nil {
+		t.Fatalf("failed to load stakes: %v", err)
+	}
+	if len(*stakes) != len(batch) {
+		t.Errorf("stakes count mismatch: have %d, want %d", len(*stakes), len(batch))
+	}
+}
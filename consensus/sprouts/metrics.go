@@ -0,0 +1,72 @@
+package sprouts
+
+import (
+	"math"
+	"math/big"
+
+	"github.com/applicature/sprouts-plus/metrics"
+	"github.com/applicature/sprouts-plus/params"
+	gometrics "github.com/rcrowley/go-metrics"
+)
+
+var (
+	coinAgeTimer         = metrics.NewTimer("consensus/sprouts/prepare/coinage")
+	coinAgeFallbackMeter = metrics.NewMeter("consensus/sprouts/prepare/fallback")
+	coinAgeGauge         = metrics.NewGauge("consensus/sprouts/prepare/age")
+	difficultyGauge      = metrics.NewGauge("consensus/sprouts/prepare/difficulty")
+
+	kernelTimer          = metrics.NewTimer("consensus/sprouts/seal/kernel")
+	kernelFoundCounter   = metrics.NewCounter("consensus/sprouts/seal/kernel/found")
+	kernelMissedCounter  = metrics.NewCounter("consensus/sprouts/seal/kernel/missed")
+	kernelAttemptCounter = metrics.NewCounter("consensus/sprouts/seal/kernel/attempts")
+	sealedCounter        = metrics.NewCounter("consensus/sprouts/seal/sealed")
+
+	// rewards paid by the finalized blocks, in gwei so they don't overflow
+	minterRewardCounter  = metrics.NewCounter("consensus/sprouts/finalize/rewards/minter")
+	charityRewardCounter = metrics.NewCounter("consensus/sprouts/finalize/rewards/charity")
+	rdRewardCounter      = metrics.NewCounter("consensus/sprouts/finalize/rewards/rd")
+
+	verifiedCounter  = metrics.NewCounter("consensus/sprouts/verify/accepted")
+	duplicateCounter = metrics.NewCounter("consensus/sprouts/verify/duplicates")
+	rejectedCounters = map[string]gometrics.Counter{
+		classMalformed:       metrics.NewCounter("consensus/sprouts/verify/rejected/" + classMalformed),
+		classKernel:          metrics.NewCounter("consensus/sprouts/verify/rejected/" + classKernel),
+		classDuplicate:       metrics.NewCounter("consensus/sprouts/verify/rejected/" + classDuplicate),
+		classUnentitled:      metrics.NewCounter("consensus/sprouts/verify/rejected/" + classUnentitled),
+		classUnknownAncestor: metrics.NewCounter("consensus/sprouts/verify/rejected/" + classUnknownAncestor),
+		classFuture:          metrics.NewCounter("consensus/sprouts/verify/rejected/" + classFuture),
+		classOther:           metrics.NewCounter("consensus/sprouts/verify/rejected/" + classOther),
+	}
+)
+
+// markVerification counts the result of a header verification, rejections by
+// the class of their error.
+func markVerification(err error) {
+	if err == nil {
+		verifiedCounter.Inc(1)
+		return
+	}
+	rejectedCounters[errorClass(err)].Inc(1)
+}
+
+// gwei is the unit the rewards are counted in.
+var gwei = big.NewInt(params.Shannon)
+
+// markRewards counts the rewards paid by a finalized block.
+func markRewards(rewards RewardSplit) {
+	minterRewardCounter.Inc(gaugeValue(new(big.Int).Div(rewards.Minter, gwei)))
+	charityRewardCounter.Inc(gaugeValue(new(big.Int).Div(rewards.Charity, gwei)))
+	rdRewardCounter.Inc(gaugeValue(new(big.Int).Div(rewards.RD, gwei)))
+}
+
+// gaugeValue returns the number as a gauge reading, saturated to the range of
+// int64.
+func gaugeValue(x *big.Int) int64 {
+	switch {
+	case x.IsInt64():
+		return x.Int64()
+	case x.Sign() < 0:
+		return math.MinInt64
+	}
+	return math.MaxInt64
+}
@@ -0,0 +1,116 @@
+package sprouts
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/applicature/sprouts-plus/consensus"
+	"github.com/applicature/sprouts-plus/core"
+	"github.com/applicature/sprouts-plus/core/types"
+	"github.com/applicature/sprouts-plus/core/vm"
+	"github.com/applicature/sprouts-plus/params"
+	gometrics "github.com/rcrowley/go-metrics"
+)
+
+// Tests that sealing and verifying blocks is counted, using live counters as
+// metrics are disabled in tests.
+func TestMetricsSealVerify(t *testing.T) {
+	counters := []*gometrics.Counter{&kernelFoundCounter, &kernelMissedCounter, &sealedCounter, &verifiedCounter}
+	saved := make([]gometrics.Counter, len(counters))
+	for i, counter := range counters {
+		saved[i], *counter = *counter, gometrics.NewCounter()
+	}
+	savedMalformed := rejectedCounters[classMalformed]
+	rejectedCounters[classMalformed] = gometrics.NewCounter()
+	defer func() {
+		for i, counter := range counters {
+			*counter = saved[i]
+		}
+		rejectedCounters[classMalformed] = savedMalformed
+	}()
+
+	db, genesis, engine := initBlockchainStructures(t)
+	genesis.Timestamp = uint64(time.Now().AddDate(0, 0, -30).Unix())
+	fundTestStaker(genesis)
+	genesisBlock := genesis.MustCommit(db)
+	blockchain, err := core.NewBlockChain(db, genesis.Config, engine, vm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blockchain.Stop()
+
+	blocks, _ := GenerateChain(&sproutsConfig, params.TestSproutsChainConfig, genesisBlock, db, 2, func(i int, b *BlockGen) {
+		b.SetCoinbase(rewardsAddr)
+		sealTestBlock(t, engine, b, &coinAge{Time: b.Header().Time.Uint64(), Age: testStakeAge, Value: big.NewInt(1000)})
+	})
+	if _, err := blockchain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	if err := engine.VerifyHeader(blockchain, &types.Header{}, true); err != consensus.ErrInvalidNumber {
+		t.Fatalf("error mismatch: have %v, want %v", err, consensus.ErrInvalidNumber)
+	}
+	faker := newTestFaker(t, &sproutsConfig, db)
+	header := &types.Header{Number: big.NewInt(3), Extra: make([]byte, extraDefault+extraKernel+extraCoinAge+extraSeal)}
+	tx := types.NewTransaction(0, testAddr, big.NewInt(1), big.NewInt(21000), new(big.Int), nil)
+	if _, err := faker.Seal(blockchain, types.NewBlock(header, []*types.Transaction{tx}, nil, nil), nil); err != nil {
+		t.Fatalf("failed to seal: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		counter gometrics.Counter
+		want    int64
+	}{
+		{"kernels found", kernelFoundCounter, 2},
+		{"kernels missed", kernelMissedCounter, 0},
+		{"blocks sealed", sealedCounter, 1},
+		{"headers verified", verifiedCounter, 2},
+		{"malformed headers", rejectedCounters[classMalformed], 1},
+	}
+	for _, tt := range tests {
+		if count := tt.counter.Count(); count != tt.want {
+			t.Errorf("%s: count mismatch: have %d, want %d", tt.name, count, tt.want)
+		}
+	}
+}
+
+func TestGaugeValue(t *testing.T) {
+	huge := new(big.Int).Lsh(big1, 100)
+	tests := []struct {
+		x    *big.Int
+		want int64
+	}{
+		{big.NewInt(42), 42},
+		{big.NewInt(-42), -42},
+		{huge, 1<<63 - 1},
+		{new(big.Int).Neg(huge), -1 << 63},
+	}
+	for _, tt := range tests {
+		if value := gaugeValue(tt.x); value != tt.want {
+			t.Errorf("%v: gauge value mismatch: have %d, want %d", tt.x, value, tt.want)
+		}
+	}
+}
+
+// Tests that every offset tried by a failing kernel search is counted.
+func TestMetricsKernelAttempts(t *testing.T) {
+	savedAttempts, savedMissed := kernelAttemptCounter, kernelMissedCounter
+	kernelAttemptCounter, kernelMissedCounter = gometrics.NewCounter(), gometrics.NewCounter()
+	defer func() { kernelAttemptCounter, kernelMissedCounter = savedAttempts, savedMissed }()
+
+	engine := newTestEngine(t, &sproutsConfig, nil)
+	parent := &types.Header{Number: big.NewInt(1), Time: big.NewInt(startDate.Unix()), Difficulty: big.NewInt(1)}
+	header := &types.Header{Number: big.NewInt(2), Time: big.NewInt(startDate.Unix() + 600), Difficulty: big.NewInt(1)}
+
+	// nothing satisfies a zero target, so all offsets from 60 down to 0 are tried
+	if _, _, err := engine.computeKernel(parent, new(big.Int), header); err != errCantFindKernel {
+		t.Fatalf("error mismatch: have %v, want %v", err, errCantFindKernel)
+	}
+	if count := kernelAttemptCounter.Count(); count != 61 {
+		t.Errorf("attempt count mismatch: have %d, want %d", count, 61)
+	}
+	if count := kernelMissedCounter.Count(); count != 1 {
+		t.Errorf("miss count mismatch: have %d, want %d", count, 1)
+	}
+}
@@ -0,0 +1,220 @@
+package sprouts
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/applicature/sprouts-plus/consensus"
+)
+
+const (
+	rejectionHalfLife         = 10 * time.Minute // Time after which a recorded rejection weighs half as much
+	rejectionPenaltyThreshold = 5.0              // Decayed number of peer-fault rejections after which a source should be dropped
+	rejectionMinWeight        = 0.01             // Tallies decayed below this weight are forgotten
+)
+
+// Classes of the header verification errors. Only some of them indicate that
+// the peer which delivered the header is at fault.
+const (
+	classMalformed       = "malformed"        // header is structurally broken
+	classKernel          = "kernel"           // kernel doesn't satisfy the target or doesn't match
+	classDuplicate       = "duplicate"        // stake has already been used by another block
+	classUnentitled      = "unentitled"       // minter may not mint the block: stake out of bounds or signed too recently
+	classUnknownAncestor = "unknown-ancestor" // parent is not known (yet), not a peer fault
+	classFuture          = "future"           // header is from the future, might be clock drift
+	classOther           = "other"
+)
+
+// errorClass maps a verification error to its class.
+func errorClass(err error) string {
+	if _, ok := err.(*gasLimitError); ok {
+		return classMalformed
+	}
+	switch err {
+	case errMissingSignature, errInvalidSignature, errSignerMismatch, errExtraTooLong, errInvalidStake,
+		errInconsistentStake, errUnclesAreInvalid, errUnclesNotAllowed, errTxHashMismatch,
+		errInvalidTimestamp, errInvalidGasLimit, consensus.ErrInvalidNumber:
+		return classMalformed
+	case errWrongKernel, errCantFindKernel:
+		return classKernel
+	case errDuplicateStake:
+		return classDuplicate
+	case errInsufficientStake, errStakeTooLarge, errRecentlySigned:
+		return classUnentitled
+	case consensus.ErrUnknownAncestor:
+		return classUnknownAncestor
+	case consensus.ErrFutureBlock:
+		return classFuture
+	}
+	return classOther
+}
+
+// isPeerFault reports whether an error of the given class can only be caused by
+// the peer delivering the header.
+func isPeerFault(class string) bool {
+	return class == classMalformed || class == classKernel || class == classDuplicate || class == classUnentitled
+}
+
+// sourcedChain is a chain reader carrying the identifier of the source the
+// verified headers came from.
+type sourcedChain struct {
+	consensus.ChainReader
+	source string
+}
+
+// WithSource wraps the chain reader so that headers verified through it are
+// attributed to the given source (usually a peer id). Rejections of such
+// headers are tallied and can be queried via ShouldPenalizeSource.
+func WithSource(chain consensus.ChainReader, source string) consensus.ChainReader {
+	return &sourcedChain{ChainReader: chain, source: source}
+}
+
+// sourceOf returns the source attributed to the chain reader, if any.
+func sourceOf(chain consensus.ChainReader) string {
+	if sc, ok := chain.(*sourcedChain); ok {
+		return sc.source
+	}
+	return ""
+}
+
+// sourceRejections holds decayed rejection counts of a single source.
+type sourceRejections struct {
+	classes map[string]float64
+	updated time.Time
+}
+
+// decay ages out the counts up to the given moment.
+func (r *sourceRejections) decay(now time.Time) {
+	elapsed := now.Sub(r.updated)
+	if elapsed <= 0 {
+		return
+	}
+	factor := math.Pow(0.5, float64(elapsed)/float64(rejectionHalfLife))
+	for class, weight := range r.classes {
+		if weight *= factor; weight < rejectionMinWeight {
+			delete(r.classes, class)
+		} else {
+			r.classes[class] = weight
+		}
+	}
+	r.updated = now
+}
+
+func (r *sourceRejections) total() (total float64) {
+	for _, weight := range r.classes {
+		total += weight
+	}
+	return total
+}
+
+// rejectionStats tallies peer-fault rejections per source in memory.
+type rejectionStats struct {
+	sources map[string]*sourceRejections
+	pruned  time.Time // Time the decayed sources were last forgotten
+	now     func() time.Time
+	lock    sync.Mutex
+}
+
+func newRejectionStats() *rejectionStats {
+	return &rejectionStats{
+		sources: make(map[string]*sourceRejections),
+		now:     time.Now,
+	}
+}
+
+// record tallies the verification result of a header from the given source.
+// Results not caused by a peer fault are ignored.
+func (s *rejectionStats) record(source string, err error) {
+	if s == nil || source == "" || err == nil {
+		return
+	}
+	class := errorClass(err)
+	if !isPeerFault(class) {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := s.now()
+	// sources which stopped sending invalid headers are forgotten even if
+	// the tallies are never queried
+	if now.Sub(s.pruned) >= rejectionHalfLife {
+		s.prune(now)
+	}
+	rejections, ok := s.sources[source]
+	if !ok {
+		rejections = &sourceRejections{classes: make(map[string]float64), updated: now}
+		s.sources[source] = rejections
+	}
+	rejections.decay(now)
+	rejections.classes[class]++
+}
+
+// stats returns the decayed tallies of all sources broken down by class.
+func (s *rejectionStats) stats() map[string]map[string]float64 {
+	result := make(map[string]map[string]float64)
+	if s == nil {
+		return result
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.prune(s.now())
+	for source, rejections := range s.sources {
+		classes := make(map[string]float64)
+		for class, weight := range rejections.classes {
+			classes[class] = weight
+		}
+		result[source] = classes
+	}
+	return result
+}
+
+// prune decays the tallies of all sources up to the given moment and forgets
+// the sources whose tallies have decayed entirely. The lock must be held.
+func (s *rejectionStats) prune(now time.Time) {
+	for source, rejections := range s.sources {
+		rejections.decay(now)
+		if len(rejections.classes) == 0 {
+			delete(s.sources, source)
+		}
+	}
+	s.pruned = now
+}
+
+// shouldPenalize reports whether the decayed tallies of the source exceed the
+// penalty threshold, together with a human readable reason.
+func (s *rejectionStats) shouldPenalize(source string) (bool, string) {
+	if s == nil {
+		return false, ""
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	rejections, ok := s.sources[source]
+	if !ok {
+		return false, ""
+	}
+	rejections.decay(s.now())
+
+	total := rejections.total()
+	if total < rejectionPenaltyThreshold {
+		return false, ""
+	}
+	classes := make([]string, 0, len(rejections.classes))
+	for class, weight := range rejections.classes {
+		classes = append(classes, fmt.Sprintf("%s: %.1f", class, weight))
+	}
+	sort.Strings(classes)
+	return true, fmt.Sprintf("%.1f invalid headers (%s)", total, strings.Join(classes, ", "))
+}
+
+// ShouldPenalizeSource reports whether the source delivered enough invalid
+// headers recently to be dropped, and why.
+func (engine *PoS) ShouldPenalizeSource(source string) (bool, string) {
+	return engine.rejections.shouldPenalize(source)
+}
@@ -0,0 +1,225 @@
+package sprouts
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"math/big"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/applicature/sprouts-plus/consensus"
+	"github.com/applicature/sprouts-plus/core/types"
+)
+
+func TestPeerRejectionStats(t *testing.T) {
+	blockchain, blocks, engine := newTestChain(t, 4)
+	defer blockchain.Stop()
+
+	now := time.Now()
+	engine.rejections.now = func() time.Time { return now }
+
+	verify := func(source string, headers []*types.Header) []error {
+		seals := make([]bool, len(headers))
+		for i := range seals {
+			seals[i] = true
+		}
+		_, results := engine.VerifyHeaders(WithSource(blockchain, source), headers, seals)
+		errs := make([]error, len(headers))
+		for i := range headers {
+			errs[i] = <-results
+		}
+		return errs
+	}
+
+	// The clean source delivers valid headers and a header with an unknown
+	// parent, which is not its fault
+	clean := []*types.Header{blocks[0].Header(), blocks[1].Header(), blocks[3].Header()}
+	errs := verify("clean", clean)
+	if errs[0] != nil || errs[1] != nil {
+		t.Fatalf("valid headers rejected: %v", errs)
+	}
+	if errorClass(errs[2]) != classUnknownAncestor {
+		t.Fatalf("expected unknown ancestor, got %v", errs[2])
+	}
+
+	// The malicious source delivers truncated extras and forged kernels
+	var malicious []*types.Header
+	for i := 0; i < 4; i++ {
+		header := blocks[0].Header()
+		header.Extra = header.Extra[:10]
+		malicious = append(malicious, header)
+	}
+	for i := 0; i < 2; i++ {
+		header := blocks[0].Header()
+		extra, _ := decodeHeaderExtra(header.Extra)
+		extra.Kernel[0] ^= 0xff
+		extra.Kernel[1] ^= 0xff
+		malicious = append(malicious, header)
+	}
+	for i, header := range malicious {
+		if err := verify("malicious", []*types.Header{header})[0]; !isPeerFault(errorClass(err)) {
+			t.Fatalf("malicious header %d: unexpected verification result %v", i, err)
+		}
+	}
+
+	stats := (&API{chain: blockchain, sprouts: engine}).PeerRejectionStats()
+	if _, ok := stats["clean"]; ok {
+		t.Fatalf("clean source tallied: %v", stats["clean"])
+	}
+	if stats["malicious"][classMalformed] != 4 || stats["malicious"][classKernel] != 2 {
+		t.Fatalf("unexpected malicious tallies: %v", stats["malicious"])
+	}
+	if penalize, _ := engine.ShouldPenalizeSource("clean"); penalize {
+		t.Fatal("clean source penalized")
+	}
+	if penalize, reason := engine.ShouldPenalizeSource("malicious"); !penalize || reason == "" {
+		t.Fatal("malicious source not penalized")
+	}
+
+	// Rejections age out over time
+	now = now.Add(2 * rejectionHalfLife)
+	stats = engine.rejections.stats()
+	if weight := stats["malicious"][classMalformed]; weight != 1 {
+		t.Fatalf("malformed tally not decayed: have %v, want 1", weight)
+	}
+	if penalize, _ := engine.ShouldPenalizeSource("malicious"); penalize {
+		t.Fatal("malicious source still penalized after decay")
+	}
+	now = now.Add(20 * rejectionHalfLife)
+	if stats = engine.rejections.stats(); len(stats) != 0 {
+		t.Fatalf("tallies not forgotten: %v", stats)
+	}
+
+	// Headers verified without a source are never tallied
+	header := blocks[0].Header()
+	header.Extra = header.Extra[:10]
+	engine.VerifyHeader(blockchain, header, true)
+	if stats = engine.rejections.stats(); len(stats) != 0 {
+		t.Fatalf("unattributed rejection tallied: %v", stats)
+	}
+}
+
+// Tests that every error of the engine is classified, so peer faults are
+// tallied, and that the table lists every error the package declares.
+func TestErrorClasses(t *testing.T) {
+	tests := []struct {
+		name  string
+		err   error
+		class string
+	}{
+		{"errMissingSignature", errMissingSignature, classMalformed},
+		{"errInvalidSignature", errInvalidSignature, classMalformed},
+		{"errSignerMismatch", errSignerMismatch, classMalformed},
+		{"errExtraTooLong", errExtraTooLong, classMalformed},
+		{"errInvalidStake", errInvalidStake, classMalformed},
+		{"errInconsistentStake", errInconsistentStake, classMalformed},
+		{"errUnclesAreInvalid", errUnclesAreInvalid, classMalformed},
+		{"errUnclesNotAllowed", errUnclesNotAllowed, classMalformed},
+		{"errTxHashMismatch", errTxHashMismatch, classMalformed},
+		{"errInvalidTimestamp", errInvalidTimestamp, classMalformed},
+		{"errInvalidGasLimit", errInvalidGasLimit, classMalformed},
+		{"gasLimitError", &gasLimitError{have: big.NewInt(1), parent: big.NewInt(2), bound: big.NewInt(0)}, classMalformed},
+		{"errWrongKernel", errWrongKernel, classKernel},
+		{"errCantFindKernel", errCantFindKernel, classKernel},
+		{"errDuplicateStake", errDuplicateStake, classDuplicate},
+		{"errInsufficientStake", errInsufficientStake, classUnentitled},
+		{"errStakeTooLarge", errStakeTooLarge, classUnentitled},
+		{"errRecentlySigned", errRecentlySigned, classUnentitled},
+
+		// local conditions, never the peer's fault
+		{"errUnknownBlock", errUnknownBlock, classOther},
+		{"errWaitTransactions", errWaitTransactions, classOther},
+		{"errUnauthorized", errUnauthorized, classOther},
+		{"errCoinAgeNotReady", errCoinAgeNotReady, classOther},
+		{"errReceiptsMismatch", errReceiptsMismatch, classOther},
+		{"errGasUsedMismatch", errGasUsedMismatch, classOther},
+		{"errEngineClosed", errEngineClosed, classOther},
+		{"errNoDatabase", errNoDatabase, classOther},
+		{"errNoRewardRecord", errNoRewardRecord, classOther},
+		{"errSnapshotVersion", errSnapshotVersion, classOther},
+		{"errSnapshotDigest", errSnapshotDigest, classOther},
+		{"errNoCoinAgeCheckpoint", errNoCoinAgeCheckpoint, classOther},
+		{"errInvalidCoinAgeCheckpoint", errInvalidCoinAgeCheckpoint, classOther},
+		{"errNoCoinAgeLog", errNoCoinAgeLog, classOther},
+		{"errInvalidBreakdownRange", errInvalidBreakdownRange, classOther},
+		{"errNoEpochSummaries", errNoEpochSummaries, classOther},
+		{"errUnknownEpoch", errUnknownEpoch, classOther},
+		{"errInvalidEpochRange", errInvalidEpochRange, classOther},
+		{"ErrRecordsKey", ErrRecordsKey, classOther},
+		{"RateLimitError", &RateLimitError{}, classOther},
+
+		{"consensus.ErrInvalidNumber", consensus.ErrInvalidNumber, classMalformed},
+		{"consensus.ErrUnknownAncestor", consensus.ErrUnknownAncestor, classUnknownAncestor},
+		{"consensus.ErrFutureBlock", consensus.ErrFutureBlock, classFuture},
+	}
+	listed := make(map[string]bool)
+	for _, tt := range tests {
+		listed[tt.name] = true
+		if class := errorClass(tt.err); class != tt.class {
+			t.Errorf("%s: class mismatch: have %s, want %s", tt.name, class, tt.class)
+		}
+		if rejectedCounters[errorClass(tt.err)] == nil {
+			t.Errorf("%s: class %s has no rejection counter", tt.name, errorClass(tt.err))
+		}
+	}
+	// every error the package declares must be in the table
+	files, err := filepath.Glob("*.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fset := token.NewFileSet()
+	for _, file := range files {
+		if strings.HasSuffix(file, "_test.go") {
+			continue
+		}
+		parsed, err := parser.ParseFile(fset, file, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, decl := range parsed.Decls {
+			gen, ok := decl.(*ast.GenDecl)
+			if !ok {
+				continue
+			}
+			for _, spec := range gen.Specs {
+				var names []*ast.Ident
+				switch spec := spec.(type) {
+				case *ast.ValueSpec:
+					names = spec.Names
+				case *ast.TypeSpec:
+					names = []*ast.Ident{spec.Name}
+				}
+				for _, name := range names {
+					declared := strings.HasPrefix(name.Name, "err") || strings.HasPrefix(name.Name, "Err") || strings.HasSuffix(name.Name, "Error")
+					if declared && !listed[name.Name] {
+						t.Errorf("%v: error %s missing from the table", fset.Position(name.Pos()), name.Name)
+					}
+				}
+			}
+		}
+	}
+}
+
+// Tests that sources which stopped sending invalid headers are forgotten as
+// rejections are recorded, even if the tallies are never queried.
+func TestPeerRejectionPruning(t *testing.T) {
+	stats := newRejectionStats()
+	now := time.Now()
+	stats.now = func() time.Time { return now }
+
+	for i := 0; i < 100; i++ {
+		stats.record(fmt.Sprintf("peer-%d", i), errInvalidStake)
+	}
+	if len(stats.sources) != 100 {
+		t.Fatalf("sources mismatch: have %d, want 100", len(stats.sources))
+	}
+	now = now.Add(20 * rejectionHalfLife)
+	stats.record("latest", errInvalidStake)
+	if len(stats.sources) != 1 || stats.sources["latest"] == nil {
+		t.Errorf("decayed sources kept: have %d sources", len(stats.sources))
+	}
+}
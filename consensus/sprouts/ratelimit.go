@@ -0,0 +1,128 @@
+package sprouts
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/applicature/sprouts-plus/params"
+)
+
+// anonymousCaller is the identity all RPC callers are accounted to, the RPC
+// layer doesn't tell callers apart.
+const anonymousCaller = ""
+
+// coinAgeBlockWeight is the cost of walking a single block to accumulate the
+// coin age.
+const coinAgeBlockWeight = 1
+
+// RPCBudget limits the cost of the expensive API calls of every caller. The
+// cost of a call is the number of blocks it touches times their weight.
+type RPCBudget struct {
+	Rate  float64 `json:"rate"`  // Cost regained per second, calls aren't limited if 0
+	Burst uint64  `json:"burst"` // Cost which can be spent at once
+}
+
+// RateLimitError is returned by expensive API calls if their caller exceeded
+// its budget. The calls are not queued, they fail right away.
+type RateLimitError struct {
+	RetryAfter time.Duration // Time until the call's cost is regained
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("rpc budget exceeded, retry after %v", e.RetryAfter)
+}
+
+// costBucket is the budget left to a single caller.
+type costBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// costLimiter limits the cost of the expensive API calls with a token bucket
+// per caller.
+type costLimiter struct {
+	budget  RPCBudget
+	buckets map[string]*costBucket
+	now     func() time.Time
+	lock    sync.Mutex
+}
+
+func newCostLimiter(budget RPCBudget) *costLimiter {
+	return &costLimiter{
+		budget:  budget,
+		buckets: make(map[string]*costBucket),
+		now:     time.Now,
+	}
+}
+
+// setBudget replaces the budget. The buckets are kept, capped to the new
+// burst.
+func (l *costLimiter) setBudget(budget RPCBudget) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.budget = budget
+	for _, bucket := range l.buckets {
+		if bucket.tokens > float64(budget.Burst) {
+			bucket.tokens = float64(budget.Burst)
+		}
+	}
+}
+
+// currentBudget returns the budget in effect.
+func (l *costLimiter) currentBudget() RPCBudget {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.budget
+}
+
+// charge takes the cost from the caller's bucket, or returns a RateLimitError
+// if the bucket doesn't hold enough. Costs beyond the burst are capped to it,
+// so any call can eventually be made.
+func (l *costLimiter) charge(caller string, cost uint64) error {
+	if l == nil {
+		return nil
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.budget.Rate <= 0 {
+		return nil
+	}
+	now := l.now()
+	bucket := l.buckets[caller]
+	if bucket == nil {
+		bucket = &costBucket{tokens: float64(l.budget.Burst), updated: now}
+		l.buckets[caller] = bucket
+	}
+	bucket.tokens += now.Sub(bucket.updated).Seconds() * l.budget.Rate
+	if bucket.tokens > float64(l.budget.Burst) {
+		bucket.tokens = float64(l.budget.Burst)
+	}
+	bucket.updated = now
+
+	need := float64(cost)
+	if need > float64(l.budget.Burst) {
+		need = float64(l.budget.Burst)
+	}
+	if bucket.tokens < need {
+		wait := (need - bucket.tokens) / l.budget.Rate
+		return &RateLimitError{RetryAfter: time.Duration(wait * float64(time.Second))}
+	}
+	bucket.tokens -= need
+	return nil
+}
+
+// coinAgeCost estimates the cost of accumulating the coin age on top of the
+// block with the given number, walking back over the coin age lifetime.
+func coinAgeCost(config *params.SproutsConfig, number uint64) uint64 {
+	blocks := number
+	if config.CoinAgeLifetime != nil && config.BlockPeriod > 0 {
+		if lifetime := config.CoinAgeLifetime.Uint64() / config.BlockPeriod; lifetime < blocks {
+			blocks = lifetime
+		}
+	}
+	return blocks * coinAgeBlockWeight
+}
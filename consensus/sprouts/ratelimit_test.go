@@ -0,0 +1,84 @@
+package sprouts
+
+import (
+	"testing"
+	"time"
+
+	"github.com/applicature/sprouts-plus/common/hexutil"
+)
+
+// Tests that every caller has its own budget and that over-limit calls report
+// when they can be retried.
+func TestCostLimiter(t *testing.T) {
+	now := time.Unix(1000, 0)
+	limiter := newCostLimiter(RPCBudget{Rate: 10, Burst: 100})
+	limiter.now = func() time.Time { return now }
+
+	if err := limiter.charge("a", 60); err != nil {
+		t.Fatalf("first call limited: %v", err)
+	}
+	err := limiter.charge("a", 60)
+	if limited, ok := err.(*RateLimitError); !ok || limited.RetryAfter != 2*time.Second {
+		t.Fatalf("exhausted budget error mismatch: have %v, want retry after 2s", err)
+	}
+	// Another caller isn't affected
+	if err := limiter.charge("b", 60); err != nil {
+		t.Fatalf("other caller limited: %v", err)
+	}
+	// The budget is regained over time
+	now = now.Add(2 * time.Second)
+	if err := limiter.charge("a", 60); err != nil {
+		t.Fatalf("call after retry period limited: %v", err)
+	}
+	// Costs beyond the burst are capped, so the call isn't refused forever
+	now = now.Add(time.Minute)
+	if err := limiter.charge("a", 1000); err != nil {
+		t.Fatalf("call beyond burst limited: %v", err)
+	}
+	// Lifting the limit
+	limiter.setBudget(RPCBudget{})
+	for i := 0; i < 10; i++ {
+		if err := limiter.charge("a", 1000); err != nil {
+			t.Fatalf("unlimited call limited: %v", err)
+		}
+	}
+	var unset *costLimiter
+	if err := unset.charge("a", 1000); err != nil {
+		t.Fatalf("call without limiter limited: %v", err)
+	}
+}
+
+// Tests that the expensive API calls are charged to the budget, which can be
+// adjusted through the admin API.
+func TestAPIRateLimit(t *testing.T) {
+	blockchain, blocks, engine := newTestChain(t, 4)
+	defer blockchain.Stop()
+
+	if _, err := blockchain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	engine.limiter = newCostLimiter(RPCBudget{Rate: 0.001, Burst: 5})
+
+	api := &API{chain: blockchain, sprouts: engine}
+	admin := &AdminAPI{sprouts: engine}
+
+	if _, err := api.CoinAgeAt(hexutil.Uint64(4)); err != nil {
+		t.Fatalf("first call failed: %v", err)
+	}
+	if _, err := api.CoinAgeAt(hexutil.Uint64(4)); err == nil {
+		t.Fatal("call beyond budget succeeded")
+	} else if _, ok := err.(*RateLimitError); !ok {
+		t.Fatalf("error mismatch: have %v, want rate limit error", err)
+	}
+	// Cheap calls aren't charged
+	if _, err := api.ListStakes(); err != nil {
+		t.Fatalf("cheap call failed: %v", err)
+	}
+	admin.SetSproutsRPCBudget(RPCBudget{})
+	if budget := admin.SproutsRPCBudget(); budget != (RPCBudget{}) {
+		t.Errorf("budget mismatch: have %+v, want none", budget)
+	}
+	if _, err := api.CoinAgeAt(hexutil.Uint64(4)); err != nil {
+		t.Fatalf("call without budget failed: %v", err)
+	}
+}
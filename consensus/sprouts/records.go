@@ -0,0 +1,256 @@
+package sprouts
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/applicature/sprouts-plus/common"
+	"github.com/applicature/sprouts-plus/ethdb"
+	"github.com/applicature/sprouts-plus/rlp"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// recordsCipherVersion prefixes encrypted record values. Plaintext records are
+// JSON encoded, so they never start with it.
+const recordsCipherVersion = 0x01
+
+var (
+	coinAgePrefix    = []byte("coinage")                // Prefix of the coin age records, followed by the signer
+	mappedStakesKey  = []byte("mappedStakes")           // Key of the known stakes record
+	recordsMarkerKey = []byte("sprouts-records-cipher") // Key of the encryption marker, never encrypted itself
+
+	// recordsCheck is encrypted into the marker to tell a wrong key apart.
+	recordsCheck = []byte("sprouts records")
+)
+
+// ErrRecordsKey is returned if the engine's records are encrypted and the key
+// they were encrypted with hasn't been provided.
+var ErrRecordsKey = errors.New("engine records encrypted with a different key")
+
+// recordsMarker is persisted once encryption of the records is enabled. A
+// marker which isn't complete means the records may still be partly plaintext.
+type recordsMarker struct {
+	Check    []byte // recordsCheck encrypted with the records key
+	Complete bool   // Whether all plaintext records have been encrypted
+}
+
+// isRecordKey reports whether the database key belongs to the engine's own
+// records, whose values are encrypted at rest.
+func isRecordKey(key []byte) bool {
+	switch {
+	case bytes.Equal(key, mappedStakesKey):
+		return true
+	case bytes.HasPrefix(key, coinAgeCheckpointPrefix):
+		return len(key) == len(coinAgeCheckpointPrefix)+common.HashLength+common.AddressLength
+	case bytes.HasPrefix(key, coinAgeLogPrefix):
+		return len(key) == len(coinAgeLogPrefix)+common.AddressLength
+	}
+	return len(key) == len(coinAgePrefix)+common.AddressLength && bytes.HasPrefix(key, coinAgePrefix)
+}
+
+// LoadRecordsKey reads a records key from the given file, which holds the key
+// hex encoded. Surrounding whitespace is ignored.
+func LoadRecordsKey(file string) ([]byte, error) {
+	blob, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(blob)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid records key: %v", err)
+	}
+	switch len(key) {
+	case 16, 24, 32:
+		return key, nil
+	}
+	return nil, fmt.Errorf("invalid records key length %d, want 16, 24 or 32 bytes", len(key))
+}
+
+// recordsCipher encrypts record values with AES-GCM.
+type recordsCipher struct {
+	aead cipher.AEAD
+}
+
+// newRecordsCipher creates a cipher from an AES key of 16, 24 or 32 bytes.
+func newRecordsCipher(key []byte) (*recordsCipher, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &recordsCipher{aead: aead}, nil
+}
+
+// seal encrypts the value under a random nonce.
+func (c *recordsCipher) seal(value []byte) ([]byte, error) {
+	nonceSize := c.aead.NonceSize()
+
+	sealed := make([]byte, 1+nonceSize, 1+nonceSize+len(value)+c.aead.Overhead())
+	sealed[0] = recordsCipherVersion
+	if _, err := rand.Read(sealed[1:]); err != nil {
+		return nil, err
+	}
+	return c.aead.Seal(sealed, sealed[1:], value, nil), nil
+}
+
+// open decrypts a value produced by seal. Plaintext values are returned as
+// they are, as they may be left over from before encryption was enabled.
+func (c *recordsCipher) open(blob []byte) ([]byte, error) {
+	if !isSealed(blob) {
+		return blob, nil
+	}
+	if c == nil {
+		return nil, ErrRecordsKey
+	}
+	nonceSize := c.aead.NonceSize()
+	if len(blob) < 1+nonceSize {
+		return nil, ErrRecordsKey
+	}
+	value, err := c.aead.Open(nil, blob[1:1+nonceSize], blob[1+nonceSize:], nil)
+	if err != nil {
+		return nil, ErrRecordsKey
+	}
+	return value, nil
+}
+
+// isSealed reports whether the value has been encrypted.
+func isSealed(blob []byte) bool {
+	return len(blob) > 0 && blob[0] == recordsCipherVersion
+}
+
+// recordsDatabase transparently encrypts the values of the engine's records
+// and passes any other access through. Batches are not wrapped, the records
+// are never written in batches.
+type recordsDatabase struct {
+	ethdb.Database
+	cipher *recordsCipher // Cipher of the records, nil if they are stored in plaintext
+}
+
+// Get retrieves the value of the key, decrypting it if it is a record.
+func (db *recordsDatabase) Get(key []byte) ([]byte, error) {
+	blob, err := db.Database.Get(key)
+	if err != nil || !isRecordKey(key) {
+		return blob, err
+	}
+	return db.cipher.open(blob)
+}
+
+// Put stores the value of the key, encrypting it if it is a record and a
+// cipher is configured.
+func (db *recordsDatabase) Put(key []byte, value []byte) error {
+	if db.cipher != nil && isRecordKey(key) {
+		sealed, err := db.cipher.seal(value)
+		if err != nil {
+			return err
+		}
+		value = sealed
+	}
+	return db.Database.Put(key, value)
+}
+
+// recordKeys lists the keys of the records stored in the database. Records
+// other than the known stakes can only be found in databases which can be
+// iterated.
+func recordKeys(db ethdb.Database) ([][]byte, error) {
+	var keys [][]byte
+	if has, err := db.Has(mappedStakesKey); err != nil {
+		return nil, err
+	} else if has {
+		keys = append(keys, mappedStakesKey)
+	}
+	switch db := db.(type) {
+	case *ethdb.LDBDatabase:
+		for _, prefix := range [][]byte{coinAgePrefix, coinAgeCheckpointPrefix, coinAgeLogPrefix} {
+			it := db.LDB().NewIterator(util.BytesPrefix(prefix), nil)
+			for it.Next() {
+				if isRecordKey(it.Key()) {
+					keys = append(keys, common.CopyBytes(it.Key()))
+				}
+			}
+			it.Release()
+			if err := it.Error(); err != nil {
+				return nil, err
+			}
+		}
+	case *ethdb.MemDatabase:
+		for _, key := range db.Keys() {
+			if isRecordKey(key) && !bytes.Equal(key, mappedStakesKey) {
+				keys = append(keys, key)
+			}
+		}
+	}
+	return keys, nil
+}
+
+// recordsEncrypted reports whether encryption of the records has been enabled
+// in the database.
+func recordsEncrypted(db ethdb.Database) (bool, error) {
+	return db.Has(recordsMarkerKey)
+}
+
+// migrateRecords encrypts the plaintext records in place. The marker is
+// written before any record is touched and completed afterwards, so an
+// interrupted migration is detected and resumed on the next start.
+func migrateRecords(db ethdb.Database, c *recordsCipher) error {
+	var marker recordsMarker
+	if blob, err := db.Get(recordsMarkerKey); err == nil {
+		if err := rlp.DecodeBytes(blob, &marker); err != nil {
+			return err
+		}
+		if check, err := c.open(marker.Check); err != nil || !bytes.Equal(check, recordsCheck) {
+			return ErrRecordsKey
+		}
+		if marker.Complete {
+			return nil
+		}
+	} else {
+		check, err := c.seal(recordsCheck)
+		if err != nil {
+			return err
+		}
+		marker.Check = check
+		if err := putRecordsMarker(db, &marker); err != nil {
+			return err
+		}
+	}
+	keys, err := recordKeys(db)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		blob, err := db.Get(key)
+		if err != nil {
+			return err
+		}
+		if isSealed(blob) {
+			continue
+		}
+		sealed, err := c.seal(blob)
+		if err != nil {
+			return err
+		}
+		if err := db.Put(key, sealed); err != nil {
+			return err
+		}
+	}
+	marker.Complete = true
+	return putRecordsMarker(db, &marker)
+}
+
+func putRecordsMarker(db ethdb.Database, marker *recordsMarker) error {
+	blob, err := rlp.EncodeToBytes(marker)
+	if err != nil {
+		return err
+	}
+	return db.Put(recordsMarkerKey, blob)
+}
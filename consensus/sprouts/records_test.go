@@ -0,0 +1,285 @@
+package sprouts
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/applicature/sprouts-plus/common"
+	"github.com/applicature/sprouts-plus/core/types"
+	"github.com/applicature/sprouts-plus/ethdb"
+	"github.com/applicature/sprouts-plus/rlp"
+)
+
+var (
+	testRecordsKey  = bytes.Repeat([]byte{0x11}, 32)
+	otherRecordsKey = bytes.Repeat([]byte{0x22}, 32)
+
+	testCheckpointHash = common.HexToHash("0x44")
+)
+
+// storeTestRecords saves a coin age record, a known stake, a coin age
+// checkpoint and a coin age log through the engine's database.
+func storeTestRecords(t *testing.T, engine *PoS) (*coinAge, *mappedStakes) {
+	ca := &coinAge{Time: 1234, Age: big.NewInt(5678), Value: big.NewInt(9)}
+	if err := ca.saveCoinAge(engine.db, testAddr); err != nil {
+		t.Fatal(err)
+	}
+	stakes := make(mappedStakes)
+	stakes.add(&types.Header{Number: big1}, ca, bytes.Repeat([]byte{0x33}, extraKernel))
+	if err := engine.saveMappedStakes(&stakes); err != nil {
+		t.Fatal(err)
+	}
+	cp := &coinAgeCheckpoint{Number: 1, Hash: testCheckpointHash, Signer: testAddr, Entries: []coinAgeEntry{}}
+	if err := engine.storeCoinAgeCheckpoint(cp); err != nil {
+		t.Fatal(err)
+	}
+	l := &coinAgeLog{Signer: testAddr, Age: big.NewInt(5678), Contributions: []coinAgeContribution{{Number: 1, Time: 1234, Delta: big.NewInt(5678)}}}
+	if err := engine.storeCoinAgeLog(l); err != nil {
+		t.Fatal(err)
+	}
+	return ca, &stakes
+}
+
+// checkTestRecords verifies that the records stored by storeTestRecords can be
+// read back through the engine's database.
+func checkTestRecords(t *testing.T, engine *PoS, want *coinAge) {
+	ca, err := loadCoinAge(engine.db, testAddr)
+	if err != nil {
+		t.Fatalf("failed to load coin age: %v", err)
+	}
+	if ca.Time != want.Time || ca.Age.Cmp(want.Age) != 0 || ca.Value.Cmp(want.Value) != 0 {
+		t.Errorf("coin age mismatch: have %+v, want %+v", ca, want)
+	}
+	stakes, err := engine.getMappedStakes()
+	if err != nil {
+		t.Fatalf("failed to load stakes: %v", err)
+	}
+	if len(*stakes) != 1 {
+		t.Errorf("stakes count mismatch: have %d, want 1", len(*stakes))
+	}
+	cp, err := engine.loadCoinAgeCheckpoint(testCheckpointHash, testAddr)
+	if err != nil {
+		t.Fatalf("failed to load checkpoint: %v", err)
+	}
+	if cp.Signer != testAddr {
+		t.Errorf("checkpoint signer mismatch: have %x, want %x", cp.Signer, testAddr)
+	}
+	l, err := engine.loadCoinAgeLog(testAddr)
+	if err != nil {
+		t.Fatalf("failed to load coin age log: %v", err)
+	}
+	if len(l.Contributions) != 1 || l.Age.Cmp(big.NewInt(5678)) != 0 {
+		t.Errorf("coin age log mismatch: %+v", l)
+	}
+}
+
+// checkSealedRecords verifies whether the raw record values are encrypted.
+func checkSealedRecords(t *testing.T, db ethdb.Database, sealed bool) {
+	for _, key := range [][]byte{coinAgeKey(testAddr), mappedStakesKey, coinAgeCheckpointKey(testCheckpointHash, testAddr), coinAgeLogKey(testAddr)} {
+		blob, err := db.Get(key)
+		if err != nil {
+			t.Fatalf("record %q missing: %v", key, err)
+		}
+		if isSealed(blob) != sealed {
+			t.Errorf("record %q: sealed mismatch: have %v, want %v", key, isSealed(blob), sealed)
+		}
+	}
+}
+
+func TestRecordsRoundTrip(t *testing.T) {
+	db, _ := ethdb.NewMemDatabase()
+
+	engine, err := NewWithOptions(&sproutsConfig, db, Options{RecordsKey: testRecordsKey})
+	if err != nil {
+		t.Fatalf("failed to create engine: %v", err)
+	}
+	ca, _ := storeTestRecords(t, engine)
+	checkSealedRecords(t, db, true)
+	checkTestRecords(t, engine, ca)
+
+	// The records survive a restart with the same key
+	engine, err = NewWithOptions(&sproutsConfig, db, Options{RecordsKey: testRecordsKey})
+	if err != nil {
+		t.Fatalf("failed to reopen engine: %v", err)
+	}
+	checkTestRecords(t, engine, ca)
+}
+
+func TestRecordsWrongKey(t *testing.T) {
+	db, _ := ethdb.NewMemDatabase()
+
+	engine, err := NewWithOptions(&sproutsConfig, db, Options{RecordsKey: testRecordsKey})
+	if err != nil {
+		t.Fatalf("failed to create engine: %v", err)
+	}
+	storeTestRecords(t, engine)
+
+	if _, err := NewWithOptions(&sproutsConfig, db, Options{RecordsKey: otherRecordsKey}); err != ErrRecordsKey {
+		t.Errorf("wrong key error mismatch: have %v, want %v", err, ErrRecordsKey)
+	}
+	if _, err := NewWithOptions(&sproutsConfig, db, Options{}); err != ErrRecordsKey {
+		t.Errorf("missing key error mismatch: have %v, want %v", err, ErrRecordsKey)
+	}
+	// Engines bypassing the check fail loading instead of decoding garbage
+	plain := newTestEngine(t, &sproutsConfig, db)
+	if _, err := loadCoinAge(plain.db, testAddr); err != ErrRecordsKey {
+		t.Errorf("coin age error mismatch: have %v, want %v", err, ErrRecordsKey)
+	}
+	if _, err := plain.getMappedStakes(); err != ErrRecordsKey {
+		t.Errorf("stakes error mismatch: have %v, want %v", err, ErrRecordsKey)
+	}
+	wrong := newEngine(&sproutsConfig, db, mustRecordsCipher(t, otherRecordsKey), Options{})
+	if _, err := loadCoinAge(wrong.db, testAddr); err != ErrRecordsKey {
+		t.Errorf("wrong key coin age error mismatch: have %v, want %v", err, ErrRecordsKey)
+	}
+}
+
+func TestRecordsMigration(t *testing.T) {
+	db, _ := ethdb.NewMemDatabase()
+
+	// Records written in plaintext are encrypted in place
+	plain := newTestEngine(t, &sproutsConfig, db)
+	ca, _ := storeTestRecords(t, plain)
+	checkSealedRecords(t, db, false)
+
+	engine, err := NewWithOptions(&sproutsConfig, db, Options{RecordsKey: testRecordsKey})
+	if err != nil {
+		t.Fatalf("failed to migrate records: %v", err)
+	}
+	checkSealedRecords(t, db, true)
+	checkTestRecords(t, engine, ca)
+}
+
+func TestRecordsMigrationResume(t *testing.T) {
+	db, _ := ethdb.NewMemDatabase()
+	plain := newTestEngine(t, &sproutsConfig, db)
+	ca, _ := storeTestRecords(t, plain)
+
+	// Simulate a migration interrupted after encrypting the coin age only
+	c := mustRecordsCipher(t, testRecordsKey)
+	check, _ := c.seal(recordsCheck)
+	if err := putRecordsMarker(db, &recordsMarker{Check: check}); err != nil {
+		t.Fatal(err)
+	}
+	blob, _ := db.Get(coinAgeKey(testAddr))
+	sealed, _ := c.seal(blob)
+	db.Put(coinAgeKey(testAddr), sealed)
+
+	// The mixed state is still readable and completed on the next start
+	engine, err := NewWithOptions(&sproutsConfig, db, Options{RecordsKey: testRecordsKey})
+	if err != nil {
+		t.Fatalf("failed to resume migration: %v", err)
+	}
+	checkSealedRecords(t, db, true)
+	checkTestRecords(t, engine, ca)
+
+	blob, _ = db.Get(recordsMarkerKey)
+	var marker recordsMarker
+	if err := rlp.DecodeBytes(blob, &marker); err != nil || !marker.Complete {
+		t.Errorf("marker not completed: %+v (%v)", marker, err)
+	}
+}
+
+func TestRecordKeys(t *testing.T) {
+	tests := []struct {
+		key    []byte
+		record bool
+	}{
+		{mappedStakesKey, true},
+		{coinAgeKey(testAddr), true},
+		{coinAgePrefix, false},
+		{append(coinAgeKey(testAddr), 0x00), false},
+		{coinAgeCheckpointKey(testCheckpointHash, testAddr), true},
+		{append(coinAgeCheckpointKey(testCheckpointHash, testAddr), 0x00), false},
+		{coinAgeCheckpointPrefix, false},
+		{latestCheckpointKey(testAddr), false},
+		{coinAgeLogKey(testAddr), true},
+		{coinAgeLogPrefix, false},
+		{recordsMarkerKey, false},
+		{cacheSnapshotKey, false},
+		{common.Hash{}.Bytes(), false},
+	}
+	for i, tt := range tests {
+		if record := isRecordKey(tt.key); record != tt.record {
+			t.Errorf("test %d: key %q: record mismatch: have %v, want %v", i, tt.key, record, tt.record)
+		}
+	}
+}
+
+func mustRecordsCipher(t testing.TB, key []byte) *recordsCipher {
+	c, err := newRecordsCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// Tests that records keys are read from hex encoded key files, and that keys
+// of invalid lengths are refused.
+func TestLoadRecordsKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sprouts-records-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		content string
+		key     []byte
+	}{
+		{hex.EncodeToString(testRecordsKey) + "\n", testRecordsKey},
+		{hex.EncodeToString(testRecordsKey[:16]), testRecordsKey[:16]},
+		{hex.EncodeToString(testRecordsKey[:20]), nil},
+		{"not a key", nil},
+	}
+	for i, tt := range tests {
+		file := filepath.Join(dir, "key")
+		if err := ioutil.WriteFile(file, []byte(tt.content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		key, err := LoadRecordsKey(file)
+		if tt.key == nil {
+			if err == nil {
+				t.Errorf("test %d: invalid key %x accepted", i, key)
+			}
+			continue
+		}
+		if err != nil || !bytes.Equal(key, tt.key) {
+			t.Errorf("test %d: key mismatch: have %x, %v, want %x", i, key, err, tt.key)
+		}
+	}
+	if _, err := LoadRecordsKey(filepath.Join(dir, "missing")); err == nil {
+		t.Error("missing key file accepted")
+	}
+}
+
+func benchmarkRecords(b *testing.B, key []byte) {
+	db, _ := ethdb.NewMemDatabase()
+	engine, err := NewWithOptions(&sproutsConfig, db, Options{RecordsKey: key})
+	if err != nil {
+		b.Fatal(err)
+	}
+	stakes := make(mappedStakes)
+	for i := 0; i < 1000; i++ {
+		ca := &coinAge{Time: uint64(i), Age: big.NewInt(int64(i)), Value: big.NewInt(1000)}
+		stakes.add(&types.Header{Number: big.NewInt(int64(i))}, ca, bytes.Repeat([]byte{byte(i)}, extraKernel))
+	}
+	b.ResetTimer()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := engine.saveMappedStakes(&stakes); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := engine.getMappedStakes(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkRecordsPlaintext(b *testing.B) { benchmarkRecords(b, nil) }
+func BenchmarkRecordsEncrypted(b *testing.B) { benchmarkRecords(b, testRecordsKey) }
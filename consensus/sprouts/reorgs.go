@@ -0,0 +1,75 @@
+package sprouts
+
+import (
+	"github.com/applicature/sprouts-plus/common"
+	"github.com/applicature/sprouts-plus/consensus"
+	"github.com/applicature/sprouts-plus/core"
+	"github.com/applicature/sprouts-plus/event"
+	"github.com/applicature/sprouts-plus/log"
+)
+
+// chainSideSubscriber is a chain announcing the blocks which aren't or are no
+// longer canonical, like core.BlockChain.
+type chainSideSubscriber interface {
+	consensus.ChainReader
+	SubscribeChainSideEvent(ch chan<- core.ChainSideEvent) event.Subscription
+}
+
+// InvalidateCoinAge drops the recorded coin age of the signer, which the
+// stakes of blocks no longer canonical may have been subtracted from. It is
+// recorded afresh the next time it is computed for sealing.
+func (engine *PoS) InvalidateCoinAge(signer common.Address) error {
+	if engine.db == nil {
+		return nil
+	}
+	return engine.persist(func() error { return engine.db.Delete(coinAgeKey(signer)) })
+}
+
+// recomputeCoinAge replaces the recorded coin age of the local signer with the
+// one computed on top of the current head.
+func (engine *PoS) recomputeCoinAge(chain consensus.ChainReader, signer common.Address) error {
+	if err := engine.InvalidateCoinAge(signer); err != nil {
+		return err
+	}
+	ca, err := engine.ComputeCoinAge(chain, signer, engine.unixNow())
+	if err != nil {
+		return err
+	}
+	return engine.persist(func() error { return ca.saveCoinAge(engine.db, signer) })
+}
+
+// StartCoinAgeInvalidation keeps the recorded coin ages of the local signers
+// consistent with the canonical chain until the engine is closed. Whenever a
+// block one of them minted ends up off the canonical chain, e.g. reorged away,
+// its coin age is recomputed from the new head.
+func (engine *PoS) StartCoinAgeInvalidation(chain chainSideSubscriber) {
+	if engine.db == nil {
+		return
+	}
+	sides := make(chan core.ChainSideEvent, 16)
+	sub := chain.SubscribeChainSideEvent(sides)
+
+	spawned := engine.life.spawn(func(quit <-chan struct{}, _ uint64) {
+		defer sub.Unsubscribe()
+
+		for {
+			select {
+			case ev := <-sides:
+				minter := ev.Block.Coinbase()
+				if !engine.isItMe(minter) {
+					continue
+				}
+				if err := engine.recomputeCoinAge(chain, minter); err != nil {
+					log.Warn("Failed to recompute coin age", "err", err)
+				}
+			case <-sub.Err():
+				return
+			case <-quit:
+				return
+			}
+		}
+	})
+	if !spawned {
+		sub.Unsubscribe()
+	}
+}
@@ -0,0 +1,85 @@
+package sprouts
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/applicature/sprouts-plus/common"
+	"github.com/applicature/sprouts-plus/core"
+	"github.com/applicature/sprouts-plus/core/vm"
+	"github.com/applicature/sprouts-plus/params"
+)
+
+// Tests that the recorded coin age of the signer is recomputed from the new
+// head once blocks it minted are reorged away.
+func TestCoinAgeInvalidation(t *testing.T) {
+	db, genesis, _ := initBlockchainStructures(t)
+	engine := newTestFaker(t, &sproutsConfig, db)
+	engine.Authorize(rewardsAddr, nil)
+	defer engine.Close()
+
+	genesisBlock := genesis.MustCommit(db)
+	blockchain, err := core.NewBlockChain(db, genesis.Config, engine, vm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blockchain.Stop()
+	engine.StartCoinAgeInvalidation(blockchain)
+
+	blocks, _ := GenerateFakeChain(&sproutsConfig, params.TestSproutsChainConfig, genesisBlock, db, 3, func(i int, b *BlockGen) {
+		b.SetCoinbase(rewardsAddr)
+	})
+	if _, err := blockchain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	stale := &coinAge{Time: 1, Age: big.NewInt(5000), Value: new(big.Int)}
+	if err := stale.saveCoinAge(engine.db, rewardsAddr); err != nil {
+		t.Fatal(err)
+	}
+	// a longer chain minted by someone else replaces the signer's blocks
+	fork, _ := GenerateFakeChain(&sproutsConfig, params.TestSproutsChainConfig, genesisBlock, db, 4, func(i int, b *BlockGen) {
+		b.SetCoinbase(testAddr)
+	})
+	if _, err := blockchain.InsertChain(fork); err != nil {
+		t.Fatalf("failed to insert fork: %v", err)
+	}
+	var ca *coinAge
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if ca, err = loadCoinAge(engine.db, rewardsAddr); err == nil && ca.Time != stale.Time {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("coin age not recomputed: %v, %v", ca, err)
+		}
+	}
+	want, err := engine.ComputeCoinAge(blockchain, rewardsAddr, ca.Time)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ca.Age.Cmp(want.Age) != 0 || ca.Value.Cmp(want.Value) != 0 {
+		t.Errorf("coin age mismatch: have %v/%v, want %v/%v", ca.Age, ca.Value, want.Age, want.Value)
+	}
+	if ca.Age.Cmp(stale.Age) == 0 {
+		t.Errorf("coin age still stale: %v", ca.Age)
+	}
+}
+
+// Tests that an invalidated coin age record is gone, and that others are kept.
+func TestInvalidateCoinAge(t *testing.T) {
+	db, _, engine := initBlockchainStructures(t)
+	for _, addr := range []common.Address{rewardsAddr, testAddr} {
+		if err := (&coinAge{Time: 1, Age: big.NewInt(5000), Value: new(big.Int)}).saveCoinAge(engine.db, addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := engine.InvalidateCoinAge(rewardsAddr); err != nil {
+		t.Fatalf("failed to invalidate coin age: %v", err)
+	}
+	if _, err := loadCoinAge(db, rewardsAddr); err == nil {
+		t.Errorf("invalidated coin age still recorded")
+	}
+	if _, err := loadCoinAge(db, testAddr); err != nil {
+		t.Errorf("coin age of another signer dropped: %v", err)
+	}
+}
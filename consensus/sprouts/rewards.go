@@ -0,0 +1,91 @@
+package sprouts
+
+import (
+	"encoding/json"
+	"errors"
+	"math/big"
+
+	"github.com/applicature/sprouts-plus/common"
+	"github.com/applicature/sprouts-plus/core/types"
+	"github.com/applicature/sprouts-plus/log"
+)
+
+// blockRewardPrefix is the prefix of the reward records, followed by the block
+// hash.
+var blockRewardPrefix = []byte("sprouts-block-reward-")
+
+// errNoRewardRecord is returned if the reward of a block hasn't been recorded.
+var errNoRewardRecord = errors.New("no reward record")
+
+// inMemoryMinted is the number of blocks being minted whose paid rewards are
+// kept until they are sealed.
+const inMemoryMinted = 16
+
+// rewardRecord is what finalization credited to the recipients of a block.
+// The coinbase and the stake are left to the header.
+type rewardRecord struct {
+	Netto   *big.Int `json:"netto"`   // Credited to the coinbase
+	Charity *big.Int `json:"charity"` // Credited to the charity account
+	RD      *big.Int `json:"rd"`      // Credited to the r&d account
+}
+
+func blockRewardKey(hash common.Hash) []byte {
+	key := make([]byte, 0, len(blockRewardPrefix)+common.HashLength)
+	return append(append(key, blockRewardPrefix...), hash[:]...)
+}
+
+// hasSeal reports whether the header carries a signature. Headers being
+// minted are finalized before they are sealed, which changes their hash.
+func hasSeal(header *types.Header) bool {
+	extra, err := decodeHeaderExtra(header.Extra)
+	if err != nil {
+		return false
+	}
+	for _, b := range extra.Seal {
+		if b != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// recordBlockReward persists the rewards finalization paid for the block,
+// keyed by its hash.
+func (engine *PoS) recordBlockReward(header *types.Header, paid RewardSplit) {
+	blob, err := json.Marshal(&rewardRecord{Netto: paid.Minter, Charity: paid.Charity, RD: paid.RD})
+	if err != nil {
+		return
+	}
+	hash := header.Hash()
+	if err := engine.persist(func() error { return engine.db.Put(blockRewardKey(hash), blob) }); err != nil {
+		log.Debug("Failed to record block reward", "hash", hash, "err", err)
+	}
+}
+
+// recordMintedReward records the rewards finalization paid for the block being
+// minted on top of the header's parent, now that the header is sealed.
+func (engine *PoS) recordMintedReward(header *types.Header) {
+	paid, ok := engine.minted.Get(header.ParentHash)
+	if !ok {
+		return
+	}
+	engine.minted.Remove(header.ParentHash)
+	engine.recordBlockReward(header, paid.(RewardSplit))
+}
+
+// loadBlockReward retrieves the recorded reward of the block with the given
+// hash.
+func (engine *PoS) loadBlockReward(hash common.Hash) (*rewardRecord, error) {
+	if engine.db == nil {
+		return nil, errNoRewardRecord
+	}
+	blob, err := engine.db.Get(blockRewardKey(hash))
+	if err != nil {
+		return nil, errNoRewardRecord
+	}
+	record := new(rewardRecord)
+	if err := json.Unmarshal(blob, record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
@@ -0,0 +1,118 @@
+package sprouts
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/applicature/sprouts-plus/common"
+	"github.com/applicature/sprouts-plus/core/types"
+	"github.com/applicature/sprouts-plus/ethdb"
+	"github.com/applicature/sprouts-plus/params"
+)
+
+// Tests that the rewards recorded for imported blocks match the balance
+// changes of their recipients, and that unsealed headers aren't recorded.
+func TestBlockRewardRecords(t *testing.T) {
+	blockchain, generated, engine := newTestChain(t, 4)
+	defer blockchain.Stop()
+
+	// imported blocks are sealed, so sign the generated ones
+	blocks := make(types.Blocks, len(generated))
+	parent := blockchain.Genesis().Hash()
+	for i, block := range generated {
+		header := block.Header()
+		header.ParentHash = parent
+		signTestHeader(t, header, rewardsKey)
+		blocks[i] = types.NewBlockWithHeader(header).WithBody(block.Transactions(), nil)
+		parent = header.Hash()
+	}
+	if _, err := blockchain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	api := &API{chain: blockchain, sprouts: engine}
+
+	for i, block := range blocks {
+		record, err := engine.loadBlockReward(block.Hash())
+		if err != nil {
+			t.Fatalf("block %d: reward not recorded: %v", i+1, err)
+		}
+		before, err := blockchain.StateAt(blockchain.GetBlockByNumber(uint64(i)).Root())
+		if err != nil {
+			t.Fatal(err)
+		}
+		after, err := blockchain.StateAt(block.Root())
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the recipients may coincide, so the credits are summed per account
+		credits := make(map[common.Address]*big.Int)
+		for _, credit := range []struct {
+			account common.Address
+			amount  *big.Int
+		}{
+			{block.Coinbase(), record.Netto},
+			{engine.config.RewardsCharityAccount, record.Charity},
+			{engine.config.RewardsRDAccount, record.RD},
+		} {
+			if credits[credit.account] == nil {
+				credits[credit.account] = new(big.Int)
+			}
+			credits[credit.account].Add(credits[credit.account], credit.amount)
+		}
+		for account, credit := range credits {
+			delta := new(big.Int).Sub(after.GetBalance(account), before.GetBalance(account))
+			if delta.Cmp(credit) != 0 {
+				t.Errorf("block %d: credit of %x mismatch: have %v, want %v", i+1, account, delta, credit)
+			}
+		}
+		reward, err := api.GetBlockReward(uint64(i + 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reward.Coinbase != rewardsAddr || reward.StakeAge.ToInt().Cmp(testStakeAge) != 0 || reward.StakeValue.ToInt().Cmp(big.NewInt(1000)) != 0 {
+			t.Errorf("block %d: reward mismatch: %+v", i+1, reward)
+		}
+	}
+
+	// headers still being minted aren't final, so they aren't recorded
+	unsealed := generated[0].Header()
+	if hasSeal(unsealed) {
+		t.Fatal("generated header reported sealed")
+	}
+	if _, err := engine.loadBlockReward(unsealed.Hash()); err != errNoRewardRecord {
+		t.Errorf("unsealed header recorded: %v", err)
+	}
+}
+
+// Tests that the rewards finalization paid for a block being minted are
+// recorded once the block is sealed.
+func TestMintedBlockRewardRecord(t *testing.T) {
+	db, _ := ethdb.NewMemDatabase()
+	engine := newTestEngine(t, &sproutsConfig, db)
+	chain := &configChainReader{config: params.TestSproutsChainConfig}
+
+	statedb, header := newFinalizeTestState(t, db, &coinAge{Time: uint64(startDate.Unix()), Age: big.NewInt(1000), Value: big.NewInt(123456789)})
+	block, err := engine.Finalize(chain, header, statedb, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := engine.loadBlockReward(block.Hash()); err != errNoRewardRecord {
+		t.Fatalf("unsealed header recorded: %v", err)
+	}
+	sealed := block.Header()
+	signTestHeader(t, sealed, testKey)
+	engine.recordMintedReward(sealed)
+
+	record, err := engine.loadBlockReward(sealed.Hash())
+	if err != nil {
+		t.Fatalf("reward not recorded: %v", err)
+	}
+	if netto := new(big.Int).Sub(statedb.GetBalance(testAddr), big.NewInt(1000000)); record.Netto.Cmp(netto) != 0 {
+		t.Errorf("netto mismatch: have %v, want %v", record.Netto, netto)
+	}
+	// charity and r&d share the same test account
+	credited := new(big.Int).Sub(statedb.GetBalance(rewardsAddr), big.NewInt(10))
+	if paid := new(big.Int).Add(record.Charity, record.RD); paid.Cmp(credited) != 0 {
+		t.Errorf("charity and r&d mismatch: have %v, want %v", paid, credited)
+	}
+}
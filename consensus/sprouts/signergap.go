@@ -0,0 +1,85 @@
+package sprouts
+
+import (
+	"github.com/applicature/sprouts-plus/common"
+	"github.com/applicature/sprouts-plus/consensus"
+	"github.com/applicature/sprouts-plus/core/types"
+)
+
+// inMemoryRecents is the number of blocks to keep the coinbases of the blocks
+// up to them in memory for.
+const inMemoryRecents = 1024
+
+// checkSignerGap returns errRecentlySigned if the coinbase of the header
+// sealed one of the MinSignerGap blocks up to its parent. The ancestors are
+// looked up among the given parents first, then in the chain.
+func (engine *PoS) checkSignerGap(chain consensus.ChainReader, header, parent *types.Header, parents []*types.Header) error {
+	if engine.config.MinSignerGap == 0 {
+		return nil
+	}
+	signers, err := engine.recentSigners(chain, parent, parents)
+	if err != nil {
+		return err
+	}
+	for _, signer := range signers {
+		if signer == header.Coinbase {
+			return errRecentlySigned
+		}
+	}
+	return nil
+}
+
+// recentSigners returns the coinbases of the MinSignerGap blocks up to the
+// given header, the latest first, and fewer close to the genesis block, which
+// has no signer. The lists are shared and must not be modified.
+func (engine *PoS) recentSigners(chain consensus.ChainReader, header *types.Header, parents []*types.Header) ([]common.Address, error) {
+	var (
+		gap      = int(engine.config.MinSignerGap)
+		signers  []common.Address
+		complete bool // whether signers holds all coinbases before the pending headers
+		pending  []*types.Header
+	)
+	for {
+		if header.Number.Sign() == 0 {
+			complete = true
+			break
+		}
+		if cached, ok := engine.recents.Get(header.Hash()); ok {
+			signers, complete = cached.([]common.Address), true
+			break
+		}
+		if len(pending) == gap {
+			break
+		}
+		pending = append(pending, header)
+
+		hash, number := header.ParentHash, header.Number.Uint64()-1
+		header = nil
+		for i := len(parents) - 1; i >= 0; i-- {
+			if parents[i].Hash() == hash {
+				header = parents[i]
+				break
+			}
+		}
+		if header == nil {
+			header = chain.GetHeader(hash, number)
+		}
+		if header == nil {
+			return nil, consensus.ErrUnknownAncestor
+		}
+	}
+	for i := len(pending) - 1; i >= 0; i-- {
+		extended := make([]common.Address, 0, gap)
+		extended = append(extended, pending[i].Coinbase)
+		extended = append(extended, signers...)
+		if len(extended) > gap {
+			extended = extended[:gap]
+		}
+		// lists missing older coinbases are only good for this walk
+		if complete || len(extended) == gap {
+			engine.recents.Add(pending[i].Hash(), extended)
+		}
+		signers = extended
+	}
+	return signers, nil
+}
@@ -0,0 +1,98 @@
+package sprouts
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/applicature/sprouts-plus/common"
+	"github.com/applicature/sprouts-plus/consensus"
+	"github.com/applicature/sprouts-plus/core"
+	"github.com/applicature/sprouts-plus/core/types"
+	"github.com/applicature/sprouts-plus/core/vm"
+	"github.com/applicature/sprouts-plus/params"
+)
+
+// Tests that a coinbase can't seal again within the minimum signer gap, but
+// once enough blocks of others followed its last one.
+func TestSignerGap(t *testing.T) {
+	config := sproutsConfig
+	config.MinSignerGap = 2
+
+	db, genesis, _ := initBlockchainStructures(t)
+	engine := newTestFaker(t, &config, db)
+	genesisBlock := genesis.MustCommit(db)
+	blockchain, err := core.NewBlockChain(db, genesis.Config, engine, vm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blockchain.Stop()
+
+	other := common.HexToAddress("0x0000000000000000000000000000000000000003")
+	signers := []common.Address{testAddr, rewardsAddr, other, testAddr, rewardsAddr}
+	blocks, _ := GenerateFakeChain(&config, params.TestSproutsChainConfig, genesisBlock, db, len(signers), func(i int, b *BlockGen) {
+		b.SetCoinbase(signers[i])
+	})
+	if _, err := blockchain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	// the same signer right after its block, and one block later
+	for _, parent := range blocks[:2] {
+		fork, _ := GenerateFakeChain(&config, params.TestSproutsChainConfig, parent, db, 1, func(i int, b *BlockGen) {
+			b.SetCoinbase(testAddr)
+		})
+		if err := engine.VerifyHeader(blockchain, fork[0].Header(), true); err != errRecentlySigned {
+			t.Errorf("block %d: error mismatch: have %v, want %v", fork[0].NumberU64(), err, errRecentlySigned)
+		}
+	}
+	// header-only verification skips the check like the kernel's
+	fork, _ := GenerateFakeChain(&config, params.TestSproutsChainConfig, blocks[0], db, 1, func(i int, b *BlockGen) {
+		b.SetCoinbase(testAddr)
+	})
+	if err := engine.VerifyHeader(blockchain, fork[0].Header(), false); err != nil {
+		t.Errorf("header-only verification failed: %v", err)
+	}
+}
+
+// Tests that the signers of a batch are taken from the batch itself, and
+// that only complete lists are cached.
+func TestRecentSignersBatch(t *testing.T) {
+	config := sproutsConfig
+	config.MinSignerGap = 3
+
+	db, genesis, _ := initBlockchainStructures(t)
+	engine := newTestFaker(t, &config, db)
+	genesisBlock := genesis.MustCommit(db)
+	blockchain, err := core.NewBlockChain(db, genesis.Config, engine, vm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blockchain.Stop()
+
+	signers := []common.Address{testAddr, rewardsAddr, testAddr, rewardsAddr, testAddr}
+	blocks, _ := GenerateFakeChain(&config, params.TestSproutsChainConfig, genesisBlock, db, len(signers), func(i int, b *BlockGen) {
+		b.SetCoinbase(signers[i])
+	})
+	headers := make([]*types.Header, len(blocks))
+	for i, block := range blocks {
+		headers[i] = block.Header()
+	}
+	have, err := engine.recentSigners(blockchain, headers[4], headers[:4])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []common.Address{testAddr, rewardsAddr, testAddr}; !reflect.DeepEqual(have, want) {
+		t.Errorf("signers mismatch: have %x, want %x", have, want)
+	}
+	if _, ok := engine.recents.Get(headers[4].Hash()); !ok {
+		t.Errorf("signers of block 5 not cached")
+	}
+	for _, header := range headers[2:4] {
+		if _, ok := engine.recents.Get(header.Hash()); ok {
+			t.Errorf("incomplete signers of block %d cached", header.Number)
+		}
+	}
+	// none of the batch was inserted
+	if _, err := engine.recentSigners(blockchain, headers[3], nil); err != consensus.ErrUnknownAncestor {
+		t.Errorf("error mismatch without the batch: have %v, want %v", err, consensus.ErrUnknownAncestor)
+	}
+}
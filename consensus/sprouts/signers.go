@@ -0,0 +1,121 @@
+package sprouts
+
+import (
+	"github.com/applicature/sprouts-plus/accounts"
+	"github.com/applicature/sprouts-plus/common"
+	"github.com/applicature/sprouts-plus/consensus"
+	"github.com/applicature/sprouts-plus/core/types"
+	"github.com/applicature/sprouts-plus/log"
+)
+
+// localSigner is an account the engine mints blocks with.
+type localSigner struct {
+	address common.Address
+	signFn  func(account accounts.Account, hash []byte) ([]byte, error)
+}
+
+// AddSigner authorizes one more account to mint blocks with, next to those
+// already authorized, or replaces the sign function of an authorized one.
+// Every block is minted by the signer with the highest coin age at the time,
+// the coin age of each is recorded separately.
+func (engine *PoS) AddSigner(signer common.Address, signFn func(account accounts.Account, hash []byte) ([]byte, error)) {
+	engine.lock.Lock()
+	defer engine.lock.Unlock()
+
+	for i := range engine.signers {
+		if engine.signers[i].address == signer {
+			engine.signers[i].signFn = signFn
+			engine.life.bump()
+			return
+		}
+	}
+	engine.signers = append(engine.signers, localSigner{address: signer, signFn: signFn})
+	engine.life.bump()
+}
+
+// primarySigner returns the first authorized signer, the one the coin age
+// checkpoints, estimates and APIs without an explicit address are about. It is
+// empty if no signer is authorized.
+func (engine *PoS) primarySigner() localSigner {
+	engine.lock.RLock()
+	defer engine.lock.RUnlock()
+
+	if len(engine.signers) == 0 {
+		return localSigner{}
+	}
+	return engine.signers[0]
+}
+
+// localSigners returns a copy of the authorized signers, the primary first.
+func (engine *PoS) localSigners() []localSigner {
+	engine.lock.RLock()
+	defer engine.lock.RUnlock()
+
+	return append([]localSigner(nil), engine.signers...)
+}
+
+// signerOf returns the authorized signer with the given address, and whether
+// there is one.
+func (engine *PoS) signerOf(address common.Address) (localSigner, bool) {
+	engine.lock.RLock()
+	defer engine.lock.RUnlock()
+
+	for _, signer := range engine.signers {
+		if signer.address == address {
+			return signer, true
+		}
+	}
+	return localSigner{}, false
+}
+
+// bestSigner picks the signer to mint the header with: the one with the
+// highest coin age at the header's timestamp, preferring those outside the
+// minimum signer gap. The coin age of every signer is computed within one
+// shared budget, only the one of the chosen signer is recorded. Signers whose
+// coin age can't be computed are skipped, the error is returned only if none
+// is left.
+func (engine *PoS) bestSigner(chain consensus.ChainReader, header, parent *types.Header) (common.Address, *coinAge, error) {
+	ctx, cancel := engine.prepareContext()
+	defer cancel()
+
+	at := header.Time.Uint64()
+	signers := engine.localSigners()
+	if len(signers) == 0 {
+		// nothing can be sealed, the zero coinbase keeps the former behavior
+		ca, acc, err := engine.signerCoinAge(ctx, chain, common.Address{}, at)
+		if err != nil {
+			return common.Address{}, nil, err
+		}
+		engine.recordCoinAge(common.Address{}, ca, acc, at)
+		return common.Address{}, ca, nil
+	}
+	var (
+		best     common.Address
+		bestAge  *coinAge
+		bestAcc  *accrual
+		bestGap  bool // whether the best signer is outside the minimum signer gap
+		firstErr error
+	)
+	for _, signer := range signers {
+		ca, acc, err := engine.signerCoinAge(ctx, chain, signer.address, at)
+		if err != nil {
+			log.Debug("Skipping signer without coin age", "signer", signer.address, "err", err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		candidate := *header
+		candidate.Coinbase = signer.address
+		outside := engine.checkSignerGap(chain, &candidate, parent, nil) == nil
+
+		if bestAge == nil || (outside && !bestGap) || (outside == bestGap && ca.Age.Cmp(bestAge.Age) > 0) {
+			best, bestAge, bestAcc, bestGap = signer.address, ca, acc, outside
+		}
+	}
+	if bestAge == nil {
+		return common.Address{}, nil, firstErr
+	}
+	engine.recordCoinAge(best, bestAge, bestAcc, at)
+	return best, bestAge, nil
+}
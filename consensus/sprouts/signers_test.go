@@ -0,0 +1,180 @@
+package sprouts
+
+import (
+	"crypto/ecdsa"
+	"math/big"
+	"testing"
+
+	"github.com/applicature/sprouts-plus/accounts"
+	"github.com/applicature/sprouts-plus/common"
+	"github.com/applicature/sprouts-plus/core"
+	"github.com/applicature/sprouts-plus/core/types"
+	"github.com/applicature/sprouts-plus/core/vm"
+	"github.com/applicature/sprouts-plus/crypto"
+	"github.com/applicature/sprouts-plus/params"
+)
+
+// testSignFn signs with the given key.
+func testSignFn(key *ecdsa.PrivateKey) func(accounts.Account, []byte) ([]byte, error) {
+	return func(_ accounts.Account, hash []byte) ([]byte, error) {
+		return crypto.Sign(hash, key)
+	}
+}
+
+// prepareSignersTest runs Prepare for a block on top of the current head.
+func prepareSignersTest(t *testing.T, blockchain *core.BlockChain, engine *PoS) *types.Header {
+	parent := blockchain.CurrentBlock()
+	header := &types.Header{
+		ParentHash: parent.Hash(),
+		Number:     new(big.Int).Add(parent.Number(), big1),
+		GasLimit:   core.CalcGasLimit(parent),
+		GasUsed:    new(big.Int),
+		Time:       new(big.Int),
+	}
+	if err := engine.Prepare(blockchain, header); err != nil {
+		t.Fatalf("failed to prepare header %d: %v", header.Number, err)
+	}
+	return header
+}
+
+// Tests that of several local signers the one with the most coin age mints,
+// and that the others take over once it has staked its coin age.
+func TestMultipleSigners(t *testing.T) {
+	poorKey, _ := crypto.GenerateKey()
+	poorAddr := crypto.PubkeyToAddress(poorKey.PublicKey)
+	coins := func(n int64) *big.Int { return new(big.Int).Mul(big.NewInt(n), new(big.Int).SetUint64(coinValue)) }
+
+	db, genesis, _ := initBlockchainStructures(t)
+	fundTestStaker(genesis)
+	genesis.MustCommit(db)
+
+	// the signers are funded by the distribution account with the first
+	// block, their coin age is computed a month later, so the allowed clock
+	// skew has to span the month, and so does the holding period for a stake
+	// to be held back
+	config := sproutsConfig
+	config.DistributionAccount = rewardsAddr
+	skew := uint64(31 * 24 * 60 * 60)
+	config.AllowedFutureBlockTime = &skew
+	config.CoinAgeHoldingPeriod = new(big.Int).SetUint64(skew)
+
+	engine := newTestEngine(t, &config, db)
+	blockchain, err := core.NewBlockChain(db, genesis.Config, engine, vm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blockchain.Stop()
+
+	// the coin age walk leaves out the head, so every block of interest is
+	// followed by one of the funded staker
+	signer := types.NewEIP155Signer(genesis.Config.ChainId)
+	extend := func(coinbase common.Address, stake *coinAge, txs ...*types.Transaction) {
+		parent := blockchain.CurrentBlock()
+		blocks, _ := GenerateChain(&config, params.TestSproutsChainConfig, parent, db, 2, func(i int, b *BlockGen) {
+			if i == 1 {
+				b.SetCoinbase(rewardsAddr)
+				sealTestBlock(t, engine, b, &coinAge{Time: b.Header().Time.Uint64(), Age: testStakeAge, Value: big.NewInt(1000)})
+				return
+			}
+			b.SetCoinbase(coinbase)
+			for _, tx := range txs {
+				b.AddTx(tx)
+			}
+			sealTestBlock(t, engine, b, stake)
+		})
+		if _, err := blockchain.InsertChain(blocks); err != nil {
+			t.Fatalf("failed to insert blocks of %x: %v", coinbase, err)
+		}
+	}
+	funding := make([]*types.Transaction, 0, 2)
+	for i, to := range []struct {
+		addr  common.Address
+		value *big.Int
+	}{{testAddr, coins(1000000)}, {poorAddr, coins(1000)}} {
+		tx, _ := types.SignTx(types.NewTransaction(uint64(i), to.addr, to.value, big.NewInt(21000), new(big.Int), nil), signer, rewardsKey)
+		funding = append(funding, tx)
+	}
+	extend(rewardsAddr, &coinAge{Time: blockchain.Genesis().Time().Uint64() + 10, Age: testStakeAge, Value: big.NewInt(1000)}, funding...)
+
+	engine.SetClock(newFakeClock(blockchain.CurrentBlock().Time().Int64() + 30*24*60*60))
+	engine.Authorize(poorAddr, testSignFn(poorKey))
+	engine.AddSigner(testAddr, testSignFn(testKey))
+
+	// the richer signer mints first, though it isn't the primary one
+	header := prepareSignersTest(t, blockchain, engine)
+	if header.Coinbase != testAddr {
+		t.Fatalf("coinbase mismatch: have %x, want %x", header.Coinbase, testAddr)
+	}
+	rich, err := extractStake(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// only the coin age of the chosen signer is recorded
+	if ca, err := loadCoinAge(db, testAddr); err != nil || ca.Age.Sign() == 0 {
+		t.Errorf("signer %x: coin age not recorded: %v, %v", testAddr, ca, err)
+	}
+	if ca, err := loadCoinAge(db, poorAddr); err == nil {
+		t.Errorf("signer %x: coin age recorded: %v", poorAddr, ca)
+	}
+	extend(testAddr, rich)
+
+	// its coin age staked, the poorer signer mints and signs the next block
+	header = prepareSignersTest(t, blockchain, engine)
+	if header.Coinbase != poorAddr {
+		t.Fatalf("coinbase mismatch after staking: have %x, want %x", header.Coinbase, poorAddr)
+	}
+	poor, err := extractStake(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if poor.Age.Sign() == 0 || poor.Age.Cmp(rich.Age) >= 0 {
+		t.Errorf("stake mismatch: have %v, want below %v", poor.Age, rich.Age)
+	}
+	if ca, err := loadCoinAge(db, poorAddr); err != nil || ca.Age.Cmp(poor.Age) != 0 {
+		t.Errorf("signer %x: coin age mismatch: have %v (%v), want %v", poorAddr, ca, err, poor.Age)
+	}
+	tx, _ := types.SignTx(types.NewTransaction(0, testAddr, big.NewInt(1), big.NewInt(21000), new(big.Int), nil), signer, poorKey)
+	engine.fakeMode = true
+	sealed, err := engine.Seal(blockchain, types.NewBlock(header, []*types.Transaction{tx}, nil, nil), make(chan struct{}))
+	if err != nil {
+		t.Fatalf("failed to seal block: %v", err)
+	}
+	if author, err := engine.Author(sealed.Header()); err != nil || author != poorAddr {
+		t.Errorf("author mismatch: have %x (%v), want %x", author, err, poorAddr)
+	}
+}
+
+// Tests that adding a signer keeps the primary one, replacing only the sign
+// function of a signer added twice, and that Authorize starts over.
+func TestAddSigner(t *testing.T) {
+	engine := newTestEngine(t, &sproutsConfig, nil)
+	engine.AddSigner(rewardsAddr, testSignFn(rewardsKey))
+	engine.AddSigner(testAddr, testSignFn(rewardsKey))
+	engine.AddSigner(testAddr, testSignFn(testKey))
+
+	if signers := engine.localSigners(); len(signers) != 2 || signers[0].address != rewardsAddr {
+		t.Fatalf("signers mismatch: %v", signers)
+	}
+	signer, ok := engine.signerOf(testAddr)
+	if !ok {
+		t.Fatal("added signer missing")
+	}
+	sig, err := signer.signFn(accounts.Account{Address: testAddr}, make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pub, err := crypto.SigToPub(make([]byte, 32), sig); err != nil || crypto.PubkeyToAddress(*pub) != testAddr {
+		t.Errorf("sign function not replaced")
+	}
+	if !engine.isItMe(testAddr) || !engine.isItMe(rewardsAddr) {
+		t.Error("signers not recognized as local")
+	}
+	engine.Authorize(testAddr, testSignFn(testKey))
+	if engine.isItMe(rewardsAddr) || engine.primarySigner().address != testAddr {
+		t.Error("signers not replaced by Authorize")
+	}
+	engine.Deauthorize()
+	if engine.isItMe(testAddr) {
+		t.Error("signer kept after Deauthorize")
+	}
+}
@@ -2,14 +2,17 @@ package sprouts
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/json"
 	"math/big"
-	"time"
+	"sync"
 
 	"github.com/applicature/sprouts-plus/common"
-	"github.com/applicature/sprouts-plus/core/state"
 	"github.com/applicature/sprouts-plus/core/types"
+	"github.com/applicature/sprouts-plus/crypto/sha3"
 	"github.com/applicature/sprouts-plus/ethdb"
+	"github.com/applicature/sprouts-plus/log"
+	"github.com/applicature/sprouts-plus/params"
 )
 
 type coinAge struct {
@@ -18,6 +21,19 @@ type coinAge struct {
 	Value *big.Int `json:"value"`
 }
 
+// encode returns the stake as embedded into the extra-data of a header, or
+// errInvalidStake if its age or value don't fit their fields.
+func (c *coinAge) encode() ([]byte, error) {
+	for _, n := range []*big.Int{c.Age, c.Value} {
+		if n == nil || n.Sign() < 0 || len(n.Bytes()) > maxStakeLength {
+			return nil, errInvalidStake
+		}
+	}
+	return c.bytes(), nil
+}
+
+// bytes packs the stake into its 52 byte encoding. The age and the value must
+// fit their fields, see encode.
 func (c *coinAge) bytes() []byte {
 	encodedAge := c.Age.Bytes()
 	encodedLength := big.NewInt(int64(len(encodedAge))).Bytes()
@@ -36,43 +52,215 @@ func (c *coinAge) bytes() []byte {
 		encoded = append(encoded, bytes.Repeat([]byte{0x00}, 40-len(encoded))...)
 	}
 
-	encoded = append(encoded, bytes.Repeat([]byte{0x00}, 52-40)...)
-	copy(encoded[40:], new(big.Int).SetUint64(c.Time).Bytes())
+	encoded = append(encoded, bytes.Repeat([]byte{0x00}, extraCoinAge-40)...)
+	binary.BigEndian.PutUint64(encoded[stakeTimeOffset:], c.Time)
 
 	return encoded
 }
 
+// parseStake decodes the 52 byte encoding of a stake. Stakes come from the
+// network, so only the encodings bytes produces are accepted, apart from the
+// legacy time: lengths must fit their fields, the numbers must be minimal and
+// the bytes after them zero.
 func parseStake(stakeBytes []byte) (*coinAge, error) {
 	if len(stakeBytes) != extraCoinAge {
 		return nil, errInvalidStake
 	}
-
 	ca := new(coinAge)
 
-	ageLength := new(big.Int).SetBytes(stakeBytes[:1]).Uint64()
-
-	// We can safely assume that len(ageLength) == 1
-	// Length can be up to 20 bytes, and that number can be encoded in one byte.
-	ca.Age = new(big.Int).SetBytes(stakeBytes[1 : 1+ageLength])
-
+	var err error
+	if ca.Age, err = parseStakeNumber(stakeBytes[:20]); err != nil {
+		return nil, err
+	}
 	// value is handled similarly to age
-	valueLength := new(big.Int).SetBytes(stakeBytes[20:21]).Uint64()
-
-	ca.Value = new(big.Int).SetBytes(stakeBytes[21 : 21+valueLength])
+	if ca.Value, err = parseStakeNumber(stakeBytes[20:40]); err != nil {
+		return nil, err
+	}
 
+	if stakeBytes[40] == 0 {
+		if !isZero(stakeBytes[40:stakeTimeOffset]) {
+			return nil, errInvalidStake
+		}
+		ca.Time = binary.BigEndian.Uint64(stakeBytes[stakeTimeOffset:])
+		return ca, nil
+	}
+	// legacy encodings start the time at byte 40 and end it at its first zero
+	// byte, the fixed width time leaves that byte empty. Whatever follows is
+	// ignored and longer runs keep their low 8 bytes, as the legacy decoding
+	// did, so blocks accepted back then still are.
 	i := 40
 	for ; i < len(stakeBytes); i++ {
 		if stakeBytes[i] == 0 {
 			break
 		}
 	}
-
-	ca.Time = new(big.Int).SetBytes(stakeBytes[40:i]).Uint64()
+	start := 40
+	if i-start > 8 {
+		start = i - 8
+	}
+	ca.Time = new(big.Int).SetBytes(stakeBytes[start:i]).Uint64()
 	return ca, nil
 }
 
+// parseStakeNumber decodes a length prefixed number of a 20 byte stake field.
+func parseStakeNumber(field []byte) (*big.Int, error) {
+	// the length of up to 19 bytes is encoded in the first byte
+	length := int(field[0])
+	if length > maxStakeLength {
+		return nil, errInvalidStake
+	}
+	number := field[1 : 1+length]
+	if (length > 0 && number[0] == 0) || !isZero(field[1+length:]) {
+		return nil, errInvalidStake
+	}
+	return new(big.Int).SetBytes(number), nil
+}
+
+// isZero reports whether all bytes are zero.
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+const (
+	// maxStakeLength is the number of bytes the age and the value of a stake
+	// are encoded in at most.
+	maxStakeLength = 19
+
+	// stakeTimeOffset is the offset of the time of a stake, encoded in the
+	// last 8 bytes of its 52.
+	stakeTimeOffset = 44
+)
+
+// HeaderStake is the stake a block claims in its extra-data.
+//
+// The age and the value are encoded in up to 19 bytes each, so they must be
+// below 2^152. Sealers cap the age at 10^45-1 coin-days though, the largest
+// age which still speeds up the kernel search. The time is encoded in 8 bytes.
+type HeaderStake struct {
+	Time  uint64   // Time the coin age was computed at
+	Age   *big.Int // Coin age in coin-days
+	Value *big.Int // Value the coin age was accrued with
+}
+
+// ParseStake decodes a stake from its 52 byte encoding in the extra-data of
+// a header.
+func ParseStake(b []byte) (*HeaderStake, error) {
+	ca, err := parseStake(b)
+	if err != nil {
+		return nil, err
+	}
+	return &HeaderStake{Time: ca.Time, Age: ca.Age, Value: ca.Value}, nil
+}
+
+// Bytes encodes the stake as embedded into the extra-data of a header. An
+// error is returned if the stake can't be represented.
+func (s *HeaderStake) Bytes() ([]byte, error) {
+	return (&coinAge{Time: s.Time, Age: s.Age, Value: s.Value}).encode()
+}
+
+// checkMinStakeAge rejects stakes whose age is below the configured minimum.
+func checkMinStakeAge(config *params.SproutsConfig, stake *coinAge) error {
+	if config.MinStakeAge != nil && stake.Age.Cmp(config.MinStakeAge) < 0 {
+		return errInsufficientStake
+	}
+	return nil
+}
+
+// checkStakeTime rejects stakes computed after the timestamp of their block,
+// beyond the allowed clock drift, or longer ago than the coin age lifetime.
+// Blocks before the stake time fork aren't checked.
+func checkStakeTime(config *params.SproutsConfig, header *types.Header, stake *coinAge) error {
+	if !config.IsStakeTimeBounded(header.Number) {
+		return nil
+	}
+	time := header.Time.Uint64()
+	if stake.Time > time+config.FutureBlockTime() {
+		return errInvalidStake
+	}
+	if config.CoinAgeLifetime != nil && config.CoinAgeLifetime.Uint64() < time && stake.Time < time-config.CoinAgeLifetime.Uint64() {
+		return errInvalidStake
+	}
+	return nil
+}
+
+// minStakeAccrual returns the least coin-seconds a single wei of the stake
+// value has accrued: received value counts only once fermented, value from the
+// distribution account right away but multiplied by distributionAgeFactor. It
+// returns nil if the fermentation isn't configured.
+func minStakeAccrual(config *params.SproutsConfig) *big.Int {
+	if config == nil || config.CoinAgeFermentation == nil || config.CoinAgeFermentation.Sign() <= 0 {
+		return nil
+	}
+	accrual := new(big.Int).Set(config.CoinAgeFermentation)
+	if !config.EnforceFermentationForDistribution && accrual.Cmp(big.NewInt(distributionAgeFactor)) > 0 {
+		accrual.SetInt64(distributionAgeFactor)
+	}
+	return accrual
+}
+
+// maxStakeValue returns the largest value a stake of the given age in
+// coin-days can have accrued it with, or nil if there is no bound. The age is
+// rounded down to coin-days, so the bound is taken just below the next one.
+func maxStakeValue(config *params.SproutsConfig, age *big.Int) *big.Int {
+	accrual := minStakeAccrual(config)
+	if accrual == nil {
+		return nil
+	}
+	numerator, denominator := coinDayRatio(config)
+
+	max := new(big.Int).Add(age, big1)
+	max.Mul(max, denominator)
+	max.Sub(max, big1)
+	return max.Div(max, accrual.Mul(accrual, numerator))
+}
+
+// checkStakeConsistency checks that the value of the stake can have accrued
+// its age. A value requires an age, and no more value than its least accrual
+// explains. An age without value is consistent, genesis allocations and
+// rewards accrue age alone, and is bounded by the balance instead.
+func checkStakeConsistency(config *params.SproutsConfig, stake *coinAge) error {
+	switch {
+	case stake.Value.Sign() == 0:
+		return nil
+	case stake.Age.Sign() == 0:
+		return errInconsistentStake
+	case stake.Age.Cmp(stakeMaxAge) >= 0:
+		// the age was capped, it explains any value
+		return nil
+	}
+	if max := maxStakeValue(config, stake.Age); max != nil && stake.Value.Cmp(max) > 0 {
+		return errInconsistentStake
+	}
+	return nil
+}
+
+// clampValue reduces the value of the stake to the largest one consistent
+// with its age.
+func (c *coinAge) clampValue(config *params.SproutsConfig) {
+	switch {
+	case c.Age.Sign() == 0:
+		c.Value.Set(big0)
+	case c.Age.Cmp(stakeMaxAge) >= 0:
+	default:
+		if max := maxStakeValue(config, c.Age); max != nil && c.Value.Cmp(max) > 0 {
+			c.Value.Set(max)
+		}
+	}
+}
+
+// coinAgeKey returns the database key of the coin age record of the signer.
+func coinAgeKey(signer common.Address) []byte {
+	key := make([]byte, 0, len(coinAgePrefix)+common.AddressLength)
+	return append(append(key, coinAgePrefix...), signer[:]...)
+}
+
 func loadCoinAge(db ethdb.Database, hash common.Address) (*coinAge, error) {
-	caData, err := db.Get(append([]byte("coinage"), hash[:]...))
+	caData, err := db.Get(coinAgeKey(hash))
 	if err != nil {
 		return nil, err
 	}
@@ -90,19 +278,25 @@ func (c *coinAge) saveCoinAge(db ethdb.Database, hash common.Address) error {
 		return err
 	}
 	common.BytesToHash(blob)
-	return db.Put(append([]byte("coinage"), hash[:]...), blob)
+	return db.Put(coinAgeKey(hash), blob)
 }
 
-func reduceCoinAge(state *state.StateDB, db ethdb.Database, header *types.Header, stake *big.Int) {
+// reduceCoinAge subtracts the stake consumed by the block from the coin age
+// record of its coinbase at the given time. The coin age never drops below
+// zero.
+func reduceCoinAge(db ethdb.Database, header *types.Header, stake *big.Int, now uint64) {
 	ca, err := loadCoinAge(db, header.Coinbase)
-	if err != nil || stake == nil {
-		ca = &coinAge{Age: new(big.Int).Set(big0), Time: uint64(time.Now().Unix())}
-	} else {
-		updatedAge := new(big.Int).Set(ca.Age)
-		updatedAge.Sub(updatedAge, stake)
-		ca.Age = updatedAge
-		ca.Time = uint64(time.Now().Unix())
+	if err != nil {
+		// nothing accumulated yet
+		return
+	}
+	updatedAge := new(big.Int).Set(ca.Age)
+	updatedAge.Sub(updatedAge, stake)
+	if updatedAge.Sign() < 0 {
+		updatedAge.Set(big0)
 	}
+	ca.Age = updatedAge
+	ca.Time = now
 	ca.saveCoinAge(db, header.Coinbase)
 }
 
@@ -116,37 +310,173 @@ type stake struct {
 
 type mappedStakes map[common.Hash]stake
 
+// stakeFlushInterval is the number of stakes verified one by one between two
+// writes of the known stakes. Batches of headers are written once each.
+const stakeFlushInterval = 64
+
+// stakeIndex holds the known stakes in memory, so verifying a seal doesn't
+// load and store all of them. Only the stakes within the stake window of the
+// latest one are kept, see stakeWindow.
+type stakeIndex struct {
+	stakes  mappedStakes
+	loaded  bool   // Whether the stored stakes have been loaded
+	pending int    // Stakes added since the index was last written
+	latest  uint64 // Time of the latest stake, the window ends at it
+	lock    sync.Mutex
+}
+
+// stakeWindow returns how long a stake is kept to reject blocks reusing it.
+// Past the holding period the staked age is free again, so the stake can't be
+// claimed as a duplicate anymore. Without a holding period the coin age
+// lifetime bounds the window, 0 keeps all stakes.
+func stakeWindow(config *params.SproutsConfig) uint64 {
+	switch {
+	case config.CoinAgeHoldingPeriod != nil && config.CoinAgeHoldingPeriod.Sign() > 0:
+		return config.CoinAgeHoldingPeriod.Uint64()
+	case config.CoinAgeLifetime != nil:
+		return config.CoinAgeLifetime.Uint64()
+	}
+	return 0
+}
+
+// withStakes runs fn on the known stakes, loading the stored ones first if
+// they haven't been yet. The index is locked while fn runs.
+func (engine *PoS) withStakes(fn func(stakes mappedStakes) error) error {
+	if engine.db == nil {
+		return errNoDatabase
+	}
+	index := &engine.stakes
+	index.lock.Lock()
+	defer index.lock.Unlock()
+
+	if !index.loaded {
+		stored, err := loadMappedStakes(engine.db)
+		if err != nil {
+			return err
+		}
+		index.stakes, index.loaded = *stored, true
+		for _, s := range index.stakes {
+			if s.Timestamp > index.latest {
+				index.latest = s.Timestamp
+			}
+		}
+	}
+	return fn(index.stakes)
+}
+
+// flushStakes prunes the stakes past the stake window and writes the rest.
+// The index must be locked.
+func (engine *PoS) flushStakes() error {
+	index := &engine.stakes
+	if window := stakeWindow(engine.config); window > 0 && index.latest > window {
+		for hash, s := range index.stakes {
+			if s.Timestamp < index.latest-window {
+				delete(index.stakes, hash)
+			}
+		}
+	}
+	index.pending = 0
+	return engine.persist(func() error {
+		return index.stakes.store(engine.db)
+	})
+}
+
+// indexStake checks the stake of the header against the known stakes and adds
+// it to them on success. The index is written once stakeFlushInterval stakes
+// are pending, unless the write is deferred to the end of a batch.
+func (engine *PoS) indexStake(header *types.Header, deferred bool) error {
+	return engine.withStakes(func(stakes mappedStakes) error {
+		if err := engine.verifyStake(header, &stakes); err != nil {
+			return err
+		}
+		index := &engine.stakes
+		if s := stakes[header.Hash()]; s.Timestamp > index.latest {
+			index.latest = s.Timestamp
+		}
+		index.pending++
+		if deferred || index.pending < stakeFlushInterval {
+			return nil
+		}
+		return engine.flushStakes()
+	})
+}
+
+// saveStakes writes the known stakes if any are pending.
+func (engine *PoS) saveStakes() error {
+	if engine.db == nil {
+		return nil
+	}
+	index := &engine.stakes
+	index.lock.Lock()
+	defer index.lock.Unlock()
+
+	if index.pending == 0 {
+		return nil
+	}
+	return engine.flushStakes()
+}
+
+// getMappedStakes returns a copy of the known stakes.
 func (engine *PoS) getMappedStakes() (*mappedStakes, error) {
-	// TODO implement caching as required
-	return loadMappedStakes(engine.db)
+	copied := make(mappedStakes)
+	err := engine.withStakes(func(stakes mappedStakes) error {
+		for hash, s := range stakes {
+			copied[hash] = s
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &copied, nil
 }
 
+// saveMappedStakes adds the given stakes to the known ones and writes them.
 func (engine *PoS) saveMappedStakes(sm *mappedStakes) error {
-	return sm.store(engine.db)
+	return engine.withStakes(func(stakes mappedStakes) error {
+		index := &engine.stakes
+		for hash, s := range *sm {
+			stakes[hash] = s
+			if s.Timestamp > index.latest {
+				index.latest = s.Timestamp
+			}
+		}
+		return engine.flushStakes()
+	})
 }
 
-func (engine *PoS) addStake(header *types.Header, ca *coinAge) {
-	stakeMapP, ok := engine.getMappedStakes()
-	if ok != nil {
-		return
-	}
-	stakeMap := *stakeMapP
+// isKnownStake reports whether a block other than the given one has already
+// used the stake, see isDuplicate.
+func (engine *PoS) isKnownStake(hash common.Hash, stake *coinAge, kernel []byte) (bool, error) {
+	var known bool
+	err := engine.withStakes(func(stakes mappedStakes) error {
+		known = stakes.isDuplicate(hash, stake, kernel)
+		return nil
+	})
+	return known, err
+}
 
+// add records the stake of the block.
+func (stakeMap mappedStakes) add(header *types.Header, ca *coinAge, kernel []byte) {
 	stakeMap[header.Hash()] = stake{
 		Number:    header.Number.Uint64(),
 		Hash:      header.Hash(),
-		Timestamp: header.Time.Uint64(),
-		Kernel:    make([]byte, extraKernel),
+		Timestamp: ca.Time,
+		Kernel:    common.CopyBytes(kernel),
 		Stake:     new(big.Int).Set(ca.Age),
 	}
-	copy(stakeMap[header.Hash()].Kernel, header.Extra[len(header.Extra)-extraCoinAge-extraKernel:])
-
-	go engine.saveMappedStakes(stakeMapP)
 }
 
-func (stakeMap mappedStakes) isDuplicate(stake *coinAge, kernel []byte) bool {
+// isDuplicate checks whether a block other than the given one has already
+// used the same stake. The block itself may be seen several times, e.g. when
+// the chain reorganises back to it. The time of the stake is left out, as the
+// sealer may pick any within the bounds of checkStakeTime.
+func (stakeMap mappedStakes) isDuplicate(hash common.Hash, stake *coinAge, kernel []byte) bool {
 	for _, s := range stakeMap {
-		if stake.Age == s.Stake && stake.Time == s.Timestamp && bytes.Equal(kernel, s.Kernel) {
+		if s.Hash == hash {
+			continue
+		}
+		if stake.Age.Cmp(s.Stake) == 0 && bytes.Equal(kernel, s.Kernel) {
 			return true
 		}
 	}
@@ -154,18 +484,24 @@ func (stakeMap mappedStakes) isDuplicate(stake *coinAge, kernel []byte) bool {
 }
 
 func loadMappedStakes(db ethdb.Database) (*mappedStakes, error) {
-	blob, err := db.Get([]byte("mappedStakes"))
+	stakeMap := make(mappedStakes)
+
+	// no stakes have been stored yet
+	if has, err := db.Has(mappedStakesKey); err != nil || !has {
+		return &stakeMap, err
+	}
+	blob, err := db.Get(mappedStakesKey)
 	if err != nil {
 		return nil, err
 	}
 	smArr := make([]stake, 0)
-	if err := json.Unmarshal(blob, smArr); err != nil {
-		return nil, err
+	if err := json.Unmarshal(blob, &smArr); err != nil {
+		// the stakes are rebuilt from the headers verified from now on, the
+		// corrupt record is overwritten by the next save
+		log.Warn("Discarding corrupt stake records", "err", err)
+		return &stakeMap, nil
 	}
 
-	var stakeMap mappedStakes
-	stakeMap = make(map[common.Hash]stake)
-
 	for _, s := range smArr {
 		stakeMap[s.Hash] = s
 	}
@@ -182,5 +518,104 @@ func (stakeMap mappedStakes) store(db ethdb.Database) error {
 		return err
 	}
 	common.BytesToHash(blob)
-	return db.Put([]byte("mappedStakes"), blob)
+	return db.Put(mappedStakesKey, blob)
+}
+
+// decodedExtra is the stake and kernel decoded from the extra-data of a header.
+type decodedExtra struct {
+	stake  *coinAge
+	kernel []byte
+}
+
+// stakeAndKernel returns the stake and kernel embedded into a header. Decoded
+// values are cached keyed by the encoded bytes themselves, so headers mutated
+// during Prepare or Seal never hit stale entries. The returned values are
+// shared and must not be modified. Headers come from the network, so a stake
+// failing to decode in any way is rejected rather than crashing the node.
+func (engine *PoS) stakeAndKernel(header *types.Header) (stake *coinAge, kernel []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Warn("Malformed stake", "number", header.Number, "hash", header.Hash(), "err", r)
+			stake, kernel, err = nil, nil, errInvalidStake
+		}
+	}()
+	extra, err := decodeHeaderExtra(header.Extra)
+	if err != nil {
+		return nil, nil, err
+	}
+	kernel = append(common.CopyBytes(extra.Kernel), extra.HashedTimestamp...)
+	if engine.extras == nil {
+		stake, err = parseStake(extra.Stake)
+		if err != nil {
+			return nil, nil, err
+		}
+		return stake, kernel, nil
+	}
+	key := string(kernel) + string(extra.Stake)
+	if cached, ok := engine.extras.Get(key); ok {
+		decoded := cached.(*decodedExtra)
+		return decoded.stake, decoded.kernel, nil
+	}
+	if stake, err = parseStake(extra.Stake); err != nil {
+		return nil, nil, err
+	}
+	decoded := &decodedExtra{stake: stake, kernel: kernel}
+	engine.extras.Add(key, decoded)
+
+	return decoded.stake, decoded.kernel, nil
+}
+
+// headerStake returns the stake embedded into a header, see stakeAndKernel.
+func (engine *PoS) headerStake(header *types.Header) (*coinAge, error) {
+	stake, _, err := engine.stakeAndKernel(header)
+	return stake, err
+}
+
+// BlockWeight describes how heavy the stake of a minted block was. Its numbers
+// are decoded afresh and owned by the caller.
+type BlockWeight struct {
+	Value      *big.Int // Value of the stake
+	Age        *big.Int // Coin age consumed by the stake
+	TimeWeight uint64   // Time weight the kernel target was computed with
+}
+
+// StakeWeight decodes the stake of a minted block and recovers the time weight
+// its kernel was found with against the parent. The kernel can't predate the
+// parent, errInvalidTimestamp is returned if it does.
+func StakeWeight(parent, header *types.Header) (*BlockWeight, error) {
+	stake, err := extractStake(header)
+	if err != nil {
+		return nil, err
+	}
+	kernel, err := extractKernel(header)
+	if err != nil {
+		return nil, err
+	}
+	step, ok := kernelStep(kernel)
+	if !ok {
+		return nil, errWrongKernel
+	}
+	if header.Time.Uint64() < parent.Time.Uint64()+step {
+		return nil, errInvalidTimestamp
+	}
+	timeWeight := header.Time.Uint64() - step - parent.Time.Uint64()
+	if timeWeight > stakeMaxTime {
+		timeWeight = stakeMaxTime
+	}
+	return &BlockWeight{Value: stake.Value, Age: stake.Age, TimeWeight: timeWeight}, nil
+}
+
+// kernelStep recovers the search step a kernel was found at from its hashed
+// timestamp half.
+func kernelStep(kernel []byte) (uint64, bool) {
+	hashed := make([]byte, 32)
+	for step := uint64(0); step <= 60; step++ {
+		h := sha3.NewShake256()
+		h.Write(new(big.Int).SetUint64(step).Bytes())
+		h.Read(hashed)
+		if bytes.Equal(kernel[extraKernel/2:extraKernel], hashed) {
+			return step, true
+		}
+	}
+	return 0, false
 }
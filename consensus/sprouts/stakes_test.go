@@ -1,8 +1,20 @@
 package sprouts
 
 import (
+	"bytes"
+	"math"
 	"math/big"
+	"math/rand"
 	"testing"
+	"time"
+
+	"github.com/applicature/sprouts-plus/common"
+	"github.com/applicature/sprouts-plus/core"
+	"github.com/applicature/sprouts-plus/core/types"
+	"github.com/applicature/sprouts-plus/core/vm"
+	"github.com/applicature/sprouts-plus/ethdb"
+	"github.com/applicature/sprouts-plus/params"
+	lru "github.com/hashicorp/golang-lru"
 )
 
 func TestCoinAgeSerialization(t *testing.T) {
@@ -17,6 +29,8 @@ func TestCoinAgeSerialization(t *testing.T) {
 		coinAge{Time: 1515155715, Age: new(big.Int).SetUint64(100000000000000), Value: new(big.Int).SetUint64(0)},
 		coinAge{Time: 0, Age: new(big.Int).SetUint64(100100000000000000), Value: new(big.Int).SetUint64(100100000000000000)},
 		coinAge{Time: 1516631561, Age: stakeMaxAge, Value: new(big.Int).SetUint64(0)},
+		coinAge{Time: 1516631561, Age: new(big.Int).Lsh(big1, 64), Value: new(big.Int).Lsh(big1, 100)},
+		coinAge{Time: 1516631561, Age: new(big.Int).Lsh(big1, 150), Value: new(big.Int).SetUint64(1)},
 	}
 
 	for _, testcase := range cases {
@@ -30,3 +44,830 @@ func TestCoinAgeSerialization(t *testing.T) {
 		}
 	}
 }
+
+// Tests that stakes whose age and value fill their fields exactly are encoded,
+// and that a byte more is refused instead of overrunning the next field.
+func TestCoinAgeEncodingBounds(t *testing.T) {
+	max := new(big.Int).Sub(new(big.Int).Lsh(big1, 8*maxStakeLength), big1)
+	over := new(big.Int).Lsh(big1, 8*maxStakeLength)
+
+	tests := []struct {
+		age, value *big.Int
+		err        error
+	}{
+		{max, max, nil},
+		{stakeMaxAge, max, nil},
+		{over, big1, errInvalidStake},
+		{big1, over, errInvalidStake},
+		{over, over, errInvalidStake},
+		{big.NewInt(-1), big1, errInvalidStake},
+		{nil, big1, errInvalidStake},
+	}
+	for i, test := range tests {
+		stake := &coinAge{Time: math.MaxUint64, Age: test.age, Value: test.value}
+		blob, err := stake.encode()
+		if err != test.err {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, test.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if len(blob) != extraCoinAge {
+			t.Fatalf("test %d: encoding length mismatch: have %d, want %d", i, len(blob), extraCoinAge)
+		}
+		parsed, err := parseStake(blob)
+		if err != nil {
+			t.Fatalf("test %d: failed to parse: %v", i, err)
+		}
+		if parsed.Age.Cmp(test.age) != 0 || parsed.Value.Cmp(test.value) != 0 || parsed.Time != stake.Time {
+			t.Errorf("test %d: stake mismatch: have %+v, want %+v", i, parsed, stake)
+		}
+	}
+}
+
+// Tests that times with zero bytes in their big-endian form survive a round
+// trip, and that stakes encoded with the legacy zero terminated time still
+// decode.
+func TestStakeTimeEncoding(t *testing.T) {
+	for _, time := range []uint64{0, 1, 0x100, 0x0100000000, 0x5a650009, 1516631561, math.MaxUint64} {
+		stake := &coinAge{Time: time, Age: big.NewInt(100), Value: big.NewInt(10)}
+		parsed, err := parseStake(stake.bytes())
+		if err != nil {
+			t.Fatalf("time %#x: failed to parse: %v", time, err)
+		}
+		if parsed.Time != time {
+			t.Errorf("time mismatch: have %#x, want %#x", parsed.Time, time)
+		}
+	}
+	legacy := (&coinAge{Age: big.NewInt(100), Value: big.NewInt(10)}).bytes()
+	copy(legacy[40:], []byte{0x5a, 0x65, 0x9a, 0x09})
+	parsed, err := parseStake(legacy)
+	if err != nil {
+		t.Fatalf("failed to parse legacy stake: %v", err)
+	}
+	if parsed.Time != 1516608009 || parsed.Age.Cmp(big.NewInt(100)) != 0 || parsed.Value.Cmp(big.NewInt(10)) != 0 {
+		t.Errorf("legacy stake mismatch: %+v", parsed)
+	}
+}
+
+// Tests that stake times truncated by the legacy encoding pass before the stake
+// time fork and are bounded by the block timestamp from it on.
+func TestStakeTimeFork(t *testing.T) {
+	config := sproutsConfig
+	config.StakeTimeBlock = big.NewInt(10)
+
+	// 0x5a659a00 ends at its first zero byte
+	legacy := (&coinAge{Age: big.NewInt(100), Value: big.NewInt(10)}).bytes()
+	copy(legacy[40:], []byte{0x5a, 0x65, 0x9a})
+	stake, err := parseStake(legacy)
+	if err != nil {
+		t.Fatalf("failed to parse legacy stake: %v", err)
+	}
+	tests := []struct {
+		number int64
+		err    error
+	}{
+		{9, nil},
+		{10, errInvalidStake},
+	}
+	for _, tt := range tests {
+		header := &types.Header{Number: big.NewInt(tt.number), Time: big.NewInt(0x5a659a00)}
+		if err := checkStakeTime(&config, header, stake); err != tt.err {
+			t.Errorf("block %d: error mismatch: have %v, want %v", tt.number, err, tt.err)
+		}
+	}
+}
+
+// Tests that a block with a fixed width stake time on top of a parent sealed
+// with the legacy encoding verifies, and the other way around.
+func TestStakeTimeEncodingBoundary(t *testing.T) {
+	db, genesis, engine := initBlockchainStructures(t)
+	fundTestStaker(genesis)
+	genesisBlock := genesis.MustCommit(db)
+	blockchain, err := core.NewBlockChain(db, genesis.Config, engine, vm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blockchain.Stop()
+
+	blocks, _ := GenerateChain(&sproutsConfig, params.TestSproutsChainConfig, genesisBlock, db, 3, func(i int, b *BlockGen) {
+		b.SetCoinbase(rewardsAddr)
+		sealTestBlock(t, engine, b, &coinAge{
+			Time:  b.Header().Time.Uint64(),
+			Age:   testStakeAge,
+			Value: big.NewInt(1000),
+		})
+		if i != 1 {
+			// the time up to its first zero byte right after the value
+			extra, _ := decodeHeaderExtra(b.header.Extra)
+			copy(extra.Stake[40:], make([]byte, extraCoinAge-40))
+			copy(extra.Stake[40:], b.header.Time.Bytes())
+		}
+	})
+	if _, err := blockchain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	for _, block := range blocks {
+		stake, err := extractStake(block.Header())
+		if err != nil {
+			t.Fatalf("block %d: failed to decode stake: %v", block.NumberU64(), err)
+		}
+		if stake.Time != block.Time().Uint64() {
+			t.Errorf("block %d: stake time mismatch: have %d, want %d", block.NumberU64(), stake.Time, block.Time())
+		}
+	}
+}
+
+// checkParsedStake fails unless the stake is rejected as invalid or decodes to
+// numbers bytes encodes back to it. Legacy times are encoded at fixed width, so
+// those stakes are only required to decode to the same numbers again.
+func checkParsedStake(t *testing.T, blob []byte) {
+	parsed, err := parseStake(blob)
+	if err != nil {
+		if err != errInvalidStake {
+			t.Fatalf("stake %x: error mismatch: have %v, want %v", blob, err, errInvalidStake)
+		}
+		return
+	}
+	encoded := parsed.bytes()
+	if blob[40] == 0 {
+		if !bytes.Equal(encoded, blob) {
+			t.Fatalf("stake %x: round trip mismatch: have %x", blob, encoded)
+		}
+		return
+	}
+	reparsed, err := parseStake(encoded)
+	if err != nil {
+		t.Fatalf("stake %x: failed to parse re-encoded %x: %v", blob, encoded, err)
+	}
+	if reparsed.Age.Cmp(parsed.Age) != 0 || reparsed.Value.Cmp(parsed.Value) != 0 || reparsed.Time != parsed.Time {
+		t.Fatalf("stake %x: legacy round trip mismatch: have %+v, want %+v", blob, reparsed, parsed)
+	}
+}
+
+// Tests that parsing arbitrary stake encodings never panics, that lengths
+// overrunning their fields are rejected and that whatever is accepted round
+// trips.
+func TestParseStakeRandom(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		blob := make([]byte, extraCoinAge)
+		rng.Read(blob)
+
+		overrun := blob[0] > 19 || blob[20] > 19
+		if _, err := parseStake(blob); overrun && err != errInvalidStake {
+			t.Fatalf("stake %x: error mismatch: have %v, want %v", blob, err, errInvalidStake)
+		}
+		checkParsedStake(t, blob)
+	}
+	// random stakes with a single byte flipped
+	for i := 0; i < 10000; i++ {
+		stake := &coinAge{
+			Time:  rng.Uint64(),
+			Age:   new(big.Int).Rand(rng, new(big.Int).Lsh(big1, uint(8*rng.Intn(maxStakeLength+1)))),
+			Value: new(big.Int).Rand(rng, new(big.Int).Lsh(big1, uint(8*rng.Intn(maxStakeLength+1)))),
+		}
+		blob := stake.bytes()
+		checkParsedStake(t, blob)
+
+		blob[rng.Intn(len(blob))] ^= byte(1 + rng.Intn(255))
+		checkParsedStake(t, blob)
+	}
+	for _, length := range []byte{20, 200, 255} {
+		blob := make([]byte, extraCoinAge)
+		blob[0] = length
+		if _, err := parseStake(blob); err != errInvalidStake {
+			t.Errorf("age length %d: error mismatch: have %v, want %v", length, err, errInvalidStake)
+		}
+		blob[0], blob[20] = 0, length
+		if _, err := parseStake(blob); err != errInvalidStake {
+			t.Errorf("value length %d: error mismatch: have %v, want %v", length, err, errInvalidStake)
+		}
+	}
+}
+
+// Tests that stakes with bytes beyond their numbers, or numbers not encoded
+// in the fewest bytes, are rejected.
+func TestParseStakeMalformed(t *testing.T) {
+	valid := (&coinAge{Time: 1516631561, Age: big.NewInt(0x1234), Value: big.NewInt(0x56)}).bytes()
+	if _, err := parseStake(valid); err != nil {
+		t.Fatalf("failed to parse valid stake: %v", err)
+	}
+	tests := []struct {
+		name   string
+		blob   []byte
+		mutate func(blob []byte)
+	}{
+		{"garbage after age", valid, func(blob []byte) { blob[3] = 0x01 }},
+		{"garbage at end of age field", valid, func(blob []byte) { blob[19] = 0xff }},
+		{"age with leading zero", valid, func(blob []byte) { copy(blob, []byte{3, 0x00, 0x12, 0x34}) }},
+		{"garbage after value", valid, func(blob []byte) { blob[22] = 0x01 }},
+		{"value with leading zero", valid, func(blob []byte) { copy(blob[20:], []byte{2, 0x00, 0x56}) }},
+		{"garbage before time", valid, func(blob []byte) { blob[42] = 0x01 }},
+	}
+	for _, tt := range tests {
+		blob := common.CopyBytes(tt.blob)
+		tt.mutate(blob)
+		if _, err := parseStake(blob); err != errInvalidStake {
+			t.Errorf("%s: error mismatch: have %v, want %v", tt.name, err, errInvalidStake)
+		}
+	}
+	zeroAge := make([]byte, extraCoinAge)
+	zeroAge[5] = 0x01
+	if _, err := parseStake(zeroAge); err != errInvalidStake {
+		t.Errorf("zero length age with bytes: error mismatch: have %v, want %v", err, errInvalidStake)
+	}
+}
+
+// Tests that legacy stake times are decoded like they always were: up to their
+// first zero byte, ignoring whatever follows, so the stakes of baseline blocks
+// whose time has a zero byte inside still parse.
+func TestParseStakeLegacyTime(t *testing.T) {
+	tests := []struct {
+		name string
+		time []byte
+		want uint64
+	}{
+		{"plain", []byte{0x5a, 0x65, 0x9a, 0x09}, 0x5a659a09},
+		{"interior zero byte", []byte{0x5a, 0x00, 0x9a, 0x09}, 0x5a},
+		{"garbage after time", []byte{0x5a, 0x65, 0x9a, 0x09, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01}, 0x5a659a09},
+		{"beyond 8 bytes", bytes.Repeat([]byte{0x01}, 9), 0x0101010101010101},
+	}
+	for _, tt := range tests {
+		blob := (&coinAge{Age: big.NewInt(100), Value: big.NewInt(10)}).bytes()
+		copy(blob[40:], make([]byte, extraCoinAge-40))
+		copy(blob[40:], tt.time)
+
+		stake, err := parseStake(blob)
+		if err != nil {
+			t.Errorf("%s: failed to parse stake: %v", tt.name, err)
+			continue
+		}
+		if stake.Time != tt.want || stake.Age.Cmp(big.NewInt(100)) != 0 || stake.Value.Cmp(big.NewInt(10)) != 0 {
+			t.Errorf("%s: stake mismatch: have %+v, want time %#x", tt.name, stake, tt.want)
+		}
+	}
+}
+
+// Tests that a header with a malformed stake is rejected by the verification
+// instead of crashing it.
+func TestVerifyMalformedStake(t *testing.T) {
+	blockchain, blocks, engine := newTestChain(t, 1)
+	defer blockchain.Stop()
+
+	header := blocks[0].Header()
+	extra, err := decodeHeaderExtra(header.Extra)
+	if err != nil {
+		t.Fatal(err)
+	}
+	extra.Stake[0] = 200
+	header.Extra = extra.encode()
+	if err := engine.VerifyHeader(blockchain, header, true); err != errInvalidStake {
+		t.Errorf("error mismatch: have %v, want %v", err, errInvalidStake)
+	}
+}
+
+// FuzzParseStake checks that parsing never panics and that every stake
+// accepted round trips.
+func FuzzParseStake(f *testing.F) {
+	f.Add((&coinAge{Time: 1516631561, Age: testStakeAge, Value: big.NewInt(1000)}).bytes())
+	f.Add(make([]byte, extraCoinAge))
+	f.Add(bytes.Repeat([]byte{0xff}, extraCoinAge))
+	f.Add(append([]byte{200}, make([]byte, extraCoinAge-1)...))
+
+	f.Fuzz(func(t *testing.T, blob []byte) {
+		if len(blob) != extraCoinAge {
+			if _, err := parseStake(blob); err != errInvalidStake {
+				t.Fatalf("stake of %d bytes: error mismatch: have %v, want %v", len(blob), err, errInvalidStake)
+			}
+			return
+		}
+		checkParsedStake(t, blob)
+	})
+}
+
+// Tests that every representable stake survives encoding and decoding, and
+// that unrepresentable ones are refused.
+func FuzzStakeRoundTrip(f *testing.F) {
+	f.Add([]byte{1}, []byte{}, uint64(1257894000))
+	f.Add(stakeMaxAge.Bytes(), big.NewInt(2310).Bytes(), uint64(0))
+	f.Add(new(big.Int).Lsh(big1, 151).Bytes(), new(big.Int).Lsh(big1, 151).Bytes(), uint64(math.MaxUint64))
+	f.Add([]byte{1}, new(big.Int).Lsh(big1, 152).Bytes(), uint64(256))
+
+	f.Fuzz(func(t *testing.T, age, value []byte, time uint64) {
+		stake := &HeaderStake{Time: time, Age: new(big.Int).SetBytes(age), Value: new(big.Int).SetBytes(value)}
+		representable := len(stake.Age.Bytes()) <= 19 && len(stake.Value.Bytes()) <= 19
+
+		blob, err := stake.Bytes()
+		if !representable {
+			if err != errInvalidStake {
+				t.Fatalf("error mismatch: have %v, want %v", err, errInvalidStake)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatalf("failed to encode %+v: %v", stake, err)
+		}
+		if len(blob) != extraCoinAge {
+			t.Fatalf("encoding length mismatch: have %d, want %d", len(blob), extraCoinAge)
+		}
+		parsed, err := ParseStake(blob)
+		if err != nil {
+			t.Fatalf("failed to decode %x: %v", blob, err)
+		}
+		if parsed.Time != stake.Time || parsed.Age.Cmp(stake.Age) != 0 || parsed.Value.Cmp(stake.Value) != 0 {
+			t.Fatalf("stake mismatch: have %+v, want %+v", parsed, stake)
+		}
+	})
+}
+
+func TestCoinAgeRecords(t *testing.T) {
+	db, _ := ethdb.NewMemDatabase()
+
+	// records written when the age was a plain integer still load
+	legacy := []byte(`{"time":1516631561,"age":18446744073709551615,"value":10}`)
+	if err := db.Put(append([]byte("coinage"), testAddr[:]...), legacy); err != nil {
+		t.Fatal(err)
+	}
+	ca, err := loadCoinAge(db, testAddr)
+	if err != nil {
+		t.Fatalf("failed to load legacy record: %v", err)
+	}
+	if ca.Age.Cmp(new(big.Int).SetUint64(math.MaxUint64)) != 0 || ca.Time != 1516631561 {
+		t.Fatalf("legacy record mismatch: %v", ca)
+	}
+
+	// ages beyond 64 bits survive a round trip
+	huge := &coinAge{Time: 1, Age: new(big.Int).Lsh(big1, 100), Value: big.NewInt(10)}
+	if err := huge.saveCoinAge(db, testAddr); err != nil {
+		t.Fatal(err)
+	}
+	if ca, err = loadCoinAge(db, testAddr); err != nil || ca.Age.Cmp(huge.Age) != 0 {
+		t.Fatalf("huge age mismatch: have %v (%v), want %v", ca, err, huge.Age)
+	}
+
+	// staking more than accumulated clamps the age at zero instead of wrapping
+	header := &types.Header{Coinbase: testAddr}
+	reduceCoinAge(db, header, new(big.Int).Lsh(big1, 101), 1)
+	if ca, err = loadCoinAge(db, testAddr); err != nil || ca.Age.Sign() != 0 {
+		t.Fatalf("underflowed age: have %v (%v), want 0", ca, err)
+	}
+}
+
+func TestShortExtra(t *testing.T) {
+	header := &types.Header{Number: big1, Extra: make([]byte, 10)}
+
+	if _, err := extractStake(header); err != errInvalidStake {
+		t.Errorf("stake error mismatch: have %v, want %v", err, errInvalidStake)
+	}
+	if _, err := extractKernel(header); err != errMissingSignature {
+		t.Errorf("kernel error mismatch: have %v, want %v", err, errMissingSignature)
+	}
+	if reward := estimateBlockReward(&sproutsConfig, header); reward.Sign() != 0 {
+		t.Errorf("reward of a block without stake: have %v, want 0", reward)
+	}
+	db, _ := ethdb.NewMemDatabase()
+	engine := newTestEngine(t, &sproutsConfig, db)
+	if err := engine.VerifySeal(nil, header); err != errMissingSignature {
+		t.Errorf("seal error mismatch: have %v, want %v", err, errMissingSignature)
+	}
+}
+
+// waitForStake blocks until the stake of the given block is known, or also
+// written to the database if stored is set.
+func waitForStake(t *testing.T, engine *PoS, hash common.Hash, stored bool) {
+	load := engine.getMappedStakes
+	if stored {
+		load = func() (*mappedStakes, error) { return loadMappedStakes(engine.db) }
+	}
+	for i := 0; i < 100; i++ {
+		if stakeMap, err := load(); err == nil {
+			if _, ok := (*stakeMap)[hash]; ok {
+				return
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("stake of block %x not persisted", hash)
+}
+
+func TestDuplicateStake(t *testing.T) {
+	blockchain, blocks, engine := newTestChain(t, 1)
+	defer blockchain.Stop()
+
+	header := blocks[0].Header()
+	if err := engine.VerifySeal(blockchain, header); err != nil {
+		t.Fatalf("failed to verify block: %v", err)
+	}
+	waitForStake(t, engine, header.Hash(), false)
+
+	// Seeing the very same block again is fine
+	if err := engine.VerifySeal(blockchain, header); err != nil {
+		t.Fatalf("re-verifying the same block failed: %v", err)
+	}
+	// A different block reusing the stake is not
+	forged := blocks[0].Header()
+	forged.GasLimit = new(big.Int).Add(forged.GasLimit, big1)
+	if err := engine.VerifySeal(blockchain, forged); err != errDuplicateStake {
+		t.Fatalf("duplicate stake error mismatch: have %v, want %v", err, errDuplicateStake)
+	}
+}
+
+// Tests that of two blocks sharing a stake and verified concurrently, only one
+// is accepted.
+func TestConcurrentDuplicateStake(t *testing.T) {
+	for i := 0; i < 16; i++ {
+		db, _ := ethdb.NewMemDatabase()
+		engine := newTestEngine(t, &sproutsConfig, db)
+
+		first := stakeHeader(7)
+		second := types.CopyHeader(first)
+		second.GasLimit = big.NewInt(1)
+
+		errs := make(chan error, 2)
+		for _, header := range []*types.Header{first, second} {
+			go func(header *types.Header) {
+				errs <- engine.VerifySeal(nil, header)
+			}(header)
+		}
+		var accepted int
+		for j := 0; j < 2; j++ {
+			switch err := <-errs; err {
+			case nil:
+				accepted++
+			case errDuplicateStake:
+			default:
+				t.Fatalf("run %d: unexpected error: %v", i, err)
+			}
+		}
+		if accepted != 1 {
+			t.Fatalf("run %d: accepted blocks mismatch: have %d, want 1", i, accepted)
+		}
+		engine.Close()
+	}
+}
+
+// Tests that a stake isn't accepted if the known stakes can't be loaded.
+func TestVerifySealStakesUnavailable(t *testing.T) {
+	db, _ := ethdb.NewMemDatabase()
+	encrypted, err := NewWithOptions(&sproutsConfig, db, Options{RecordsKey: testRecordsKey})
+	if err != nil {
+		t.Fatalf("failed to create engine: %v", err)
+	}
+	storeTestRecords(t, encrypted)
+
+	// the engine lacks the key the known stakes are encrypted with
+	engine := newTestEngine(t, &sproutsConfig, db)
+	defer engine.Close()
+
+	if err := engine.VerifySeal(nil, stakeHeader(7)); err != ErrRecordsKey {
+		t.Errorf("error mismatch: have %v, want %v", err, ErrRecordsKey)
+	}
+}
+
+// Tests that stakes verified one by one are written in batches, and that the
+// stakes past the stake window are dropped from memory and from the database.
+func TestStakeIndexWindow(t *testing.T) {
+	db, _ := ethdb.NewMemDatabase()
+	engine := newTestEngine(t, &sproutsConfig, db)
+	defer engine.Close()
+
+	old := stakeHeader(1)
+	if err := engine.VerifySeal(nil, old); err != nil {
+		t.Fatalf("failed to verify stake: %v", err)
+	}
+	if has, _ := db.Has(mappedStakesKey); has {
+		t.Fatalf("stakes written before a batch was complete")
+	}
+	window := stakeWindow(&sproutsConfig)
+	for i := uint64(0); i < stakeFlushInterval-1; i++ {
+		if err := engine.VerifySeal(nil, stakeHeader(window+2+i)); err != nil {
+			t.Fatalf("failed to verify stake %d: %v", i, err)
+		}
+	}
+	if has, _ := db.Has(mappedStakesKey); !has {
+		t.Fatalf("stakes not written once a batch was complete")
+	}
+	stored, err := loadMappedStakes(engine.db)
+	if err != nil {
+		t.Fatalf("failed to load stakes: %v", err)
+	}
+	known, _ := engine.getMappedStakes()
+	for _, stakes := range []*mappedStakes{stored, known} {
+		if _, ok := (*stakes)[old.Hash()]; ok {
+			t.Errorf("stake past the window kept")
+		}
+		if len(*stakes) != stakeFlushInterval-1 {
+			t.Errorf("stakes mismatch: have %d, want %d", len(*stakes), stakeFlushInterval-1)
+		}
+	}
+}
+
+func TestVerifyHeadersStoresStakes(t *testing.T) {
+	blockchain, blocks, engine := newTestChain(t, 4)
+	defer blockchain.Stop()
+
+	headers := make([]*types.Header, len(blocks))
+	for i, block := range blocks {
+		headers[i] = block.Header()
+	}
+	seals := make([]bool, len(headers))
+	for i := range seals {
+		seals[i] = true
+	}
+	_, results := engine.VerifyHeaders(blockchain, headers, seals)
+	for i := range headers {
+		if err := <-results; err != nil {
+			t.Fatalf("header %d rejected: %v", i, err)
+		}
+	}
+	// the batch is written once at its end
+	for _, header := range headers {
+		waitForStake(t, engine, header.Hash(), true)
+	}
+
+	// Stakes of the batch are checked against each other before being stored
+	stakeMap := make(mappedStakes)
+	if err := engine.verifyStake(headers[0], &stakeMap); err != nil {
+		t.Fatalf("failed to verify stake: %v", err)
+	}
+	forged := blocks[0].Header()
+	forged.GasLimit = new(big.Int).Add(forged.GasLimit, big1)
+	if err := engine.verifyStake(forged, &stakeMap); err != errDuplicateStake {
+		t.Fatalf("duplicate stake error mismatch: have %v, want %v", err, errDuplicateStake)
+	}
+}
+
+func TestVerifyHeadersIntraBatchDuplicate(t *testing.T) {
+	blockchain, blocks, engine := newTestChain(t, 2)
+	defer blockchain.Stop()
+
+	// the second header reuses the stake and kernel bytes of the first one
+	first, second := blocks[0].Header(), blocks[1].Header()
+	firstExtra, _ := decodeHeaderExtra(first.Extra)
+	secondExtra, _ := decodeHeaderExtra(second.Extra)
+	secondExtra.Kernel, secondExtra.HashedTimestamp, secondExtra.Stake = firstExtra.Kernel, firstExtra.HashedTimestamp, firstExtra.Stake
+	second.Extra = secondExtra.encode()
+
+	_, results := engine.VerifyHeaders(blockchain, []*types.Header{first, second}, []bool{true, true})
+	if err := <-results; err != nil {
+		t.Fatalf("first header rejected: %v", err)
+	}
+	if err := <-results; err != errDuplicateStake {
+		t.Fatalf("duplicate stake error mismatch: have %v, want %v", err, errDuplicateStake)
+	}
+}
+
+func TestStakeWeight(t *testing.T) {
+	blockchain, blocks, engine := newTestChain(t, 3)
+	defer blockchain.Stop()
+
+	parent := blockchain.Genesis().Header()
+	for i, block := range blocks {
+		header := block.Header()
+		_, step, err := engine.computeKernel(parent, testStakeAge, header)
+		if err != nil {
+			t.Fatalf("block %d: %v", i, err)
+		}
+		// the kernel time is recovered against a parent preceding it
+		early := types.CopyHeader(parent)
+		early.Time = new(big.Int).SetUint64(header.Time.Uint64() - step.Uint64() - 5)
+
+		weight, err := StakeWeight(early, header)
+		if err != nil {
+			t.Fatalf("block %d: %v", i, err)
+		}
+		if weight.Value.Cmp(big.NewInt(1000)) != 0 || weight.Age.Cmp(testStakeAge) != 0 {
+			t.Errorf("block %d: stake mismatch: have %v/%v, want 1000/%v", i, weight.Value, weight.Age, testStakeAge)
+		}
+		if weight.TimeWeight != 5 {
+			t.Errorf("block %d: time weight mismatch: have %d, want 5", i, weight.TimeWeight)
+		}
+		parent = header
+	}
+
+	header := blocks[0].Header()
+	header.Extra = header.Extra[:10]
+	if _, err := StakeWeight(blockchain.Genesis().Header(), header); err != errInvalidStake {
+		t.Errorf("short extra error mismatch: have %v, want %v", err, errInvalidStake)
+	}
+
+	// a kernel predating the parent would underflow the time weight
+	header = blocks[0].Header()
+	kernel, _ := extractKernel(header)
+	step, _ := kernelStep(kernel)
+	for _, offset := range []uint64{1, step + 1} {
+		parent := types.CopyHeader(blockchain.Genesis().Header())
+		parent.Time = new(big.Int).SetUint64(header.Time.Uint64() - step + offset)
+		if _, err := StakeWeight(parent, header); err != errInvalidTimestamp {
+			t.Errorf("parent %d seconds past the kernel: error mismatch: have %v, want %v", offset, err, errInvalidTimestamp)
+		}
+	}
+}
+
+func TestVerifyHeaderSealFlag(t *testing.T) {
+	blockchain, blocks, engine := newTestChain(t, 1)
+	defer blockchain.Stop()
+
+	header := blocks[0].Header()
+	extra, _ := decodeHeaderExtra(header.Extra)
+	extra.Kernel[0] ^= 0xff
+
+	if err := engine.VerifyHeader(blockchain, header, false); err != nil {
+		t.Errorf("header-only verification failed: %v", err)
+	}
+	if err := engine.VerifyHeader(blockchain, header, true); err != errWrongKernel {
+		t.Errorf("corrupted kernel error mismatch: have %v, want %v", err, errWrongKernel)
+	}
+	_, results := engine.VerifyHeaders(blockchain, []*types.Header{header}, []bool{false})
+	if err := <-results; err != nil {
+		t.Errorf("header-only batch verification failed: %v", err)
+	}
+	_, results = engine.VerifyHeaders(blockchain, []*types.Header{header}, []bool{true})
+	if err := <-results; err != errWrongKernel {
+		t.Errorf("corrupted kernel batch error mismatch: have %v, want %v", err, errWrongKernel)
+	}
+}
+
+func benchmarkVerifyHeadersBatch(b *testing.B, seal bool) {
+	blockchain, blocks, engine := newTestChain(b, 100)
+	defer blockchain.Stop()
+	if _, err := blockchain.InsertChain(blocks); err != nil {
+		b.Fatal(err)
+	}
+	headers := make([]*types.Header, len(blocks))
+	seals := make([]bool, len(blocks))
+	for i, block := range blocks {
+		headers[i] = block.Header()
+		seals[i] = seal
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, results := engine.VerifyHeaders(blockchain, headers, seals)
+		for range headers {
+			<-results
+		}
+	}
+}
+
+func BenchmarkVerifyHeadersBatch(b *testing.B)       { benchmarkVerifyHeadersBatch(b, true) }
+func BenchmarkVerifyHeadersBatchNoSeal(b *testing.B) { benchmarkVerifyHeadersBatch(b, false) }
+
+func BenchmarkVerifyHeadersSingle(b *testing.B) {
+	blockchain, blocks, engine := newTestChain(b, 100)
+	defer blockchain.Stop()
+	if _, err := blockchain.InsertChain(blocks); err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, block := range blocks {
+			engine.VerifyHeader(blockchain, block.Header(), true)
+		}
+	}
+}
+
+func TestStakeAndKernelCache(t *testing.T) {
+	engine := newTestEngine(t, params.TestSproutsChainConfig.Sprouts, nil)
+	header := &types.Header{Number: big1}
+	ca := &coinAge{Time: 1, Age: big.NewInt(100), Value: big.NewInt(10)}
+	setTestStake(header, ca)
+
+	stake, _, err := engine.stakeAndKernel(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stake.Age.Cmp(ca.Age) != 0 {
+		t.Fatalf("stake age mismatch: have %v, want %v", stake.Age, ca.Age)
+	}
+	// mutating the extra-data must not serve the stale entry
+	ca.Age = big.NewInt(200)
+	kernel := common.HexToHash("0x01")
+	extra, _ := decodeHeaderExtra(header.Extra)
+	copy(extra.Stake, ca.bytes())
+	copy(extra.Kernel, kernel.Bytes())
+
+	stake, cachedKernel, err := engine.stakeAndKernel(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stake.Age.Cmp(ca.Age) != 0 {
+		t.Fatalf("stale stake age: have %v, want %v", stake.Age, ca.Age)
+	}
+	if common.BytesToHash(cachedKernel[:32]) != kernel {
+		t.Fatalf("stale kernel: have %x, want %x", cachedKernel[:32], kernel)
+	}
+}
+
+// benchmarkDecodeExtras decodes the stake and kernel of every header several
+// times, as verification, stake tracking and finalization do.
+func benchmarkDecodeExtras(b *testing.B, engine *PoS) {
+	headers := make([]*types.Header, 10000)
+	for i := range headers {
+		ca := &coinAge{Time: uint64(i), Age: big.NewInt(int64(i) + 1), Value: big.NewInt(1000)}
+		headers[i] = &types.Header{Number: big.NewInt(int64(i) + 1)}
+		setTestStake(headers[i], ca)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, header := range headers {
+			for j := 0; j < 5; j++ {
+				if _, _, err := engine.stakeAndKernel(header); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	}
+}
+
+func BenchmarkDecodeExtrasCached(b *testing.B) {
+	engine := newTestEngine(b, params.TestSproutsChainConfig.Sprouts, nil)
+	engine.extras, _ = lru.NewARC(10000)
+	benchmarkDecodeExtras(b, engine)
+}
+
+func BenchmarkDecodeExtrasUncached(b *testing.B) {
+	benchmarkDecodeExtras(b, &PoS{})
+}
+
+// Tests that stakes claiming more value than their age explains are rejected,
+// and that the sealer clamps its own stakes into the same bounds.
+func TestStakeConsistency(t *testing.T) {
+	config := sproutsConfig
+	numerator, denominator := coinDayRatio(&config)
+
+	// the least accrual is a second of distributed value
+	perDay := new(big.Int).Div(denominator, numerator)
+	max := new(big.Int).Div(new(big.Int).Sub(new(big.Int).Mul(perDay, big.NewInt(2)), big1), big.NewInt(distributionAgeFactor))
+
+	enforced := config
+	enforced.EnforceFermentationForDistribution = true
+	enforcedMax := new(big.Int).Div(new(big.Int).Sub(new(big.Int).Mul(perDay, big.NewInt(2)), big1), config.CoinAgeFermentation)
+
+	tests := []struct {
+		config *params.SproutsConfig
+		age    *big.Int
+		value  *big.Int
+		err    error
+		value2 *big.Int // value after clamping
+	}{
+		// the four quadrants
+		{&config, big.NewInt(0), big.NewInt(0), nil, big.NewInt(0)},
+		{&config, big.NewInt(0), big.NewInt(1), errInconsistentStake, big.NewInt(0)},
+		{&config, big.NewInt(1), big.NewInt(0), nil, big.NewInt(0)},
+		{&config, big.NewInt(1), big.NewInt(1), nil, big.NewInt(1)},
+		// the bounds of the value
+		{&config, big.NewInt(1), max, nil, max},
+		{&config, big.NewInt(1), new(big.Int).Add(max, big1), errInconsistentStake, max},
+		{&enforced, big.NewInt(1), enforcedMax, nil, enforcedMax},
+		{&enforced, big.NewInt(1), new(big.Int).Add(enforcedMax, big1), errInconsistentStake, enforcedMax},
+		// capped ages explain any value
+		{&config, stakeMaxAge, testStakeBalance, nil, testStakeBalance},
+	}
+	for i, tt := range tests {
+		stake := &coinAge{Age: new(big.Int).Set(tt.age), Value: new(big.Int).Set(tt.value)}
+		if err := checkStakeConsistency(tt.config, stake); err != tt.err {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, tt.err)
+		}
+		stake.clampValue(tt.config)
+		if stake.Value.Cmp(tt.value2) != 0 {
+			t.Errorf("test %d: clamped value mismatch: have %v, want %v", i, stake.Value, tt.value2)
+		}
+		if err := checkStakeConsistency(tt.config, stake); err != nil {
+			t.Errorf("test %d: clamped stake rejected: %v", i, err)
+		}
+	}
+}
+
+// Tests that a small distribution rounding down to no coin-days, which used to
+// be staked with its value, is rejected and clamped by the sealer.
+func TestStakeConsistencyTruncation(t *testing.T) {
+	entry := coinAgeEntry{Number: 1, Time: 1000, Kind: entryDistributed, Amount: big.NewInt(1000)}
+
+	stake := &coinAge{Time: 1060, Age: new(big.Int), Value: new(big.Int)}
+	entry.accumulate(&sproutsConfig, stake.Value, stake.Age, big.NewInt(60))
+
+	numerator, denominator := coinDayRatio(&sproutsConfig)
+	stake.Age.Mul(stake.Age, numerator)
+	stake.Age.Div(stake.Age, denominator)
+	if stake.Age.Sign() != 0 || stake.Value.Cmp(big.NewInt(1000)) != 0 {
+		t.Fatalf("fixture mismatch: have %+v, want age 0 and value 1000", stake)
+	}
+	if err := checkStakeConsistency(&sproutsConfig, stake); err != errInconsistentStake {
+		t.Fatalf("error mismatch: have %v, want %v", err, errInconsistentStake)
+	}
+	db, _ := ethdb.NewMemDatabase()
+	engine := newTestEngine(t, &sproutsConfig, db)
+
+	header := &types.Header{Number: big1}
+	setTestStake(header, stake)
+	if err := engine.VerifySeal(nil, header); err != errInconsistentStake {
+		t.Errorf("seal error mismatch: have %v, want %v", err, errInconsistentStake)
+	}
+	stake.clampValue(&sproutsConfig)
+	if stake.Value.Sign() != 0 {
+		t.Errorf("clamped value mismatch: have %v, want 0", stake.Value)
+	}
+}
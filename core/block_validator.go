@@ -60,6 +60,21 @@ func (v *BlockValidator) ValidateBody(block *types.Block) error {
 	}
 	// Header validity is known at this point, check the uncles and transactions
 	header := block.Header()
+	if validator, ok := v.engine.(consensus.BodyValidator); ok {
+		if err := validator.ValidateBody(block); err != nil {
+			return err
+		}
+	}
+	if verifier, ok := v.engine.(consensus.StakeVerifier); ok {
+		parent := v.bc.GetHeader(block.ParentHash(), block.NumberU64()-1)
+		statedb, err := v.bc.StateAt(parent.Root)
+		if err != nil {
+			return err
+		}
+		if err := verifier.VerifyStakeBalance(v.bc, header, statedb); err != nil {
+			return err
+		}
+	}
 	if err := v.engine.VerifyUncles(v.bc, block); err != nil {
 		return err
 	}
@@ -730,6 +730,12 @@ func (bc *BlockChain) InsertReceiptChain(blockChain types.Blocks, receiptChain [
 			stats.ignored++
 			continue
 		}
+		// Bodies aren't validated otherwise on this path
+		if validator, ok := bc.engine.(consensus.BodyValidator); ok {
+			if err := validator.ValidateBody(block); err != nil {
+				return i, fmt.Errorf("invalid block body #%d [%x…]: %v", block.Number(), block.Hash().Bytes()[:4], err)
+			}
+		}
 		// Compute all the non-consensus fields of the receipts
 		SetReceiptsData(bc.config, block, receipts)
 		// Write all the data out into the database
@@ -818,8 +824,17 @@ func (bc *BlockChain) WriteBlockAndState(block *types.Block, receipts []*types.R
 	// If the total difficulty is higher than our known, add it to the canonical chain
 	// Second clause in the if statement reduces the vulnerability to selfish mining.
 	// Please refer to http://www.cs.cornell.edu/~ie53/publications/btcProcFC.pdf
-	reorg := externTd.Cmp(localTd) > 0
-	if !reorg && externTd.Cmp(localTd) == 0 {
+	// Engines weighing the chains themselves replace the total difficulties,
+	// unless they leave the choice to them.
+	localWeight, externWeight := localTd, externTd
+	if weigher, ok := bc.engine.(consensus.ChainWeigher); ok {
+		local, extern := weigher.ChainWeight(bc, bc.currentBlock.Header()), weigher.ChainWeight(bc, block.Header())
+		if local != nil && extern != nil {
+			localWeight, externWeight = local, extern
+		}
+	}
+	reorg := externWeight.Cmp(localWeight) > 0
+	if !reorg && externWeight.Cmp(localWeight) == 0 {
 		// Split same-difficulty blocks by number, then at random
 		reorg = block.NumberU64() < bc.currentBlock.NumberU64() || (block.NumberU64() == bc.currentBlock.NumberU64() && mrand.Float64() < 0.5)
 	}
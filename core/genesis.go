@@ -343,8 +343,10 @@ func DefaultRinkebyGenesisBlock() *Genesis {
 }
 
 func DefaultSproutsGenesisBlock() *Genesis {
-	// TODO define
-	return &Genesis{}
+	// TODO define timestamp and allocations
+	return &Genesis{
+		Config: params.SproutsChainConfig,
+	}
 }
 
 func DefaultSproutsTestnetGenesisBlock() *Genesis {
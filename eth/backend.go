@@ -158,6 +158,10 @@ func New(ctx *node.ServiceContext, config *Config) (*Ethereum, error) {
 		core.WriteChainConfig(chainDb, genesisHash, chainConfig)
 	}
 	eth.bloomIndexer.Start(eth.blockchain)
+	if engine, ok := eth.engine.(*sprouts.PoS); ok {
+		engine.StartEpochSummaries(eth.blockchain)
+		engine.StartCoinAgeInvalidation(eth.blockchain)
+	}
 
 	if config.TxPool.Journal != "" {
 		config.TxPool.Journal = ctx.ResolvePath(config.TxPool.Journal)
@@ -217,7 +221,29 @@ func CreateConsensusEngine(ctx *node.ServiceContext, config *Config, chainConfig
 	}
 
 	if chainConfig.Sprouts != nil {
-		return sprouts.New(chainConfig.Sprouts, db)
+		recordsKey := config.SproutsRecordsKey
+		if len(recordsKey) == 0 && config.SproutsRecordsKeyFile != "" {
+			var err error
+			if recordsKey, err = sprouts.LoadRecordsKey(config.SproutsRecordsKeyFile); err != nil {
+				log.Crit("Failed to load sprouts records key", "file", config.SproutsRecordsKeyFile, "err", err)
+			}
+		}
+		engine, err := sprouts.NewWithOptions(chainConfig.Sprouts, db, sprouts.Options{
+			RecordsKey:                recordsKey,
+			CoinAgeCheckpointInterval: config.SproutsCoinAgeCheckpointInterval,
+			PrepareBudget:             config.SproutsPrepareBudget,
+			EpochLength:               config.SproutsEpochLength,
+			SealRetry:                 config.SproutsSealRetry,
+			// only les runs in light sync mode, its headers come without bodies
+			LightClient: config.SyncMode == downloader.LightSync,
+		})
+		if err != nil {
+			log.Crit("Failed to open sprouts engine records", "err", err)
+		}
+		if config.Genesis != nil {
+			engine.SetGenesis(config.Genesis)
+		}
+		return engine
 	}
 
 	// Otherwise assume proof-of-work
@@ -421,6 +447,9 @@ func (s *Ethereum) Stop() error {
 	}
 	s.txPool.Stop()
 	s.miner.Stop()
+	if engine, ok := s.engine.(*sprouts.PoS); ok {
+		engine.Close()
+	}
 	s.eventMux.Stop()
 
 	s.chainDb.Close()
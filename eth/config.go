@@ -22,9 +22,11 @@ import (
 	"os/user"
 	"path/filepath"
 	"runtime"
+	"time"
 
 	"github.com/applicature/sprouts-plus/common"
 	"github.com/applicature/sprouts-plus/common/hexutil"
+	"github.com/applicature/sprouts-plus/consensus/sprouts"
 	"github.com/applicature/sprouts-plus/core"
 	"github.com/applicature/sprouts-plus/eth/downloader"
 	"github.com/applicature/sprouts-plus/eth/gasprice"
@@ -44,6 +46,10 @@ var DefaultConfig = Config{
 	DatabaseCache:        128,
 	GasPrice:             big.NewInt(18 * params.Shannon),
 
+	SproutsCoinAgeCheckpointInterval: sprouts.DefaultCoinAgeCheckpointInterval,
+	SproutsEpochLength:               sprouts.DefaultEpochLength,
+	SproutsSealRetry:                 sprouts.DefaultSealRetry,
+
 	TxPool: core.DefaultTxPoolConfig,
 	GPO: gasprice.Config{
 		Blocks:     10,
@@ -99,6 +105,14 @@ type Config struct {
 	EthashDatasetsInMem  int
 	EthashDatasetsOnDisk int
 
+	// Sprouts options
+	SproutsRecordsKey                []byte        `toml:"-"` // AES key to encrypt the engine's records with, plaintext if empty
+	SproutsRecordsKeyFile            string        // File holding the hex encoded records key, used unless SproutsRecordsKey is set
+	SproutsCoinAgeCheckpointInterval uint64        // Blocks between two coin age checkpoints, none are written if 0
+	SproutsPrepareBudget             time.Duration // Time the coin age of a prepared block may take, half the block period if 0
+	SproutsEpochLength               uint64        // Blocks summarized by an epoch summary, none are kept if 0
+	SproutsSealRetry                 time.Duration // Time sealing retries later timestamps after missing a kernel, none if 0
+
 	// Transaction pool options
 	TxPool core.TxPoolConfig
 
@@ -4,6 +4,7 @@ package eth
 
 import (
 	"math/big"
+	"time"
 
 	"github.com/applicature/sprouts-plus/common"
 	"github.com/applicature/sprouts-plus/common/hexutil"
@@ -14,32 +15,38 @@ import (
 
 func (c Config) MarshalTOML() (interface{}, error) {
 	type Config struct {
-		Genesis                 *core.Genesis `toml:",omitempty"`
-		NetworkId               uint64
-		SyncMode                downloader.SyncMode
-		LightServ               int  `toml:",omitempty"`
-		LightPeers              int  `toml:",omitempty"`
-		MaxPeers                int  `toml:"-"`
-		SkipBcVersionCheck      bool `toml:"-"`
-		DatabaseHandles         int  `toml:"-"`
-		DatabaseCache           int
-		Etherbase               common.Address `toml:",omitempty"`
-		MinerThreads            int            `toml:",omitempty"`
-		ExtraData               hexutil.Bytes  `toml:",omitempty"`
-		GasPrice                *big.Int
-		EthashCacheDir          string
-		EthashCachesInMem       int
-		EthashCachesOnDisk      int
-		EthashDatasetDir        string
-		EthashDatasetsInMem     int
-		EthashDatasetsOnDisk    int
-		TxPool                  core.TxPoolConfig
-		GPO                     gasprice.Config
-		EnablePreimageRecording bool
-		DocRoot                 string `toml:"-"`
-		PowFake                 bool   `toml:"-"`
-		PowTest                 bool   `toml:"-"`
-		PowShared               bool   `toml:"-"`
+		Genesis                          *core.Genesis `toml:",omitempty"`
+		NetworkId                        uint64
+		SyncMode                         downloader.SyncMode
+		LightServ                        int  `toml:",omitempty"`
+		LightPeers                       int  `toml:",omitempty"`
+		MaxPeers                         int  `toml:"-"`
+		SkipBcVersionCheck               bool `toml:"-"`
+		DatabaseHandles                  int  `toml:"-"`
+		DatabaseCache                    int
+		Etherbase                        common.Address `toml:",omitempty"`
+		MinerThreads                     int            `toml:",omitempty"`
+		ExtraData                        hexutil.Bytes  `toml:",omitempty"`
+		GasPrice                         *big.Int
+		EthashCacheDir                   string
+		EthashCachesInMem                int
+		EthashCachesOnDisk               int
+		EthashDatasetDir                 string
+		EthashDatasetsInMem              int
+		EthashDatasetsOnDisk             int
+		SproutsRecordsKey                []byte `toml:"-"`
+		SproutsRecordsKeyFile            string
+		SproutsCoinAgeCheckpointInterval uint64
+		SproutsPrepareBudget             time.Duration
+		SproutsEpochLength               uint64
+		SproutsSealRetry                 time.Duration
+		TxPool                           core.TxPoolConfig
+		GPO                              gasprice.Config
+		EnablePreimageRecording          bool
+		DocRoot                          string `toml:"-"`
+		PowFake                          bool   `toml:"-"`
+		PowTest                          bool   `toml:"-"`
+		PowShared                        bool   `toml:"-"`
 	}
 	var enc Config
 	enc.Genesis = c.Genesis
@@ -60,6 +67,12 @@ func (c Config) MarshalTOML() (interface{}, error) {
 	enc.EthashDatasetDir = c.EthashDatasetDir
 	enc.EthashDatasetsInMem = c.EthashDatasetsInMem
 	enc.EthashDatasetsOnDisk = c.EthashDatasetsOnDisk
+	enc.SproutsRecordsKey = c.SproutsRecordsKey
+	enc.SproutsRecordsKeyFile = c.SproutsRecordsKeyFile
+	enc.SproutsCoinAgeCheckpointInterval = c.SproutsCoinAgeCheckpointInterval
+	enc.SproutsPrepareBudget = c.SproutsPrepareBudget
+	enc.SproutsEpochLength = c.SproutsEpochLength
+	enc.SproutsSealRetry = c.SproutsSealRetry
 	enc.TxPool = c.TxPool
 	enc.GPO = c.GPO
 	enc.EnablePreimageRecording = c.EnablePreimageRecording
@@ -72,32 +85,38 @@ func (c Config) MarshalTOML() (interface{}, error) {
 
 func (c *Config) UnmarshalTOML(unmarshal func(interface{}) error) error {
 	type Config struct {
-		Genesis                 *core.Genesis `toml:",omitempty"`
-		NetworkId               *uint64
-		SyncMode                *downloader.SyncMode
-		LightServ               *int  `toml:",omitempty"`
-		LightPeers              *int  `toml:",omitempty"`
-		MaxPeers                *int  `toml:"-"`
-		SkipBcVersionCheck      *bool `toml:"-"`
-		DatabaseHandles         *int  `toml:"-"`
-		DatabaseCache           *int
-		Etherbase               *common.Address `toml:",omitempty"`
-		MinerThreads            *int            `toml:",omitempty"`
-		ExtraData               hexutil.Bytes   `toml:",omitempty"`
-		GasPrice                *big.Int
-		EthashCacheDir          *string
-		EthashCachesInMem       *int
-		EthashCachesOnDisk      *int
-		EthashDatasetDir        *string
-		EthashDatasetsInMem     *int
-		EthashDatasetsOnDisk    *int
-		TxPool                  *core.TxPoolConfig
-		GPO                     *gasprice.Config
-		EnablePreimageRecording *bool
-		DocRoot                 *string `toml:"-"`
-		PowFake                 *bool   `toml:"-"`
-		PowTest                 *bool   `toml:"-"`
-		PowShared               *bool   `toml:"-"`
+		Genesis                          *core.Genesis `toml:",omitempty"`
+		NetworkId                        *uint64
+		SyncMode                         *downloader.SyncMode
+		LightServ                        *int  `toml:",omitempty"`
+		LightPeers                       *int  `toml:",omitempty"`
+		MaxPeers                         *int  `toml:"-"`
+		SkipBcVersionCheck               *bool `toml:"-"`
+		DatabaseHandles                  *int  `toml:"-"`
+		DatabaseCache                    *int
+		Etherbase                        *common.Address `toml:",omitempty"`
+		MinerThreads                     *int            `toml:",omitempty"`
+		ExtraData                        hexutil.Bytes   `toml:",omitempty"`
+		GasPrice                         *big.Int
+		EthashCacheDir                   *string
+		EthashCachesInMem                *int
+		EthashCachesOnDisk               *int
+		EthashDatasetDir                 *string
+		EthashDatasetsInMem              *int
+		EthashDatasetsOnDisk             *int
+		SproutsRecordsKey                []byte `toml:"-"`
+		SproutsRecordsKeyFile            *string
+		SproutsCoinAgeCheckpointInterval *uint64
+		SproutsPrepareBudget             *time.Duration
+		SproutsEpochLength               *uint64
+		SproutsSealRetry                 *time.Duration
+		TxPool                           *core.TxPoolConfig
+		GPO                              *gasprice.Config
+		EnablePreimageRecording          *bool
+		DocRoot                          *string `toml:"-"`
+		PowFake                          *bool   `toml:"-"`
+		PowTest                          *bool   `toml:"-"`
+		PowShared                        *bool   `toml:"-"`
 	}
 	var dec Config
 	if err := unmarshal(&dec); err != nil {
@@ -157,6 +176,24 @@ func (c *Config) UnmarshalTOML(unmarshal func(interface{}) error) error {
 	if dec.EthashDatasetsOnDisk != nil {
 		c.EthashDatasetsOnDisk = *dec.EthashDatasetsOnDisk
 	}
+	if dec.SproutsRecordsKey != nil {
+		c.SproutsRecordsKey = dec.SproutsRecordsKey
+	}
+	if dec.SproutsRecordsKeyFile != nil {
+		c.SproutsRecordsKeyFile = *dec.SproutsRecordsKeyFile
+	}
+	if dec.SproutsCoinAgeCheckpointInterval != nil {
+		c.SproutsCoinAgeCheckpointInterval = *dec.SproutsCoinAgeCheckpointInterval
+	}
+	if dec.SproutsPrepareBudget != nil {
+		c.SproutsPrepareBudget = *dec.SproutsPrepareBudget
+	}
+	if dec.SproutsEpochLength != nil {
+		c.SproutsEpochLength = *dec.SproutsEpochLength
+	}
+	if dec.SproutsSealRetry != nil {
+		c.SproutsSealRetry = *dec.SproutsSealRetry
+	}
 	if dec.TxPool != nil {
 		c.TxPool = *dec.TxPool
 	}
@@ -19,13 +19,17 @@ package build
 import (
 	"archive/tar"
 	"archive/zip"
+	"bytes"
 	"compress/gzip"
 	"crypto/md5"
 	"encoding/hex"
 	"fmt"
 	"io"
+	"io/fs"
+	"io/ioutil"
 	"log"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 )
@@ -44,17 +48,28 @@ type Archive interface {
 	Close() error
 }
 
-func NewArchive(file *os.File) (Archive, string) {
+// archiveFormat returns the constructor of the archives written to files with
+// the given name, along with their extension. The constructor is nil for
+// unknown extensions.
+func archiveFormat(name string) (func(io.WriteCloser) Archive, string) {
 	switch {
-	case strings.HasSuffix(file.Name(), ".zip"):
-		return NewZipArchive(file), strings.TrimSuffix(file.Name(), ".zip")
-	case strings.HasSuffix(file.Name(), ".tar.gz"):
-		return NewTarballArchive(file), strings.TrimSuffix(file.Name(), ".tar.gz")
+	case strings.HasSuffix(name, ".zip"):
+		return NewZipArchive, ".zip"
+	case strings.HasSuffix(name, ".tar.gz"):
+		return NewTarballArchive, ".tar.gz"
 	default:
 		return nil, ""
 	}
 }
 
+func NewArchive(file *os.File) (Archive, string) {
+	newArchive, ext := archiveFormat(file.Name())
+	if newArchive == nil {
+		return nil, ""
+	}
+	return newArchive(file), strings.TrimSuffix(file.Name(), ext)
+}
+
 // AddFile appends an existing file to an archive.
 func AddFile(a Archive, file string) error {
 	fd, err := os.Open(file)
@@ -76,8 +91,55 @@ func AddFile(a Archive, file string) error {
 	return nil
 }
 
+// namedFileInfo renames a file, so it's archived under its path relative to
+// the directory of the archive.
+type namedFileInfo struct {
+	os.FileInfo
+	name string
+}
+
+func (fi namedFileInfo) Name() string { return fi.name }
+
+// AddTree appends the directories and files below root to an archive, keeping
+// their paths relative to root within the directory set by Directory. The
+// content of the files is streamed, anything but directories and regular files
+// is skipped.
+func AddTree(a Archive, root string) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || path == root {
+			return err
+		}
+		if !d.IsDir() && !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		w, err := a.Header(namedFileInfo{fi, filepath.ToSlash(rel)})
+		if err != nil || d.IsDir() {
+			return err
+		}
+		fd, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer fd.Close()
+
+		_, err = io.Copy(w, fd)
+		return err
+	})
+}
+
 // WriteArchive creates an archive containing the given files.
 func WriteArchive(name string, files []string) (err error) {
+	if newArchive, _ := archiveFormat(name); newArchive == nil {
+		return fmt.Errorf("unknown archive extension")
+	}
 	archfd, err := os.Create(name)
 	if err != nil {
 		return err
@@ -91,9 +153,6 @@ func WriteArchive(name string, files []string) (err error) {
 		}
 	}()
 	archive, basename := NewArchive(archfd)
-	if archive == nil {
-		return fmt.Errorf("unknown archive extension")
-	}
 	fmt.Println(name)
 	if err := archive.Directory(basename); err != nil {
 		return err
@@ -107,6 +166,9 @@ func WriteArchive(name string, files []string) (err error) {
 	return archive.Close()
 }
 
+// ZipArchive writes zip archives. Entries and archives beyond 4GB are written
+// with zip64 extensions, which archive/zip adds on its own from the sizes and
+// offsets actually written.
 type ZipArchive struct {
 	dir  string
 	zipw *zip.Writer
@@ -194,9 +256,18 @@ type ArchiveReader interface {
 	// Without extension
 	BareName() string
 
-	// Read filenames in root directory of the archive
+	// Read the names of the files in the archive, those in nested
+	// directories included, leaving out the directories
 	TopFiles() []string
 
+	// Check the content of the named entry against its checksum: the CRC32
+	// stored in zip archives, the MD5 in a sidecar entry named after it with
+	// an .md5 suffix in tarballs, if there is one
+	VerifyEntry(name string) error
+
+	// Open the named entry for reading its content
+	Open(name string) (io.ReadCloser, error)
+
 	// Close all associated streams
 	Close() error
 }
@@ -212,7 +283,7 @@ func NewZipArchiveReader(name string) (ArchiveReader, error) {
 		return nil, err
 	}
 
-	return &ZipArchiveReader{zipr, name[:len(name)-4]}, nil
+	return &ZipArchiveReader{zipr, strings.TrimSuffix(name, ".zip")}, nil
 }
 
 func (a *ZipArchiveReader) Type() string { return "zip" }
@@ -220,7 +291,7 @@ func (a *ZipArchiveReader) Type() string { return "zip" }
 func (a *ZipArchiveReader) BareName() string { return a.bareName }
 
 func (a *ZipArchiveReader) TopFiles() []string {
-	filenames := make([]string, 2)
+	filenames := make([]string, 0, len(a.zipr.File))
 	for _, file := range a.zipr.File {
 		if !file.FileInfo().IsDir() {
 			filenames = append(filenames, file.Name)
@@ -229,12 +300,41 @@ func (a *ZipArchiveReader) TopFiles() []string {
 	return filenames
 }
 
+func (a *ZipArchiveReader) VerifyEntry(name string) error {
+	for _, file := range a.zipr.File {
+		if file.Name != name {
+			continue
+		}
+		entry, err := file.Open()
+		if err != nil {
+			return err
+		}
+		defer entry.Close()
+
+		// the reader checks the CRC32 once the content is read to the end
+		if _, err := io.Copy(ioutil.Discard, entry); err != nil {
+			return fmt.Errorf("entry %s of %s: %v", name, a.bareName, err)
+		}
+		return nil
+	}
+	return fmt.Errorf("no entry %s in %s", name, a.bareName)
+}
+
+func (a *ZipArchiveReader) Open(name string) (io.ReadCloser, error) {
+	for _, file := range a.zipr.File {
+		if file.Name == name {
+			return file.Open()
+		}
+	}
+	return nil, fmt.Errorf("no entry %s in %s", name, a.bareName)
+}
+
 func (a *ZipArchiveReader) Close() error {
-	a.zipr.Close()
-	return nil
+	return a.zipr.Close()
 }
 
 type TarballArchiveReader struct {
+	file     *os.File
 	gzipr    *gzip.Reader
 	tarr     *tar.Reader
 	bareName string
@@ -247,18 +347,26 @@ func NewTarballArchiveReader(file *os.File) (ArchiveReader, error) {
 	}
 	tarr := tar.NewReader(gzipr)
 	name := file.Name()
-	return &TarballArchiveReader{gzipr, tarr, name[:len(name)-7]}, nil
+	return &TarballArchiveReader{file, gzipr, tarr, strings.TrimSuffix(name, ".tar.gz")}, nil
 }
 
 func (a *TarballArchiveReader) Type() string { return "tar" }
 
 func (a *TarballArchiveReader) BareName() string { return a.bareName }
 
-func (a *TarballArchiveReader) TopFiles() (filenames []string) {
+// TopFiles reads the whole tarball, which is rewound before and after.
+func (a *TarballArchiveReader) TopFiles() []string {
+	filenames := []string{}
+	if err := a.rewind(); err != nil {
+		return filenames
+	}
+	defer a.rewind()
+
 	for {
 		header, err := a.tarr.Next()
-		if err == io.EOF {
-			return
+		if err != nil {
+			// io.EOF, or a truncated tarball listed as far as it goes
+			return filenames
 		}
 		if !header.FileInfo().IsDir() {
 			filenames = append(filenames, header.Name)
@@ -266,11 +374,110 @@ func (a *TarballArchiveReader) TopFiles() (filenames []string) {
 	}
 }
 
-func (a *TarballArchiveReader) Close() error {
-	a.gzipr.Close()
+// rewind restarts reading the entries from the start of the tarball.
+func (a *TarballArchiveReader) rewind() error {
+	if _, err := a.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := a.gzipr.Reset(a.file); err != nil {
+		return err
+	}
+	a.tarr = tar.NewReader(a.gzipr)
+	return nil
+}
+
+// VerifyEntry reads the whole tarball, which is rewound before and after, so
+// the entries can still be listed afterwards.
+func (a *TarballArchiveReader) VerifyEntry(name string) error {
+	if err := a.rewind(); err != nil {
+		return err
+	}
+	defer a.rewind()
+
+	var found bool
+	var have, want string
+	for {
+		header, err := a.tarr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		switch header.Name {
+		case name:
+			hash := md5.New()
+			if _, err := io.Copy(hash, a.tarr); err != nil {
+				return fmt.Errorf("entry %s of %s: %v", name, a.bareName, err)
+			}
+			found, have = true, hex.EncodeToString(hash.Sum(nil))
+		case name + ".md5":
+			sidecar, err := ioutil.ReadAll(a.tarr)
+			if err != nil {
+				return err
+			}
+			if fields := strings.Fields(string(sidecar)); len(fields) > 0 {
+				want = strings.ToLower(fields[0])
+			}
+		}
+	}
+	if !found {
+		return fmt.Errorf("no entry %s in %s", name, a.bareName)
+	}
+	if want != "" && have != want {
+		return fmt.Errorf("entry %s of %s: md5 mismatch: have %s, want %s", name, a.bareName, have, want)
+	}
 	return nil
 }
 
+// tarballEntry reads an entry of a tarball, rewinding it once closed.
+type tarballEntry struct {
+	io.Reader
+	archive *TarballArchiveReader
+}
+
+func (e *tarballEntry) Close() error { return e.archive.rewind() }
+
+// Open scans the tarball from its start up to the named entry. The entry must
+// be closed before the tarball is read otherwise, closing it rewinds the
+// tarball.
+func (a *TarballArchiveReader) Open(name string) (io.ReadCloser, error) {
+	if err := a.rewind(); err != nil {
+		return nil, err
+	}
+	for {
+		header, err := a.tarr.Next()
+		if err == io.EOF {
+			a.rewind()
+			return nil, fmt.Errorf("no entry %s in %s", name, a.bareName)
+		}
+		if err != nil {
+			a.rewind()
+			return nil, err
+		}
+		if header.Name == name {
+			return &tarballEntry{a.tarr, a}, nil
+		}
+	}
+}
+
+// Close closes the tarball file too, the one the reader was created with.
+func (a *TarballArchiveReader) Close() error {
+	err := a.gzipr.Close()
+	if ferr := a.file.Close(); err == nil {
+		err = ferr
+	}
+	return err
+}
+
+var (
+	zipMagic  = []byte("PK\x03\x04") // Start of the first local file header of a zip archive
+	gzipMagic = []byte{0x1f, 0x8b}   // Start of a gzip stream
+)
+
+// OpenArchive opens a zip archive or a gzipped tarball, telling them apart by
+// the suffix of the file name. Files named otherwise are told apart by their
+// first bytes, the file is rewound afterwards.
 func OpenArchive(filename string, file *os.File) (ArchiveReader, error) {
 	if strings.HasSuffix(filename, ".zip") {
 		return NewZipArchiveReader(filename)
@@ -278,10 +485,58 @@ func OpenArchive(filename string, file *os.File) (ArchiveReader, error) {
 	if strings.HasSuffix(filename, ".tar.gz") {
 		return NewTarballArchiveReader(file)
 	}
-	return nil, fmt.Errorf("unsupported archive" + filename)
+	magic := make([]byte, len(zipMagic))
+	n, err := io.ReadFull(file, magic)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	switch magic = magic[:n]; {
+	case bytes.HasPrefix(magic, zipMagic):
+		return NewZipArchiveReader(filename)
+	case bytes.HasPrefix(magic, gzipMagic):
+		return NewTarballArchiveReader(file)
+	}
+	return nil, fmt.Errorf("unsupported archive %s", filename)
+}
+
+// findBinary returns the base name and the path of the file whose base name
+// starts with the given prefix, the shallowest one if there are several, the
+// first listed if they are equally deep. Both are empty if there is none.
+func findBinary(files []string, prefix string) (names [2]string) {
+	depth := -1
+	for _, f := range files {
+		base := path.Base(f)
+		if !strings.HasPrefix(base, prefix) {
+			continue
+		}
+		if d := strings.Count(strings.Trim(f, "/"), "/"); depth < 0 || d < depth {
+			names, depth = [2]string{base, f}, d
+		}
+	}
+	return names
+}
+
+// fileMD5 returns the hex encoded md5 of the content of the named file.
+func fileMD5(filename string) (string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := md5.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
 }
 
-// InvestigateArchive looks into an existing archive.
+// InvestigateArchive looks into an existing archive. It returns the base name
+// of the geth binary along with its path within the archive, the type of the
+// archive and the md5 of the whole archive file.
 func InvestigateArchive(filename string) (binaryNames [2]string, archiveType, md5String string, err error) {
 	log.Println("Investigating archive", filename)
 	file, err := os.Open(filename)
@@ -291,30 +546,16 @@ func InvestigateArchive(filename string) (binaryNames [2]string, archiveType, md
 	defer file.Close()
 
 	archive, err := OpenArchive(filename, file)
-	if archive == nil {
+	if err != nil {
 		return
 	}
-
 	archiveType = archive.Type()
-	files := archive.TopFiles()
-	for _, f := range files {
-		delimIndex := strings.LastIndex(f, "/")
-		if delimIndex > 0 && f[delimIndex+1:delimIndex+5] == "geth" {
-			binaryNames[0] = f[delimIndex+1:]
-			binaryNames[1] = f
-			break
-		}
-	}
-
-	archive.Close()
-	if _, err = file.Seek(0, io.SeekStart); err != nil {
-		return
-	}
-	hash := md5.New()
-	if _, err = io.Copy(hash, file); err != nil {
+	binaryNames = findBinary(archive.TopFiles(), "geth")
+	if err = archive.Close(); err != nil {
 		return
 	}
-	hashInBytes := hash.Sum(nil)[:16]
-	md5String = hex.EncodeToString(hashInBytes)
+	// the archive is hashed with a handle of its own, whichever the offset
+	// the reader left the other one at
+	md5String, err = fileMD5(filename)
 	return
 }
@@ -0,0 +1,613 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package build
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"encoding/hex"
+	"flag"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Tests that TopFiles lists exactly the files of a zip archive, skipping the
+// directories.
+func TestZipArchiveTopFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "geth-test.zip")
+	archfd, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zipw := zip.NewWriter(archfd)
+	for _, entry := range []string{"geth-test/", "geth-test/geth", "geth-test/docs/", "geth-test/COPYING"} {
+		if _, err := zipw.Create(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zipw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	archfd.Close()
+
+	reader, err := NewZipArchiveReader(name)
+	if err != nil {
+		t.Fatalf("failed to open the archive: %v", err)
+	}
+	defer reader.Close()
+
+	want := []string{"geth-test/geth", "geth-test/COPYING"}
+	if have := reader.TopFiles(); !reflect.DeepEqual(have, want) {
+		t.Errorf("files mismatch: have %q, want %q", have, want)
+	}
+}
+
+var zip64 = flag.Bool("zip64", false, "test zip archives with an entry beyond 4GB")
+
+// Tests that zip archives with an entry beyond 4GB are written with zip64
+// extensions and can be read back intact. The entry is a sparse file of
+// zeroes, so it takes neither disk space nor much space in the archive, but
+// compressing it takes a while, so the test only runs with -zip64.
+func TestZipArchiveZip64(t *testing.T) {
+	if !*zip64 {
+		t.Skip("compresses more than 4GB, enable with -zip64")
+	}
+	dir, err := ioutil.TempDir("", "zip64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const size = 1<<32 + 1
+	sparse := filepath.Join(dir, "geth")
+	fd, err := os.Create(sparse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fd.Truncate(size); err != nil {
+		fd.Close()
+		t.Skipf("sparse files not supported: %v", err)
+	}
+	fd.Close()
+
+	name := filepath.Join(dir, "geth-large.zip")
+	archfd, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive, basename := NewArchive(archfd)
+	if err := archive.Directory(filepath.Base(basename)); err != nil {
+		t.Fatal(err)
+	}
+	if err := AddFile(archive, sparse); err != nil {
+		t.Fatalf("failed to add the large file: %v", err)
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatalf("failed to close the archive: %v", err)
+	}
+
+	reader, err := NewZipArchiveReader(name)
+	if err != nil {
+		t.Fatalf("failed to open the archive: %v", err)
+	}
+	defer reader.Close()
+
+	files := reader.(*ZipArchiveReader).zipr.File
+	if len(files) != 1 || files[0].Name != "geth-large/geth" {
+		t.Fatalf("unexpected entries: %v", files)
+	}
+	if files[0].UncompressedSize64 != size {
+		t.Fatalf("size mismatch: have %d, want %d", files[0].UncompressedSize64, size)
+	}
+	// reading to the end checks the checksum too
+	entry, err := files[0].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer entry.Close()
+	if n, err := io.Copy(ioutil.Discard, entry); err != nil || n != size {
+		t.Fatalf("failed to read the entry back: read %d bytes, %v", n, err)
+	}
+}
+
+// Tests that archives named without a known suffix are opened by their content.
+func TestOpenArchiveByContent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sniff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	binary := filepath.Join(dir, "geth")
+	if err := ioutil.WriteFile(binary, []byte("binary"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name   string
+		create func(io.WriteCloser) Archive
+		typ    string
+	}{
+		{"geth-test.bin", NewZipArchive, "zip"},
+		{"geth-test.dat", NewTarballArchive, "tar"},
+	} {
+		name := filepath.Join(dir, test.name)
+		archfd, err := os.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		archive := test.create(archfd)
+		if err := archive.Directory("geth-test"); err != nil {
+			t.Fatal(err)
+		}
+		if err := AddFile(archive, binary); err != nil {
+			t.Fatal(err)
+		}
+		if err := archive.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		file, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader, err := OpenArchive(name, file)
+		if err != nil {
+			file.Close()
+			t.Fatalf("%s: failed to open the archive: %v", test.name, err)
+		}
+		if reader.Type() != test.typ {
+			t.Errorf("%s: type mismatch: have %s, want %s", test.name, reader.Type(), test.typ)
+		}
+		if files := reader.TopFiles(); !reflect.DeepEqual(files, []string{"geth-test/geth"}) {
+			t.Errorf("%s: files mismatch: have %q", test.name, files)
+		}
+		reader.Close()
+		file.Close()
+	}
+	// anything else is still refused, with the file rewound
+	name := filepath.Join(dir, "geth-test.txt")
+	if err := ioutil.WriteFile(name, []byte("PK"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	if _, err := OpenArchive(name, file); err == nil {
+		t.Fatal("opened a text file as an archive")
+	}
+	if offset, _ := file.Seek(0, io.SeekCurrent); offset != 0 {
+		t.Errorf("file not rewound: offset %d", offset)
+	}
+}
+
+// Tests that VerifyEntry catches a zip entry whose content no longer matches
+// its CRC32.
+func TestZipArchiveVerifyEntry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zipcrc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the entry is stored, so its content shows up verbatim in the archive
+	content := []byte("geth binary content")
+	blob := new(bytes.Buffer)
+	zipw := zip.NewWriter(blob)
+	entry, err := zipw.CreateHeader(&zip.FileHeader{Name: "geth-test/geth", Method: zip.Store})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry.Write(content)
+	if err := zipw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	intact, corrupt := filepath.Join(dir, "intact.zip"), filepath.Join(dir, "corrupt.zip")
+	if err := ioutil.WriteFile(intact, blob.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	flipped := blob.Bytes()
+	flipped[bytes.Index(flipped, content)] ^= 0x01
+	if err := ioutil.WriteFile(corrupt, flipped, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name string
+		fail bool
+	}{
+		{intact, false},
+		{corrupt, true},
+	} {
+		reader, err := NewZipArchiveReader(test.name)
+		if err != nil {
+			t.Fatalf("%s: failed to open the archive: %v", test.name, err)
+		}
+		if err := reader.VerifyEntry("geth-test/geth"); (err != nil) != test.fail {
+			t.Errorf("%s: verification mismatch: have %v, want failure %v", test.name, err, test.fail)
+		}
+		if err := reader.VerifyEntry("geth-test/missing"); err == nil {
+			t.Errorf("%s: verified a missing entry", test.name)
+		}
+		reader.Close()
+	}
+}
+
+// Tests that VerifyEntry checks tarball entries against their sidecar MD5,
+// and leaves the entries listable.
+func TestTarballArchiveVerifyEntry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tarmd5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	content := []byte("geth binary content")
+	sum := md5.Sum(content)
+	for _, test := range []struct {
+		sidecar string
+		fail    bool
+	}{
+		{"", false},
+		{hex.EncodeToString(sum[:]) + "  geth\n", false},
+		{hex.EncodeToString(make([]byte, md5.Size)), true},
+	} {
+		name := filepath.Join(dir, "geth-test.tar.gz")
+		archfd, err := os.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gzw := gzip.NewWriter(archfd)
+		tarw := tar.NewWriter(gzw)
+		entries := map[string][]byte{"geth-test/geth": content}
+		if test.sidecar != "" {
+			entries["geth-test/geth.md5"] = []byte(test.sidecar)
+		}
+		for _, entry := range []string{"geth-test/geth", "geth-test/geth.md5"} {
+			if data, ok := entries[entry]; ok {
+				tarw.WriteHeader(&tar.Header{Name: entry, Mode: 0644, Size: int64(len(data))})
+				tarw.Write(data)
+			}
+		}
+		tarw.Close()
+		gzw.Close()
+		archfd.Close()
+
+		file, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader, err := NewTarballArchiveReader(file)
+		if err != nil {
+			t.Fatalf("sidecar %q: failed to open the archive: %v", test.sidecar, err)
+		}
+		if err := reader.VerifyEntry("geth-test/geth"); (err != nil) != test.fail {
+			t.Errorf("sidecar %q: verification mismatch: have %v, want failure %v", test.sidecar, err, test.fail)
+		}
+		if files := reader.TopFiles(); len(files) != len(entries) {
+			t.Errorf("sidecar %q: files mismatch after verification: %q", test.sidecar, files)
+		}
+		reader.Close()
+		file.Close()
+	}
+}
+
+// Tests that the content of a file written with WriteArchive can be read back
+// from the archive.
+func TestArchiveOpenRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "roundtrip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	content := []byte("geth binary content")
+	binary := filepath.Join(dir, "geth")
+	if err := ioutil.WriteFile(binary, content, 0755); err != nil {
+		t.Fatal(err)
+	}
+	readme := filepath.Join(dir, "README")
+	if err := ioutil.WriteFile(readme, []byte("readme"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, ext := range []string{".zip", ".tar.gz"} {
+		name := filepath.Join(dir, "geth-test"+ext)
+		if err := WriteArchive(name, []string{readme, binary}); err != nil {
+			t.Fatalf("%s: failed to write the archive: %v", ext, err)
+		}
+		file, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader, err := OpenArchive(name, file)
+		if err != nil {
+			file.Close()
+			t.Fatalf("%s: failed to open the archive: %v", ext, err)
+		}
+		// entries are named after the archive, directory included
+		entry := filepath.Join(dir, "geth-test", "geth")
+		for i := 0; i < 2; i++ {
+			r, err := reader.Open(entry)
+			if err != nil {
+				t.Fatalf("%s: failed to open the entry: %v", ext, err)
+			}
+			data, err := ioutil.ReadAll(r)
+			r.Close()
+			if err != nil {
+				t.Fatalf("%s: failed to read the entry: %v", ext, err)
+			}
+			if !bytes.Equal(data, content) {
+				t.Errorf("%s: content mismatch: have %q, want %q", ext, data, content)
+			}
+		}
+		if _, err := reader.Open(entry + ".missing"); err == nil {
+			t.Errorf("%s: opened a missing entry", ext)
+		}
+		reader.Close()
+		file.Close()
+	}
+}
+
+// Tests that closing archive readers releases their files, opening archives
+// over and over without the number of open descriptors growing.
+func TestArchiveReaderCloseReleasesFiles(t *testing.T) {
+	if _, err := ioutil.ReadDir("/proc/self/fd"); err != nil {
+		t.Skip("open file descriptors can't be counted:", err)
+	}
+	dir, err := ioutil.TempDir("", "fdleak")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	binary := filepath.Join(dir, "geth")
+	if err := ioutil.WriteFile(binary, []byte("binary"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, ext := range []string{".zip", ".tar.gz"} {
+		name := filepath.Join(dir, "geth-test"+ext)
+		if err := WriteArchive(name, []string{binary}); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+	openFiles := func() int {
+		fds, err := ioutil.ReadDir("/proc/self/fd")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(fds)
+	}
+	before := openFiles()
+	for i := 0; i < 100; i++ {
+		for _, name := range names {
+			file, err := os.Open(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			reader, err := OpenArchive(name, file)
+			if err != nil {
+				t.Fatalf("%s: failed to open the archive: %v", name, err)
+			}
+			if err := reader.Close(); err != nil {
+				t.Fatalf("%s: failed to close the archive: %v", name, err)
+			}
+			// the zip reader opens a file of its own
+			if reader.Type() == "zip" {
+				file.Close()
+			}
+		}
+	}
+	// leave some slack for descriptors opened by the runtime meanwhile
+	if after := openFiles(); after > before+5 {
+		t.Errorf("file descriptors leaked: %d open before, %d after", before, after)
+	}
+}
+
+// Tests that InvestigateArchive finds the same binary in zip archives and
+// tarballs, at whichever depth, and hashes the whole archive file.
+func TestInvestigateArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "investigate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// short names and deeper binaries must not get in the way
+	entries := []string{"geth-test/", "geth-test/g", "geth-test/tools/", "geth-test/tools/evm/", "geth-test/tools/evm/geth-evm", "geth-test/bin/", "geth-test/bin/geth", "geth-test/README"}
+
+	zipBlob := new(bytes.Buffer)
+	zipw := zip.NewWriter(zipBlob)
+	for _, entry := range entries {
+		w, err := zipw.Create(entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(entry))
+	}
+	if err := zipw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	tarBlob := new(bytes.Buffer)
+	gzw := gzip.NewWriter(tarBlob)
+	tarw := tar.NewWriter(gzw)
+	for _, entry := range entries {
+		header := &tar.Header{Name: entry, Mode: 0755, Size: int64(len(entry))}
+		if entry[len(entry)-1] == '/' {
+			header.Typeflag, header.Size = tar.TypeDir, 0
+		}
+		if err := tarw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if header.Size > 0 {
+			tarw.Write([]byte(entry))
+		}
+	}
+	tarw.Close()
+	gzw.Close()
+
+	for _, test := range []struct {
+		name string
+		blob []byte
+		typ  string
+	}{
+		{"geth-test.zip", zipBlob.Bytes(), "zip"},
+		{"geth-test.tar.gz", tarBlob.Bytes(), "tar"},
+	} {
+		name := filepath.Join(dir, test.name)
+		if err := ioutil.WriteFile(name, test.blob, 0644); err != nil {
+			t.Fatal(err)
+		}
+		binaryNames, archiveType, md5String, err := InvestigateArchive(name)
+		if err != nil {
+			t.Fatalf("%s: failed to investigate: %v", test.name, err)
+		}
+		if want := [2]string{"geth", "geth-test/bin/geth"}; binaryNames != want {
+			t.Errorf("%s: binary mismatch: have %q, want %q", test.name, binaryNames, want)
+		}
+		if archiveType != test.typ {
+			t.Errorf("%s: type mismatch: have %s, want %s", test.name, archiveType, test.typ)
+		}
+		if sum := md5.Sum(test.blob); md5String != hex.EncodeToString(sum[:]) {
+			t.Errorf("%s: md5 mismatch: have %s, want %x", test.name, md5String, sum)
+		}
+	}
+}
+
+// Tests that the binary is looked up by the prefix of the base names, whichever
+// their length.
+func TestFindBinary(t *testing.T) {
+	for _, test := range []struct {
+		files []string
+		want  [2]string
+	}{
+		{nil, [2]string{}},
+		{[]string{"a", "dir/ge", "dir/"}, [2]string{}},
+		{[]string{"geth"}, [2]string{"geth", "geth"}},
+		{[]string{"a/b/geth", "a/geth.exe"}, [2]string{"geth.exe", "a/geth.exe"}},
+		{[]string{"a/geth", "b/geth-tools"}, [2]string{"geth", "a/geth"}},
+		{[]string{"a/getty/x"}, [2]string{}},
+	} {
+		if have := findBinary(test.files, "geth"); have != test.want {
+			t.Errorf("%q: have %q, want %q", test.files, have, test.want)
+		}
+	}
+}
+
+// Tests that WriteArchive refuses unknown extensions without creating the
+// file.
+func TestWriteArchiveUnknownExtension(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unknown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "geth-test.rar")
+	if err := WriteArchive(name, nil); err == nil || err.Error() != "unknown archive extension" {
+		t.Fatalf("error mismatch: have %v, want unknown archive extension", err)
+	}
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Errorf("archive file created: %v", err)
+	}
+}
+
+// Tests that AddTree keeps the nested paths of the files it archives.
+func TestAddTree(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	root := filepath.Join(dir, "release")
+	files := map[string]string{
+		"geth":                "binary",
+		"docs/README":         "readme",
+		"docs/api/eth.md":     "eth api",
+		"tools/abigen/abigen": "abigen",
+	}
+	for name, content := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, ext := range []string{".zip", ".tar.gz"} {
+		name := filepath.Join(dir, "release"+ext)
+		archfd, err := os.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		archive, _ := NewArchive(archfd)
+		if err := archive.Directory("release"); err != nil {
+			t.Fatal(err)
+		}
+		if err := AddTree(archive, root); err != nil {
+			t.Fatalf("%s: failed to add the tree: %v", ext, err)
+		}
+		if err := archive.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		file, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader, err := OpenArchive(name, file)
+		if err != nil {
+			file.Close()
+			t.Fatalf("%s: failed to open the archive: %v", ext, err)
+		}
+		want := []string{"release/docs/README", "release/docs/api/eth.md", "release/geth", "release/tools/abigen/abigen"}
+		if have := reader.TopFiles(); !reflect.DeepEqual(have, want) {
+			t.Errorf("%s: files mismatch: have %q, want %q", ext, have, want)
+		}
+		for name, content := range files {
+			r, err := reader.Open("release/" + name)
+			if err != nil {
+				t.Fatalf("%s: failed to open %s: %v", ext, name, err)
+			}
+			data, _ := ioutil.ReadAll(r)
+			r.Close()
+			if string(data) != content {
+				t.Errorf("%s: %s content mismatch: have %q, want %q", ext, name, data, content)
+			}
+		}
+		reader.Close()
+		file.Close()
+	}
+}
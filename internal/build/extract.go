@@ -0,0 +1,162 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package build
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ExtractArchive extracts a zip archive or a gzipped tarball into the given
+// directory, keeping the modes and modification times of the files. Entries
+// resolving outside of the directory are rejected, links and other special
+// entries are skipped.
+func ExtractArchive(archivePath, destDir string) error {
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	archive, err := OpenArchive(archivePath, file)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+
+	switch a := archive.(type) {
+	case *ZipArchiveReader:
+		for _, f := range a.zipr.File {
+			if err := extractZipEntry(destDir, f.Name, f.Mode(), f.Modified, f.Open); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case *TarballArchiveReader:
+		for {
+			header, err := a.tarr.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			mode := header.FileInfo().Mode()
+			if !mode.IsDir() && !mode.IsRegular() {
+				continue
+			}
+			if err := extractEntry(destDir, header.Name, mode, header.ModTime, a.tarr); err != nil {
+				return err
+			}
+		}
+	}
+	return fmt.Errorf("unsupported archive %s", archivePath)
+}
+
+// ExtractFile writes the content of the named entry of a zip archive or a
+// gzipped tarball to w.
+func ExtractFile(archivePath, nameInArchive string, w io.Writer) error {
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	archive, err := OpenArchive(archivePath, file)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+
+	entry, err := archive.Open(nameInArchive)
+	if err != nil {
+		return err
+	}
+	defer entry.Close()
+
+	_, err = io.Copy(w, entry)
+	return err
+}
+
+// extractZipEntry extracts a zip entry, opening its content only if it is a
+// regular file.
+func extractZipEntry(destDir, name string, mode os.FileMode, modTime time.Time, open func() (io.ReadCloser, error)) error {
+	if !mode.IsRegular() {
+		if mode.IsDir() {
+			return extractEntry(destDir, name, mode, modTime, nil)
+		}
+		return nil
+	}
+	content, err := open()
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	return extractEntry(destDir, name, mode, modTime, content)
+}
+
+// extractEntry creates the directory or the regular file an archive entry
+// stands for below destDir, along with the missing directories leading to it.
+// The content of a file is streamed from the given reader.
+func extractEntry(destDir, name string, mode os.FileMode, modTime time.Time, content io.Reader) error {
+	target, err := extractPath(destDir, name)
+	if err != nil {
+		return err
+	}
+	if mode.IsDir() {
+		return os.MkdirAll(target, mode.Perm()|0700)
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode.Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, content); err != nil {
+		file.Close()
+		return fmt.Errorf("can't extract %s: %v", name, err)
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	// the mode is applied regardless of the umask
+	if err := os.Chmod(target, mode.Perm()); err != nil {
+		return err
+	}
+	if !modTime.IsZero() {
+		return os.Chtimes(target, modTime, modTime)
+	}
+	return nil
+}
+
+// extractPath returns the path an archive entry is extracted to, refusing
+// entries which would end up outside of destDir.
+func extractPath(destDir, name string) (string, error) {
+	dest := filepath.Clean(destDir)
+	target := filepath.Join(dest, filepath.FromSlash(name))
+	if target != dest && !strings.HasPrefix(target, dest+string(filepath.Separator)) {
+		return "", fmt.Errorf("archive entry %s outside of %s", name, destDir)
+	}
+	return target, nil
+}
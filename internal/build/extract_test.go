@@ -0,0 +1,146 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package build
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Tests that archives written with WriteArchive are extracted with the
+// content, modes and modification times of their files.
+func TestExtractArchiveRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "extract")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	modTime := time.Unix(1500000000, 0)
+	files := map[string]struct {
+		content []byte
+		mode    os.FileMode
+	}{
+		"geth":   {[]byte("geth binary content"), 0755},
+		"README": {[]byte("readme"), 0644},
+	}
+	var paths []string
+	for name, file := range files {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, file.content, file.mode); err != nil {
+			t.Fatal(err)
+		}
+		os.Chmod(path, file.mode)
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+	for _, ext := range []string{".zip", ".tar.gz"} {
+		name := filepath.Join(dir, "geth-test"+ext)
+		if err := WriteArchive(name, paths); err != nil {
+			t.Fatalf("%s: failed to write the archive: %v", ext, err)
+		}
+		dest := filepath.Join(dir, "out"+ext)
+		if err := ExtractArchive(name, dest); err != nil {
+			t.Fatalf("%s: failed to extract the archive: %v", ext, err)
+		}
+		// the directory of the entries is named after the archive
+		root := filepath.Join(dest, strings.TrimSuffix(name, ext))
+		for base, file := range files {
+			path := filepath.Join(root, base)
+			content, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatalf("%s: %s not extracted: %v", ext, base, err)
+			}
+			if !bytes.Equal(content, file.content) {
+				t.Errorf("%s: %s content mismatch: have %q, want %q", ext, base, content, file.content)
+			}
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Mode().Perm() != file.mode {
+				t.Errorf("%s: %s mode mismatch: have %v, want %v", ext, base, info.Mode().Perm(), file.mode)
+			}
+			if !info.ModTime().Equal(modTime) {
+				t.Errorf("%s: %s time mismatch: have %v, want %v", ext, base, info.ModTime(), modTime)
+			}
+		}
+		// single entries are extracted as well
+		content := new(bytes.Buffer)
+		if err := ExtractFile(name, strings.TrimSuffix(name, ext)+"/geth", content); err != nil {
+			t.Fatalf("%s: failed to extract the binary: %v", ext, err)
+		}
+		if !bytes.Equal(content.Bytes(), files["geth"].content) {
+			t.Errorf("%s: binary content mismatch: have %q", ext, content.Bytes())
+		}
+		if err := ExtractFile(name, "missing", content); err == nil {
+			t.Errorf("%s: extracted a missing entry", ext)
+		}
+	}
+}
+
+// Tests that entries escaping the destination directory are rejected.
+func TestExtractArchiveTraversal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "traversal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const evil = "geth-test/../../evil"
+
+	zipBlob := new(bytes.Buffer)
+	zipw := zip.NewWriter(zipBlob)
+	w, err := zipw.Create(evil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("evil"))
+	zipw.Close()
+
+	tarBlob := new(bytes.Buffer)
+	gzw := gzip.NewWriter(tarBlob)
+	tarw := tar.NewWriter(gzw)
+	tarw.WriteHeader(&tar.Header{Name: evil, Mode: 0644, Size: 4})
+	tarw.Write([]byte("evil"))
+	tarw.Close()
+	gzw.Close()
+
+	for name, blob := range map[string][]byte{"evil.zip": zipBlob.Bytes(), "evil.tar.gz": tarBlob.Bytes()} {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, blob, 0644); err != nil {
+			t.Fatal(err)
+		}
+		dest := filepath.Join(dir, "out", "nested")
+		if err := ExtractArchive(path, dest); err == nil {
+			t.Errorf("%s: traversing entry extracted", name)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "out", "evil")); !os.IsNotExist(err) {
+			t.Errorf("%s: file written outside of the destination: %v", name, err)
+		}
+	}
+}
@@ -193,16 +193,174 @@ type SproutsConfig struct {
 	RewardsRDAccount      common.Address `json:"rewardsRDAcc"`
 	DistributionAccount   common.Address `json:"distributionAcc"`
 
+	// Accounts distributing the premine, replacing DistributionAccount unless
+	// empty
+	DistributionAccounts []common.Address `json:"distributionAccs,omitempty"`
+
 	CoinAgeLifetime      *big.Int `json:"coinageLifetime"`     // how far down the chain to accumulate transaction values
 	CoinAgeHoldingPeriod *big.Int `json:"coinagePeriod"`       // staking time or for how long after a successful stake, staked amount can’t be used for another stake
 	CoinAgeFermentation  *big.Int `json:"coinageFermentation"` // how long coins must be held to result in positive coin age
 	BlockPeriod          uint64   `json:"blockPeriod"`         // min period between blocks
+
+	// Seconds a header may be ahead of the local clock to tolerate drifting
+	// clocks, DefaultAllowedFutureBlockTime is used if unset
+	AllowedFutureBlockTime *uint64 `json:"allowedFutureBlockTime,omitempty"`
+
+	EnforceFermentationForDistribution bool `json:"enforceFermentationForDistribution,omitempty"` // count transactions from the distribution account only once fermented
+
+	// Rational coefficients applied once at the end of the kernel target,
+	// coin-day and block reward computations, defaults are used if unset
+	KernelTargetNumerator   *big.Int `json:"kernelTargetNumerator,omitempty"`
+	KernelTargetDenominator *big.Int `json:"kernelTargetDenominator,omitempty"`
+	CoinDayNumerator        *big.Int `json:"coinDayNumerator,omitempty"`
+	CoinDayDenominator      *big.Int `json:"coinDayDenominator,omitempty"`
+	AnnualRewardNumerator   *big.Int `json:"annualRewardNumerator,omitempty"`
+	AnnualRewardDenominator *big.Int `json:"annualRewardDenominator,omitempty"`
+
+	MaxBlockReward *big.Int `json:"maxBlockReward,omitempty"` // upper bound of the total reward of a block, a default is used if unset
+
+	KeyMigrationBlock *big.Int `json:"keyMigrationBlock,omitempty"` // block from which on key migrations carry over the coin age, disabled if nil
+
+	// Block from which on the stake time is bounded by the block timestamp,
+	// unbounded if nil. Stakes sealed before it may truncate their time at
+	// its first zero byte, so they can't be bounded.
+	StakeTimeBlock *big.Int `json:"stakeTimeBlock,omitempty"`
+
+	MinStakeAge *big.Int `json:"minStakeAge,omitempty"` // coin-days a block must stake at least, no floor if nil
+
+	MinSignerGap uint64 `json:"minSignerGap,omitempty"` // blocks a coinbase must leave to others after sealing one, none if 0
+
+	// Choose between forks by the cumulative weight of their blocks, their
+	// difficulty plus the logarithm of their stake, instead of the total
+	// difficulty alone. Changes which chain is canonical, so all nodes of a
+	// network must agree on it.
+	StakeWeightedForkChoice bool `json:"stakeWeightedForkChoice,omitempty"`
+
+	// Shares of the block reward paid to the charity and r&d accounts in basis
+	// points. If unset, the shares are taken from the whole percents, and
+	// default to 8% (DefaultRewardsBasisPoints) each if those are unset too.
+	// The entries of RewardSplitForks replace them from their activation
+	// block on.
+	RewardsCharityBasisPoints *uint64           `json:"rewardsCharityBasisPoints,omitempty"`
+	RewardsRDBasisPoints      *uint64           `json:"rewardsRDBasisPoints,omitempty"`
+	CharityPercent            *uint64           `json:"charityPercent,omitempty"`
+	RDPercent                 *uint64           `json:"rdPercent,omitempty"`
+	RewardSplitForks          []RewardSplitFork `json:"rewardSplitForks,omitempty"`
+}
+
+const (
+	BasisPoints               = 10000 // Basis points making up the whole block reward
+	DefaultRewardsBasisPoints = 800   // Default share of each of the charity and r&d accounts
+	MaxRewardsBasisPoints     = 5000  // Exclusive upper bound of the charity and r&d shares combined
+
+	DefaultAllowedFutureBlockTime = 15 // Default seconds a header may be ahead of the local clock
+)
+
+// RewardSplitFork changes the shares of the block reward from a block on.
+type RewardSplitFork struct {
+	Block              *big.Int `json:"block"`              // First block the shares apply to
+	CharityBasisPoints uint64   `json:"charityBasisPoints"` // Share of the charity account
+	RDBasisPoints      uint64   `json:"rdBasisPoints"`      // Share of the r&d account
 }
 
 func (c *SproutsConfig) String() string {
 	return "sprouts"
 }
 
+// RewardBasisPoints returns the shares of the charity and r&d accounts in the
+// reward of the block with the given number.
+func (c *SproutsConfig) RewardBasisPoints(num *big.Int) (charity, rd uint64) {
+	charity = rewardShare(c.RewardsCharityBasisPoints, c.CharityPercent)
+	rd = rewardShare(c.RewardsRDBasisPoints, c.RDPercent)
+
+	for _, fork := range c.RewardSplitForks {
+		if isForked(fork.Block, num) {
+			charity, rd = fork.CharityBasisPoints, fork.RDBasisPoints
+		}
+	}
+	return charity, rd
+}
+
+// IsKeyMigration returns whether key migrations carry over the coin age in the
+// block with the given number.
+func (c *SproutsConfig) IsKeyMigration(num *big.Int) bool {
+	return isForked(c.KeyMigrationBlock, num)
+}
+
+// IsStakeTimeBounded returns whether the stake time of the block with the
+// given number is bounded by its timestamp.
+func (c *SproutsConfig) IsStakeTimeBounded(num *big.Int) bool {
+	return isForked(c.StakeTimeBlock, num)
+}
+
+// IsDistributionAccount returns whether the address distributes the premine.
+// DistributionAccount is the only one unless DistributionAccounts is set.
+func (c *SproutsConfig) IsDistributionAccount(addr common.Address) bool {
+	if len(c.DistributionAccounts) == 0 {
+		return addr == c.DistributionAccount
+	}
+	for _, account := range c.DistributionAccounts {
+		if addr == account {
+			return true
+		}
+	}
+	return false
+}
+
+// FutureBlockTime returns the seconds a header may be ahead of the local clock.
+func (c *SproutsConfig) FutureBlockTime() uint64 {
+	if c.AllowedFutureBlockTime != nil {
+		return *c.AllowedFutureBlockTime
+	}
+	return DefaultAllowedFutureBlockTime
+}
+
+// rewardShare returns the share in basis points, falling back to the percent
+// and then to the default if unset.
+func rewardShare(basisPoints, percent *uint64) uint64 {
+	switch {
+	case basisPoints != nil:
+		return *basisPoints
+	case percent != nil && *percent < BasisPoints/100:
+		return *percent * (BasisPoints / 100)
+	case percent != nil:
+		return BasisPoints
+	}
+	return DefaultRewardsBasisPoints
+}
+
+// Validate checks that the charity and r&d shares of the block reward stay
+// below MaxRewardsBasisPoints and that the reward split forks are ordered.
+func (c *SproutsConfig) Validate() error {
+	charity, rd := c.RewardBasisPoints(big.NewInt(0))
+	if !validRewardShares(charity, rd) {
+		return fmt.Errorf("charity and r&d shares of %d+%d basis points exceed the maximum of %d", charity, rd, MaxRewardsBasisPoints-1)
+	}
+	var last *big.Int
+	for i, fork := range c.RewardSplitForks {
+		if fork.Block == nil {
+			return fmt.Errorf("reward split fork %d has no activation block", i)
+		}
+		if last != nil && fork.Block.Cmp(last) <= 0 {
+			return fmt.Errorf("reward split fork %d at block %v not after block %v", i, fork.Block, last)
+		}
+		if !validRewardShares(fork.CharityBasisPoints, fork.RDBasisPoints) {
+			return fmt.Errorf("reward split fork %d: charity and r&d shares of %d+%d basis points exceed the maximum of %d",
+				i, fork.CharityBasisPoints, fork.RDBasisPoints, MaxRewardsBasisPoints-1)
+		}
+		last = fork.Block
+	}
+	if c.MinStakeAge != nil && c.MinStakeAge.Sign() < 0 {
+		return fmt.Errorf("negative minimum stake age %v", c.MinStakeAge)
+	}
+	return nil
+}
+
+// validRewardShares reports whether the shares combined stay below the maximum.
+func validRewardShares(charity, rd uint64) bool {
+	return charity < MaxRewardsBasisPoints && rd < MaxRewardsBasisPoints && charity+rd < MaxRewardsBasisPoints
+}
+
 // String implements the fmt.Stringer interface.
 func (c *ChainConfig) String() string {
 	var engine interface{}
@@ -79,3 +79,64 @@ func TestCheckCompatible(t *testing.T) {
 		}
 	}
 }
+
+func TestSproutsRewardBasisPoints(t *testing.T) {
+	charity, rd := uint64(500), uint64(1000)
+	config := &SproutsConfig{
+		RewardsCharityBasisPoints: &charity,
+		RewardsRDBasisPoints:      &rd,
+		RewardSplitForks: []RewardSplitFork{
+			{Block: big.NewInt(10), CharityBasisPoints: 300, RDBasisPoints: 200},
+			{Block: big.NewInt(20), CharityBasisPoints: 0, RDBasisPoints: 0},
+		},
+	}
+	tests := []struct {
+		number      int64
+		charity, rd uint64
+	}{
+		{0, 500, 1000}, {9, 500, 1000}, {10, 300, 200}, {19, 300, 200}, {20, 0, 0}, {1000, 0, 0},
+	}
+	for _, tt := range tests {
+		if charity, rd := config.RewardBasisPoints(big.NewInt(tt.number)); charity != tt.charity || rd != tt.rd {
+			t.Errorf("block %d: shares mismatch: have %d/%d, want %d/%d", tt.number, charity, rd, tt.charity, tt.rd)
+		}
+	}
+	percent := uint64(5)
+	if charity, rd := (&SproutsConfig{CharityPercent: &percent, RDPercent: &percent}).RewardBasisPoints(big.NewInt(0)); charity != 500 || rd != 500 {
+		t.Errorf("percent shares mismatch: have %d/%d, want 500/500", charity, rd)
+	}
+	if charity, rd := new(SproutsConfig).RewardBasisPoints(big.NewInt(0)); charity != DefaultRewardsBasisPoints || rd != DefaultRewardsBasisPoints {
+		t.Errorf("default shares mismatch: have %d/%d, want %d/%d", charity, rd, DefaultRewardsBasisPoints, DefaultRewardsBasisPoints)
+	}
+}
+
+func TestSproutsConfigValidate(t *testing.T) {
+	points := func(n uint64) *uint64 { return &n }
+
+	tests := []struct {
+		config *SproutsConfig
+		valid  bool
+	}{
+		{&SproutsConfig{}, true},
+		{&SproutsConfig{RewardsCharityBasisPoints: points(500), RewardsRDBasisPoints: points(1000)}, true},
+		{&SproutsConfig{RewardsCharityBasisPoints: points(2500), RewardsRDBasisPoints: points(2499)}, true},
+		{&SproutsConfig{RewardsCharityBasisPoints: points(2500), RewardsRDBasisPoints: points(2500)}, false},
+		{&SproutsConfig{RewardsCharityBasisPoints: points(4300)}, false},
+		{&SproutsConfig{CharityPercent: points(5), RDPercent: points(5)}, true},
+		{&SproutsConfig{CharityPercent: points(25), RDPercent: points(24)}, true},
+		{&SproutsConfig{CharityPercent: points(25), RDPercent: points(25)}, false},
+		{&SproutsConfig{CharityPercent: points(^uint64(0) / 50)}, false},
+		{&SproutsConfig{RewardsCharityBasisPoints: points(^uint64(0)), RewardsRDBasisPoints: points(1)}, false},
+		{&SproutsConfig{RewardSplitForks: []RewardSplitFork{{Block: big.NewInt(1), CharityBasisPoints: 5000}}}, false},
+		{&SproutsConfig{RewardSplitForks: []RewardSplitFork{{CharityBasisPoints: 100}}}, false},
+		{&SproutsConfig{RewardSplitForks: []RewardSplitFork{{Block: big.NewInt(2)}, {Block: big.NewInt(2)}}}, false},
+		{&SproutsConfig{RewardSplitForks: []RewardSplitFork{{Block: big.NewInt(2)}, {Block: big.NewInt(3)}}}, true},
+		{&SproutsConfig{MinStakeAge: big.NewInt(0)}, true},
+		{&SproutsConfig{MinStakeAge: big.NewInt(-1)}, false},
+	}
+	for i, tt := range tests {
+		if err := tt.config.Validate(); (err == nil) != tt.valid {
+			t.Errorf("test %d: validity mismatch: have %v, want valid %v", i, err, tt.valid)
+		}
+	}
+}